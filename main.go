@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	_ "database/sql"
 	"fmt"
-	"github.com/jmoiron/sqlx"
-	"github.com/satori/go.uuid"
-	"github.com/tidwall/buntdb"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	_ "github.com/fignocius/echo-api/docs" // docs is generated by Swag CLI, you have to import it.
 	"github.com/fignocius/echo-api/server/handler"
 	"github.com/fignocius/echo-api/service/appconf"
 	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/support"
+	"github.com/fignocius/echo-api/service/tracing"
 	"github.com/fignocius/echo-api/service/user"
 	"github.com/fignocius/echo-api/service/user/auth/rolecache"
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+	"github.com/tidwall/buntdb"
 )
 
 // @title Swagger Example API
@@ -30,19 +42,89 @@ import (
 // @BasePath /
 
 func main() {
+	l, closer, err := logger.Open(appconf.Log.LogDir, logger.ParseLevel(appconf.Log.Level))
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	logger.Default = l
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = runMigrate(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "support" {
+		err = runSupport(os.Args[2:])
+	} else {
+		err = run(l)
+	}
+	if err != nil {
+		l.Error("exiting", "error", err)
+		closer.Close()
+		os.Exit(1)
+	}
+	closer.Close()
+}
 
+func connectDB() (*sqlx.DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		appconf.DB.Host, appconf.DB.Port, appconf.DB.User, appconf.DB.Password, appconf.DB.Name)
-	db, err := sqlx.Connect("postgres", psqlInfo)
+	return sqlx.Connect("postgres", psqlInfo)
+}
+
+func run(l *logger.Logger) error {
+	err := appconf.Check()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	// ctx is canceled on SIGINT/SIGTERM, stopping the server and any
+	// background worker started from it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			l.Info("received signal", "signal", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:    appconf.Trace.Exporter,
+		Endpoint:    appconf.Trace.Endpoint,
+		ServiceName: appconf.Trace.ServiceName,
+		SampleRatio: appconf.Trace.SampleRatio,
+	})
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	err = fieldcrypt.Setup(appconf.Crypto.MasterKeys, appconf.Crypto.IndexKey)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
 	}
 	defer db.Close()
+	err = metrics.RegisterDB("postgres", db.DB)
+	if err != nil {
+		return err
+	}
+
+	// re-encrypts values left under a previous master key
+	rot := &fieldcrypt.Rotator{DB: db.DB, Columns: user.EncryptedColumns, Log: l}
+	go rot.Every(ctx, appconf.Crypto.RotateInterval)
 
 	// in-memory cache for roles
 	memDB, err := buntdb.Open(":memory:")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer memDB.Close()
 
@@ -54,16 +136,81 @@ func main() {
 			if err != nil {
 				return roles, err
 			}
-			g := user.Getter{DB: db}
+			g := user.Getter{Store: &user.PgStore{DB: db}}
 
-			u, err := g.Run(UID)
+			u, err := g.Run(context.Background(), UID)
 			if err != nil {
 				return roles, err
 			}
 			return u.Role, nil
 		},
 	}
-	
-	server := handler.HTTPServer{DB: db, Roles: rcServ}
-	server.Run()
+
+	ecom, err := newEcommerce()
+	if err != nil {
+		return err
+	}
+
+	// finishes payments a gateway failure left behind
+	rec := &user.PaymentReconciler{
+		Payments: &user.Payments{Store: &user.PgStore{DB: db}, Gateway: ecom, SoftDescriptor: appconf.Payment.SoftDescriptor},
+		Grace:    appconf.Payment.ReconcileGrace,
+		Log:      l,
+	}
+	go rec.Every(ctx, appconf.Payment.ReconcileInterval)
+
+	// frees the slots of proposals not confirmed in time
+	me := &user.MatchExpirer{
+		Store: &user.PgStore{DB: db},
+		TTL:   appconf.Match.ProposalTTL,
+		Log:   l,
+	}
+	go me.Every(ctx, appconf.Match.ExpireInterval)
+
+	pb := &user.PayoutBatcher{
+		Store:             &user.PgStore{DB: db},
+		CommissionPercent: appconf.Payout.CommissionPercent,
+		Hold:              appconf.Payout.Hold,
+		Log:               l,
+	}
+	go pb.Every(ctx, appconf.Payout.Interval)
+
+	// applies the payment changes gateways notify
+	wp := &user.WebhookProcessor{
+		Store:   &user.PgStore{DB: db},
+		Gateway: ecom,
+		Log:     l,
+	}
+	go wp.Every(ctx, appconf.Webhook.Interval)
+
+	// computes the market prices from the completed matches
+	mr := &support.MarketPriceRefresher{
+		Store:  &support.PgStore{DB: db},
+		Window: appconf.MarketPrice.Window,
+		Log:    l,
+	}
+	go mr.Every(ctx, appconf.MarketPrice.Interval)
+
+	server := handler.HTTPServer{DB: db, Roles: rcServ, Log: l, Ecom: ecom}
+	return server.Run(ctx)
+}
+
+// newEcommerce returns the Cielo client of appconf.Cielo.Env
+func newEcommerce() (*cielo.Ecommerce, error) {
+	switch appconf.Cielo.Env {
+	case "local":
+		return cielo.NewFake().Ecommerce(), nil
+	case "sandbox", "production":
+		env := cielo.Sandbox
+		if appconf.Cielo.Env == "production" {
+			env = cielo.Production
+		}
+		return &cielo.Ecommerce{
+			MerchantID:  appconf.Cielo.MerchantID,
+			MerchantKey: appconf.Cielo.MerchantKey,
+			Env:         env,
+			Client:      &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown CIELO_ENV %q", appconf.Cielo.Env)
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/fignocius/echo-api/service/migrate"
+	"github.com/pkg/errors"
+)
+
+const migrateUsage = `usage: echo-api migrate <command>
+
+commands:
+  up                 apply every pending migration
+  down [-steps n]    revert the last n applied migrations (default 1)
+  to VERSION         migrate up or down to VERSION (0 reverts everything)
+  status             list migrations and when they were applied
+  create [-dir d] NAME
+                     create empty up/down scripts for the next version`
+
+// runMigrate implements the migrate subcommand
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	cmd, args := args[0], args[1:]
+
+	if cmd == "create" {
+		fs := flag.NewFlagSet("create", flag.ContinueOnError)
+		dir := fs.String("dir", migrate.Dir, "migrations directory")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(migrateUsage)
+		}
+		up, down, err := migrate.Create(*dir, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Println("created", up)
+		fmt.Println("created", down)
+		return nil
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var done []migrate.Migration
+	switch cmd {
+	case "up":
+		done, err = m.Up(ctx)
+	case "down":
+		fs := flag.NewFlagSet("down", flag.ContinueOnError)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		err = fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		done, err = m.Down(ctx, *steps)
+	case "to":
+		if len(args) != 1 {
+			return errors.New(migrateUsage)
+		}
+		v, perr := strconv.ParseInt(args[0], 10, 64)
+		if perr != nil {
+			return errors.Wrap(perr, "Invalid version")
+		}
+		done, err = m.To(ctx, v)
+	case "status":
+		st, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range st {
+			at := "pending"
+			if s.AppliedAt != nil {
+				at = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, at)
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	for _, mg := range done {
+		fmt.Printf("migrated %04d_%s\n", mg.Version, mg.Name)
+	}
+	return err
+}
@@ -1,16 +1,24 @@
 package handler
 
 import (
-	"github.com/labstack/echo"
-	"github.com/satori/go.uuid"
-	"github.com/Fignocius/echo-api/backend/service/user"
+	"context"
 	"net/http"
+	"strconv"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
 )
 
 type AddressHandler struct {
-	list   func(doctID uuid.UUID) (*user.Addresses, error)
-	create func(*user.Address) (*user.Address, error)
-	remove func(*user.Address) (string, error)
+	list   func(ctx context.Context, doctID uuid.UUID) (*user.Addresses, error)
+	get    func(ctx context.Context, doctID uuid.UUID, addrID int) (*user.Address, error)
+	create func(ctx context.Context, a *user.Address) (*user.Address, error)
+	update func(ctx context.Context, a *user.Address) (*user.Address, error)
+	remove func(ctx context.Context, a *user.Address, cascade bool) (string, error)
 }
 
 // List doctor address
@@ -20,39 +28,106 @@ type AddressHandler struct {
 // @Produce  json
 // @Param doct_id path string true "Doctor id"
 // @Success 200 {object} handler.listAddresses
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
 // @Router /doctors/{doct_id}/addresses/ [get]
 func (handler *AddressHandler) List(c echo.Context) error {
 	did, err := uuid.FromString(c.Param("doct_id"))
 	if err != nil {
-		return err
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
 	}
-	r, err := handler.list(did)
+	r, err := handler.list(c.Request().Context(), did)
 	if err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, listAddresses{Kind: "Addresses", TotalItems: int64(len(*r)), Items: r})
 }
 
-// Create doctor address
+// Get doctor address
+// @Summary Address.Get
+// @Description Return an address of a doctor
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param addr_id path int true "Address id"
+// @Success 200 {object} handler.singleAddress
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/addresses/{addr_id} [get]
+func (handler *AddressHandler) Get(c echo.Context) error {
+	did, aid, err := addressParams(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.get(c.Request().Context(), did, aid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleAddress{Kind: "Address", Item: r})
+}
+
+// Create doctor address, it is geocoded when sent without lat and lng
 // @Summary Address.Create
 // @Description Create doctor address
 // @Accept  json
 // @Produce  json
-// @Param context query string false "Context to return"
-// @Param credentials body handler.createAddress true "Create new address"
+// @Param doct_id path string true "Doctor id"
+// @Param address body handler.formAddress true "Create new address"
 // @Success 200 {object} handler.singleAddress
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
 // @Router /doctors/{doct_id}/addresses/ [post]
 func (handler *AddressHandler) Create(c echo.Context) error {
 	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own addresses")
+	}
+	req := formAddress{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.create(c.Request().Context(), req.address(did, 0))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleAddress{Kind: "Address", Item: r})
+}
+
+// Update doctor address, it is geocoded again when sent without lat and lng
+// @Summary Address.Update
+// @Description Update doctor address
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param addr_id path int true "Address id"
+// @Param address body handler.formAddress true "Address data"
+// @Success 200 {object} handler.singleAddress
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/addresses/{addr_id} [put]
+func (handler *AddressHandler) Update(c echo.Context) error {
+	did, aid, err := addressParams(c)
 	if err != nil {
 		return err
 	}
-	req := createAddress{}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own addresses")
+	}
+	req := formAddress{}
 	err = c.Bind(&req)
 	if err != nil {
 		return err
 	}
-	r, err := handler.create(&user.Address{DoctID: did, Description: req.Description, Location: req.Location})
+	r, err := handler.update(c.Request().Context(), req.address(did, aid))
 	if err != nil {
 		return err
 	}
@@ -61,39 +136,108 @@ func (handler *AddressHandler) Create(c echo.Context) error {
 
 // Remove doctor address
 // @Summary Address.Remove
-// @Description Remove doctor address
+// @Description Remove doctor address, refused while it has active services unless cascade is set
 // @Accept  json
 // @Produce  json
-// @Param context query string false "Context to return"
-// @Param credentials body handler.removeAddress true "Remove address"
+// @Param doct_id path string true "Doctor id"
+// @Param addr_id path int true "Address id"
+// @Param cascade query bool false "Remove the services at the address too"
 // @Success 200 {object} handler.textResponse
-// @Router /doctors/{doct_id}/addresses [put]
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/addresses/{addr_id} [delete]
 func (handler *AddressHandler) Remove(c echo.Context) error {
-	did, err := uuid.FromString(c.Param("doct_id"))
+	did, aid, err := addressParams(c)
 	if err != nil {
 		return err
 	}
-	req := removeAddress{}
-	err = c.Bind(&req)
-	if err != nil {
-		return err
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own addresses")
 	}
-	r, err := handler.remove(&user.Address{DoctID: did, AddrID: req.AddrID})
+	cascade := c.QueryParam("cascade") == "true"
+	r, err := handler.remove(c.Request().Context(), &user.Address{DoctID: did, AddrID: aid}, cascade)
 	if err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, textResponse{Res: r})
 }
 
+// addressParams parses the doctor and address ids of the path
+func addressParams(c echo.Context) (uuid.UUID, int, error) {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return did, 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	aid, err := strconv.Atoi(c.Param("addr_id"))
+	if err != nil {
+		return did, 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid address id")
+	}
+	return did, aid, nil
+}
+
+// isDoctor reports whether the request was made by the doctor doctID
+func isDoctor(c echo.Context, doctID uuid.UUID) bool {
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return false
+	}
+	return claims.DoctID != nil && *claims.DoctID == doctID.String()
+}
+
+// isAdmin reports whether the user has the admin role, as the roles
+// middleware set them
+func isAdmin(c echo.Context) bool {
+	roles, _ := c.Get("roles").([]string)
+	for _, r := range roles {
+		if r == perm.Admin {
+			return true
+		}
+	}
+	return false
+}
+
 type singleAddress struct {
 	singleItemData
 	Item *user.Address `json:"item"`
 	Kind string        `json:"kind"`
 }
 
-type createAddress struct {
-	Description string `json:"description"`
-	Location    string `json:"location"`
+type formAddress struct {
+	Description string     `json:"description"`
+	Location    string     `json:"location"`
+	CEP         string     `json:"cep" example:"01310-100"`
+	Street      string     `json:"street"`
+	Number      string     `json:"number"`
+	District    string     `json:"district"`
+	City        string     `json:"city"`
+	UF          string     `json:"uf" example:"SP"`
+	Lat         null.Float `json:"lat" swaggertype:"number"`
+	Lng         null.Float `json:"lng" swaggertype:"number"`
+	// Primary makes it the primary address of the doctor
+	Primary      bool              `json:"primary"`
+	OpeningHours user.OpeningHours `json:"openingHours"`
+}
+
+func (f formAddress) address(doctID uuid.UUID, addrID int) *user.Address {
+	return &user.Address{
+		AddrID:       addrID,
+		DoctID:       doctID,
+		Description:  f.Description,
+		Location:     f.Location,
+		CEP:          f.CEP,
+		Street:       f.Street,
+		Number:       f.Number,
+		District:     f.District,
+		City:         f.City,
+		UF:           f.UF,
+		Lat:          f.Lat,
+		Lng:          f.Lng,
+		Primary:      f.Primary,
+		OpeningHours: f.OpeningHours,
+	}
 }
 
 type listAddresses struct {
@@ -103,6 +247,6 @@ type listAddresses struct {
 	Kind       string          `json:"kind"`
 }
 
-type removeAddress struct {
-	AddrID int `json:"addrID"`
+type textResponse struct {
+	Res string `json:"response"`
 }
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"github.com/labstack/echo"
 	"github.com/pkg/errors"
 	"github.com/fignocius/echo-api/service/user"
@@ -8,7 +9,7 @@ import (
 )
 
 type AuthHandler struct {
-	signin func(email, password string) (*user.AuthResponse, error)
+	signin func(ctx context.Context, email, password string) (*user.AuthResponse, error)
 }
 
 // EmailLogin returns an echo handler
@@ -29,7 +30,7 @@ func (handler *AuthHandler) EmailLogin(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	r, err := handler.signin(request.Email, request.Password)
+	r, err := handler.signin(c.Request().Context(), request.Email, request.Password)
 	if err != nil {
 		return errors.Wrap(err, "Fail to sign in")
 	}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type BankHandler struct {
+	get       func(ctx context.Context, doctID uuid.UUID) (*user.Bank, error)
+	create    func(ctx context.Context, b *user.Bank) (*user.Bank, error)
+	update    func(ctx context.Context, b *user.Bank) (*user.Bank, error)
+	statement func(ctx context.Context, doctID uuid.UUID, limit, offset int) (*user.PayoutStatement, error)
+	mark      func(ctx context.Context, payoID uuid.UUID, status string) (*user.Payout, error)
+}
+
+// Get the bank account of a doctor
+// @Summary Bank.Get
+// @Description Bank get data
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Success 200 {object} handler.singleBank
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/bank [get]
+func (handler *BankHandler) Get(c echo.Context) error {
+	did, err := bankDoctor(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.get(c.Request().Context(), did)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleBank{Kind: "Bank", Item: r})
+}
+
+// Create registers the bank account a doctor is paid in
+// @Summary Bank.Create
+// @Description Bank create with bank account data, the check digits of agency and account are verified for the banks known to use them
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param credentials body handler.createBank true "Bank data"
+// @Success 200 {object} handler.singleBank
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/bank [post]
+func (handler *BankHandler) Create(c echo.Context) error {
+	b, err := bankForm(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.create(c.Request().Context(), b)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleBank{Kind: "Bank", Item: r})
+}
+
+// Update replaces the bank account of a doctor
+// @Summary Bank.Update
+// @Description Update bank data, payouts already scheduled still go to the old account
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param credentials body handler.createBank true "Bank data"
+// @Success 200 {object} handler.singleBank
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/bank [put]
+func (handler *BankHandler) Update(c echo.Context) error {
+	b, err := bankForm(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.update(c.Request().Context(), b)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleBank{Kind: "Bank", Item: r})
+}
+
+// Payouts returns what a doctor was paid and is owed
+// @Summary Doctor.Payouts
+// @Description Return the payout ledger entries of a doctor not paid yet and a page of its payouts, latest first, each with the matches it paid. Amounts are in cents, net of the platform commission.
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param page query int false "Page, from 1"
+// @Param pageSize query int false "Payouts per page, 20 by default"
+// @Success 200 {object} handler.payoutStatementResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/payouts [get]
+func (handler *BankHandler) Payouts(c echo.Context) error {
+	did, err := bankDoctor(c)
+	if err != nil {
+		return err
+	}
+	page, err := intParam(c, "page", 1)
+	if err != nil {
+		return err
+	}
+	pageSize, err := intParam(c, "pageSize", defaultPageSize)
+	if err != nil {
+		return err
+	}
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "page must be from 1 and pageSize from 1 to 100")
+	}
+	s, err := handler.statement(c.Request().Context(), did, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, payoutStatementResponse{Kind: "PayoutStatement", Item: s})
+}
+
+// MarkPayout records how the transfer of a payout went
+// @Summary Payout.Mark
+// @Description Mark a scheduled payout paid or failed once the finance team sent its transfer. The entries of a failed payout are paid again by the next batch, to the account the doctor has then. Only admins can mark payouts.
+// @Accept  json
+// @Produce  json
+// @Param payo_id path string true "Payout id"
+// @Param status body handler.formPayoutStatus true "Status"
+// @Success 200 {object} handler.singlePayout
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/payouts/{payo_id}/status [post]
+func (handler *BankHandler) MarkPayout(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can mark payouts")
+	}
+	id, err := uuid.FromString(c.Param("payo_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid payout id")
+	}
+	req := formPayoutStatus{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	p, err := handler.mark(c.Request().Context(), id, req.Status)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singlePayout{Kind: "Payout", Item: p})
+}
+
+// bankDoctor parses the doctor of the path, only doctors see their
+// accounts and payouts
+func bankDoctor(c echo.Context) (uuid.UUID, error) {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return uuid.Nil, echo.NewHTTPError(http.StatusForbidden, "Can only access your own bank account")
+	}
+	return did, nil
+}
+
+func bankForm(c echo.Context) (*user.Bank, error) {
+	did, err := bankDoctor(c)
+	if err != nil {
+		return nil, err
+	}
+	req := createBank{}
+	err = c.Bind(&req)
+	if err != nil {
+		return nil, err
+	}
+	return &user.Bank{
+		DoctID:     did,
+		Bank:       req.Bank,
+		Agency:     fieldcrypt.String(req.Agency),
+		Account:    fieldcrypt.String(req.Account),
+		Type:       req.Type,
+		Name:       req.Name,
+		PixKeyType: req.PixKeyType,
+		PixKey:     fieldcrypt.String(req.PixKey),
+	}, nil
+}
+
+type singleBank struct {
+	singleItemData
+	Item *user.Bank `json:"item"`
+	Kind string     `json:"kind"`
+}
+
+type createBank struct {
+	// Bank is the FEBRABAN code of the bank
+	Bank    string `json:"bank" example:"341"`
+	Agency  string `json:"agency" example:"2545"`
+	Account string `json:"account" example:"02366-1"`
+	// Type is checking or savings
+	Type string `json:"type" example:"checking"`
+	// Name of the account holder
+	Name string `json:"name"`
+	// PixKeyType is cpf, cnpj, email, phone or random, payouts go by PIX
+	// when there's a key
+	PixKeyType string `json:"pixKeyType" example:"email"`
+	PixKey     string `json:"pixKey"`
+}
+
+type formPayoutStatus struct {
+	Status string `json:"status" enums:"paid,failed" example:"paid"`
+}
+
+type singlePayout struct {
+	singleItemData
+	Item *user.Payout `json:"item"`
+	Kind string       `json:"kind" example:"Payout"`
+}
+
+type payoutStatementResponse struct {
+	singleItemData
+	Item *user.PayoutStatement `json:"item"`
+	Kind string                `json:"kind" example:"PayoutStatement"`
+}
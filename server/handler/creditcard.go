@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type CreditCardHandler struct {
+	list       func(ctx context.Context, patiID uuid.UUID) ([]user.CreditCard, error)
+	get        func(ctx context.Context, patiID, crcaID uuid.UUID) (*user.CreditCard, error)
+	create     func(ctx context.Context, c user.NewCard) (*user.CreditCard, error)
+	setDefault func(ctx context.Context, patiID, crcaID uuid.UUID) (*user.CreditCard, error)
+	remove     func(ctx context.Context, patiID, crcaID uuid.UUID) (string, error)
+}
+
+// List the saved cards of a patient
+// @Summary CreditCard.List
+// @Description Return the saved cards of the patient signed in, the default one first
+// @Accept  json
+// @Produce  json
+// @Param pati_id path string true "Patient ID" format(uuid)
+// @Success 200 {object} handler.listCards
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id}/payment-methods/creditcards [get]
+func (handler *CreditCardHandler) List(c echo.Context) error {
+	pid, err := cardPatient(c)
+	if err != nil {
+		return err
+	}
+	cs, err := handler.list(c.Request().Context(), pid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listCards{Kind: "CreditCards", TotalItems: int64(len(cs)), Items: cs})
+}
+
+// Get a saved card of a patient
+// @Summary CreditCard.Get
+// @Description Credit card get
+// @Accept  json
+// @Produce  json
+// @Param pati_id path string true "Patient ID" format(uuid)
+// @Param crca_id path string true "Credit Card ID" format(uuid)
+// @Param context query string false "Context to return"
+// @Success 200 {object} handler.singleCard
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id}/payment-methods/creditcards/{crca_id} [get]
+func (handler *CreditCardHandler) Get(c echo.Context) error {
+	pid, cid, err := cardParams(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.get(c.Request().Context(), pid, cid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleCard{Kind: "CreditCard", Item: r})
+}
+
+// Create saves a card, tokenized at the payment gateway
+// @Summary CreditCard.Create
+// @Description Credit card create with credit card data, only the gateway token, brand, last digits and expiry are kept
+// @Accept  json
+// @Produce  json
+// @Param pati_id path string true "Patient ID" format(uuid)
+// @Param card body handler.formCard true "Credit Card data"
+// @Param context query string false "Context to return"
+// @Success 200 {object} handler.singleCard
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id}/payment-methods/creditcards [post]
+func (handler *CreditCardHandler) Create(c echo.Context) error {
+	pid, err := cardPatient(c)
+	if err != nil {
+		return err
+	}
+	req := formCard{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.create(c.Request().Context(), user.NewCard{
+		PatiID:  pid,
+		Number:  req.Number,
+		Holder:  req.Holder,
+		Expiry:  req.Expiry,
+		Default: req.Default,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleCard{Kind: "CreditCard", Item: r})
+}
+
+// Update picks the default card, the number of a saved card can't change
+// @Summary CreditCard.Update
+// @Description Make a card the default one, the old default card stops being it
+// @Accept  json
+// @Produce  json
+// @Param pati_id path string true "Patient ID" format(uuid)
+// @Param crca_id path string true "Credit Card ID" format(uuid)
+// @Param card body handler.formCardUpdate true "Credit Card data"
+// @Param context query string false "Context to return"
+// @Success 200 {object} handler.singleCard
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id}/payment-methods/creditcards/{crca_id} [put]
+func (handler *CreditCardHandler) Update(c echo.Context) error {
+	pid, cid, err := cardParams(c)
+	if err != nil {
+		return err
+	}
+	req := formCardUpdate{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	if !req.Default {
+		return echo.NewHTTPError(http.StatusBadRequest, "A card stops being default when another one is made default")
+	}
+	r, err := handler.setDefault(c.Request().Context(), pid, cid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleCard{Kind: "CreditCard", Item: r})
+}
+
+// Remove a saved card, its token is removed from the payment gateway
+// @Summary CreditCard.SoftDelete
+// @Description Remove a card, the newest remaining card becomes default when it was the default one
+// @Accept  json
+// @Produce  json
+// @Param pati_id path string true "Patient ID" format(uuid)
+// @Param crca_id path string true "Credit Card ID" format(uuid)
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id}/payment-methods/creditcards/{crca_id} [delete]
+func (handler *CreditCardHandler) Remove(c echo.Context) error {
+	pid, cid, err := cardParams(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.remove(c.Request().Context(), pid, cid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// cardPatient parses the patient of the path, only patients see their
+// cards
+func cardPatient(c echo.Context) (uuid.UUID, error) {
+	pid, err := uuid.FromString(c.Param("pati_id"))
+	if err != nil {
+		return uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid patient id")
+	}
+	if !isPatient(c, pid) {
+		return uuid.Nil, echo.NewHTTPError(http.StatusForbidden, "Can only access your own cards")
+	}
+	return pid, nil
+}
+
+func cardParams(c echo.Context) (uuid.UUID, uuid.UUID, error) {
+	pid, err := cardPatient(c)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	cid, err := uuid.FromString(c.Param("crca_id"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid credit card id")
+	}
+	return pid, cid, nil
+}
+
+type singleCard struct {
+	singleItemData
+	Item *user.CreditCard `json:"item"`
+	Kind string           `json:"kind" example:"CreditCard"`
+}
+
+type listCards struct {
+	collectionItemData
+	TotalItems int64             `json:"totalItems"`
+	Items      []user.CreditCard `json:"items"`
+	Kind       string            `json:"kind" example:"CreditCards"`
+}
+
+type formCard struct {
+	Number string `json:"number" example:"4024007197692931"`
+	Holder string `json:"holder" example:"MARIA SILVA"`
+	Expiry string `json:"expiry" example:"12/2030"`
+	// Default makes it the card paid with by default
+	Default bool `json:"default"`
+}
+
+// String keeps card numbers out of logs
+func (f formCard) String() string {
+	return user.NewCard{Number: f.Number, Holder: f.Holder, Expiry: f.Expiry, Default: f.Default}.String()
+}
+
+type formCardUpdate struct {
+	Default bool `json:"default"`
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type DoctorHandler struct {
+	create func(ctx context.Context, d *user.Doctor, password string) (*user.Doctor, error)
+	get    func(ctx context.Context, doctID uuid.UUID) (*user.Doctor, error)
+	update func(ctx context.Context, d *user.Doctor) (*user.Doctor, error)
+	search func(ctx context.Context, q user.NearQuery) ([]user.DoctorDistance, error)
+}
+
+// Create onboards a doctor
+// @Summary Doctor.Create
+// @Description Create a doctor and its user
+// @Accept  json
+// @Produce  json
+// @Param doctor body handler.formDoctor true "Doctor to create"
+// @Success 200 {object} handler.doctOut
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /onboarding/doctor [post]
+func (handler *DoctorHandler) Create(c echo.Context) error {
+	req := formDoctor{}
+	err := c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	d, err := handler.create(c.Request().Context(), &user.Doctor{
+		Name:      req.Name,
+		CRM:       req.CRM,
+		Documents: req.Documents,
+		Email:     req.Email,
+		Info:      req.Info,
+	}, req.Password)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, doctOut{Kind: "Doctor", Item: d})
+}
+
+// Get returns a doctor profile
+// @Summary Doctor.Get
+// @Description Get a doctor profile
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param doct_id path string true "Doctor id"
+// @Success 200 {object} handler.doctOut
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id} [get]
+func (handler *DoctorHandler) Get(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	d, err := handler.get(c.Request().Context(), did)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, doctOut{Kind: "Doctor", Item: d})
+}
+
+// Update updates a doctor profile, only the doctor can update itself
+// @Summary Doctor.Update
+// @Description Update a doctor profile
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param doctor body user.Doctor true "Doctor data"
+// @Success 200 {object} handler.doctOut
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id} [put]
+func (handler *DoctorHandler) Update(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if claims.DoctID == nil || *claims.DoctID != did.String() {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only update your own profile")
+	}
+
+	req := user.Doctor{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	req.DoctID = did
+	d, err := handler.update(c.Request().Context(), &req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, doctOut{Kind: "Doctor", Item: d})
+}
+
+// Search ranks doctors by the distance of their nearest address
+// @Summary Doctor.Search
+// @Description Search doctors around a point, nearest first
+// @Accept  json
+// @Produce  json
+// @Param lat query number true "Latitude"
+// @Param lng query number true "Longitude"
+// @Param radiusKm query number false "Search radius, 10km by default and up to 200km"
+// @Param specID query string false "Only doctors with this specialization"
+// @Param limit query int false "Max doctors returned, 50 by default"
+// @Success 200 {object} handler.listDoctorDistances
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/search [get]
+func (handler *DoctorHandler) Search(c echo.Context) error {
+	lat, errLat := strconv.ParseFloat(c.QueryParam("lat"), 64)
+	lng, errLng := strconv.ParseFloat(c.QueryParam("lng"), 64)
+	if errLat != nil || errLng != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "lat and lng are required")
+	}
+	q := user.NearQuery{Point: geo.Point{Lat: lat, Lng: lng}, RadiusKm: 10}
+	if r := c.QueryParam("radiusKm"); len(r) > 0 {
+		km, err := strconv.ParseFloat(r, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid radiusKm")
+		}
+		q.RadiusKm = km
+	}
+	if l := c.QueryParam("limit"); len(l) > 0 {
+		n, err := strconv.ParseUint(l, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+		q.Limit = n
+	}
+	if sid := c.QueryParam("specID"); len(sid) > 0 {
+		id, err := uuid.FromString(sid)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+		}
+		q.SpecID = &id
+	}
+	ds, err := handler.search(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listDoctorDistances{Kind: "DoctorDistances", TotalItems: int64(len(ds)), Items: ds})
+}
+
+type listDoctorDistances struct {
+	collectionItemData
+	TotalItems int64                 `json:"totalItems"`
+	Items      []user.DoctorDistance `json:"items"`
+	Kind       string                `json:"kind" example:"DoctorDistances"`
+}
+
+type formDoctor struct {
+	Name      string         `json:"name"`
+	CRM       string         `json:"crm" example:"123456/SP"`
+	Documents user.Documents `json:"documents"`
+	Email     string         `json:"email"`
+	Password  string         `json:"password"`
+	Info      user.Info      `json:"info"`
+}
+
+type doctOut struct {
+	singleItemData
+	Item *user.Doctor `json:"item"`
+	Kind string       `json:"kind" example:"Doctor"`
+}
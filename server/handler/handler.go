@@ -1,12 +1,20 @@
 package handler
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/fignocius/echo-api/service/appconf"
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/logger"
+	lmw "github.com/fignocius/echo-api/service/logger/mw"
+	"github.com/fignocius/echo-api/service/metrics"
+	mmw "github.com/fignocius/echo-api/service/metrics/mw"
+	"github.com/fignocius/echo-api/service/support"
+	tmw "github.com/fignocius/echo-api/service/tracing/mw"
 	"github.com/fignocius/echo-api/service/user"
 	"github.com/fignocius/echo-api/service/user/auth"
 	"github.com/fignocius/echo-api/service/user/auth/rolecache"
@@ -15,6 +23,7 @@ import (
 	"github.com/labstack/echo"
 	mw "github.com/labstack/echo/middleware"
 	echoSwagger "github.com/pindamonhangaba/echo-swagger"
+	"github.com/pkg/errors"
 )
 
 // Based on Google JSONC styleguide
@@ -87,14 +96,27 @@ type collectionItemData struct {
 type HTTPServer struct {
 	DB    *sqlx.DB
 	Roles *rolecache.RoleCache
+	Log   *logger.Logger
+	// Ecom takes the payments
+	Ecom *cielo.Ecommerce
+
+	health *HealthHandler
 }
 
-// Run create a new echo server
-func (u *HTTPServer) Run() {
+// Echo builds the echo instance with every middleware and route, tests
+// serve it with httptest
+func (u *HTTPServer) Echo() *echo.Echo {
 	// Echo instance
 	e := echo.New()
+	e.HideBanner = true
+	e.Server.ReadTimeout = appconf.HTTP.ReadTimeout
+	e.Server.WriteTimeout = appconf.HTTP.WriteTimeout
+	e.Server.IdleTimeout = appconf.HTTP.IdleTimeout
+
+	e.Use(lmw.RequestLogger(u.Log))
+	e.Use(tmw.EchoMiddleware(appconf.Trace.ServiceName))
+	e.Use(mmw.EchoMiddleware())
 	e.Use(mw.Recover())
-	e.Use(mw.Logger())
 
 	/// CORS restricted
 	// Allows requests from all origins
@@ -104,7 +126,8 @@ func (u *HTTPServer) Run() {
 		AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE},
 	}))
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
-	e.GET("/", h)
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	u.health = Health(u.DB, u.Roles, e)
 
 	gAPI := e.Group("/api")
 	jwtConfig := mw.JWTConfig{
@@ -113,6 +136,7 @@ func (u *HTTPServer) Run() {
 		ContextKey: "user",
 	}
 	gAPI.Use(mw.JWTWithConfig(jwtConfig))
+	gAPI.Use(lmw.ClaimsLogger("user"))
 	gAPI.Use(amw.EchoMiddleware(u.Roles, amw.JWTConfig{
 		RolesCtxKey: "roles",
 		TokenCtxKey: "user",
@@ -120,12 +144,41 @@ func (u *HTTPServer) Run() {
 	Onboarding(u.DB, e)
 	RegisterTo(u.DB, e)
 	Support(u.DB, e)
+	Webhooks(u.DB, e)
 	RoutesConfig(u.DB, gAPI, u.Ecom)
 	e.HTTPErrorHandler = httpErrorHandler
+	return e
+}
+
+// Run starts the echo server and blocks until ctx is done, then drains
+// in-flight requests for up to appconf.HTTP.ShutdownTimeout
+func (u *HTTPServer) Run(ctx context.Context) error {
+	e := u.Echo()
 
-	fmt.Println("online")
-	addr := appconf.App.Address
-	e.Logger.Fatal(e.Start(addr))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.Start(appconf.App.Address)
+	}()
+	u.Log.Info("online", "address", appconf.App.Address)
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "Failed to start http server")
+	case <-ctx.Done():
+	}
+
+	u.health.drain()
+	u.Log.Info("shutting down", "timeout", appconf.HTTP.ShutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), appconf.HTTP.ShutdownTimeout)
+	defer cancel()
+	err := e.Shutdown(sctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to drain http server")
+	}
+	if err := <-errc; err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 func (d collectionItemData) Data() {}
@@ -133,7 +186,7 @@ func (d collectionItemData) Data() {}
 // Public Routes
 func RegisterTo(db *sqlx.DB, e *echo.Echo) error {
 	ua := &user.Authenticator{
-		DB: db,
+		Store: &user.PgStore{DB: db},
 		JWTConfig: user.JWTConfig{
 			Secret:          appconf.Secret,
 			HoursTillExpire: 72 * time.Hour,
@@ -148,41 +201,296 @@ func RegisterTo(db *sqlx.DB, e *echo.Echo) error {
 
 func Onboarding(db *sqlx.DB, e *echo.Echo) error {
 	ua := &user.Authenticator{
-		DB: db,
+		Store: &user.PgStore{DB: db},
 		JWTConfig: user.JWTConfig{
 			Secret:          appconf.Secret,
 			HoursTillExpire: 72 * time.Hour,
 			SigningMethod:   jwt.SigningMethodHS256,
 		},
 	}
-	cd := &user.DoctorCreator{DB: db}
+	cd := &user.DoctorCreator{Store: &user.PgStore{DB: db}}
 	cdh := &DoctorHandler{create: cd.Run}
 	e.POST("/onboarding/doctor", cdh.Create)
-	cp := &user.PatientCreator{DB: db}
+	cp := &user.PatientCreator{Store: &user.PgStore{DB: db}}
 	cph := &PatientHandler{create: cp.Run, authenticate: ua.Run}
 	e.POST("/onboarding/patient", cph.Create)
 	return nil
 }
 
+// Webhooks registers the notifications of payment gateways, authenticated
+// by the secret shared with them rather than a token
+func Webhooks(db *sqlx.DB, e *echo.Echo) error {
+	wr := &user.WebhookReceiver{Store: &user.PgStore{DB: db}}
+	wh := &WebhookHandler{secret: appconf.Webhook.Secret, receive: wr.Run}
+	e.POST("/webhooks/cielo", wh.Cielo)
+	return nil
+}
+
+// Support registers the public searches of the catalog of
+// specializations and procedures
+func Support(db *sqlx.DB, e *echo.Echo) error {
+	sl := &support.SpecializationLister{Store: &support.PgStore{DB: db}}
+	pl := &support.ProcedureLister{Store: &support.PgStore{DB: db}}
+	sh := &SupportHandler{listSpecs: sl.Run, listProcs: pl.Run}
+	e.GET("/specializations", sh.ListSpecializations)
+	e.GET("/specializations/:spec_id/procedures", sh.ListProcedures)
+	return nil
+}
+
+// Health registers the liveness and readiness probes
+func Health(db *sqlx.DB, roles *rolecache.RoleCache, e *echo.Echo) *HealthHandler {
+	hh := &HealthHandler{pingDB: db.PingContext, pingRoles: roles.Ping}
+	e.GET("/healthz", hh.Live)
+	e.GET("/readyz", hh.Ready)
+	return hh
+}
+
 // Private Routes
 func RoutesConfig(db *sqlx.DB, e *echo.Group, ecom *cielo.Ecommerce) error {
 
 	// Patients
-	p := &user.PatientUpdater{DB: db}
-	pg := &user.PatientGeter{DB: db}
+	p := &user.PatientUpdater{Store: &user.PgStore{DB: db}}
+	pg := &user.PatientGeter{Store: &user.PgStore{DB: db}}
 	ph := &PatientHandler{update: p.Run, get: pg.Run}
 	e.PUT("/patients/:pati_id", ph.Update)
 	e.GET("/patients/:pati_id", ph.Get)
 
+	// Doctors
+	dg := &user.DoctorGetter{Store: &user.PgStore{DB: db}}
+	du := &user.DoctorUpdater{Store: &user.PgStore{DB: db}}
+	dh := &DoctorHandler{get: dg.Run, update: du.Run}
+	e.GET("/doctors/:doct_id", dh.Get)
+	e.PUT("/doctors/:doct_id", dh.Update)
+	ds := &user.DoctorSearcher{Store: &user.PgStore{DB: db}}
+	dsh := &DoctorHandler{search: ds.Run}
+	e.GET("/doctors/search", dsh.Search)
+
+	// Addresses
+	al := &user.AddressLister{Store: &user.PgStore{DB: db}}
+	ag := &user.AddressGetter{Store: &user.PgStore{DB: db}}
+	ac := &user.AddressCreator{Store: &user.PgStore{DB: db}, Geocoder: geocoder()}
+	au := &user.AddressUpdater{Store: &user.PgStore{DB: db}, Geocoder: geocoder()}
+	ar := &user.AddressRemover{Store: &user.PgStore{DB: db}}
+	ah := &AddressHandler{list: al.Run, get: ag.Run, create: ac.Run, update: au.Run, remove: ar.Run}
+	e.GET("/doctors/:doct_id/addresses/", ah.List)
+	e.POST("/doctors/:doct_id/addresses/", ah.Create)
+	e.GET("/doctors/:doct_id/addresses/:addr_id", ah.Get)
+	e.PUT("/doctors/:doct_id/addresses/:addr_id", ah.Update)
+	e.DELETE("/doctors/:doct_id/addresses/:addr_id", ah.Remove)
+
+	// Doctor specializations
+	dsl := &user.DoctorSpecLister{Store: &user.PgStore{DB: db}}
+	dsa := &user.DoctorSpecAdder{Store: &user.PgStore{DB: db}}
+	dsr := &user.DoctorSpecRemover{Store: &user.PgStore{DB: db}}
+	sdu := &user.SpecDocumentUploader{Store: &user.PgStore{DB: db}}
+	sdg := &user.SpecDocumentGetter{Store: &user.PgStore{DB: db}}
+	srl := &user.SpecReviewLister{Store: &user.PgStore{DB: db}}
+	srv := &user.SpecReviewer{Store: &user.PgStore{DB: db}}
+	spech := &SpecializationHandler{
+		list: dsl.Run, add: dsa.Run, remove: dsr.Run, upload: sdu.Run, document: sdg.Run,
+		queue: srl.Run, review: srv.Run,
+	}
+	e.GET("/doctors/:doct_id/specializations/", spech.List)
+	e.POST("/doctors/:doct_id/specializations/", spech.Add)
+	e.DELETE("/doctors/:doct_id/specializations/:spec_id", spech.Remove)
+	e.POST("/doctors/:doct_id/specializations/:spec_id/documents", spech.Upload)
+	e.GET("/doctors/:doct_id/specializations/:spec_id/documents/:dsdo_id", spech.Document)
+	e.GET("/admin/doctor_specializations", spech.Queue)
+	e.POST("/admin/doctors/:doct_id/specializations/:spec_id/review", spech.Review)
+
+	// Market prices
+	mpg := &support.MarketPriceGetter{Store: &support.PgStore{DB: db}, MinSamples: appconf.MarketPrice.MinSamples}
+	mph := &MarketPriceHandler{get: mpg.Run}
+	e.GET("/market_price/procedure/:proc_id", mph.Procedure)
+	e.GET("/market_price/specialization/:spec_id", mph.Specialization)
+
+	// Services
+	rules := user.PriceRules{Market: marketPricer{get: mpg.Run}, TolerancePercent: appconf.Service.PriceTolerancePercent}
+	svl := &user.ServiceLister{Store: &user.PgStore{DB: db}}
+	svg := &user.ServiceGetter{Store: &user.PgStore{DB: db}}
+	svc := &user.ServiceCreator{Store: &user.PgStore{DB: db}, Rules: rules}
+	svu := &user.ServiceUpdater{Store: &user.PgStore{DB: db}, Rules: rules}
+	svr := &user.ServiceRemover{Store: &user.PgStore{DB: db}}
+	svh := &ServiceHandler{list: svl.Run, get: svg.Run, create: svc.Run, update: svu.Run, remove: svr.Run}
+	e.GET("/doctors/:doct_id/services/", svh.List)
+	e.POST("/doctors/:doct_id/services/", svh.Create)
+	e.GET("/doctors/:doct_id/services/:serv_id", svh.Get)
+	e.PUT("/doctors/:doct_id/services/:serv_id", svh.Update)
+	e.DELETE("/doctors/:doct_id/services/:serv_id", svh.Remove)
+
+	// Banks and payouts
+	bg := &user.BankGetter{Store: &user.PgStore{DB: db}}
+	bc := &user.BankCreator{Store: &user.PgStore{DB: db}}
+	bu := &user.BankUpdater{Store: &user.PgStore{DB: db}}
+	pol := &user.PayoutLister{Store: &user.PgStore{DB: db}}
+	pom := &user.PayoutMarker{Store: &user.PgStore{DB: db}}
+	bh := &BankHandler{get: bg.Run, create: bc.Run, update: bu.Run, statement: pol.Run, mark: pom.Run}
+	e.GET("/doctors/:doct_id/bank", bh.Get)
+	e.POST("/doctors/:doct_id/bank", bh.Create)
+	e.PUT("/doctors/:doct_id/bank", bh.Update)
+	e.GET("/doctors/:doct_id/payouts", bh.Payouts)
+	e.POST("/admin/payouts/:payo_id/status", bh.MarkPayout)
+
+	// Credit cards
+	ccl := &user.CardLister{Store: &user.PgStore{DB: db}}
+	ccg := &user.CardGetter{Store: &user.PgStore{DB: db}}
+	ccc := &user.CardCreator{Store: &user.PgStore{DB: db}, Vault: ecom}
+	ccd := &user.CardDefaulter{Store: &user.PgStore{DB: db}}
+	ccr := &user.CardRemover{Store: &user.PgStore{DB: db}, Vault: ecom}
+	cch := &CreditCardHandler{list: ccl.Run, get: ccg.Run, create: ccc.Run, setDefault: ccd.Run, remove: ccr.Run}
+	e.GET("/patients/:pati_id/payment-methods/creditcards", cch.List)
+	e.POST("/patients/:pati_id/payment-methods/creditcards", cch.Create)
+	e.GET("/patients/:pati_id/payment-methods/creditcards/:crca_id", cch.Get)
+	e.PUT("/patients/:pati_id/payment-methods/creditcards/:crca_id", cch.Update)
+	e.DELETE("/patients/:pati_id/payment-methods/creditcards/:crca_id", cch.Remove)
+
+	// Schedules
+	avl := &user.AvailabilityLister{Store: &user.PgStore{DB: db}}
+	avc := &user.AvailabilityCreator{Store: &user.PgStore{DB: db}}
+	avr := &user.AvailabilityRemover{Store: &user.PgStore{DB: db}}
+	exc := &user.ExceptionCreator{Store: &user.PgStore{DB: db}}
+	exr := &user.ExceptionRemover{Store: &user.PgStore{DB: db}}
+	sl := &user.SlotLister{Store: &user.PgStore{DB: db}}
+	sb := &user.SlotBooker{Store: &user.PgStore{DB: db}}
+	sh := &ScheduleHandler{
+		listAvailability:   avl.Run,
+		createAvailability: avc.Run,
+		removeAvailability: avr.Run,
+		createException:    exc.Run,
+		removeException:    exr.Run,
+		slots:              sl.Run,
+		book:               sb.Run,
+	}
+	e.GET("/doctors/:doct_id/availability", sh.ListAvailability)
+	e.POST("/doctors/:doct_id/availability", sh.CreateAvailability)
+	e.DELETE("/doctors/:doct_id/availability/:avai_id", sh.RemoveAvailability)
+	e.POST("/doctors/:doct_id/exceptions", sh.CreateException)
+	e.DELETE("/doctors/:doct_id/exceptions/:avex_id", sh.RemoveException)
+	e.GET("/doctors/:doct_id/slots", sh.Slots)
+	e.POST("/doctors/:doct_id/bookings", sh.Book)
+
+	// Matchmaker
+	mm := &user.Matchmaker{
+		Store: &user.PgStore{DB: db},
+		Weights: user.MatchWeights{
+			Distance:     appconf.Match.WeightDistance,
+			Price:        appconf.Match.WeightPrice,
+			Rating:       appconf.Match.WeightRating,
+			ResponseRate: appconf.Match.WeightResponseRate,
+		},
+	}
+	mp := &user.MatchProposer{Store: &user.PgStore{DB: db}}
+	pay := &user.Payments{Store: &user.PgStore{DB: db}, Gateway: ecom, SoftDescriptor: appconf.Payment.SoftDescriptor}
+	mt := &user.MatchTransitioner{
+		Store: &user.PgStore{DB: db},
+		Policy: user.CancelPolicy{
+			FreeWindow: appconf.Match.CancelFreeWindow,
+			FeePercent: appconf.Match.CancelFeePercent,
+		},
+		Listeners: []user.MatchListener{pay.OnMatch},
+	}
+	mg := &user.MatchGetter{Store: &user.PgStore{DB: db}}
+	pyg := &user.PaymentGetter{Store: &user.PgStore{DB: db}}
+	mh := &MatchHandler{match: mm.Run, propose: mp.Run, transition: mt.Run, get: mg.Run, payment: pyg.Run}
+	e.GET("/matchmaker/match", mh.Match)
+	e.POST("/matchmaker/propose", mh.Propose)
+	e.POST("/matchmaker/confirm", mh.Confirm)
+	e.GET("/matches/:matc_id", mh.Get)
+	e.POST("/matches/:matc_id/status", mh.Transition)
+	e.GET("/matches/:matc_id/payment", mh.Payment)
+
+	// Webhooks
+	wrp := &user.WebhookReplayer{Store: &user.PgStore{DB: db}}
+	wh := &WebhookHandler{replay: wrp.Run}
+	e.POST("/admin/webhooks/:wehe_id/replay", wh.Replay)
+
+	// Catalog
+	sc := &support.SpecializationCreator{Store: &support.PgStore{DB: db}}
+	su := &support.SpecializationUpdater{Store: &support.PgStore{DB: db}}
+	sr := &support.SpecializationRemover{Store: &support.PgStore{DB: db}}
+	pc := &support.ProcedureCreator{Store: &support.PgStore{DB: db}}
+	pu := &support.ProcedureUpdater{Store: &support.PgStore{DB: db}}
+	pr := &support.ProcedureRemover{Store: &support.PgStore{DB: db}}
+	cath := &SupportHandler{
+		createSpec: sc.Run, updateSpec: su.Run, removeSpec: sr.Run,
+		createProc: pc.Run, updateProc: pu.Run, removeProc: pr.Run,
+	}
+	e.POST("/admin/specializations", cath.CreateSpecialization)
+	e.PUT("/admin/specializations/:spec_id", cath.UpdateSpecialization)
+	e.DELETE("/admin/specializations/:spec_id", cath.RemoveSpecialization)
+	e.POST("/admin/specializations/:spec_id/procedures", cath.CreateProcedure)
+	e.PUT("/admin/specializations/:spec_id/procedures/:proc_id", cath.UpdateProcedure)
+	e.DELETE("/admin/specializations/:spec_id/procedures/:proc_id", cath.RemoveProcedure)
+
+	// History
+	hl := &user.MatchHistoryLister{Store: &user.PgStore{DB: db}}
+	sm := &user.StatementMaker{Store: &user.PgStore{DB: db}}
+	hh := &HistoryHandler{list: hl.Run, statement: sm.Run}
+	e.GET("/list/match", hh.List)
+	e.GET("/doctors/:doct_id/statement", hh.Statement)
+
 	return nil
 }
 
+// geocoder is the Geocoder configured in appconf.Geo, if any
+func geocoder() geo.Geocoder {
+	if len(appconf.Geo.URL) == 0 {
+		return nil
+	}
+	return &geo.Nominatim{
+		URL:       appconf.Geo.URL,
+		UserAgent: appconf.Geo.UserAgent,
+		Client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+var locationBody = "body"
+
 func httpErrorHandler(err error, c echo.Context) {
 
 	// since it's an api, it should always be in json
 	// won't be using xml anytime soon
 	//isJsonRequest := c.Request().Header().Get("Content-Type") == "application/json"
-	fmt.Println("error", err)
+	logger.FromContext(c.Request().Context()).Error("request failed", "error", err)
+
+	switch e := errors.Cause(err).(type) {
+	case *auth.ValidationError:
+		details := []detailError{}
+		for field, msg := range e.Messages {
+			f := field
+			details = append(details, detailError{
+				Domain:       "validation",
+				Reason:       "invalid",
+				Message:      msg,
+				Location:     &f,
+				LocationType: &locationBody,
+			})
+		}
+		c.JSON(http.StatusBadRequest, errorResponse{
+			Error: generalError{
+				Code:    http.StatusBadRequest,
+				Message: e.Error(),
+				Errors:  details,
+			},
+		})
+		return
+	case *auth.NotFoundError, *auth.UserNotFoundError:
+		c.JSON(http.StatusNotFound, errorResponse{
+			Error: generalError{
+				Code:    http.StatusNotFound,
+				Message: e.Error(),
+			},
+		})
+		return
+	case *auth.ConflictError:
+		c.JSON(http.StatusConflict, errorResponse{
+			Error: generalError{
+				Code:    http.StatusConflict,
+				Message: e.Error(),
+			},
+		})
+		return
+	}
 
 	if e, ok := err.(*echo.HTTPError); ok {
 		c.JSON(e.Code, errorResponse{
@@ -200,7 +508,3 @@ func httpErrorHandler(err error, c echo.Context) {
 		},
 	})
 }
-func h(c echo.Context) (err error) {
-
-	return c.JSON(http.StatusOK, "It's works")
-}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type HealthHandler struct {
+	pingDB    func(ctx context.Context) error
+	pingRoles func() error
+	// draining is set to 1 once the server starts shutting down
+	draining int32
+}
+
+// Live reports whether the process is up
+// @Summary health.live
+// @Description Liveness probe, answers as long as the process is serving
+// @Produce  json
+// @Success 200 {object} handler.healthStatus
+// @Router /healthz [get]
+func (handler *HealthHandler) Live(c echo.Context) error {
+	return c.JSON(http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// Ready reports whether the server can take traffic
+// @Summary health.ready
+// @Description Readiness probe, checks the database and the role cache
+// @Produce  json
+// @Success 200 {object} handler.healthStatus
+// @Failure 503 {object} handler.healthStatus
+// @Router /readyz [get]
+func (handler *HealthHandler) Ready(c echo.Context) error {
+	if atomic.LoadInt32(&handler.draining) == 1 {
+		return c.JSON(http.StatusServiceUnavailable, healthStatus{Status: "draining"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	checks := map[string]string{"db": "ok", "roles": "ok"}
+	status := http.StatusOK
+	if err := handler.pingDB(ctx); err != nil {
+		checks["db"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if err := handler.pingRoles(); err != nil {
+		checks["roles"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	s := "ok"
+	if status != http.StatusOK {
+		s = "unavailable"
+	}
+	return c.JSON(status, healthStatus{Status: s, Checks: checks})
+}
+
+// drain marks the server as shutting down so readiness fails
+func (handler *HealthHandler) drain() {
+	atomic.StoreInt32(&handler.draining, 1)
+}
+
+type healthStatus struct {
+	Status string            `json:"status" example:"ok"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultPageSize and maxPageSize bound the pages of listings
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type HistoryHandler struct {
+	list      func(ctx context.Context, q user.MatchHistoryQuery, role string) ([]user.MatchHistory, int, error)
+	statement func(ctx context.Context, doctID uuid.UUID, month time.Time) (*user.Statement, error)
+}
+
+// List returns the matches of the user signed in
+// @Summary Match.List
+// @Description Return a page of the matches of the patient or doctor signed in, latest first. Patients see the doctor and where, doctors see the patient.
+// @Accept  json
+// @Produce  json
+// @Param dateStart query string true "filter by start date" format(date)
+// @Param dateEnd query string true "filter by end date" format(date)
+// @Param as query string false "List as patient or doctor, for users that are both"
+// @Param status query string false "Comma separated statuses"
+// @Param specID query string false "Specialization id"
+// @Param priceMin query int false "Min price in cents"
+// @Param priceMax query int false "Max price in cents"
+// @Param page query int false "Page, from 1"
+// @Param pageSize query int false "Items per page, 20 by default"
+// @Success 200 {object} handler.matchListResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /list/match [get]
+func (handler *HistoryHandler) List(c echo.Context) error {
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	q := user.MatchHistoryQuery{}
+	role := perm.Patient
+	switch {
+	case c.QueryParam("as") != perm.Doctor && a.PatiID != uuid.Nil:
+		q.PatiID = &a.PatiID
+	case c.QueryParam("as") != perm.Patient && a.DoctID != uuid.Nil:
+		q.DoctID, role = &a.DoctID, perm.Doctor
+	default:
+		return echo.NewHTTPError(http.StatusForbidden, "Only patients and doctors have matches")
+	}
+
+	q.From, err = time.Parse("2006-01-02", c.QueryParam("dateStart"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "dateStart must be YYYY-MM-DD")
+	}
+	q.To, err = time.Parse("2006-01-02", c.QueryParam("dateEnd"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "dateEnd must be YYYY-MM-DD")
+	}
+	if st := c.QueryParam("status"); len(st) > 0 {
+		for _, s := range strings.Split(st, ",") {
+			q.Statuses = append(q.Statuses, user.MatchStatus(strings.TrimSpace(s)))
+		}
+	}
+	if sid := c.QueryParam("specID"); len(sid) > 0 {
+		id, err := uuid.FromString(sid)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+		}
+		q.SpecID = &id
+	}
+	if q.PriceMin, err = intParam(c, "priceMin", 0); err != nil {
+		return err
+	}
+	if q.PriceMax, err = intParam(c, "priceMax", 0); err != nil {
+		return err
+	}
+	page, err := intParam(c, "page", 1)
+	if err != nil {
+		return err
+	}
+	pageSize, err := intParam(c, "pageSize", defaultPageSize)
+	if err != nil {
+		return err
+	}
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "page must be from 1 and pageSize from 1 to 100")
+	}
+	q.Limit, q.Offset = pageSize, (page-1)*pageSize
+
+	hs, total, err := handler.list(c.Request().Context(), q, role)
+	if err != nil {
+		return err
+	}
+	res := matchListResponse{Kind: "MatchHistory", Items: hs}
+	res.CurrentItemCount = int64(len(hs))
+	res.ItemsPerPage = int64(pageSize)
+	res.StartIndex = int64(q.Offset + 1)
+	res.TotalItems = int64(total)
+	res.PageIndex = int64(page)
+	res.TotalPages = int64((total + pageSize - 1) / pageSize)
+	return c.JSON(http.StatusOK, res)
+}
+
+// Statement exports the monthly statement of a doctor
+// @Summary Doctor.Statement
+// @Description Export what a doctor earned in a month, completed matches and fees of late cancellations and no-shows, as CSV or PDF
+// @Produce  text/csv
+// @Produce  application/pdf
+// @Param doct_id path string true "Doctor id"
+// @Param month query string true "Month" default(2030-01)
+// @Param format query string false "csv or pdf, csv by default"
+// @Success 200 {file} file
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/statement [get]
+func (handler *HistoryHandler) Statement(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return echo.ErrForbidden
+	}
+	month, err := time.Parse("2006-01", c.QueryParam("month"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "month must be YYYY-MM")
+	}
+	format := c.QueryParam("format")
+	if len(format) == 0 {
+		format = "csv"
+	}
+	if format != "csv" && format != "pdf" {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv or pdf")
+	}
+
+	s, err := handler.statement(c.Request().Context(), did, month)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	contentType := "text/csv; charset=utf-8"
+	if format == "pdf" {
+		contentType = "application/pdf"
+		err = s.WritePDF(buf)
+	} else {
+		err = s.WriteCSV(buf)
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		`attachment; filename="statement-`+month.Format("2006-01")+`.`+format+`"`)
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// intParam reads the query parameter name, def when missing
+func intParam(c echo.Context, name string, def int) (int, error) {
+	p := c.QueryParam(name)
+	if len(p) == 0 {
+		return def, nil
+	}
+	v, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+name)
+	}
+	return v, nil
+}
+
+type matchListResponse struct {
+	collectionItemData
+	Items []user.MatchHistory `json:"items"`
+	Kind  string              `json:"kind" example:"MatchHistory"`
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/support"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type MarketPriceHandler struct {
+	get func(ctx context.Context, q support.MarketQuery) (*support.MarketPrice, error)
+}
+
+// Procedure returns the market price of a procedure
+// @Summary Market price procedure.Get
+// @Description Return market price for given procedure: the 10th, 50th and 90th percentiles of what its completed matches charged, last computed by a periodic job. A region with too few matches falls back to the whole country.
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param proc_id path string true "Procedure ID" format(uuid)
+// @Param type query string false "Type of service" Enums(in-person, telemedicine, home-visit) default(in-person)
+// @Param region query string false "UF of the region, the whole country when empty"
+// @Success 200 {object} handler.mktPrice
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /market_price/procedure/{proc_id} [get]
+func (handler *MarketPriceHandler) Procedure(c echo.Context) error {
+	pid, err := uuid.FromString(c.Param("proc_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid procedure id")
+	}
+	q := marketQuery(c)
+	q.ProcID = &pid
+	return handler.respond(c, q)
+}
+
+// Specialization returns the market price of a specialization
+// @Summary Market price specialization.Get
+// @Description Return a market price for specialization: the 10th, 50th and 90th percentiles of what its completed matches charged, last computed by a periodic job. A region with too few matches falls back to the whole country.
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param type query string false "Type of service" Enums(in-person, telemedicine, home-visit) default(in-person)
+// @Param region query string false "UF of the region, the whole country when empty"
+// @Success 200 {object} handler.mktPrice
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /market_price/specialization/{spec_id} [get]
+func (handler *MarketPriceHandler) Specialization(c echo.Context) error {
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	q := marketQuery(c)
+	q.SpecID = sid
+	return handler.respond(c, q)
+}
+
+// marketQuery parses the type of service and region of a market price
+func marketQuery(c echo.Context) support.MarketQuery {
+	q := support.MarketQuery{Type: c.QueryParam("type"), Region: c.QueryParam("region")}
+	if len(q.Type) == 0 {
+		q.Type = user.ServiceInPerson
+	}
+	return q
+}
+
+func (handler *MarketPriceHandler) respond(c echo.Context, q support.MarketQuery) error {
+	r, err := handler.get(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, mktPrice{Kind: "marketPrice", Item: r})
+}
+
+// marketPricer bounds the prices of services by the market prices of the
+// whole country, those of their procedure or else of their specialization
+type marketPricer struct {
+	get func(ctx context.Context, q support.MarketQuery) (*support.MarketPrice, error)
+}
+
+// PriceRange implements user.MarketPricer, there's no range when there are
+// too few completed matches
+func (m marketPricer) PriceRange(ctx context.Context, specID uuid.UUID, procID *uuid.UUID, serviceType string) (*user.PriceRange, error) {
+	qs := []support.MarketQuery{{SpecID: specID, Type: serviceType}}
+	if procID != nil {
+		qs = append([]support.MarketQuery{{ProcID: procID, Type: serviceType}}, qs...)
+	}
+	for _, q := range qs {
+		p, err := m.get(ctx, q)
+		if _, ok := err.(*auth.NotFoundError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &user.PriceRange{Min: p.PriceMin, Max: p.PriceMax}, nil
+	}
+	return nil, nil
+}
+
+type mktPrice struct {
+	singleItemData
+	Item *support.MarketPrice `json:"item"`
+	Kind string               `json:"kind" example:"marketPrice"`
+}
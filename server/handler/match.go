@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type MatchHandler struct {
+	match      func(ctx context.Context, req user.MatchRequest) ([]user.MatchCandidate, error)
+	propose    func(ctx context.Context, p user.MatchProposal, a user.MatchActor) (*user.Match, error)
+	transition func(ctx context.Context, t user.MatchTransition, a user.MatchActor) (*user.Match, error)
+	get        func(ctx context.Context, matcID uuid.UUID, a user.MatchActor) (*user.Match, error)
+	payment    func(ctx context.Context, matcID uuid.UUID, a user.MatchActor) (*user.Payment, error)
+}
+
+// Match ranks the doctors fitting a patient request
+// @Summary Match.Get
+// @Description Return the doctors of a specialization near location with a free slot on date within schedule and a service up to price, best scored first, with how each score was made
+// @Accept  json
+// @Produce  json
+// @Param specID query string true "Specialization id"
+// @Param location query string true "Latitude and longitude" default(-23.5614, -46.6559)
+// @Param distance query number false "Search radius in km, 10 by default"
+// @Param date query string true "Day of the appointment" default(2030-01-07)
+// @Param schedule query string true "Hours of the appointment" default(9:00-12:00)
+// @Param price query int false "Max price in cents"
+// @Param limit query int false "Max candidates, 10 by default"
+// @Success 200 {object} handler.listCandidates
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matchmaker/match [get]
+func (handler *MatchHandler) Match(c echo.Context) error {
+	req, err := parseFormMatch(c)
+	if err != nil {
+		return err
+	}
+	cs, err := handler.match(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listCandidates{Kind: "MatchCandidates", TotalItems: int64(len(cs)), Items: cs})
+}
+
+// Propose holds a slot for the patient signed in
+// @Summary Match.Propose
+// @Description Book a free slot of a doctor for a proposed match, priced at the cheapest service of the doctor in the specialization
+// @Accept  json
+// @Produce  json
+// @Param match body handler.formMatchProposal true "Slot to hold"
+// @Success 200 {object} handler.singleMatch
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matchmaker/propose [post]
+func (handler *MatchHandler) Propose(c echo.Context) error {
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	if a.PatiID == uuid.Nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Only patients can propose matches")
+	}
+	req := formMatchProposal{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	m, err := handler.propose(c.Request().Context(), user.MatchProposal{
+		PatiID:   a.PatiID,
+		DoctID:   req.DoctID,
+		SpecID:   req.SpecID,
+		AddrID:   req.AddrID,
+		StartsAt: req.StartsAt,
+	}, a)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleMatch{Kind: "Match", Item: m})
+}
+
+// Confirm confirms a match proposed to the patient signed in
+// @Summary Match.Confirm
+// @Description Confirm a proposed match
+// @Accept  json
+// @Produce  json
+// @Param match body handler.formMatchConf true "Match to confirm"
+// @Success 200 {object} handler.singleMatch
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matchmaker/confirm [post]
+func (handler *MatchHandler) Confirm(c echo.Context) error {
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	req := formMatchConf{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	m, err := handler.transition(c.Request().Context(), user.MatchTransition{
+		MatcID:  req.MatcID,
+		To:      user.MatchConfirmed,
+		Version: req.Version,
+	}, a)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleMatch{Kind: "Match", Item: m})
+}
+
+// Get returns a match of the user signed in
+// @Summary Match.Get
+// @Description Return a match of the patient or doctor signed in with its status history
+// @Accept  json
+// @Produce  json
+// @Param matc_id path string true "Match id"
+// @Success 200 {object} handler.singleMatch
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matches/{matc_id} [get]
+func (handler *MatchHandler) Get(c echo.Context) error {
+	mid, err := uuid.FromString(c.Param("matc_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid match id")
+	}
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	m, err := handler.get(c.Request().Context(), mid, a)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleMatch{Kind: "Match", Item: m})
+}
+
+// Payment returns the payment of a match of the user signed in
+// @Summary Match.Payment
+// @Description Return the payment of a match of the patient or doctor signed in, with every call made to the payment gateway for it
+// @Accept  json
+// @Produce  json
+// @Param matc_id path string true "Match id"
+// @Success 200 {object} handler.singlePayment
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matches/{matc_id}/payment [get]
+func (handler *MatchHandler) Payment(c echo.Context) error {
+	mid, err := uuid.FromString(c.Param("matc_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid match id")
+	}
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	p, err := handler.payment(c.Request().Context(), mid, a)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singlePayment{Kind: "Payment", Item: p})
+}
+
+// Transition changes the status of a match of the user signed in
+// @Summary Match.Transition
+// @Description Move a match to a status: the patient confirms or cancels it, the doctor cancels, checks in, completes or marks a no-show
+// @Accept  json
+// @Produce  json
+// @Param matc_id path string true "Match id"
+// @Param status body handler.formMatchStatus true "Status to move to"
+// @Success 200 {object} handler.singleMatch
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /matches/{matc_id}/status [post]
+func (handler *MatchHandler) Transition(c echo.Context) error {
+	mid, err := uuid.FromString(c.Param("matc_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid match id")
+	}
+	a, err := matchActor(c)
+	if err != nil {
+		return err
+	}
+	req := formMatchStatus{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	m, err := handler.transition(c.Request().Context(), user.MatchTransition{
+		MatcID:  mid,
+		To:      req.Status,
+		Version: req.Version,
+		Reason:  req.Reason,
+	}, a)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleMatch{Kind: "Match", Item: m})
+}
+
+// matchActor is the user signed in, as patient or doctor
+func matchActor(c echo.Context) (user.MatchActor, error) {
+	a := user.MatchActor{}
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return a, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	a.UserID, err = uuid.FromString(claims.UserID)
+	if err != nil {
+		return a, echo.NewHTTPError(http.StatusUnauthorized, "Invalid user id")
+	}
+	if claims.PatiID != nil {
+		a.PatiID, _ = uuid.FromString(*claims.PatiID)
+	}
+	if claims.DoctID != nil {
+		a.DoctID, _ = uuid.FromString(*claims.DoctID)
+	}
+	return a, nil
+}
+
+// parseFormMatch reads the formMatch query parameters
+func parseFormMatch(c echo.Context) (user.MatchRequest, error) {
+	req := user.MatchRequest{}
+	sid, err := uuid.FromString(c.QueryParam("specID"))
+	if err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	req.SpecID = sid
+
+	ll := strings.Split(c.QueryParam("location"), ",")
+	if len(ll) != 2 {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "location must be lat, lng")
+	}
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(ll[0]), 64)
+	lng, errLng := strconv.ParseFloat(strings.TrimSpace(ll[1]), 64)
+	if errLat != nil || errLng != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "location must be lat, lng")
+	}
+	req.Point = geo.Point{Lat: lat, Lng: lng}
+
+	req.Date, err = time.Parse("2006-01-02", c.QueryParam("date"))
+	if err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "date must be YYYY-MM-DD")
+	}
+
+	hours := strings.Split(c.QueryParam("schedule"), "-")
+	if len(hours) != 2 {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "schedule must be HH:MM-HH:MM")
+	}
+	starts, errStarts := time.Parse("15:04", strings.TrimSpace(hours[0]))
+	ends, errEnds := time.Parse("15:04", strings.TrimSpace(hours[1]))
+	if errStarts != nil || errEnds != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "schedule must be HH:MM-HH:MM")
+	}
+	req.Starts, req.Ends = starts.Format("15:04"), ends.Format("15:04")
+
+	if d := c.QueryParam("distance"); len(d) > 0 {
+		req.RadiusKm, err = strconv.ParseFloat(d, 64)
+		if err != nil {
+			return req, echo.NewHTTPError(http.StatusBadRequest, "Invalid distance")
+		}
+	}
+	if p := c.QueryParam("price"); len(p) > 0 {
+		req.Price, err = strconv.Atoi(p)
+		if err != nil {
+			return req, echo.NewHTTPError(http.StatusBadRequest, "Invalid price")
+		}
+	}
+	if l := c.QueryParam("limit"); len(l) > 0 {
+		req.Limit, err = strconv.Atoi(l)
+		if err != nil {
+			return req, echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+	}
+	return req, nil
+}
+
+type listCandidates struct {
+	collectionItemData
+	TotalItems int64                 `json:"totalItems"`
+	Items      []user.MatchCandidate `json:"items"`
+	Kind       string                `json:"kind" example:"MatchCandidates"`
+}
+
+type singleMatch struct {
+	singleItemData
+	Item *user.Match `json:"item"`
+	Kind string      `json:"kind"`
+}
+
+type singlePayment struct {
+	singleItemData
+	Item *user.Payment `json:"item"`
+	Kind string        `json:"kind"`
+}
+
+type formMatchProposal struct {
+	DoctID   uuid.UUID `json:"doctID" swaggertype:"string"`
+	SpecID   uuid.UUID `json:"specID" swaggertype:"string"`
+	AddrID   int       `json:"addrID"`
+	StartsAt time.Time `json:"startsAt"`
+}
+
+type formMatchConf struct {
+	MatcID uuid.UUID `json:"matcID" swaggertype:"string"`
+	// Version is the version of the match seen by the patient
+	Version int `json:"version" example:"1"`
+}
+
+type formMatchStatus struct {
+	Status user.MatchStatus `json:"status" example:"canceled-by-patient"`
+	// Version is the version of the match seen by the user
+	Version int    `json:"version" example:"1"`
+	Reason  string `json:"reason"`
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type PatientHandler struct {
+	create       func(ctx context.Context, p *user.Patient, password string) (*user.Patient, error)
+	authenticate func(ctx context.Context, email, password string) (*user.AuthResponse, error)
+	update       func(ctx context.Context, p *user.Patient) (*user.Patient, error)
+	get          func(ctx context.Context, patiID uuid.UUID) (*user.Patient, error)
+}
+
+// Create onboards a patient and signs it in
+// @Summary Patient.Create
+// @Description Create a patient and its user, returning a token
+// @Accept  json
+// @Produce  json
+// @Param patient body handler.formPatient true "Patient to create"
+// @Success 200 {object} handler.formResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /onboarding/patient [post]
+func (handler *PatientHandler) Create(c echo.Context) error {
+	req := formPatient{}
+	err := c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	p, err := handler.create(ctx, &user.Patient{
+		Name:      req.Name,
+		CPF:       fieldcrypt.String(req.CPF),
+		RG:        fieldcrypt.String(req.RG),
+		Address:   req.Address,
+		Documents: req.Documents,
+		Email:     req.Email,
+		Info:      req.Info,
+	}, req.Password)
+	if err != nil {
+		return err
+	}
+	a, err := handler.authenticate(ctx, req.Email, req.Password)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, formResponse{
+		Kind: "Patient",
+		Item: response{User: p, JWT: a.Jwt},
+	})
+}
+
+// Get returns a patient profile, masked unless it is the patient asking
+// @Summary Patient.Get
+// @Description Get a patient profile, CPF and RG are masked for others and address, email and info left out
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param pati_id path string true "Patient id"
+// @Success 200 {object} handler.getResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id} [get]
+func (handler *PatientHandler) Get(c echo.Context) error {
+	pid, err := uuid.FromString(c.Param("pati_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid patient id")
+	}
+	p, err := handler.get(c.Request().Context(), pid)
+	if err != nil {
+		return err
+	}
+	if !isPatient(c, pid) {
+		p = p.Masked()
+	}
+	return c.JSON(http.StatusOK, getResponse{Kind: "Patient", Item: responseGet{User: p}})
+}
+
+// Update updates a patient profile, only the patient can update itself
+// @Summary Patient.Update
+// @Description Update a patient profile
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param pati_id path string true "Patient id"
+// @Param patient body user.Patient true "Patient data"
+// @Success 200 {object} handler.getResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /patients/{pati_id} [put]
+func (handler *PatientHandler) Update(c echo.Context) error {
+	pid, err := uuid.FromString(c.Param("pati_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid patient id")
+	}
+	if !isPatient(c, pid) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only update your own profile")
+	}
+
+	req := user.Patient{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	req.PatiID = pid
+	p, err := handler.update(c.Request().Context(), &req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, getResponse{Kind: "Patient", Item: responseGet{User: p}})
+}
+
+// isPatient reports whether the JWT belongs to the patient patiID
+func isPatient(c echo.Context, patiID uuid.UUID) bool {
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return false
+	}
+	return claims.PatiID != nil && *claims.PatiID == patiID.String()
+}
+
+type formPatient struct {
+	Name      string           `json:"name"`
+	CPF       string           `json:"cpf" example:"123.456.789-09"`
+	RG        string           `json:"rg"`
+	Address   user.PatiAddress `json:"address"`
+	Documents user.Documents   `json:"documents"`
+	Email     string           `json:"email"`
+	Password  string           `json:"password"`
+	Info      user.Info        `json:"info"`
+}
+
+type response struct {
+	User *user.Patient `json:"user"`
+	JWT  string        `json:"jwt" example:"wqeoifjweoifjwef.afoj3204jfdkjf0wjf0wefj0w9fjf..."`
+}
+
+type formResponse struct {
+	singleItemData
+	Item response `json:"item"`
+	Kind string   `json:"kind"`
+}
+
+type responseGet struct {
+	User *user.Patient `json:"user"`
+}
+
+type getResponse struct {
+	singleItemData
+	Item responseGet `json:"item"`
+	Kind string      `json:"kind" example:"Patient"`
+}
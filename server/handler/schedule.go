@@ -0,0 +1,331 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+type ScheduleHandler struct {
+	listAvailability   func(ctx context.Context, doctID uuid.UUID) ([]user.Availability, error)
+	createAvailability func(ctx context.Context, av *user.Availability) (*user.Availability, error)
+	removeAvailability func(ctx context.Context, doctID, avaiID uuid.UUID) (string, error)
+	createException    func(ctx context.Context, e *user.AvailabilityException) (*user.AvailabilityException, error)
+	removeException    func(ctx context.Context, doctID, avexID uuid.UUID) (string, error)
+	slots              func(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]user.Slot, error)
+	book               func(ctx context.Context, s *user.SessionSchedule) (*user.SessionSchedule, error)
+}
+
+// ListAvailability returns the weekly hours of a doctor
+// @Summary Availability.List
+// @Description Return the weekly hours of a doctor
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Success 200 {object} handler.listAvailabilities
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/availability [get]
+func (handler *ScheduleHandler) ListAvailability(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	avs, err := handler.listAvailability(c.Request().Context(), did)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listAvailabilities{Kind: "Availabilities", TotalItems: int64(len(avs)), Items: avs})
+}
+
+// CreateAvailability adds weekly hours to a doctor address
+// @Summary Availability.Create
+// @Description Add weekly hours to a doctor address, slots are 30 minutes and the timezone America/Sao_Paulo by default
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param availability body handler.formAvailability true "Weekly hours"
+// @Success 200 {object} handler.singleAvailability
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/availability [post]
+func (handler *ScheduleHandler) CreateAvailability(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own schedule")
+	}
+	req := formAvailability{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	av, err := handler.createAvailability(c.Request().Context(), &user.Availability{
+		DoctID:        did,
+		AddrID:        req.AddrID,
+		Weekday:       req.Weekday,
+		Starts:        req.Starts,
+		Ends:          req.Ends,
+		SlotMinutes:   req.SlotMinutes,
+		BufferMinutes: req.BufferMinutes,
+		Timezone:      req.Timezone,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleAvailability{Kind: "Availability", Item: av})
+}
+
+// RemoveAvailability removes weekly hours of a doctor
+// @Summary Availability.Remove
+// @Description Remove weekly hours of a doctor, booked sessions are kept
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param avai_id path string true "Availability id"
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/availability/{avai_id} [delete]
+func (handler *ScheduleHandler) RemoveAvailability(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	aid, err := uuid.FromString(c.Param("avai_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid availability id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own schedule")
+	}
+	r, err := handler.removeAvailability(c.Request().Context(), did, aid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// CreateException blocks an interval of a doctor
+// @Summary Exception.Create
+// @Description Block an interval of a doctor, e.g. a holiday, at an address or at all of them
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param exception body handler.formException true "Interval to block"
+// @Success 200 {object} handler.singleException
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/exceptions [post]
+func (handler *ScheduleHandler) CreateException(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own schedule")
+	}
+	req := formException{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	e, err := handler.createException(c.Request().Context(), &user.AvailabilityException{
+		DoctID:   did,
+		AddrID:   req.AddrID,
+		StartsAt: req.StartsAt,
+		EndsAt:   req.EndsAt,
+		Reason:   req.Reason,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleException{Kind: "AvailabilityException", Item: e})
+}
+
+// RemoveException removes an exception of a doctor
+// @Summary Exception.Remove
+// @Description Remove an exception of a doctor
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param avex_id path string true "Exception id"
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/exceptions/{avex_id} [delete]
+func (handler *ScheduleHandler) RemoveException(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	eid, err := uuid.FromString(c.Param("avex_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid exception id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own schedule")
+	}
+	r, err := handler.removeException(c.Request().Context(), did, eid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// Slots lists the free slots of a doctor
+// @Summary Slots.List
+// @Description Return the free slots of a doctor, for the next 7 days by default and up to 31 days
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param from query string false "RFC 3339 start, now by default"
+// @Param to query string false "RFC 3339 end"
+// @Success 200 {object} handler.listSlots
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/slots [get]
+func (handler *ScheduleHandler) Slots(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	from := time.Now()
+	if f := c.QueryParam("from"); len(f) > 0 {
+		from, err = time.Parse(time.RFC3339, f)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid from, expected RFC 3339")
+		}
+	}
+	to := from.AddDate(0, 0, 7)
+	if t := c.QueryParam("to"); len(t) > 0 {
+		to, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid to, expected RFC 3339")
+		}
+	}
+	slots, err := handler.slots(c.Request().Context(), did, from, to)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listSlots{Kind: "Slots", TotalItems: int64(len(slots)), Items: slots})
+}
+
+// Book books a slot of a doctor for the patient signed in
+// @Summary Slot.Book
+// @Description Book a free slot of a doctor
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param booking body handler.formBooking true "Slot to book"
+// @Success 200 {object} handler.singleSession
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/bookings [post]
+func (handler *ScheduleHandler) Book(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if claims.PatiID == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Only patients can book")
+	}
+	pid, err := uuid.FromString(*claims.PatiID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Only patients can book")
+	}
+	req := formBooking{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	s, err := handler.book(c.Request().Context(), &user.SessionSchedule{
+		DoctID:   did,
+		AddrID:   req.AddrID,
+		PatiID:   pid,
+		StartsAt: req.StartsAt,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleSession{Kind: "SessionSchedule", Item: s})
+}
+
+type formAvailability struct {
+	AddrID int `json:"addrID"`
+	// Weekday is 0 for sunday up to 6 for saturday
+	Weekday       time.Weekday `json:"weekday" example:"1"`
+	Starts        string       `json:"starts" example:"08:00"`
+	Ends          string       `json:"ends" example:"12:00"`
+	SlotMinutes   int          `json:"slotMinutes" example:"30"`
+	BufferMinutes int          `json:"bufferMinutes" example:"10"`
+	Timezone      string       `json:"timezone" example:"America/Sao_Paulo"`
+}
+
+type formException struct {
+	// AddrID is the address blocked, all of them when null
+	AddrID   null.Int  `json:"addrID" swaggertype:"integer"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+	Reason   string    `json:"reason" example:"Holiday"`
+}
+
+type formBooking struct {
+	AddrID   int       `json:"addrID"`
+	StartsAt time.Time `json:"startsAt"`
+}
+
+type listAvailabilities struct {
+	collectionItemData
+	TotalItems int64               `json:"totalItems"`
+	Items      []user.Availability `json:"items"`
+	Kind       string              `json:"kind" example:"Availabilities"`
+}
+
+type singleAvailability struct {
+	singleItemData
+	Item *user.Availability `json:"item"`
+	Kind string             `json:"kind" example:"Availability"`
+}
+
+type singleException struct {
+	singleItemData
+	Item *user.AvailabilityException `json:"item"`
+	Kind string                      `json:"kind" example:"AvailabilityException"`
+}
+
+type listSlots struct {
+	collectionItemData
+	TotalItems int64       `json:"totalItems"`
+	Items      []user.Slot `json:"items"`
+	Kind       string      `json:"kind" example:"Slots"`
+}
+
+type singleSession struct {
+	singleItemData
+	Item *user.SessionSchedule `json:"item"`
+	Kind string                `json:"kind" example:"SessionSchedule"`
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/dbtest"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth/rolecache"
+	"github.com/tidwall/buntdb"
+)
+
+func TestMain(m *testing.M) { os.Exit(dbtest.Main(m)) }
+
+// newTestServer serves the full route tree on a fresh migrated database
+func newTestServer(t *testing.T) (*httptest.Server, *dbtest.Factory) {
+	t.Helper()
+	db := dbtest.NewDB(t)
+	memDB, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open role cache: %s", err)
+	}
+	t.Cleanup(func() { memDB.Close() })
+
+	roles := &rolecache.RoleCache{
+		DB: memDB,
+		GetUserRoles: func(userID string) ([]string, error) {
+			return []string{"user"}, nil
+		},
+	}
+	srv := &HTTPServer{DB: db, Roles: roles, Log: logger.New(ioutil.Discard, logger.LevelError)}
+	ts := httptest.NewServer(srv.Echo())
+	t.Cleanup(ts.Close)
+	return ts, &dbtest.Factory{Q: db}
+}
+
+func TestHealthProbes(t *testing.T) {
+	ts, _ := newTestServer(t)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %s", path, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected %s to be 200, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestSignin(t *testing.T) {
+	ts, f := newTestServer(t)
+	p := f.Patient(t)
+
+	body := `{"email":"` + p.Email + `","password":"` + dbtest.Password + `"}`
+	res, err := http.Post(ts.URL+"/auth/signin", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Signin failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("Expected 200, got %d: %s", res.StatusCode, b)
+	}
+	out := loginOut{}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	if err != nil {
+		t.Fatalf("Failed decoding signin response: %s", err)
+	}
+	if len(out.Item.JWT) == 0 || out.Item.User.UserID.String() != p.UserID.String() {
+		t.Errorf("Expected a token for %s, got %+v", p.UserID, out.Item)
+	}
+
+	body = `{"email":"` + p.Email + `","password":"wrong"}`
+	res, err = http.Post(ts.URL+"/auth/signin", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Signin failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		t.Errorf("Expected wrong password to be refused")
+	}
+}
+
+func TestAPIRequiresJWT(t *testing.T) {
+	ts, f := newTestServer(t)
+	p := f.Patient(t)
+
+	res, err := http.Get(ts.URL + "/api/patients/" + p.PatiID.String())
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest && res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a missing JWT to be refused, got %d", res.StatusCode)
+	}
+}
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	ts, _ := newTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/healthz", nil)
+	req.Header.Set("X-Request-ID", "e2e-request-1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("X-Request-ID"); got != "e2e-request-1" {
+		t.Errorf("Expected the request id to be echoed, got %q", got)
+	}
+}
+
+func onboardPatient(t *testing.T, ts *httptest.Server, email, cpf string) formResponse {
+	t.Helper()
+	body := `{"name":"Maria","cpf":"` + cpf + `","rg":"12.345.678-9","email":"` + email + `","password":"` + dbtest.Password +
+		`","address":{"cep":"01310-100","street":"Av. Paulista","number":"1000"},"info":{"birthdate":"1990-05-17"}}`
+	res, err := http.Post(ts.URL+"/onboarding/patient", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Onboarding failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("Expected 200, got %d: %s", res.StatusCode, b)
+	}
+	out := formResponse{}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	if err != nil {
+		t.Fatalf("Failed decoding onboarding response: %s", err)
+	}
+	return out
+}
+
+func TestPatientIsMaskedForOthers(t *testing.T) {
+	ts, _ := newTestServer(t)
+	owner := onboardPatient(t, ts, "owner@mail.com", "123.456.789-09")
+	other := onboardPatient(t, ts, "other@mail.com", dbtest.CPF(42))
+
+	get := func(jwt string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/patients/"+owner.Item.User.PatiID.String(), nil)
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET failed: %s", err)
+		}
+		return res
+	}
+	for jwt, want := range map[string]string{
+		owner.Item.JWT: "12345678909",
+		other.Item.JWT: "***.456.789-**",
+	} {
+		res := get(jwt)
+		out := getResponse{}
+		json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(out.Item.User.CPF) != want {
+			t.Errorf("Expected cpf %s, got %d %q", want, res.StatusCode, out.Item.User.CPF)
+		}
+		if jwt == other.Item.JWT && (out.Item.User.Email != "" || out.Item.User.Address != (user.PatiAddress{}) || out.Item.User.Info.Birthdate != "") {
+			t.Errorf("Expected a stranger to get no email, address or birthdate, got %+v", out.Item.User)
+		}
+	}
+
+	body := `{"name":"Maria","cpf":"123.456.789-09"}`
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/patients/"+owner.Item.User.PatiID.String(), strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+other.Item.JWT)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected another patient to be forbidden, got %d", res.StatusCode)
+	}
+}
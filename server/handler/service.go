@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type ServiceHandler struct {
+	list   func(ctx context.Context, doctID uuid.UUID) (user.Services, error)
+	get    func(ctx context.Context, doctID, servID uuid.UUID) (*user.Service, error)
+	create func(ctx context.Context, s *user.Service) (*user.Service, error)
+	update func(ctx context.Context, s *user.Service) (*user.Service, error)
+	remove func(ctx context.Context, doctID, servID uuid.UUID) (*user.Service, error)
+}
+
+// List doctor services
+// @Summary Services.List
+// @Description Return doctor services
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Success 200 {object} handler.listServices
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/services/ [get]
+func (handler *ServiceHandler) List(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	r, err := handler.list(c.Request().Context(), did)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, listServices{Kind: "Services", TotalItems: int64(len(r)), Items: r})
+}
+
+// Get doctor service with the prices it had
+// @Summary Service.Get
+// @Description Get doctor service, with its price history latest first
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param serv_id path string true "Service id"
+// @Success 200 {object} handler.singleService
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/services/{serv_id} [get]
+func (handler *ServiceHandler) Get(c echo.Context) error {
+	did, sid, err := serviceParams(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.get(c.Request().Context(), did, sid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleService{Kind: "Service", Item: r})
+}
+
+// Create doctor service
+// @Summary Service.Add
+// @Description Add doctor service in one of their specializations at one of their addresses. The price must be within the market price of the procedure, or of the specialization, give or take a tolerance.
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param service body handler.formServiceAdd true "Service data"
+// @Success 200 {object} handler.singleService
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/services/ [post]
+func (handler *ServiceHandler) Create(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own services")
+	}
+	req := formServiceAdd{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.create(c.Request().Context(), req.service(did, uuid.Nil))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleService{Kind: "Service", Item: r})
+}
+
+// Update doctor service, a new price is a new version of it
+// @Summary Service.Update
+// @Description Update doctor service. Changing the price makes a new version of the service, matches proposed before keep the price they were proposed at.
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param serv_id path string true "Service id"
+// @Param service body handler.formServiceAdd true "Service data"
+// @Success 200 {object} handler.singleService
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/services/{serv_id} [put]
+func (handler *ServiceHandler) Update(c echo.Context) error {
+	did, sid, err := serviceParams(c)
+	if err != nil {
+		return err
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own services")
+	}
+	req := formServiceAdd{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.update(c.Request().Context(), req.service(did, sid))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleService{Kind: "Service", Item: r})
+}
+
+// Remove doctor service
+// @Summary Service.Remove
+// @Description Remove doctor service, matches proposed for it keep it
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor id"
+// @Param serv_id path string true "Service id"
+// @Success 200 {object} handler.singleService
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/services/{serv_id} [delete]
+func (handler *ServiceHandler) Remove(c echo.Context) error {
+	did, sid, err := serviceParams(c)
+	if err != nil {
+		return err
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own services")
+	}
+	r, err := handler.remove(c.Request().Context(), did, sid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleService{Kind: "Service", Item: r})
+}
+
+// serviceParams parses the doctor and service ids of the path
+func serviceParams(c echo.Context) (uuid.UUID, uuid.UUID, error) {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return did, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	sid, err := uuid.FromString(c.Param("serv_id"))
+	if err != nil {
+		return did, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid service id")
+	}
+	return did, sid, nil
+}
+
+type formServiceAdd struct {
+	AddrID int       `json:"addrID"`
+	Name   string    `json:"name"`
+	SpecID uuid.UUID `json:"specID" swaggertype:"string"`
+	// ProcID is the procedure of the specialization the service is, if
+	// it's one
+	ProcID *uuid.UUID `json:"procID" swaggertype:"string"`
+	// Type is in-person, telemedicine or home-visit
+	Type string `json:"type" example:"in-person"`
+	// PriceMin is what the service costs from, in cents
+	PriceMin int `json:"priceMin"`
+}
+
+func (f formServiceAdd) service(doctID, servID uuid.UUID) *user.Service {
+	return &user.Service{
+		ServID:   servID,
+		DoctID:   doctID,
+		AddrID:   f.AddrID,
+		SpecID:   f.SpecID,
+		ProcID:   f.ProcID,
+		Name:     f.Name,
+		Type:     f.Type,
+		PriceMin: f.PriceMin,
+	}
+}
+
+type singleService struct {
+	singleItemData
+	Item *user.Service `json:"item"`
+	Kind string        `json:"kind"`
+}
+
+type listServices struct {
+	collectionItemData
+	TotalItems int64         `json:"totalItems"`
+	Items      user.Services `json:"items"`
+	Kind       string        `json:"kind"`
+}
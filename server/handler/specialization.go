@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+type SpecializationHandler struct {
+	list     func(ctx context.Context, doctID uuid.UUID, all bool) (user.Specializations, error)
+	add      func(ctx context.Context, s *user.Specialization) (string, error)
+	remove   func(ctx context.Context, doctID, specID uuid.UUID) (string, error)
+	upload   func(ctx context.Context, d *user.SpecDocument) (*user.SpecDocument, error)
+	document func(ctx context.Context, doctID, specID, dsdoID uuid.UUID) (*user.SpecDocument, error)
+	queue    func(ctx context.Context, limit, offset int) (user.Specializations, int, error)
+	review   func(ctx context.Context, s *user.Specialization, reviewerID uuid.UUID) (*user.Specialization, error)
+}
+
+// List doctor specializations
+// @Summary Specializations.List
+// @Description Return doctor specializations. The doctor and admins see them all with their review and documents, others only the approved ones.
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param context query string false "Context to return"
+// @Success 200 {object} handler.listSpecResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/specializations/ [get]
+func (handler *SpecializationHandler) List(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	ss, err := handler.list(c.Request().Context(), did, isDoctor(c, did) || isAdmin(c))
+	if err != nil {
+		return err
+	}
+	res := listSpecializations{Kind: "specializations", Items: ss}
+	res.CurrentItemCount = int64(len(ss))
+	res.TotalItems = int64(len(ss))
+	return c.JSON(http.StatusOK, listSpecResponse{Context: c.QueryParam("context"), Data: res})
+}
+
+// Add doctor specialization
+// @Summary Specialization.Add
+// @Description Add doctor specialization with the RQE of the doctor in it, pending review by an admin until then it doesn't count in search and matching. A specialization removed or rejected may be added again.
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param specialization body handler.formSpecAdd true "Add new specialization"
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/specializations/ [post]
+func (handler *SpecializationHandler) Add(c echo.Context) error {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	if !isDoctor(c, did) && !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own specializations")
+	}
+	req := formSpecAdd{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.add(c.Request().Context(), &user.Specialization{DoctID: did, SpecID: req.SpecID, RQE: req.RQE})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// Remove doctor specialization
+// @Summary Specialization.Remove
+// @Description Remove doctor specialization, its services stay but aren't offered anymore
+// @Accept  json
+// @Produce  json
+// @Param context query string false "Context to return"
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/specializations/{spec_id} [delete]
+func (handler *SpecializationHandler) Remove(c echo.Context) error {
+	did, sid, err := specializationParams(c)
+	if err != nil {
+		return err
+	}
+	if !isDoctor(c, did) && !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only change your own specializations")
+	}
+	r, err := handler.remove(c.Request().Context(), did, sid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// Upload a document of a doctor specialization
+// @Summary Specialization.Upload
+// @Description Upload a document supporting a specialization pending review, e.g. the RQE certificate. A PDF, JPEG or PNG of up to 5MB.
+// @Accept  multipart/form-data
+// @Produce  json
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param file formData file true "Document"
+// @Success 200 {object} handler.singleSpecDocument
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/specializations/{spec_id}/documents [post]
+func (handler *SpecializationHandler) Upload(c echo.Context) error {
+	did, sid, err := specializationParams(c)
+	if err != nil {
+		return err
+	}
+	if !isDoctor(c, did) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only document your own specializations")
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "File is required")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// one byte over the limit tells a file too large
+	content, err := ioutil.ReadAll(io.LimitReader(f, user.MaxSpecDocumentSize+1))
+	if err != nil {
+		return err
+	}
+	r, err := handler.upload(c.Request().Context(), &user.SpecDocument{DoctID: did, SpecID: sid, Name: fh.Filename, Content: content})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleSpecDocument{Kind: "SpecDocument", Item: r})
+}
+
+// Document downloads a document of a doctor specialization
+// @Summary Specialization.Document
+// @Description Download a document supporting a specialization, only the doctor and admins can
+// @Produce  application/pdf
+// @Produce  image/jpeg
+// @Produce  image/png
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param dsdo_id path string true "Document ID" format(uuid)
+// @Success 200 {file} file
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /doctors/{doct_id}/specializations/{spec_id}/documents/{dsdo_id} [get]
+func (handler *SpecializationHandler) Document(c echo.Context) error {
+	did, sid, err := specializationParams(c)
+	if err != nil {
+		return err
+	}
+	if !isDoctor(c, did) && !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Can only see the documents of your own specializations")
+	}
+	dsdoID, err := uuid.FromString(c.Param("dsdo_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid document id")
+	}
+	d, err := handler.document(c.Request().Context(), did, sid, dsdoID)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+d.DsdoID.String()+`"`)
+	return c.Blob(http.StatusOK, d.ContentType, d.Content)
+}
+
+// Queue lists the doctor specializations pending review
+// @Summary Specialization.Queue
+// @Description List the doctor specializations pending review with their documents, those waiting the longest first. Only admins can review.
+// @Accept  json
+// @Produce  json
+// @Param page query int false "Page to return" default(1)
+// @Param pageSize query int false "Amount of results returned per page" default(20)
+// @Success 200 {object} handler.listSpecializations
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/doctor_specializations [get]
+func (handler *SpecializationHandler) Queue(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can review specializations")
+	}
+	page, err := intParam(c, "page", 1)
+	if err != nil {
+		return err
+	}
+	pageSize, err := intParam(c, "pageSize", defaultPageSize)
+	if err != nil {
+		return err
+	}
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "page must be from 1 and pageSize from 1 to 100")
+	}
+	ss, total, err := handler.queue(c.Request().Context(), pageSize, (page-1)*pageSize)
+	if err != nil {
+		return err
+	}
+	res := listSpecializations{Kind: "specializations", Items: ss}
+	pageOf(&res.collectionItemData, len(ss), total, page, pageSize)
+	return c.JSON(http.StatusOK, res)
+}
+
+// Review approves or rejects a doctor specialization
+// @Summary Specialization.Review
+// @Description Approve or reject a doctor specialization pending review, rejecting needs a reason the doctor is shown. Only admins can review.
+// @Accept  json
+// @Produce  json
+// @Param doct_id path string true "Doctor ID" format(uuid)
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param review body handler.formSpecReview true "Review"
+// @Success 200 {object} handler.singleDoctorSpec
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/doctors/{doct_id}/specializations/{spec_id}/review [post]
+func (handler *SpecializationHandler) Review(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can review specializations")
+	}
+	did, sid, err := specializationParams(c)
+	if err != nil {
+		return err
+	}
+	claims, err := auth.Extract(c.Get("user"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	reviewer, err := uuid.FromString(claims.UserID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid user id")
+	}
+	req := formSpecReview{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.review(c.Request().Context(), &user.Specialization{DoctID: did, SpecID: sid, Status: req.Status, Reason: req.Reason}, reviewer)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleDoctorSpec{Kind: "Specialization", Item: r})
+}
+
+// specializationParams parses the doctor and specialization ids of the path
+func specializationParams(c echo.Context) (uuid.UUID, uuid.UUID, error) {
+	did, err := uuid.FromString(c.Param("doct_id"))
+	if err != nil {
+		return did, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid doctor id")
+	}
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return did, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	return did, sid, nil
+}
+
+type formSpecAdd struct {
+	SpecID uuid.UUID `json:"spec_id" swaggertype:"string"`
+	// RQE is the number of the registration of the doctor as a specialist
+	// at the CRM
+	RQE string `json:"rqe" example:"12345"`
+}
+
+type formSpecReview struct {
+	Status string `json:"status" enums:"approved,rejected" example:"approved"`
+	// Reason is required to reject
+	Reason string `json:"reason" example:"RQE doesn't match the CRM"`
+}
+
+type singleDoctorSpec struct {
+	singleItemData
+	Item *user.Specialization `json:"item"`
+	Kind string               `json:"kind"`
+}
+
+type singleSpecDocument struct {
+	singleItemData
+	Item *user.SpecDocument `json:"item"`
+	Kind string             `json:"kind"`
+}
+
+type listSpecializations struct {
+	collectionItemData
+	Items user.Specializations `json:"items"`
+	Kind  string               `json:"kind" example:"specializations"`
+}
+
+type listSpecResponse struct {
+	// Client sets this value and server echos data in the response
+	Context string              `json:"context,omitempty"`
+	Data    listSpecializations `json:"data"`
+}
@@ -0,0 +1,355 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/support"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// catalogPageSize is the default page of the catalog searches, as
+// documented
+const catalogPageSize = 50
+
+type SupportHandler struct {
+	listSpecs  func(ctx context.Context, q support.Query) (support.Specializations, int, error)
+	createSpec func(ctx context.Context, s *support.Specialization) (*support.Specialization, error)
+	updateSpec func(ctx context.Context, s *support.Specialization) (*support.Specialization, error)
+	removeSpec func(ctx context.Context, specID uuid.UUID) (string, error)
+	listProcs  func(ctx context.Context, specID uuid.UUID, q support.Query) (support.Procedures, int, error)
+	createProc func(ctx context.Context, p *support.Procedure) (*support.Procedure, error)
+	updateProc func(ctx context.Context, p *support.Procedure) (*support.Procedure, error)
+	removeProc func(ctx context.Context, specID, procID uuid.UUID) (string, error)
+}
+
+// catalogQuery parses the name filter and page of a catalog search
+func catalogQuery(c echo.Context) (support.Query, int, int, error) {
+	page, err := intParam(c, "page", 1)
+	if err != nil {
+		return support.Query{}, 0, 0, err
+	}
+	pageSize, err := intParam(c, "pageSize", catalogPageSize)
+	if err != nil {
+		return support.Query{}, 0, 0, err
+	}
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return support.Query{}, 0, 0, echo.NewHTTPError(http.StatusBadRequest, "page must be from 1 and pageSize from 1 to 100")
+	}
+	q := support.Query{Name: c.QueryParam("name"), Limit: pageSize, Offset: (page - 1) * pageSize}
+	return q, page, pageSize, nil
+}
+
+// pageOf fills the paging of a collection of total items
+func pageOf(d *collectionItemData, n, total, page, pageSize int) {
+	d.CurrentItemCount = int64(n)
+	d.ItemsPerPage = int64(pageSize)
+	d.StartIndex = int64((page-1)*pageSize + 1)
+	d.TotalItems = int64(total)
+	d.PageIndex = int64(page)
+	d.TotalPages = int64((total + pageSize - 1) / pageSize)
+}
+
+// ListSpecializations searches the specializations
+// @Summary Specializations.List
+// @Description List the specializations, those with a word starting with name when it's given, ignoring accents and case. Names starting with it come first.
+// @Accept  json
+// @Produce  json
+// @Param name query string false "Filter like name"
+// @Param page query int false "Page to return" default(1)
+// @Param pageSize query int false "Amount of results returned per page" default(50)
+// @Success 200 {object} handler.listSupportSpecResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /specializations [get]
+func (handler *SupportHandler) ListSpecializations(c echo.Context) error {
+	q, page, pageSize, err := catalogQuery(c)
+	if err != nil {
+		return err
+	}
+	ss, total, err := handler.listSpecs(c.Request().Context(), q)
+	if err != nil {
+		return err
+	}
+	res := listSpecRsp{Kind: "Specializations", Items: ss}
+	pageOf(&res.collectionItemData, len(ss), total, page, pageSize)
+	return c.JSON(http.StatusOK, listSupportSpecResponse{Data: res})
+}
+
+// ListProcedures searches the procedures of a specialization
+// @Summary Procedures.List
+// @Description List the procedures of a specialization, those with a word starting with name when it's given, ignoring accents and case. Names starting with it come first.
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param name query string false "Filter like name"
+// @Param page query int false "Page to return" default(1)
+// @Param pageSize query int false "Amount of results returned per page" default(50)
+// @Success 200 {object} handler.listProceduresRsp
+// @Failure 400 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /specializations/{spec_id}/procedures [get]
+func (handler *SupportHandler) ListProcedures(c echo.Context) error {
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	q, page, pageSize, err := catalogQuery(c)
+	if err != nil {
+		return err
+	}
+	ps, total, err := handler.listProcs(c.Request().Context(), sid, q)
+	if err != nil {
+		return err
+	}
+	res := listProceduresRsp{Kind: "Procedures", Items: ps}
+	pageOf(&res.collectionItemData, len(ps), total, page, pageSize)
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreateSpecialization adds a specialization
+// @Summary Specialization.Create
+// @Description Add a specialization, only admins can change the catalog
+// @Accept  json
+// @Produce  json
+// @Param specialization body handler.formSpecialization true "Specialization"
+// @Success 200 {object} handler.singleSpecialization
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations [post]
+func (handler *SupportHandler) CreateSpecialization(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	req := formSpecialization{}
+	err := c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.createSpec(c.Request().Context(), &support.Specialization{Name: req.Name})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleSpecialization{Kind: "Specialization", Item: r})
+}
+
+// UpdateSpecialization renames a specialization
+// @Summary Specialization.Update
+// @Description Rename a specialization, only admins can change the catalog
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param specialization body handler.formSpecialization true "Specialization"
+// @Success 200 {object} handler.singleSpecialization
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations/{spec_id} [put]
+func (handler *SupportHandler) UpdateSpecialization(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	req := formSpecialization{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.updateSpec(c.Request().Context(), &support.Specialization{SpecID: sid, Name: req.Name})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleSpecialization{Kind: "Specialization", Item: r})
+}
+
+// RemoveSpecialization removes a specialization and its procedures
+// @Summary Specialization.Remove
+// @Description Remove a specialization along with its procedures, what refers to them keeps them. Only admins can change the catalog.
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations/{spec_id} [delete]
+func (handler *SupportHandler) RemoveSpecialization(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	r, err := handler.removeSpec(c.Request().Context(), sid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// CreateProcedure adds a procedure to a specialization
+// @Summary Procedure.Create
+// @Description Add a procedure to a specialization, only admins can change the catalog
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param procedure body handler.formProcedure true "Procedure"
+// @Success 200 {object} handler.singleProcedure
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations/{spec_id}/procedures [post]
+func (handler *SupportHandler) CreateProcedure(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	req := formProcedure{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.createProc(c.Request().Context(), req.procedure(sid, uuid.Nil))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleProcedure{Kind: "Procedure", Item: r})
+}
+
+// UpdateProcedure updates a procedure
+// @Summary Procedure.Update
+// @Description Update the name and TUSS code of a procedure, only admins can change the catalog
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param proc_id path string true "Procedure ID" format(uuid)
+// @Param procedure body handler.formProcedure true "Procedure"
+// @Success 200 {object} handler.singleProcedure
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations/{spec_id}/procedures/{proc_id} [put]
+func (handler *SupportHandler) UpdateProcedure(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	sid, pid, err := procedureParams(c)
+	if err != nil {
+		return err
+	}
+	req := formProcedure{}
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	r, err := handler.updateProc(c.Request().Context(), req.procedure(sid, pid))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleProcedure{Kind: "Procedure", Item: r})
+}
+
+// RemoveProcedure removes a procedure
+// @Summary Procedure.Remove
+// @Description Remove a procedure, what refers to it keeps it. Only admins can change the catalog.
+// @Accept  json
+// @Produce  json
+// @Param spec_id path string true "Specialization ID" format(uuid)
+// @Param proc_id path string true "Procedure ID" format(uuid)
+// @Success 200 {object} handler.textResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/specializations/{spec_id}/procedures/{proc_id} [delete]
+func (handler *SupportHandler) RemoveProcedure(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can change the catalog")
+	}
+	sid, pid, err := procedureParams(c)
+	if err != nil {
+		return err
+	}
+	r, err := handler.removeProc(c.Request().Context(), sid, pid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, textResponse{Res: r})
+}
+
+// procedureParams parses the specialization and procedure ids of the path
+func procedureParams(c echo.Context) (uuid.UUID, uuid.UUID, error) {
+	sid, err := uuid.FromString(c.Param("spec_id"))
+	if err != nil {
+		return sid, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid specialization id")
+	}
+	pid, err := uuid.FromString(c.Param("proc_id"))
+	if err != nil {
+		return sid, uuid.Nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid procedure id")
+	}
+	return sid, pid, nil
+}
+
+type formSpecialization struct {
+	Name string `json:"name" example:"Cardiologia"`
+}
+
+type formProcedure struct {
+	Name string `json:"name" example:"Eletrocardiograma"`
+	// TUSSCode is the code of the procedure in the TUSS terminology, 8
+	// digits
+	TUSSCode null.String `json:"tussCode" swaggertype:"string" example:"40101010"`
+}
+
+func (f formProcedure) procedure(specID, procID uuid.UUID) *support.Procedure {
+	return &support.Procedure{ProcID: procID, SpecID: specID, Name: f.Name, TUSSCode: f.TUSSCode}
+}
+
+type singleSpecialization struct {
+	singleItemData
+	Item *support.Specialization `json:"item"`
+	Kind string                  `json:"kind"`
+}
+
+type singleProcedure struct {
+	singleItemData
+	Item *support.Procedure `json:"item"`
+	Kind string             `json:"kind"`
+}
+
+type listSpecRsp struct {
+	collectionItemData
+	Items support.Specializations `json:"items"`
+	Kind  string                  `json:"kind" example:"Specializations"`
+}
+
+type listSupportSpecResponse struct {
+	// Client sets this value and server echos data in the response
+	Context string      `json:"context,omitempty"`
+	Data    listSpecRsp `json:"data"`
+}
+
+type listProceduresRsp struct {
+	collectionItemData
+	Items support.Procedures `json:"items"`
+	Kind  string             `json:"kind" example:"Procedures"`
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/fignocius/echo-api/service/user"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+// webhookSecretHeader carries the secret shared with the gateway, set in
+// the notification settings of the merchant
+const webhookSecretHeader = "X-Webhook-Secret"
+
+// maxWebhookBody is the size of the largest notification read, they're a
+// few ids
+const maxWebhookBody = 64 << 10
+
+type WebhookHandler struct {
+	secret  string
+	receive func(ctx context.Context, body []byte) (bool, error)
+	replay  func(ctx context.Context, weheID uuid.UUID) (*user.WebhookEvent, error)
+}
+
+// Cielo receives the payment notifications of Cielo
+// @Summary Webhook.Cielo
+// @Description Receive a notification of Cielo, authenticated by the secret shared with it. It's stored and answered right away, the payment notified is synced in the background. A notification repeated before it was processed is the same event.
+// @Accept  json
+// @Produce  json
+// @Param X-Webhook-Secret header string true "Shared secret"
+// @Param notification body cielo.Notification true "Notification"
+// @Success 200 {object} handler.webhookReceiptResponse
+// @Failure 400 {object} handler.errorResponse
+// @Failure 401 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /webhooks/cielo [post]
+func (handler *WebhookHandler) Cielo(c echo.Context) error {
+	secret := []byte(c.Request().Header.Get(webhookSecretHeader))
+	if len(handler.secret) == 0 || subtle.ConstantTimeCompare(secret, []byte(handler.secret)) != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid webhook secret")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBody))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read notification")
+	}
+	stored, err := handler.receive(c.Request().Context(), body)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, webhookReceiptResponse{Kind: "WebhookReceipt", Item: webhookReceipt{Duplicate: !stored}})
+}
+
+// Replay processes a webhook event again
+// @Summary Webhook.Replay
+// @Description Make a webhook event pending again with its attempts reset, e.g. one failed before what failed it was fixed. Only admins can replay events.
+// @Accept  json
+// @Produce  json
+// @Param wehe_id path string true "Webhook event id"
+// @Success 200 {object} handler.singleWebhookEvent
+// @Failure 400 {object} handler.errorResponse
+// @Failure 403 {object} handler.errorResponse
+// @Failure 404 {object} handler.errorResponse
+// @Failure 409 {object} handler.errorResponse
+// @Failure 500 {object} handler.errorResponse
+// @Router /admin/webhooks/{wehe_id}/replay [post]
+func (handler *WebhookHandler) Replay(c echo.Context) error {
+	if !isAdmin(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can replay webhook events")
+	}
+	id, err := uuid.FromString(c.Param("wehe_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid webhook event id")
+	}
+	e, err := handler.replay(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, singleWebhookEvent{Kind: "WebhookEvent", Item: e})
+}
+
+type webhookReceipt struct {
+	// Duplicate is true when the notification repeats one not processed
+	// yet
+	Duplicate bool `json:"duplicate"`
+}
+
+type webhookReceiptResponse struct {
+	singleItemData
+	Item webhookReceipt `json:"item"`
+	Kind string         `json:"kind" example:"WebhookReceipt"`
+}
+
+type singleWebhookEvent struct {
+	singleItemData
+	Item *user.WebhookEvent `json:"item"`
+	Kind string             `json:"kind" example:"WebhookEvent"`
+}
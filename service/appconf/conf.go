@@ -1,8 +1,13 @@
 package appconf
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -13,6 +18,7 @@ var (
 	portDB     = os.Getenv("DB_PORT")
 
 	logPath   = os.Getenv("LOGPATH")
+	logLevel  = os.Getenv("LOG_LEVEL")
 	jwtSecret = os.Getenv("JWT_SCECRET")
 
 	smtpHost = os.Getenv("SMTP_HOST")
@@ -24,6 +30,55 @@ var (
 	appUSER     = os.Getenv("APP_USER")
 	appPASSWORD = os.Getenv("APP_PASSWORD")
 	appAddr     = os.Getenv("APP_ADDRESS")
+	appEnv      = os.Getenv("APP_ENV")
+
+	httpReadTimeout     = os.Getenv("HTTP_READ_TIMEOUT")
+	httpWriteTimeout    = os.Getenv("HTTP_WRITE_TIMEOUT")
+	httpIdleTimeout     = os.Getenv("HTTP_IDLE_TIMEOUT")
+	httpShutdownTimeout = os.Getenv("HTTP_SHUTDOWN_TIMEOUT")
+
+	traceExporter    = os.Getenv("TRACE_EXPORTER")
+	traceEndpoint    = os.Getenv("TRACE_ENDPOINT")
+	traceServiceName = os.Getenv("TRACE_SERVICE_NAME")
+	traceSampleRatio = os.Getenv("TRACE_SAMPLE_RATIO")
+
+	fieldMasterKeys     = os.Getenv("FIELD_MASTER_KEYS")
+	fieldEncKey         = os.Getenv("FIELD_ENC_KEY")
+	fieldIndexKey       = os.Getenv("FIELD_INDEX_KEY")
+	fieldRotateInterval = os.Getenv("FIELD_ROTATE_INTERVAL")
+
+	geocoderURL       = os.Getenv("GEOCODER_URL")
+	geocoderUserAgent = os.Getenv("GEOCODER_USER_AGENT")
+
+	matchWeightDistance     = os.Getenv("MATCH_WEIGHT_DISTANCE")
+	matchWeightPrice        = os.Getenv("MATCH_WEIGHT_PRICE")
+	matchWeightRating       = os.Getenv("MATCH_WEIGHT_RATING")
+	matchWeightResponseRate = os.Getenv("MATCH_WEIGHT_RESPONSE_RATE")
+	matchCancelFreeWindow   = os.Getenv("MATCH_CANCEL_FREE_WINDOW")
+	matchCancelFeePercent   = os.Getenv("MATCH_CANCEL_FEE_PERCENT")
+	matchProposalTTL        = os.Getenv("MATCH_PROPOSAL_TTL")
+	matchExpireInterval     = os.Getenv("MATCH_EXPIRE_INTERVAL")
+
+	cieloMerchantID  = os.Getenv("CIELO_MERCHANT_ID")
+	cieloMerchantKey = os.Getenv("CIELO_MERCHANT_KEY")
+	cieloEnv         = os.Getenv("CIELO_ENV")
+
+	paymentSoftDescriptor    = os.Getenv("PAYMENT_SOFT_DESCRIPTOR")
+	paymentReconcileInterval = os.Getenv("PAYMENT_RECONCILE_INTERVAL")
+	paymentReconcileGrace    = os.Getenv("PAYMENT_RECONCILE_GRACE")
+
+	payoutCommissionPercent = os.Getenv("PAYOUT_COMMISSION_PERCENT")
+	payoutInterval          = os.Getenv("PAYOUT_INTERVAL")
+	payoutHold              = os.Getenv("PAYOUT_HOLD")
+
+	webhookSecret   = os.Getenv("WEBHOOK_SECRET")
+	webhookInterval = os.Getenv("WEBHOOK_INTERVAL")
+
+	servicePriceTolerancePercent = os.Getenv("SERVICE_PRICE_TOLERANCE_PERCENT")
+
+	marketPriceMinSamples = os.Getenv("MARKET_PRICE_MIN_SAMPLES")
+	marketPriceWindow     = os.Getenv("MARKET_PRICE_WINDOW")
+	marketPriceInterval   = os.Getenv("MARKET_PRICE_INTERVAL")
 
 	mailFrom  = os.Getenv("MAIL_FROM")
 	mailAlias = os.Getenv("MAIL_ALIAS")
@@ -43,6 +98,7 @@ var SMTP = struct {
 // Log holds env. configuration for Logging
 var Log = struct {
 	LogDir string
+	Level  string
 }{}
 
 // DB holds env. configuration for database connection
@@ -60,7 +116,127 @@ var App = struct {
 	User     string
 	Password string
 	Address  string
-}{appURL, appUSER, appPASSWORD, appAddr}
+	// Env is production unless APP_ENV is development, which allows the
+	// defaults only fit for development, e.g. keys derived from Secret
+	Env string
+}{appURL, appUSER, appPASSWORD, appAddr, appEnv}
+
+// HTTP holds env. configuration for the http server timeouts
+var HTTP = struct {
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}{}
+
+// Trace holds env. configuration for OpenTelemetry tracing
+var Trace = struct {
+	// Exporter is one of otlp, stdout or none
+	Exporter    string
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+}{}
+
+// Crypto holds env. configuration for encrypted columns, base64 encoded
+// 32 byte keys. They are required, only in development keys derived from
+// Secret are used when unset.
+var Crypto = struct {
+	// MasterKeys wrap the keys encrypting sensitive columns, a comma
+	// separated id:key list, current first. FIELD_ENC_KEY is master key 1.
+	MasterKeys string
+	// IndexKey derives the blind indexes used to look them up
+	IndexKey string
+	// RotateInterval is how often values are re-encrypted under the
+	// current master key
+	RotateInterval time.Duration
+}{}
+
+// Geo holds env. configuration for geocoding addresses, addresses sent
+// without coordinates are kept unplaced when URL is empty
+var Geo = struct {
+	// URL of a Nominatim server
+	URL       string
+	UserAgent string
+}{}
+
+// Match holds env. configuration for the matchmaker, the weights of the
+// factors candidates are scored by, relative to each other, for
+// cancellations and for proposals
+var Match = struct {
+	WeightDistance     float64
+	WeightPrice        float64
+	WeightRating       float64
+	WeightResponseRate float64
+	// CancelFreeWindow is how long before a session patients cancel for free
+	CancelFreeWindow time.Duration
+	// CancelFeePercent is the share of the price charged after it
+	CancelFeePercent int
+	// ProposalTTL is how long a proposal holds its slot unconfirmed
+	ProposalTTL time.Duration
+	// ExpireInterval is how often proposals are expired
+	ExpireInterval time.Duration
+}{}
+
+// Cielo holds env. configuration for the Cielo e-commerce API
+var Cielo = struct {
+	MerchantID  string
+	MerchantKey string
+	// Env is one of production, sandbox or local, the in-process fake. It's
+	// required, only in development it's local when unset.
+	Env string
+}{}
+
+// Payment holds env. configuration for charging matches
+var Payment = struct {
+	// SoftDescriptor is shown in card statements, up to 13 letters
+	SoftDescriptor string
+	// ReconcileInterval is how often payments left behind are finished
+	ReconcileInterval time.Duration
+	// ReconcileGrace is how long a payment is left to the request
+	// handling it before being reconciled
+	ReconcileGrace time.Duration
+}{}
+
+// Payout holds env. configuration for paying doctors what their matches
+// were charged
+var Payout = struct {
+	// CommissionPercent is the share of each captured match kept by the
+	// platform
+	CommissionPercent int
+	// Interval is how often payout batches are scheduled
+	Interval time.Duration
+	// Hold is how long after a match is charged it is left out of payouts
+	Hold time.Duration
+}{}
+
+// Webhook holds env. configuration for the notifications of payment
+// gateways
+var Webhook = struct {
+	// Secret is sent by the gateway in the X-Webhook-Secret header,
+	// notifications are refused when it's empty
+	Secret string
+	// Interval is how often the notifications received are processed
+	Interval time.Duration
+}{}
+
+// Service holds env. configuration for the services doctors offer
+var Service = struct {
+	// PriceTolerancePercent is how far below the market min and above the
+	// market max the price of a service may be
+	PriceTolerancePercent int
+}{}
+
+// MarketPrice holds env. configuration for the prices computed from
+// completed matches
+var MarketPrice = struct {
+	// MinSamples is how many completed matches a price needs to be told
+	MinSamples int
+	// Window is how far back completed matches count
+	Window time.Duration
+	// Interval is how often the prices are computed again
+	Interval time.Duration
+}{}
 
 // Mail holds env. configuration for email sending
 var Mail = struct {
@@ -88,4 +264,174 @@ func init() {
 	DB.Port = portDB
 
 	Log.LogDir = logPath
+	Log.Level = logLevel
+
+	HTTP.ReadTimeout = durationOr(httpReadTimeout, 15*time.Second)
+	HTTP.WriteTimeout = durationOr(httpWriteTimeout, 15*time.Second)
+	HTTP.IdleTimeout = durationOr(httpIdleTimeout, 60*time.Second)
+	HTTP.ShutdownTimeout = durationOr(httpShutdownTimeout, 30*time.Second)
+
+	Trace.Exporter = traceExporter
+	if len(Trace.Exporter) == 0 {
+		Trace.Exporter = "none"
+	}
+	Trace.Endpoint = traceEndpoint
+	Trace.ServiceName = traceServiceName
+	if len(Trace.ServiceName) == 0 {
+		Trace.ServiceName = "echo-api"
+	}
+	Trace.SampleRatio = 1
+	if len(traceSampleRatio) > 0 {
+		ratio, err := strconv.ParseFloat(traceSampleRatio, 64)
+		if err != nil {
+			panic(err)
+		}
+		Trace.SampleRatio = ratio
+	}
+
+	if len(App.Env) == 0 {
+		App.Env = "production"
+	}
+
+	Crypto.MasterKeys = fieldMasterKeys
+	if len(Crypto.MasterKeys) == 0 && len(fieldEncKey) > 0 {
+		Crypto.MasterKeys = "1:" + fieldEncKey
+	}
+	Crypto.IndexKey = fieldIndexKey
+	if Development() {
+		if len(Crypto.MasterKeys) == 0 {
+			Crypto.MasterKeys = "1:" + developmentKey("field-enc")
+		}
+		if len(Crypto.IndexKey) == 0 {
+			Crypto.IndexKey = developmentKey("field-index")
+		}
+	}
+	Crypto.RotateInterval = durationOr(fieldRotateInterval, time.Hour)
+
+	Match.WeightDistance = floatOr(matchWeightDistance, 0.4)
+	Match.WeightPrice = floatOr(matchWeightPrice, 0.3)
+	Match.WeightRating = floatOr(matchWeightRating, 0.2)
+	Match.WeightResponseRate = floatOr(matchWeightResponseRate, 0.1)
+	Match.CancelFreeWindow = durationOr(matchCancelFreeWindow, 24*time.Hour)
+	Match.CancelFeePercent = percentOr(matchCancelFeePercent, 50)
+	Match.ProposalTTL = durationOr(matchProposalTTL, 30*time.Minute)
+	Match.ExpireInterval = durationOr(matchExpireInterval, time.Minute)
+
+	Cielo.MerchantID = cieloMerchantID
+	Cielo.MerchantKey = cieloMerchantKey
+	Cielo.Env = cieloEnv
+	if len(Cielo.Env) == 0 && Development() {
+		Cielo.Env = "local"
+	}
+
+	Payment.SoftDescriptor = paymentSoftDescriptor
+	Payment.ReconcileInterval = durationOr(paymentReconcileInterval, 10*time.Minute)
+	Payment.ReconcileGrace = durationOr(paymentReconcileGrace, 5*time.Minute)
+
+	Payout.CommissionPercent = percentOr(payoutCommissionPercent, 15)
+	Payout.Interval = durationOr(payoutInterval, 24*time.Hour)
+	Payout.Hold = durationOr(payoutHold, 72*time.Hour)
+
+	Webhook.Secret = webhookSecret
+	Webhook.Interval = durationOr(webhookInterval, 30*time.Second)
+
+	Service.PriceTolerancePercent = percentOr(servicePriceTolerancePercent, 50)
+
+	MarketPrice.MinSamples = countOr(marketPriceMinSamples, 10)
+	MarketPrice.Window = durationOr(marketPriceWindow, 365*24*time.Hour)
+	MarketPrice.Interval = durationOr(marketPriceInterval, 6*time.Hour)
+
+	Geo.URL = geocoderURL
+	Geo.UserAgent = geocoderUserAgent
+	if len(Geo.UserAgent) == 0 {
+		Geo.UserAgent = "echo-api"
+	}
+}
+
+// Development reports whether the app runs in development, APP_ENV
+func Development() bool {
+	return App.Env == "development"
+}
+
+// Check returns an error naming the required configuration left unset, to
+// fail at startup
+func Check() error {
+	missing := []string{}
+	if len(Crypto.MasterKeys) == 0 {
+		missing = append(missing, "FIELD_MASTER_KEYS or FIELD_ENC_KEY")
+	}
+	if len(Crypto.IndexKey) == 0 {
+		missing = append(missing, "FIELD_INDEX_KEY")
+	}
+	if len(Cielo.Env) == 0 {
+		missing = append(missing, "CIELO_ENV")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must be set unless APP_ENV is development", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// developmentKey is a key derived from Secret for purpose, never to be used
+// in production
+func developmentKey(purpose string) string {
+	sum := sha256.Sum256([]byte(purpose + ":" + Secret))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// floatOr parses a non negative float, falling back to def when empty
+func floatOr(v string, def float64) float64 {
+	if len(v) == 0 {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(err)
+	}
+	if f < 0 {
+		panic("negative value " + v)
+	}
+	return f
+}
+
+// percentOr parses a percent from 0 to 100, falling back to def when empty
+func percentOr(v string, def int) int {
+	if len(v) == 0 {
+		return def
+	}
+	pct, err := strconv.Atoi(v)
+	if err != nil {
+		panic(err)
+	}
+	if pct < 0 || pct > 100 {
+		panic("percent out of 0-100: " + v)
+	}
+	return pct
+}
+
+// countOr parses a positive integer, falling back to def when empty
+func countOr(v string, def int) int {
+	if len(v) == 0 {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		panic(err)
+	}
+	if n < 1 {
+		panic("count below 1: " + v)
+	}
+	return n
+}
+
+// durationOr parses a duration like "15s", falling back to def when empty
+func durationOr(v string, def time.Duration) time.Duration {
+	if len(v) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(err)
+	}
+	return d
 }
@@ -0,0 +1,316 @@
+// Package cielo is a client of the Cielo e-commerce API 3.0, with a fake
+// of it for tests and local development.
+package cielo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Environments of the Cielo API, the transactional and the query URLs
+var (
+	Sandbox    = Environment{APIURL: "https://apisandbox.cieloecommerce.cielo.com.br", QueryURL: "https://apiquerysandbox.cieloecommerce.cielo.com.br"}
+	Production = Environment{APIURL: "https://api.cieloecommerce.cielo.com.br", QueryURL: "https://apiquery.cieloecommerce.cielo.com.br"}
+)
+
+// Environment is where requests go, creating and changing payments at
+// APIURL and reading them at QueryURL
+type Environment struct {
+	APIURL   string
+	QueryURL string
+}
+
+// Ecommerce is a client of the Cielo e-commerce API for one merchant
+type Ecommerce struct {
+	MerchantID  string
+	MerchantKey string
+	Env         Environment
+	Client      *http.Client
+}
+
+// Status is the status of a Payment
+type Status int
+
+// Payment statuses
+const (
+	NotFinished      Status = 0
+	Authorized       Status = 1
+	PaymentConfirmed Status = 2
+	Denied           Status = 3
+	Voided           Status = 10
+	Refunded         Status = 11
+	Pending          Status = 12
+	Aborted          Status = 13
+	Scheduled        Status = 20
+)
+
+var statusNames = map[Status]string{
+	NotFinished: "not-finished", Authorized: "authorized", PaymentConfirmed: "confirmed", Denied: "denied",
+	Voided: "voided", Refunded: "refunded", Pending: "pending", Aborted: "aborted", Scheduled: "scheduled",
+}
+
+func (s Status) String() string {
+	if n, ok := statusNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("status-%d", int(s))
+}
+
+// Card is a credit card to tokenize, its number is never stored by us
+type Card struct {
+	CustomerName string `json:"CustomerName"`
+	Number       string `json:"CardNumber"`
+	Holder       string `json:"Holder"`
+	// Expiration is MM/YYYY
+	Expiration string `json:"ExpirationDate"`
+	Brand      string `json:"Brand"`
+}
+
+// CreditCard is the card a Payment is made with, by token
+type CreditCard struct {
+	CardToken    string `json:"CardToken,omitempty"`
+	SecurityCode string `json:"SecurityCode,omitempty"`
+	Brand        string `json:"Brand,omitempty"`
+	// CardNumber comes masked in responses
+	CardNumber string `json:"CardNumber,omitempty"`
+}
+
+// Payment is a credit card payment, amounts in cents
+type Payment struct {
+	PaymentID         string      `json:"PaymentId,omitempty"`
+	Type              string      `json:"Type"`
+	Amount            int         `json:"Amount"`
+	CapturedAmount    int         `json:"CapturedAmount,omitempty"`
+	VoidedAmount      int         `json:"VoidedAmount,omitempty"`
+	Installments      int         `json:"Installments"`
+	Capture           bool        `json:"Capture"`
+	SoftDescriptor    string      `json:"SoftDescriptor,omitempty"`
+	CreditCard        *CreditCard `json:"CreditCard,omitempty"`
+	Tid               string      `json:"Tid,omitempty"`
+	ProofOfSale       string      `json:"ProofOfSale,omitempty"`
+	AuthorizationCode string      `json:"AuthorizationCode,omitempty"`
+	Status            Status      `json:"Status"`
+	ReturnCode        string      `json:"ReturnCode,omitempty"`
+	ReturnMessage     string      `json:"ReturnMessage,omitempty"`
+}
+
+// Sale is an order paid by a Payment
+type Sale struct {
+	MerchantOrderID string `json:"MerchantOrderId"`
+	Customer        struct {
+		Name string `json:"Name"`
+	} `json:"Customer"`
+	Payment Payment `json:"Payment"`
+}
+
+// OrderID is the MerchantOrderId of the payment of a match, the same on
+// every attempt so a retried authorization finds the first one
+func OrderID(matcID uuid.UUID) string {
+	return strings.Replace(matcID.String(), "-", "", -1)
+}
+
+// Authorization asks to authorize, and optionally capture, an amount on a
+// tokenized card
+type Authorization struct {
+	OrderID      string
+	CustomerName string
+	Amount       int
+	CardToken    string
+	Brand        string
+	SecurityCode string
+	// Installments are 1 when 0
+	Installments   int
+	SoftDescriptor string
+	Capture        bool
+}
+
+// Tokenize stores c at Cielo, returning the token payments are made with
+func (e *Ecommerce) Tokenize(ctx context.Context, c Card) (string, error) {
+	res := struct {
+		CardToken string `json:"CardToken"`
+	}{}
+	err := e.do(ctx, http.MethodPost, e.Env.APIURL+"/1/card/", c, &res)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to tokenize card")
+	}
+	return res.CardToken, nil
+}
+
+// RemoveCard deletes a token, payments can't be made with it anymore. A
+// token already gone isn't an error.
+func (e *Ecommerce) RemoveCard(ctx context.Context, token string) error {
+	err := e.do(ctx, http.MethodDelete, e.Env.APIURL+"/1/card/"+url.PathEscape(token), nil, nil)
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	return errors.Wrap(err, "Failed to remove card")
+}
+
+// Authorize authorizes a.Amount for a.OrderID. It's idempotent: when the
+// order already has a payment not denied, that one is returned instead of
+// charging again. A payment denied by the issuer is a *DeclinedError.
+func (e *Ecommerce) Authorize(ctx context.Context, a Authorization) (*Payment, error) {
+	ids, err := e.OrderPayments(ctx, a.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		p, err := e.Payment(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if p.Status != Denied && p.Status != Aborted && p.Status != Voided {
+			return p, nil
+		}
+	}
+
+	sale := Sale{MerchantOrderID: a.OrderID}
+	sale.Customer.Name = a.CustomerName
+	sale.Payment = Payment{
+		Type:           "CreditCard",
+		Amount:         a.Amount,
+		Installments:   a.Installments,
+		Capture:        a.Capture,
+		SoftDescriptor: a.SoftDescriptor,
+		CreditCard:     &CreditCard{CardToken: a.CardToken, SecurityCode: a.SecurityCode, Brand: a.Brand},
+	}
+	if sale.Payment.Installments == 0 {
+		sale.Payment.Installments = 1
+	}
+	res := Sale{}
+	err = e.do(ctx, http.MethodPost, e.Env.APIURL+"/1/sales/", sale, &res)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to authorize payment")
+	}
+	p := &res.Payment
+	if p.Status == Denied || p.Status == Aborted {
+		return p, declined(p.ReturnCode, p.ReturnMessage)
+	}
+	return p, nil
+}
+
+// Capture captures amount of an authorized payment, all of it when 0
+func (e *Ecommerce) Capture(ctx context.Context, paymentID string, amount int) (*Payment, error) {
+	p, err := e.change(ctx, paymentID, "capture", amount)
+	return p, errors.Wrap(err, "Failed to capture payment")
+}
+
+// Cancel voids amount of a payment, all of it when 0. Captured payments
+// are refunded.
+func (e *Ecommerce) Cancel(ctx context.Context, paymentID string, amount int) (*Payment, error) {
+	p, err := e.change(ctx, paymentID, "void", amount)
+	return p, errors.Wrap(err, "Failed to cancel payment")
+}
+
+func (e *Ecommerce) change(ctx context.Context, paymentID, op string, amount int) (*Payment, error) {
+	u := e.Env.APIURL + "/1/sales/" + url.PathEscape(paymentID) + "/" + op
+	if amount > 0 {
+		u += fmt.Sprintf("?amount=%d", amount)
+	}
+	res := Payment{}
+	err := e.do(ctx, http.MethodPut, u, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	res.PaymentID = paymentID
+	return &res, nil
+}
+
+// Payment queries a payment, ErrNotFound when there's none
+func (e *Ecommerce) Payment(ctx context.Context, paymentID string) (*Payment, error) {
+	s, err := e.Sale(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return &s.Payment, nil
+}
+
+// Sale queries a payment with the order it paid, ErrNotFound when there's
+// none
+func (e *Ecommerce) Sale(ctx context.Context, paymentID string) (*Sale, error) {
+	res := Sale{}
+	err := e.do(ctx, http.MethodGet, e.Env.QueryURL+"/1/sales/"+url.PathEscape(paymentID), nil, &res)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query payment")
+	}
+	return &res, nil
+}
+
+// OrderPayments returns the ids of the payments of an order, oldest first
+func (e *Ecommerce) OrderPayments(ctx context.Context, orderID string) ([]string, error) {
+	res := struct {
+		Payments []struct {
+			PaymentID string `json:"PaymentId"`
+		} `json:"Payments"`
+	}{}
+	err := e.do(ctx, http.MethodGet, e.Env.QueryURL+"/1/sales?merchantOrderId="+url.QueryEscape(orderID), nil, &res)
+	if errors.Cause(err) == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query order")
+	}
+	ids := []string{}
+	for _, p := range res.Payments {
+		ids = append(ids, p.PaymentID)
+	}
+	return ids, nil
+}
+
+// do sends body as JSON and decodes the response into out, refusals are an
+// *Error
+func (e *Ecommerce) do(ctx context.Context, method, u string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("MerchantId", e.MerchantID)
+	req.Header.Set("MerchantKey", e.MerchantKey)
+	if id, err := uuid.NewV4(); err == nil {
+		req.Header.Set("RequestId", id.String())
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		apiErr := &Error{HTTPStatus: res.StatusCode}
+		json.Unmarshal(raw, &apiErr.Errors)
+		return apiErr
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(raw, out), "Failed to decode cielo response")
+}
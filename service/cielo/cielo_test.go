@@ -0,0 +1,147 @@
+package cielo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+func tokenize(t *testing.T, e *Ecommerce, number string) string {
+	token, err := e.Tokenize(context.Background(), Card{
+		CustomerName: "Maria", Number: number, Holder: "MARIA SILVA", Expiration: "12/2030", Brand: "Visa",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	return token
+}
+
+func TestPaymentFlow(t *testing.T) {
+	ctx := context.Background()
+	e := NewFake().Ecommerce()
+	matcID, _ := uuid.NewV4()
+
+	a := Authorization{
+		OrderID:      OrderID(matcID),
+		CustomerName: "Maria",
+		Amount:       20000,
+		CardToken:    tokenize(t, e, "4024007197692931"),
+		Brand:        "Visa",
+	}
+	p, err := e.Authorize(ctx, a)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.Status != Authorized || p.CreditCard.CardNumber != "402400******2931" {
+		t.Fatalf("Expected a masked card authorized, got %+v", p)
+	}
+
+	p, err = e.Capture(ctx, p.PaymentID, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.Status != PaymentConfirmed || p.CapturedAmount != 20000 {
+		t.Errorf("Expected 20000 captured, got %s of %d", p.Status, p.CapturedAmount)
+	}
+	_, err = e.Capture(ctx, p.PaymentID, 0)
+	if apiErr, ok := errors.Cause(err).(*Error); !ok || apiErr.Errors[0].Code != codeNotCapturable {
+		t.Errorf("Expected capturing twice to be refused, got %v", err)
+	}
+
+	// a partial refund keeps it confirmed, refunding the rest refunds it
+	p, err = e.Cancel(ctx, p.PaymentID, 5000)
+	if err != nil || p.Status != PaymentConfirmed {
+		t.Fatalf("Expected a partial refund, got %v %v", p, err)
+	}
+	p, err = e.Cancel(ctx, p.PaymentID, 0)
+	if err != nil || p.Status != Refunded || p.VoidedAmount != 20000 {
+		t.Fatalf("Expected it refunded, got %v %v", p, err)
+	}
+
+	got, err := e.Payment(ctx, p.PaymentID)
+	if err != nil || got.Status != Refunded {
+		t.Errorf("Expected to query it refunded, got %v %v", got, err)
+	}
+	_, err = e.Payment(ctx, "nope")
+	if errors.Cause(err) != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAuthorizeDeclined(t *testing.T) {
+	ctx := context.Background()
+	e := NewFake().Ecommerce()
+
+	cases := []struct {
+		number    string
+		reason    DeclineReason
+		temporary bool
+	}{
+		{"4024007197692932", DeclineNotAuthorized, false},
+		{"4024007197692933", DeclineExpiredCard, false},
+		{"4024007197692935", DeclineBlockedCard, false},
+		{"4024007197692936", DeclineTimeout, true},
+		{"4024007197692937", DeclineCanceledCard, false},
+		{"4024007197692938", DeclineCardProblem, false},
+	}
+	for _, c := range cases {
+		matcID, _ := uuid.NewV4()
+		p, err := e.Authorize(ctx, Authorization{OrderID: OrderID(matcID), Amount: 100, CardToken: tokenize(t, e, c.number)})
+		d, ok := err.(*DeclinedError)
+		if !ok {
+			t.Errorf("%s: expected a DeclinedError, got %v", c.number, err)
+			continue
+		}
+		if d.Reason != c.reason || d.Temporary() != c.temporary || p.Status != Denied {
+			t.Errorf("%s: expected %s, got %+v", c.number, c.reason, d)
+		}
+	}
+
+	_, err := e.Tokenize(ctx, Card{Number: "4024", Expiration: "12/2030"})
+	if _, ok := errors.Cause(err).(*Error); !ok {
+		t.Errorf("Expected a short number refused, got %v", err)
+	}
+}
+
+func TestAuthorizeIdempotent(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake()
+	e := f.Ecommerce()
+	matcID, _ := uuid.NewV4()
+	a := Authorization{OrderID: OrderID(matcID), Amount: 20000, CardToken: tokenize(t, e, "4024007197692931"), Capture: true}
+
+	f.LoseNext = true
+	_, err := e.Authorize(ctx, a)
+	if apiErr, ok := errors.Cause(err).(*Error); !ok || !apiErr.Temporary() {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	p, err := e.Authorize(ctx, a)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	again, err := e.Authorize(ctx, a)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	ids, _ := e.OrderPayments(ctx, a.OrderID)
+	if len(ids) != 1 || p.PaymentID != ids[0] || again.PaymentID != ids[0] || p.Status != PaymentConfirmed {
+		t.Errorf("Expected the one payment of the order, got %v, %s and %s", ids, p.PaymentID, again.PaymentID)
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	n, err := ParseNotification([]byte(`{"PaymentId":"24bc8366-fc31-4d6c-8555-17049a836a07","ChangeType":7}`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if n.ChangeType != ChangeChargeback || n.EventID() != "24bc8366-fc31-4d6c-8555-17049a836a07:7" {
+		t.Errorf("Expected a chargeback of the payment, got %+v", n)
+	}
+	for _, body := range []string{`{"ChangeType":1}`, `PaymentId=1&ChangeType=1`} {
+		if _, err := ParseNotification([]byte(body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
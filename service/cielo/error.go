@@ -0,0 +1,91 @@
+package cielo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is returned when Cielo has no such payment or order
+var ErrNotFound = errors.New("Payment not found")
+
+// APIError is one of the reasons Cielo refused a request
+type APIError struct {
+	Code    int    `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// Error is a request Cielo refused, e.g. a malformed card or a payment that
+// can't be captured anymore
+type Error struct {
+	HTTPStatus int
+	Errors     []APIError
+}
+
+func (e *Error) Error() string {
+	msgs := []string{}
+	for _, a := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d %s", a.Code, a.Message))
+	}
+	if len(msgs) == 0 {
+		return fmt.Sprintf("Cielo refused the request: status %d", e.HTTPStatus)
+	}
+	return "Cielo refused the request: " + strings.Join(msgs, "; ")
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *Error) Temporary() bool {
+	return e.HTTPStatus >= http.StatusInternalServerError
+}
+
+// DeclineReason is why an issuer didn't authorize a payment
+type DeclineReason string
+
+// Decline reasons, grouping the return codes of the authorizers
+const (
+	DeclineNotAuthorized DeclineReason = "not-authorized"
+	DeclineExpiredCard   DeclineReason = "expired-card"
+	DeclineBlockedCard   DeclineReason = "blocked-card"
+	DeclineCanceledCard  DeclineReason = "canceled-card"
+	DeclineCardProblem   DeclineReason = "card-problem"
+	DeclineTimeout       DeclineReason = "timeout"
+)
+
+// declineReasons maps authorization return codes to reasons, the others
+// are DeclineNotAuthorized
+var declineReasons = map[string]DeclineReason{
+	"57": DeclineExpiredCard,
+	"54": DeclineExpiredCard,
+	"78": DeclineBlockedCard,
+	"77": DeclineCanceledCard,
+	"70": DeclineCardProblem,
+	"14": DeclineCardProblem,
+	"99": DeclineTimeout,
+	"AA": DeclineTimeout,
+}
+
+// DeclinedError is a payment the issuer didn't authorize
+type DeclinedError struct {
+	ReturnCode    string
+	ReturnMessage string
+	Reason        DeclineReason
+}
+
+func (e *DeclinedError) Error() string {
+	return fmt.Sprintf("Payment declined: %s (%s %s)", e.Reason, e.ReturnCode, e.ReturnMessage)
+}
+
+// Temporary reports whether trying again later may succeed, otherwise the
+// patient should use another card
+func (e *DeclinedError) Temporary() bool {
+	return e.Reason == DeclineTimeout
+}
+
+func declined(code, msg string) *DeclinedError {
+	reason, ok := declineReasons[code]
+	if !ok {
+		reason = DeclineNotAuthorized
+	}
+	return &DeclinedError{ReturnCode: code, ReturnMessage: msg, Reason: reason}
+}
@@ -0,0 +1,259 @@
+package cielo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Local is where requests go for a Fake, it's never dialed
+var Local = Environment{APIURL: "http://cielo.local", QueryURL: "http://cielo.local"}
+
+// Fake is an in-memory stand-in of the Cielo API, for tests and local
+// development. Like the sandbox, the last digit of the card number decides
+// the outcome of authorizations: 0, 1, 4 and 9 are authorized, 2 is not
+// authorized (05), 3 is an expired card (57), 5 a blocked card (78), 6 a
+// timeout (99), 7 a canceled card (77) and 8 a problem with the card (70).
+type Fake struct {
+	// LoseNext makes the next sale be authorized but answered with a 503,
+	// like a response lost on the way back
+	LoseNext bool
+
+	mu     sync.Mutex
+	cards  map[string]Card
+	sales  map[string]*Sale
+	orders map[string][]string
+}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+	return &Fake{cards: map[string]Card{}, sales: map[string]*Sale{}, orders: map[string][]string{}}
+}
+
+// Ecommerce returns a client of f, served in-process
+func (f *Fake) Ecommerce() *Ecommerce {
+	return &Ecommerce{MerchantID: "local", MerchantKey: "local", Env: Local, Client: &http.Client{Transport: fakeTransport{f}}}
+}
+
+type fakeTransport struct {
+	h http.Handler
+}
+
+func (t fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, req)
+	res := rec.Result()
+	res.Request = req
+	return res, nil
+}
+
+// codes of the errors the fake refuses requests with, as Cielo's
+const (
+	codeMerchantRequired = 101
+	codeInvalidRequest   = 100
+	codeInvalidCard      = 126
+	codeNotCapturable    = 308
+	codeNotVoidable      = 309
+)
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(r.Header.Get("MerchantId")) == 0 || len(r.Header.Get("MerchantKey")) == 0 {
+		refuse(w, http.StatusUnauthorized, codeMerchantRequired, "MerchantId is required")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/1/card/":
+		f.tokenize(w, r)
+	case r.Method == http.MethodDelete && len(path) == 3 && path[1] == "card":
+		if _, ok := f.cards[path[2]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.cards, path[2])
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && r.URL.Path == "/1/sales/":
+		f.authorize(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/1/sales":
+		f.order(w, r.URL.Query().Get("merchantOrderId"))
+	case r.Method == http.MethodGet && len(path) == 3 && path[1] == "sales":
+		s, ok := f.sales[path[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reply(w, http.StatusOK, s)
+	case r.Method == http.MethodPut && len(path) == 4 && path[1] == "sales":
+		s, ok := f.sales[path[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		amount, _ := strconv.Atoi(r.URL.Query().Get("amount"))
+		switch path[3] {
+		case "capture":
+			f.capture(w, &s.Payment, amount)
+		case "void":
+			f.void(w, &s.Payment, amount)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *Fake) tokenize(w http.ResponseWriter, r *http.Request) {
+	c := Card{}
+	if json.NewDecoder(r.Body).Decode(&c) != nil {
+		refuse(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	if len(c.Number) < 13 || len(c.Number) > 19 || strings.Trim(c.Number, "0123456789") != "" {
+		refuse(w, http.StatusBadRequest, codeInvalidCard, "Credit Card Number is invalid")
+		return
+	}
+	if _, err := time.Parse("01/2006", c.Expiration); err != nil {
+		refuse(w, http.StatusBadRequest, codeInvalidCard, "Credit Card Expiration Date is invalid")
+		return
+	}
+	token := newID()
+	f.cards[token] = c
+	reply(w, http.StatusCreated, map[string]string{"CardToken": token})
+}
+
+func (f *Fake) authorize(w http.ResponseWriter, r *http.Request) {
+	s := &Sale{}
+	if json.NewDecoder(r.Body).Decode(s) != nil || s.Payment.CreditCard == nil || s.Payment.Amount <= 0 {
+		refuse(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	p := &s.Payment
+	p.PaymentID = newID()
+	p.Tid = fmt.Sprintf("%020d", time.Now().UnixNano())
+	p.ProofOfSale = p.Tid[len(p.Tid)-6:]
+	c, ok := f.cards[p.CreditCard.CardToken]
+	if !ok {
+		p.Status, p.ReturnCode, p.ReturnMessage = Denied, "14", "Invalid card"
+	} else {
+		p.CreditCard.CardNumber = c.Number[:6] + "******" + c.Number[len(c.Number)-4:]
+		code, msg := sandboxOutcome(c.Number[len(c.Number)-1])
+		p.ReturnCode, p.ReturnMessage = code, msg
+		switch {
+		case code != "4":
+			p.Status = Denied
+		case p.Capture:
+			p.Status, p.ReturnCode, p.CapturedAmount = PaymentConfirmed, "6", p.Amount
+		default:
+			p.Status = Authorized
+		}
+		if p.Status != Denied {
+			p.AuthorizationCode = p.ProofOfSale
+		}
+	}
+	f.sales[p.PaymentID] = s
+	f.orders[s.MerchantOrderID] = append(f.orders[s.MerchantOrderID], p.PaymentID)
+	if f.LoseNext {
+		f.LoseNext = false
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	reply(w, http.StatusCreated, s)
+}
+
+func sandboxOutcome(last byte) (code, msg string) {
+	switch last {
+	case '2':
+		return "05", "Not Authorized"
+	case '3':
+		return "57", "Card Expired"
+	case '5':
+		return "78", "Blocked Card"
+	case '6':
+		return "99", "Time Out"
+	case '7':
+		return "77", "Card Canceled"
+	case '8':
+		return "70", "Problems with Creditcard"
+	}
+	return "4", "Operation Successful"
+}
+
+func (f *Fake) order(w http.ResponseWriter, orderID string) {
+	ids := f.orders[orderID]
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	res := struct {
+		Payments []map[string]string `json:"Payments"`
+	}{}
+	for _, id := range ids {
+		res.Payments = append(res.Payments, map[string]string{"PaymentId": id})
+	}
+	reply(w, http.StatusOK, res)
+}
+
+func (f *Fake) capture(w http.ResponseWriter, p *Payment, amount int) {
+	if amount == 0 {
+		amount = p.Amount
+	}
+	if p.Status != Authorized || amount > p.Amount-p.VoidedAmount {
+		refuse(w, http.StatusBadRequest, codeNotCapturable, "Transaction not available to capture")
+		return
+	}
+	p.Status, p.CapturedAmount, p.ReturnCode, p.ReturnMessage = PaymentConfirmed, amount, "6", "Operation Successful"
+	reply(w, http.StatusOK, p)
+}
+
+func (f *Fake) void(w http.ResponseWriter, p *Payment, amount int) {
+	left := p.Amount - p.VoidedAmount
+	if p.Status == PaymentConfirmed {
+		left = p.CapturedAmount - p.VoidedAmount
+	}
+	if amount == 0 {
+		amount = left
+	}
+	if p.Status != Authorized && p.Status != PaymentConfirmed || amount > left {
+		refuse(w, http.StatusBadRequest, codeNotVoidable, "Transaction not available to void")
+		return
+	}
+	p.VoidedAmount += amount
+	switch {
+	case amount < left:
+	case p.Status == Authorized:
+		p.Status = Voided
+	default:
+		p.Status = Refunded
+	}
+	p.ReturnCode, p.ReturnMessage = "9", "Operation Successful"
+	reply(w, http.StatusOK, p)
+}
+
+func newID() string {
+	id, _ := uuid.NewV4()
+	return id.String()
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func refuse(w http.ResponseWriter, status, code int, msg string) {
+	reply(w, status, []APIError{{Code: code, Message: msg}})
+}
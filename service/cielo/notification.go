@@ -0,0 +1,54 @@
+package cielo
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ChangeType is what changed in a payment Cielo notifies about
+type ChangeType int
+
+// Change types
+const (
+	ChangePaymentStatus          ChangeType = 1
+	ChangeRecurrenceCreated      ChangeType = 2
+	ChangeAntifraudStatus        ChangeType = 3
+	ChangeRecurrentPaymentStatus ChangeType = 4
+	ChangeCancellationDenied     ChangeType = 5
+	ChangeChargeback             ChangeType = 7
+	ChangeFraudAlert             ChangeType = 8
+)
+
+// Notification is what Cielo posts to the notification URL of the
+// merchant when a payment changes. It carries no status, the payment has
+// to be queried for it.
+type Notification struct {
+	RecurrentPaymentID string     `json:"RecurrentPaymentId,omitempty"`
+	PaymentID          string     `json:"PaymentId"`
+	ChangeType         ChangeType `json:"ChangeType"`
+}
+
+// ParseNotification decodes the body of a notification
+func ParseNotification(body []byte) (*Notification, error) {
+	n := &Notification{}
+	err := json.Unmarshal(body, n)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid cielo notification")
+	}
+	if len(n.PaymentID) == 0 && len(n.RecurrentPaymentID) == 0 {
+		return nil, errors.New("Invalid cielo notification: no payment id")
+	}
+	return n, nil
+}
+
+// EventID identifies n, Cielo sends none: every notification of the same
+// kind of change of a payment has the same one, including retries
+func (n *Notification) EventID() string {
+	id := n.PaymentID
+	if len(id) == 0 {
+		id = n.RecurrentPaymentID
+	}
+	return fmt.Sprintf("%s:%d", id, n.ChangeType)
+}
@@ -0,0 +1,136 @@
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/migrate"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// NewEmptyDB creates a database with a random name on the test server and
+// drops it when the test ends
+func NewEmptyDB(t testing.TB) *sqlx.DB {
+	t.Helper()
+	raw := URL(t)
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("Invalid test database url: %s", err)
+	}
+
+	admin, err := sqlx.Connect("postgres", raw)
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %s", err)
+	}
+	name := fmt.Sprintf("test_%d_%d", time.Now().UnixNano(), rand.Intn(1e6))
+	_, err = admin.Exec(`CREATE DATABASE ` + name)
+	if err != nil {
+		admin.Close()
+		t.Fatalf("Failed to create database %s: %s", name, err)
+	}
+
+	u.Path = "/" + name
+	db, err := sqlx.Connect("postgres", u.String())
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %s", name, err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		_, err := admin.Exec(`DROP DATABASE IF EXISTS ` + name)
+		if err != nil {
+			t.Errorf("Failed to drop database %s: %s", name, err)
+		}
+		admin.Close()
+	})
+	return db
+}
+
+// NewDB is NewEmptyDB with every migration applied
+func NewDB(t testing.TB) *sqlx.DB {
+	t.Helper()
+	db := NewEmptyDB(t)
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %s", err)
+	}
+	_, err = m.Up(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to apply migrations: %s", err)
+	}
+	return db
+}
+
+var shared struct {
+	once  sync.Once
+	db    *sqlx.DB
+	admin *sqlx.DB
+	name  string
+	err   error
+}
+
+// SharedDB returns a migrated database created once per test binary and
+// dropped by Main. Use it with Tx so tests stay isolated.
+func SharedDB(t testing.TB) *sqlx.DB {
+	t.Helper()
+	raw := URL(t)
+	shared.once.Do(func() {
+		shared.admin, shared.err = sqlx.Connect("postgres", raw)
+		if shared.err != nil {
+			return
+		}
+		shared.name = fmt.Sprintf("test_shared_%d", time.Now().UnixNano())
+		_, shared.err = shared.admin.Exec(`CREATE DATABASE ` + shared.name)
+		if shared.err != nil {
+			return
+		}
+		u, _ := url.Parse(raw)
+		u.Path = "/" + shared.name
+		shared.db, shared.err = sqlx.Connect("postgres", u.String())
+		if shared.err != nil {
+			return
+		}
+		m, err := migrate.New(shared.db)
+		if err != nil {
+			shared.err = err
+			return
+		}
+		_, shared.err = m.Up(context.Background())
+	})
+	if shared.err != nil {
+		t.Fatalf("Failed to create shared test database: %s", shared.err)
+	}
+	return shared.db
+}
+
+func dropShared() {
+	if shared.admin == nil {
+		return
+	}
+	if shared.db != nil {
+		shared.db.Close()
+	}
+	if len(shared.name) > 0 {
+		shared.admin.Exec(`DROP DATABASE IF EXISTS ` + shared.name)
+	}
+	shared.admin.Close()
+}
+
+// Tx begins a transaction on db that is rolled back when the test ends,
+// so tests sharing a database never see each other's rows
+func Tx(t testing.TB, db *sqlx.DB) *sqlx.Tx {
+	t.Helper()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("Failed to begin test transaction: %s", err)
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+	})
+	return tx
+}
@@ -0,0 +1,173 @@
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password is the plain text password of every factory user
+const Password = "secret123"
+
+var seq int64
+
+func next() int64 {
+	return atomic.AddInt64(&seq, 1)
+}
+
+// Factory inserts rows with sensible defaults through Q, usually a Tx
+type Factory struct {
+	Q sqlx.ExtContext
+}
+
+// UserRow is an inserted "user"
+type UserRow struct {
+	UserID uuid.UUID
+	Email  string
+}
+
+// DoctorRow is an inserted doctor and its user
+type DoctorRow struct {
+	UserRow
+	DoctID uuid.UUID
+	Name   string
+	CRM    string
+}
+
+// PatientRow is an inserted patient and its user
+type PatientRow struct {
+	UserRow
+	PatiID uuid.UUID
+	Name   string
+	CPF    string
+}
+
+// MatchRow is an inserted match
+type MatchRow struct {
+	MatcID uuid.UUID
+	PatiID uuid.UUID
+	DoctID uuid.UUID
+	Date   time.Time
+	Price  int64
+}
+
+func (f *Factory) exec(t testing.TB, q string, args ...interface{}) {
+	t.Helper()
+	_, err := f.Q.ExecContext(context.Background(), q, args...)
+	if err != nil {
+		t.Fatalf("Factory failed on %q: %s", q, err)
+	}
+}
+
+func newID(t testing.TB) uuid.UUID {
+	t.Helper()
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatalf("Failed generating uuid: %s", err)
+	}
+	return id
+}
+
+// User inserts an user with Password and the given roles
+func (f *Factory) User(t testing.TB, roles ...string) UserRow {
+	t.Helper()
+	u := UserRow{UserID: newID(t), Email: fmt.Sprintf("user%d@mail.com", next())}
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed hashing password: %s", err)
+	}
+	role := `["user"]`
+	if len(roles) > 0 {
+		role = `["` + roles[0] + `"`
+		for _, r := range roles[1:] {
+			role += `,"` + r + `"`
+		}
+		role += `]`
+	}
+	f.exec(t, `INSERT INTO "user" (user_id, email, password, role) VALUES ($1, $2, $3, $4)`,
+		u.UserID, u.Email, hash, role)
+	return u
+}
+
+// Doctor inserts a doctor with a new user
+func (f *Factory) Doctor(t testing.TB) DoctorRow {
+	t.Helper()
+	n := next()
+	d := DoctorRow{
+		UserRow: f.User(t, "user", "doctor"),
+		DoctID:  newID(t),
+		Name:    fmt.Sprintf("Doctor %d", n),
+		CRM:     fmt.Sprintf("%d/SP", 100000+n),
+	}
+	f.exec(t, `INSERT INTO doctor (doct_id, user_id, name, crm) VALUES ($1, $2, $3, $4)`,
+		d.DoctID, d.UserID, d.Name, d.CRM)
+	return d
+}
+
+// Patient inserts a patient with a new user and a valid, unique CPF. It
+// needs fieldcrypt configured, as Main does.
+func (f *Factory) Patient(t testing.TB) PatientRow {
+	t.Helper()
+	n := next()
+	p := PatientRow{
+		UserRow: f.User(t, "user", "patient"),
+		PatiID:  newID(t),
+		Name:    fmt.Sprintf("Patient %d", n),
+		CPF:     CPF(n),
+	}
+	index, err := fieldcrypt.Index(p.CPF)
+	if err != nil {
+		t.Fatalf("Failed indexing cpf: %s", err)
+	}
+	f.exec(t, `INSERT INTO patient (pati_id, user_id, name, cpf, cpf_index) VALUES ($1, $2, $3, $4, $5)`,
+		p.PatiID, p.UserID, p.Name, fieldcrypt.String(p.CPF), index)
+	return p
+}
+
+// Match inserts a match between p and d for tomorrow
+func (f *Factory) Match(t testing.TB, p PatientRow, d DoctorRow) MatchRow {
+	t.Helper()
+	m := MatchRow{
+		MatcID: newID(t),
+		PatiID: p.PatiID,
+		DoctID: d.DoctID,
+		Date:   time.Now().AddDate(0, 0, 1).Truncate(24 * time.Hour),
+		Price:  15000,
+	}
+	f.exec(t, `INSERT INTO match (matc_id, pati_id, doct_id, date, time, price, type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		m.MatcID, m.PatiID, m.DoctID, m.Date, "09:00", m.Price, "in-person")
+	return m
+}
+
+// CPF builds the n-th valid CPF (11 digits, no punctuation)
+func CPF(n int64) string {
+	base := fmt.Sprintf("%09d", 100000000+n%800000000)
+	digits := make([]int, 0, 11)
+	for _, c := range base {
+		digits = append(digits, int(c-'0'))
+	}
+	for _, size := range []int{9, 10} {
+		sum := 0
+		for i := 0; i < size; i++ {
+			sum += digits[i] * (size + 1 - i)
+		}
+		d := (sum * 10) % 11
+		if d == 10 {
+			d = 0
+		}
+		digits = append(digits, d)
+	}
+	s := ""
+	for _, d := range digits {
+		s += fmt.Sprint(d)
+	}
+	return s
+}
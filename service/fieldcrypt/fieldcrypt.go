@@ -0,0 +1,270 @@
+// Package fieldcrypt encrypts sensitive columns at rest with envelope
+// encryption: values are sealed with AES-GCM under a data key, and the data
+// key is wrapped by a master key from config and stored along the value.
+// String encrypts on its way to the database and decrypts when scanned;
+// Index derives a blind index so encrypted values can still be looked up by
+// equality. Rotator re-encrypts stored values after the master key changes.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Stored values are "enc:v2:<master key id>:<wrapped data key>:<sealed>".
+// Plaintext values from before encryption are still read, Rotator rewrites
+// them.
+const prefixV2 = "enc:v2:"
+
+// defaultKeyID is the id of a master key given without one
+const defaultKeyID = "1"
+
+var keys struct {
+	mu      sync.RWMutex
+	current string
+	masters map[string]cipher.AEAD
+	// dek seals new values, wrapped is it sealed by the current master
+	dek     cipher.AEAD
+	wrapped string
+	// deks caches unwrapped data keys by id:wrapped
+	deks  map[string]cipher.AEAD
+	index []byte
+}
+
+// Setup configures the keys. masterKeys is a comma separated list of
+// id:key, the first one being current and the others kept to read values
+// not yet rotated; a key without id has id 1. Keys are base64 encoded and
+// 32 bytes long. The index key can't be rotated, blind indexes depend on
+// it. Setup must be called before any String is stored or scanned.
+func Setup(masterKeys, indexKey string) error {
+	masters := map[string]cipher.AEAD{}
+	current := ""
+	for _, spec := range strings.Split(masterKeys, ",") {
+		id, k := defaultKeyID, strings.TrimSpace(spec)
+		if i := strings.Index(k, ":"); i >= 0 {
+			id, k = k[:i], k[i+1:]
+		}
+		if len(id) == 0 || strings.Contains(id, ":") {
+			return errors.New("Invalid master key id " + id)
+		}
+		aead, err := newAEAD(k)
+		if err != nil {
+			return errors.Wrap(err, "Invalid master key "+id)
+		}
+		if _, ok := masters[id]; ok {
+			return errors.New("Duplicated master key " + id)
+		}
+		masters[id] = aead
+		if len(current) == 0 {
+			current = id
+		}
+	}
+	idx, err := decodeKey(indexKey)
+	if err != nil {
+		return errors.Wrap(err, "Invalid index key")
+	}
+
+	// one data key per process, wrapped once by the current master
+	raw := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, raw)
+	if err != nil {
+		return err
+	}
+	dek, err := newAEAD(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		return err
+	}
+	wrapped, err := seal(masters[current], raw)
+	if err != nil {
+		return err
+	}
+
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	keys.current, keys.masters, keys.index = current, masters, idx
+	keys.dek, keys.wrapped = dek, base64.StdEncoding.EncodeToString(wrapped)
+	keys.deks = map[string]cipher.AEAD{current + ":" + keys.wrapped: dek}
+	return nil
+}
+
+func decodeKey(k string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	return b, nil
+}
+
+func newAEAD(k string) (cipher.AEAD, error) {
+	b, err := decodeKey(k)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain under a random nonce, prepended to the result
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(aead cipher.AEAD, b64 string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, errors.Wrap(err, "Malformed encrypted value")
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt value")
+	}
+	return plain, nil
+}
+
+func ready() error {
+	if keys.masters == nil {
+		return errors.New("fieldcrypt: Setup was not called")
+	}
+	return nil
+}
+
+// Encrypt seals plain with the data key
+func Encrypt(plain string) (string, error) {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	if err := ready(); err != nil {
+		return "", err
+	}
+	sealed, err := seal(keys.dek, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+	return prefixV2 + keys.current + ":" + keys.wrapped + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value made by Encrypt, values without an encrypted
+// prefix are legacy plaintext and returned as they are
+func Decrypt(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, prefixV2):
+		parts := strings.SplitN(strings.TrimPrefix(v, prefixV2), ":", 3)
+		if len(parts) != 3 {
+			return "", errors.New("Malformed encrypted value")
+		}
+		dek, err := dataKey(parts[0], parts[1])
+		if err != nil {
+			return "", err
+		}
+		plain, err := open(dek, parts[2])
+		return string(plain), err
+	default:
+		return v, nil
+	}
+}
+
+// dataKey unwraps a data key with the master key id, caching it
+func dataKey(id, wrapped string) (cipher.AEAD, error) {
+	keys.mu.RLock()
+	dek, ok := keys.deks[id+":"+wrapped]
+	master, known := keys.masters[id]
+	err := ready()
+	keys.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return dek, nil
+	}
+	if !known {
+		return nil, errors.New("Unknown master key " + id)
+	}
+
+	raw, err := open(master, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unwrap data key")
+	}
+	dek, err = newAEAD(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		return nil, err
+	}
+	keys.mu.Lock()
+	keys.deks[id+":"+wrapped] = dek
+	keys.mu.Unlock()
+	return dek, nil
+}
+
+// Stale reports whether a stored value isn't encrypted under the current
+// master key, i.e. it is plaintext or wrapped by an older master
+func Stale(v string) bool {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	return !strings.HasPrefix(v, prefixV2+keys.current+":")
+}
+
+// Index is the blind index of v, a keyed hash that is equal for equal
+// values without revealing them
+func Index(v string) (string, error) {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	if err := ready(); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, keys.index)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// String is a string column encrypted at rest
+type String string
+
+// Value implements the driver Valuer interface.
+func (s String) Value() (driver.Value, error) {
+	return Encrypt(string(s))
+}
+
+// Scan implements the Scanner interface.
+func (s *String) Scan(src interface{}) error {
+	var source string
+	switch v := src.(type) {
+	case string:
+		source = v
+	case []byte:
+		source = string(v)
+	case nil:
+		*s = ""
+		return nil
+	default:
+		return errors.New("Incompatible type for fieldcrypt.String")
+	}
+	plain, err := Decrypt(source)
+	if err != nil {
+		return err
+	}
+	*s = String(plain)
+	return nil
+}
@@ -0,0 +1,104 @@
+package fieldcrypt
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey  = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func TestStringRoundTrip(t *testing.T) {
+	err := Setup(testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+
+	v, err := String("12345678909").Value()
+	if err != nil {
+		t.Fatalf("Value failed: %s", err)
+	}
+	stored := v.(string)
+	if !strings.HasPrefix(stored, prefixV2) || strings.Contains(stored, "12345678909") {
+		t.Errorf("Expected an encrypted value, got %q", stored)
+	}
+	other, _ := String("12345678909").Value()
+	if other == v {
+		t.Errorf("Expected a random nonce per value")
+	}
+
+	var s String
+	err = s.Scan([]byte(stored))
+	if err != nil || s != "12345678909" {
+		t.Errorf("Expected to decrypt %q, got %q %v", stored, s, err)
+	}
+
+	err = s.Scan("legacy plaintext")
+	if err != nil || s != "legacy plaintext" {
+		t.Errorf("Expected legacy plaintext to be kept, got %q %v", s, err)
+	}
+
+	err = s.Scan(stored[:len(stored)-4] + "AAAA")
+	if err == nil {
+		t.Errorf("Expected a tampered value to fail")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	err := Setup(testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	a, _ := Index("12345678909")
+	b, _ := Index("12345678909")
+	c, _ := Index("98765432100")
+	if a != b || a == c || strings.Contains(a, "12345678909") {
+		t.Errorf("Unexpected blind indexes %s %s %s", a, b, c)
+	}
+}
+
+func TestSetupRejectsShortKeys(t *testing.T) {
+	if err := Setup("c2hvcnQ=", testKey); err == nil {
+		t.Errorf("Expected a short key to be refused")
+	}
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	err := Setup(testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	old, _ := Encrypt("12345678909")
+
+	err = Setup("2:"+newKey+",1:"+testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	if !Stale(old) || !Stale("plaintext") {
+		t.Errorf("Expected values under the old master key to be stale")
+	}
+	plain, err := Decrypt(old)
+	if err != nil || plain != "12345678909" {
+		t.Errorf("Expected the old master key to still decrypt, got %q %v", plain, err)
+	}
+	cur, _ := Encrypt("12345678909")
+	if Stale(cur) || !strings.HasPrefix(cur, prefixV2+"2:") {
+		t.Errorf("Expected a value under the current master key, got %q", cur)
+	}
+
+	// a restarted replica unwraps the data key of another process
+	err = Setup("2:"+newKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	plain, err = Decrypt(cur)
+	if err != nil || plain != "12345678909" {
+		t.Errorf("Expected to unwrap the data key, got %q %v", plain, err)
+	}
+	_, err = Decrypt(old)
+	if err == nil {
+		t.Errorf("Expected a retired master key to fail")
+	}
+}
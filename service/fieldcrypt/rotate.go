@@ -0,0 +1,216 @@
+package fieldcrypt
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+// lockID is the pg_advisory_lock key held while rotating, so only one
+// replica rewrites rows at a time
+const lockID = 7305196012
+
+// Field is a column type that encrypts in Value and decrypts in Scan
+type Field interface {
+	sql.Scanner
+	driver.Valuer
+}
+
+// Column is an encrypted column Rotator keeps under the current master key
+type Column struct {
+	Table string
+	// Key is the primary key column, used to page and update rows
+	Key  string
+	Name string
+	// New returns the type the column is scanned into and rewritten from
+	New func() Field
+	// Stale reports whether a stored value needs re-encryption, Stale when
+	// nil. Columns holding JSON with encrypted members need their own.
+	Stale func(raw string) bool
+	// Derived are columns Derive computes from the value, in order, e.g. a
+	// blind index. They're set along every rewrite, and rows missing one
+	// are rewritten even when they aren't stale.
+	Derived []string
+	Derive  func(f Field) ([]interface{}, error)
+}
+
+// Rotator re-encrypts stored values under the current master key, e.g.
+// after a new one was added in front of the key list
+type Rotator struct {
+	DB        *sql.DB
+	Columns   []Column
+	BatchSize uint64
+	Log       *logger.Logger
+}
+
+// Run rewrites every stale value once and returns how many it rewrote.
+// It does nothing when another replica is already rotating.
+func (r *Rotator) Run(ctx context.Context) (n int, err error) {
+	conn, err := r.DB.Conn(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get rotation connection")
+	}
+	defer conn.Close()
+
+	locked := false
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, lockID).Scan(&locked)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to acquire rotation lock")
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	for _, c := range r.Columns {
+		cn, err := r.column(ctx, conn, c)
+		n += cn
+		if err != nil {
+			return n, errors.Wrapf(err, "Failed to rotate %s.%s", c.Table, c.Name)
+		}
+	}
+	return n, nil
+}
+
+func (r *Rotator) column(ctx context.Context, conn *sql.Conn, c Column) (n int, err error) {
+	stale := c.Stale
+	if stale == nil {
+		stale = Stale
+	}
+	batch := r.BatchSize
+	if batch == 0 {
+		batch = 500
+	}
+	l := r.Log
+	if l == nil {
+		l = logger.Default
+	}
+	missing := make([]string, len(c.Derived))
+	for i, d := range c.Derived {
+		missing[i] = d + " IS NULL"
+	}
+
+	last := ""
+	for {
+		query := psql.Select(c.Key+"::text", c.Name+"::text").
+			From(c.Table).
+			Where(sq.NotEq{c.Name: nil}).
+			OrderBy(c.Key + "::text").
+			Limit(batch)
+		if len(missing) > 0 {
+			query = query.Column("(" + strings.Join(missing, " OR ") + ")")
+		}
+		if len(last) > 0 {
+			query = query.Where(sq.Gt{c.Key + "::text": last})
+		}
+		qSQL, args, err := query.ToSql()
+		if err != nil {
+			return n, errors.Wrap(err, "Error generating rotation sql")
+		}
+
+		type row struct {
+			key, raw string
+			missing  bool
+		}
+		var rows []row
+		rs, err := conn.QueryContext(ctx, qSQL, args...)
+		if err != nil {
+			return n, err
+		}
+		for rs.Next() {
+			rw := row{}
+			dest := []interface{}{&rw.key, &rw.raw}
+			if len(missing) > 0 {
+				dest = append(dest, &rw.missing)
+			}
+			err = rs.Scan(dest...)
+			if err != nil {
+				rs.Close()
+				return n, err
+			}
+			rows = append(rows, rw)
+		}
+		rs.Close()
+		if err = rs.Err(); err != nil {
+			return n, err
+		}
+
+		for _, rw := range rows {
+			if !stale(rw.raw) && !rw.missing {
+				continue
+			}
+			f := c.New()
+			err = f.Scan(rw.raw)
+			if err != nil {
+				return n, err
+			}
+			// only if unchanged since read, a concurrent write already
+			// encrypts under the current key
+			upd := psql.Update(c.Table).
+				Set(c.Name, f).
+				Where(sq.Eq{c.Key + "::text": rw.key, c.Name + "::text": rw.raw})
+			if c.Derive != nil {
+				vs, err := c.Derive(f)
+				if err != nil {
+					return n, err
+				}
+				for i, d := range c.Derived {
+					upd = upd.Set(d, vs[i])
+				}
+			}
+			qSQL, args, err := upd.ToSql()
+			if err != nil {
+				return n, errors.Wrap(err, "Error generating rotation update sql")
+			}
+			_, err = conn.ExecContext(ctx, qSQL, args...)
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				// a derived column is unique and another row has the same
+				// value, e.g. two rows from before encryption alike. The row
+				// is left as it is for someone to sort out.
+				l.Error("value not rotated", "table", c.Table, "key", rw.key, "error", err)
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if uint64(len(rows)) < batch {
+			return n, nil
+		}
+		last = rows[len(rows)-1].key
+	}
+}
+
+// Every runs the Rotator now and then every interval until ctx is done
+func (r *Rotator) Every(ctx context.Context, interval time.Duration) {
+	l := r.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := r.Run(ctx)
+		if err != nil {
+			l.Error("key rotation failed", "error", err)
+		} else if n > 0 {
+			l.Info("key rotation", "rewritten", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fieldcrypt
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// encryptedWith matches a value encrypted under the master key id
+type encryptedWith string
+
+func (e encryptedWith) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, prefixV2+string(e)+":")
+}
+
+func TestRotatorRewritesStaleValues(t *testing.T) {
+	err := Setup(testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	old, _ := Encrypt("12345678909")
+	err = Setup("2:"+newKey+",1:"+testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	cur, _ := Encrypt("98765432100")
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(`SELECT pati_id::text, cpf::text FROM patient WHERE cpf IS NOT NULL ORDER BY pati_id::text LIMIT 2`).
+		WillReturnRows(sqlmock.NewRows([]string{"pati_id", "cpf"}).
+			AddRow("a", old).
+			AddRow("b", cur))
+	mock.ExpectExec(`UPDATE patient SET cpf = \$1 WHERE cpf::text = \$2 AND pati_id::text = \$3`).
+		WithArgs(encryptedWith("2"), old, "a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT pati_id::text, cpf::text FROM patient WHERE cpf IS NOT NULL AND pati_id::text > \$1 ORDER BY pati_id::text LIMIT 2`).
+		WithArgs("b").
+		WillReturnRows(sqlmock.NewRows([]string{"pati_id", "cpf"}).AddRow("c", "legacy"))
+	mock.ExpectExec(`UPDATE patient SET cpf`).
+		WithArgs(encryptedWith("2"), "legacy", "c").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`SELECT pg_advisory_unlock`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	r := &Rotator{
+		DB:        mockDB,
+		BatchSize: 2,
+		Columns: []Column{{Table: "patient", Key: "pati_id", Name: "cpf", New: func() Field {
+			s := String("")
+			return &s
+		}}},
+	}
+	n, err := r.Run(context.Background())
+	if err != nil || n != 2 {
+		t.Errorf("Expected 2 values rotated, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestRotatorSetsDerivedColumns(t *testing.T) {
+	err := Setup(testKey, testKey)
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	cur, _ := Encrypt("12345678909")
+	index, _ := Index("12345678909")
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(`SELECT pati_id::text, cpf::text, \(cpf_index IS NULL\) FROM patient WHERE cpf IS NOT NULL ORDER BY pati_id::text LIMIT 500`).
+		WillReturnRows(sqlmock.NewRows([]string{"pati_id", "cpf", "missing"}).
+			AddRow("a", cur, true).
+			AddRow("b", cur, false).
+			AddRow("c", "12345678909", true))
+	mock.ExpectExec(`UPDATE patient SET cpf = \$1, cpf_index = \$2 WHERE cpf::text = \$3 AND pati_id::text = \$4`).
+		WithArgs(encryptedWith("1"), index, cur, "a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// a legacy duplicate of a, left alone
+	mock.ExpectExec(`UPDATE patient SET cpf = \$1, cpf_index = \$2`).
+		WithArgs(encryptedWith("1"), index, "12345678909", "c").
+		WillReturnError(&pq.Error{Code: "23505"})
+	mock.ExpectExec(`SELECT pg_advisory_unlock`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	r := &Rotator{
+		DB: mockDB,
+		Columns: []Column{{
+			Table:   "patient",
+			Key:     "pati_id",
+			Name:    "cpf",
+			Derived: []string{"cpf_index"},
+			New: func() Field {
+				s := String("")
+				return &s
+			},
+			Derive: func(f Field) ([]interface{}, error) {
+				index, err := Index(string(*f.(*String)))
+				return []interface{}{index}, err
+			},
+		}},
+	}
+	n, err := r.Run(context.Background())
+	if err != nil || n != 1 {
+		t.Errorf("Expected the missing index set once, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestRotatorSkipsWhenLocked(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+
+	r := &Rotator{DB: mockDB, Columns: []Column{{Table: "patient", Key: "pati_id", Name: "cpf"}}}
+	n, err := r.Run(context.Background())
+	if err != nil || n != 0 {
+		t.Errorf("Expected nothing rotated, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Package geo geocodes brazilian addresses and measures distances between
+// coordinates.
+package geo
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// ErrNotFound is returned by a Geocoder that can't place an address
+var ErrNotFound = errors.New("Address not found")
+
+// earthRadiusKm is the mean radius used by Haversine
+const earthRadiusKm = 6371.0
+
+// Point is a WGS84 coordinate
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Valid reports whether p is a coordinate on Earth
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// Haversine is the great-circle distance between a and b in km
+func Haversine(a, b Point) float64 {
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := rad(b.Lat - a.Lat)
+	dLng := rad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Query is the address to geocode
+type Query struct {
+	CEP    string
+	Street string
+	Number string
+	City   string
+	UF     string
+}
+
+// Geocoder places an address, ErrNotFound when it can't
+type Geocoder interface {
+	Geocode(ctx context.Context, q Query) (Point, error)
+}
+
+// NormalizeCEP returns the 8 digits of a CEP, or "" when it isn't one
+func NormalizeCEP(cep string) string {
+	d := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, cep)
+	if len(d) != 8 {
+		return ""
+	}
+	return d
+}
+
+// CEPTable is an offline Geocoder from CEPs to coordinates. A CEP missing
+// from the table falls back to the longest prefix of it that is there, so
+// "80" can place the whole of Curitiba.
+type CEPTable map[string]Point
+
+// Geocode implements Geocoder
+func (t CEPTable) Geocode(ctx context.Context, q Query) (Point, error) {
+	cep := NormalizeCEP(q.CEP)
+	for n := len(cep); n > 0; n-- {
+		if p, ok := t[cep[:n]]; ok {
+			return p, nil
+		}
+	}
+	return Point{}, ErrNotFound
+}
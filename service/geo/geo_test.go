@@ -0,0 +1,61 @@
+package geo
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHaversine(t *testing.T) {
+	curitiba := Point{Lat: -25.4284, Lng: -49.2733}
+	saoPaulo := Point{Lat: -23.5505, Lng: -46.6333}
+	d := Haversine(curitiba, saoPaulo)
+	if math.Abs(d-339) > 5 {
+		t.Errorf("Expected about 339km between Curitiba and São Paulo, got %f", d)
+	}
+	if Haversine(curitiba, curitiba) != 0 {
+		t.Errorf("Expected no distance to itself")
+	}
+}
+
+func TestCEPTable(t *testing.T) {
+	table := CEPTable{
+		"80010000": {Lat: -25.4297, Lng: -49.2711},
+		"80":       {Lat: -25.4284, Lng: -49.2733},
+	}
+	p, err := table.Geocode(context.Background(), Query{CEP: "80010-000"})
+	if err != nil || p.Lat != -25.4297 {
+		t.Errorf("Expected the exact CEP, got %v %v", p, err)
+	}
+	p, err = table.Geocode(context.Background(), Query{CEP: "80530-000"})
+	if err != nil || p.Lat != -25.4284 {
+		t.Errorf("Expected the CEP prefix, got %v %v", p, err)
+	}
+	_, err = table.Geocode(context.Background(), Query{CEP: "01001-000"})
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestNominatim(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("postalcode") != "80010-000" || r.Header.Get("User-Agent") != "test" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"lat":"-25.4297","lon":"-49.2711"}]`))
+	}))
+	defer ts.Close()
+
+	n := &Nominatim{URL: ts.URL, UserAgent: "test"}
+	p, err := n.Geocode(context.Background(), Query{CEP: "80010000"})
+	if err != nil || p.Lat != -25.4297 || p.Lng != -49.2711 {
+		t.Errorf("Unexpected point %v %v", p, err)
+	}
+	_, err = n.Geocode(context.Background(), Query{CEP: "01001000"})
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Nominatim geocodes with an OpenStreetMap Nominatim server
+type Nominatim struct {
+	// URL of the server, e.g. https://nominatim.openstreetmap.org
+	URL string
+	// UserAgent identifies the application, required by the public server
+	UserAgent string
+	Client    *http.Client
+}
+
+// Geocode implements Geocoder
+func (n *Nominatim) Geocode(ctx context.Context, q Query) (Point, error) {
+	v := url.Values{}
+	v.Set("format", "json")
+	v.Set("limit", "1")
+	v.Set("countrycodes", "br")
+	if cep := NormalizeCEP(q.CEP); len(cep) > 0 {
+		v.Set("postalcode", cep[:5]+"-"+cep[5:])
+	}
+	if len(q.Street) > 0 {
+		v.Set("street", strings.TrimSpace(q.Number+" "+q.Street))
+	}
+	if len(q.City) > 0 {
+		v.Set("city", q.City)
+	}
+	if len(q.UF) > 0 {
+		v.Set("state", q.UF)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(n.URL, "/")+"/search?"+v.Encode(), nil)
+	if err != nil {
+		return Point{}, err
+	}
+	req.Header.Set("User-Agent", n.UserAgent)
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return Point{}, errors.Wrap(err, "Failed to geocode")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Point{}, errors.Errorf("Failed to geocode: status %d", res.StatusCode)
+	}
+
+	places := []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&places)
+	if err != nil {
+		return Point{}, errors.Wrap(err, "Failed to decode geocoding")
+	}
+	if len(places) == 0 {
+		return Point{}, ErrNotFound
+	}
+	lat, err := strconv.ParseFloat(places[0].Lat, 64)
+	if err != nil {
+		return Point{}, err
+	}
+	lng, err := strconv.ParseFloat(places[0].Lon, 64)
+	if err != nil {
+		return Point{}, err
+	}
+	return Point{Lat: lat, Lng: lng}, nil
+}
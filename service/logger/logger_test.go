@@ -0,0 +1,46 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestLoggerJSONFields(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	l := New(b, LevelInfo).With("request_id", "abc")
+
+	l.Debug("hidden")
+	l.Error("failed", "error", errors.New("boom"), "status", 500)
+
+	line := map[string]interface{}{}
+	err := json.Unmarshal(b.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("Expected a single JSON line, got %q: %s", b.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":      "ERROR",
+		"msg":        "failed",
+		"request_id": "abc",
+		"error":      "boom",
+		"status":     float64(500),
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, line[k])
+		}
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) != Default {
+		t.Errorf("Expected Default logger for empty context")
+	}
+	l := New(bytes.NewBuffer(nil), LevelDebug)
+	ctx := NewContext(context.Background(), l)
+	if FromContext(ctx) != l {
+		t.Errorf("Expected logger attached to context")
+	}
+}
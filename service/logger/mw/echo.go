@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+// HeaderRequestID is the header used to accept and return request IDs
+const HeaderRequestID = "X-Request-ID"
+
+// RequestLogger accepts or generates a request ID, attaches a Logger
+// carrying it to the request context and writes an access log line
+func RequestLogger(l *logger.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			rid := req.Header.Get(HeaderRequestID)
+			if !validRequestID(rid) {
+				id, err := uuid.NewV4()
+				if err != nil {
+					return err
+				}
+				rid = id.String()
+			}
+			c.Response().Header().Set(HeaderRequestID, rid)
+
+			rl := l.With("request_id", rid)
+			c.SetRequest(req.WithContext(logger.NewContext(req.Context(), rl)))
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			// the claims middleware may have enriched the logger
+			rl = logger.FromContext(c.Request().Context())
+			rl.Info("request",
+				"method", req.Method,
+				"route", c.Path(),
+				"uri", req.RequestURI,
+				"status", c.Response().Status,
+				"latency_ms", float64(time.Since(start).Microseconds())/1000,
+				"remote_ip", c.RealIP(),
+				"bytes_out", c.Response().Size,
+			)
+			return nil
+		}
+	}
+}
+
+// ClaimsLogger adds the authenticated UserID to the request Logger; it must
+// run after the JWT middleware has stored the token under tokenCtxKey
+func ClaimsLogger(tokenCtxKey string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, err := auth.Extract(c.Get(tokenCtxKey))
+			if err == nil {
+				req := c.Request()
+				rl := logger.FromContext(req.Context()).With("user_id", claims.UserID)
+				c.SetRequest(req.WithContext(logger.NewContext(req.Context(), rl)))
+			}
+			return next(c)
+		}
+	}
+}
+
+// validRequestID accepts short printable IDs so clients can't inject
+// arbitrary content in the logs
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "echoapi"
+
+// Registry holds every collector exposed on /metrics
+var Registry = prometheus.NewRegistry()
+
+// HTTP metrics, labeled by the echo route template instead of the raw URL
+// so path params don't blow up cardinality
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// PasswordHashDuration observes the time spent in bcrypt hashing
+var PasswordHashDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: "auth",
+	Name:      "password_hash_duration_seconds",
+	Help:      "Time spent generating bcrypt password hashes.",
+	Buckets:   []float64{.05, .1, .2, .3, .5, .75, 1, 2},
+})
+
+// Business events
+var (
+	SignIns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "signins_total",
+		Help:      "Sign in attempts by result (succeeded, failed).",
+	}, []string{"result"})
+
+	Onboardings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "user",
+		Name:      "onboardings_total",
+		Help:      "Completed onboardings by user type (doctor, patient).",
+	}, []string{"type"})
+
+	MatchesConfirmed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "match",
+		Name:      "confirmed_total",
+		Help:      "Matches confirmed by patients.",
+	})
+
+	MatchTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "match",
+		Name:      "transitions_total",
+		Help:      "Match status changes by the status moved to.",
+	}, []string{"status"})
+
+	Payments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "payment",
+		Name:      "operations_total",
+		Help:      "Payment gateway calls by operation (authorize, capture, void) and result (succeeded, failed).",
+	}, []string{"operation", "result"})
+)
+
+// Sign in results
+const (
+	SignInSucceeded = "succeeded"
+	SignInFailed    = "failed"
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		PasswordHashDuration,
+		SignIns,
+		Onboardings,
+		MatchesConfirmed,
+		MatchTransitions,
+		Payments,
+	)
+}
+
+// RegisterDB exposes the connection pool stats of db
+func RegisterDB(name string, db *sql.DB) error {
+	return Registry.Register(newDBStatsCollector(name, db.Stats))
+}
+
+// Handler serves the Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,75 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/metrics"
+	mmw "github.com/fignocius/echo-api/service/metrics/mw"
+	"github.com/labstack/echo"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected scrape status 200, got %d", rec.Code)
+	}
+	b, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed reading scrape %s", err)
+	}
+	return string(b)
+}
+
+func TestScrapeRouteTemplates(t *testing.T) {
+	e := echo.New()
+	e.Use(mmw.EchoMiddleware())
+	e.GET("/doctors/:doct_id", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	for _, id := range []string{"a1", "b2"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/doctors/"+id, nil))
+	}
+	metrics.SignIns.WithLabelValues(metrics.SignInFailed).Inc()
+
+	out := scrape(t)
+	expected := []string{
+		`echoapi_http_requests_total{method="GET",route="/doctors/:doct_id",status="200"} 2`,
+		`echoapi_http_request_duration_seconds_count{method="GET",route="/doctors/:doct_id"} 2`,
+		`echoapi_auth_signins_total{result="failed"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected scrape to contain %q", line)
+		}
+	}
+	if strings.Contains(out, "/doctors/a1") {
+		t.Errorf("Expected raw URLs to stay out of the labels")
+	}
+}
+
+func TestScrapeDBStats(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+
+	err = metrics.RegisterDB("test", db)
+	if err != nil {
+		t.Fatalf("Failed registering db stats %s", err)
+	}
+
+	out := scrape(t)
+	if !strings.Contains(out, `echoapi_db_max_open_connections{db="test"} 7`) {
+		t.Errorf("Expected pool gauges in scrape, got\n%s", out)
+	}
+}
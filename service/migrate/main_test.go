@@ -0,0 +1,10 @@
+package migrate_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/dbtest"
+)
+
+func TestMain(m *testing.M) { os.Exit(dbtest.Main(m)) }
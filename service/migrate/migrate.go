@@ -0,0 +1,311 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// Dir is where migrations live in the source tree, used by Create
+const Dir = "service/migrate/migrations"
+
+// lockID is the pg_advisory_lock key held while migrating, so replicas
+// starting at the same time don't race each other
+const lockID = 7305196011
+
+var fileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned pair of up/down SQL scripts
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a Migration and when it was applied, if it was
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	DB         *sqlx.DB
+	Migrations []Migration
+}
+
+// New creates a Migrator with the migrations embedded in the binary
+func New(db *sqlx.DB) (*Migrator, error) {
+	sub, err := fs.Sub(embedded, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	ms, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: ms}, nil
+}
+
+// Load reads NNNN_name.up.sql/NNNN_name.down.sql pairs from fsys
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, f := range files {
+		m := fileRe.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		b, err := fs.ReadFile(fsys, f.Name())
+		if err != nil {
+			return nil, err
+		}
+		mg, ok := byVersion[v]
+		if !ok {
+			mg = &Migration{Version: v, Name: m[2]}
+			byVersion[v] = mg
+		}
+		if mg.Name != m[2] {
+			return nil, fmt.Errorf("Migration %d has two names: %s and %s", v, mg.Name, m[2])
+		}
+		if m[3] == "up" {
+			mg.Up = string(b)
+		} else {
+			mg.Down = string(b)
+		}
+	}
+
+	ms := []Migration{}
+	for _, mg := range byVersion {
+		if len(mg.Up) == 0 || len(mg.Down) == 0 {
+			return nil, fmt.Errorf("Migration %d_%s needs both up and down scripts", mg.Version, mg.Name)
+		}
+		ms = append(ms, *mg)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// Latest is the version of the newest migration, 0 if there are none
+func (m *Migrator) Latest() int64 {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the last steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mg := m.Migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			err = run(ctx, conn, mg, false)
+			if err != nil {
+				return err
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// To migrates up or down until version is the last one applied
+func (m *Migrator) To(ctx context.Context, version int64) ([]Migration, error) {
+	if version != 0 && !m.has(version) {
+		return nil, fmt.Errorf("No migration with version %d", version)
+	}
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		// revert newer ones first, newest to oldest
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			mg := m.Migrations[i]
+			if _, ok := applied[mg.Version]; !ok || mg.Version <= version {
+				continue
+			}
+			err = run(ctx, conn, mg, false)
+			if err != nil {
+				return err
+			}
+			done = append(done, mg)
+		}
+		for _, mg := range m.Migrations {
+			if _, ok := applied[mg.Version]; ok || mg.Version > version {
+				continue
+			}
+			err = run(ctx, conn, mg, true)
+			if err != nil {
+				return err
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var st []Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.Migrations {
+			s := Status{Migration: mg}
+			if at, ok := applied[mg.Version]; ok {
+				s.AppliedAt = &at
+			}
+			st = append(st, s)
+		}
+		return nil
+	})
+	return st, err
+}
+
+func (m *Migrator) has(version int64) bool {
+	for _, mg := range m.Migrations {
+		if mg.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// locked runs f on a single connection holding the advisory lock, the
+// lock is released when the connection's session ends
+func (m *Migrator) locked(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get migration connection")
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to acquire migration lock")
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    bigint PRIMARY KEY,
+		name       text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create schema_migrations")
+	}
+	return f(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var v int64
+		var at time.Time
+		err = rows.Scan(&v, &at)
+		if err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+// run applies or reverts mg and records it, in a single transaction
+func run(ctx context.Context, conn *sql.Conn, mg Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	script, record, args := mg.Down, `DELETE FROM schema_migrations WHERE version = $1`, []interface{}{mg.Version}
+	if up {
+		script, record, args = mg.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, []interface{}{mg.Version, mg.Name}
+	}
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "Failed to run migration %d_%s", mg.Version, mg.Name)
+	}
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "Failed to record migration %d_%s", mg.Version, mg.Name)
+	}
+	return tx.Commit()
+}
+
+// Create writes empty up/down scripts for the next version into dir
+func Create(dir, name string) (up, down string, err error) {
+	name = strings.ToLower(strings.Join(strings.Fields(name), "_"))
+	if !regexp.MustCompile(`^\w+$`).MatchString(name) {
+		return "", "", errors.New("Migration name must be alphanumeric: " + name)
+	}
+	ms, err := Load(os.DirFS(dir))
+	if err != nil {
+		return "", "", err
+	}
+	next := int64(1)
+	if len(ms) > 0 {
+		next = ms[len(ms)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%04d_%s", next, name))
+	up, down = base+".up.sql", base+".down.sql"
+	for _, f := range []string{up, down} {
+		err = os.WriteFile(f, []byte("\n"), 0644)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return up, down, nil
+}
@@ -0,0 +1,82 @@
+package migrate_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/dbtest"
+	"github.com/fignocius/echo-api/service/migrate"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := migrate.New(nil)
+	if err != nil {
+		t.Fatalf("Failed to load embedded migrations %s", err)
+	}
+	if len(m.Migrations) == 0 {
+		t.Fatalf("Expected embedded migrations")
+	}
+	for i, mg := range m.Migrations {
+		if mg.Version != int64(i+1) {
+			t.Errorf("Expected migration %d to have version %d, got %d", i, i+1, mg.Version)
+		}
+	}
+}
+
+func TestUpDownRoundTrip(t *testing.T) {
+	db := dbtest.NewEmptyDB(t)
+	ctx := context.Background()
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations %s", err)
+	}
+
+	// replicas starting together must serialize on the advisory lock
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Up(ctx)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed concurrent up %s", err)
+		}
+	}
+
+	st, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Failed status %s", err)
+	}
+	for _, s := range st {
+		if s.AppliedAt == nil {
+			t.Errorf("Expected migration %d to be applied", s.Version)
+		}
+	}
+
+	_, err = m.To(ctx, 0)
+	if err != nil {
+		t.Fatalf("Failed migrating down to 0 %s", err)
+	}
+	var tables []string
+	err = db.Select(&tables, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema = 'public' AND table_name <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatalf("Failed listing tables %s", err)
+	}
+	if len(tables) > 0 {
+		t.Errorf("Expected down migrations to drop every table, left %v", tables)
+	}
+
+	_, err = m.Up(ctx)
+	if err != nil {
+		t.Fatalf("Failed to re-apply migrations %s", err)
+	}
+}
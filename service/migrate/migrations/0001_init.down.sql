@@ -0,0 +1,12 @@
+DROP TABLE credit_card;
+DROP TABLE match;
+DROP TABLE service;
+DROP TABLE doctor_specialization;
+DROP TABLE procedure;
+DROP TABLE specialization;
+DROP TABLE bank;
+DROP TABLE address;
+DROP TABLE patient;
+DROP TABLE doctor;
+DROP TABLE action_verification;
+DROP TABLE "user";
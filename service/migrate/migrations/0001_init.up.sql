@@ -0,0 +1,122 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE "user" (
+	user_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	email      text NOT NULL,
+	password   bytea NOT NULL,
+	role       jsonb NOT NULL DEFAULT '[]',
+	info       jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
+CREATE UNIQUE INDEX user_email_key ON "user" (lower(email)) WHERE deleted_at IS NULL;
+
+CREATE TABLE action_verification (
+	acve_id      uuid PRIMARY KEY,
+	user_id      uuid NOT NULL REFERENCES "user" (user_id),
+	verification text NOT NULL,
+	type         text NOT NULL,
+	created_at   timestamptz NOT NULL DEFAULT now(),
+	deleted_at   timestamptz
+);
+
+CREATE TABLE doctor (
+	doct_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	user_id    uuid NOT NULL UNIQUE REFERENCES "user" (user_id),
+	name       text NOT NULL,
+	crm        text NOT NULL,
+	documents  jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
+
+CREATE TABLE patient (
+	pati_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	user_id    uuid NOT NULL UNIQUE REFERENCES "user" (user_id),
+	name       text NOT NULL,
+	cpf        text NOT NULL,
+	rg         text NOT NULL DEFAULT '',
+	address    jsonb NOT NULL DEFAULT '{}',
+	documents  jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
+
+CREATE TABLE address (
+	addr_id     serial PRIMARY KEY,
+	doct_id     uuid NOT NULL REFERENCES doctor (doct_id),
+	description text NOT NULL DEFAULT '',
+	location    text NOT NULL DEFAULT '',
+	created_at  timestamptz NOT NULL DEFAULT now(),
+	deleted_at  timestamptz
+);
+
+CREATE TABLE bank (
+	bank_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	bank       text NOT NULL,
+	agency     text NOT NULL,
+	account    text NOT NULL,
+	type       text NOT NULL,
+	name       text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
+
+CREATE TABLE specialization (
+	spec_id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	name    text NOT NULL
+);
+
+CREATE TABLE procedure (
+	proc_id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	spec_id uuid NOT NULL REFERENCES specialization (spec_id),
+	name    text NOT NULL
+);
+
+CREATE TABLE doctor_specialization (
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	spec_id    uuid NOT NULL REFERENCES specialization (spec_id),
+	created_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (doct_id, spec_id)
+);
+
+CREATE TABLE service (
+	serv_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	addr_id    integer NOT NULL REFERENCES address (addr_id),
+	spec_id    uuid NOT NULL REFERENCES specialization (spec_id),
+	name       text NOT NULL,
+	type       text NOT NULL,
+	price_min  integer NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
+
+CREATE TABLE match (
+	matc_id     uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	pati_id     uuid NOT NULL REFERENCES patient (pati_id),
+	doct_id     uuid NOT NULL REFERENCES doctor (doct_id),
+	spec_id     uuid REFERENCES specialization (spec_id),
+	proc_id     uuid REFERENCES procedure (proc_id),
+	serv_id     uuid REFERENCES service (serv_id),
+	sesc_id     uuid,
+	date        date NOT NULL,
+	time        text NOT NULL,
+	price       integer NOT NULL,
+	type        text NOT NULL,
+	created_at  timestamptz NOT NULL DEFAULT now(),
+	canceled_at timestamptz,
+	deleted_at  timestamptz
+);
+
+CREATE TABLE credit_card (
+	crca_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	pati_id    uuid NOT NULL REFERENCES patient (pati_id),
+	token      text NOT NULL,
+	brand      text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+);
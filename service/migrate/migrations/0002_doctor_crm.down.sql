@@ -0,0 +1 @@
+DROP INDEX doctor_crm_key;
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX doctor_crm_key ON doctor (crm) WHERE deleted_at IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX patient_cpf_index_key;
+ALTER TABLE patient DROP COLUMN cpf_index;
@@ -0,0 +1,5 @@
+-- cpf and rg now hold values encrypted by the application, cpf_index is
+-- the blind index of the cpf so it can still be unique. Rows from before
+-- keep their plaintext until they are saved again.
+ALTER TABLE patient ADD COLUMN cpf_index text;
+CREATE UNIQUE INDEX patient_cpf_index_key ON patient (cpf_index) WHERE deleted_at IS NULL;
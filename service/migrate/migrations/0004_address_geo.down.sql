@@ -0,0 +1,10 @@
+ALTER TABLE address
+	DROP COLUMN IF EXISTS geog,
+	DROP COLUMN cep,
+	DROP COLUMN street,
+	DROP COLUMN number,
+	DROP COLUMN district,
+	DROP COLUMN city,
+	DROP COLUMN uf,
+	DROP COLUMN lat,
+	DROP COLUMN lng;
@@ -0,0 +1,24 @@
+ALTER TABLE address
+	ADD COLUMN cep      text NOT NULL DEFAULT '',
+	ADD COLUMN street   text NOT NULL DEFAULT '',
+	ADD COLUMN number   text NOT NULL DEFAULT '',
+	ADD COLUMN district text NOT NULL DEFAULT '',
+	ADD COLUMN city     text NOT NULL DEFAULT '',
+	ADD COLUMN uf       text NOT NULL DEFAULT '',
+	ADD COLUMN lat      double precision,
+	ADD COLUMN lng      double precision;
+
+CREATE INDEX address_lat_lng_idx ON address (lat, lng) WHERE deleted_at IS NULL;
+
+-- where PostGIS is available searches use an indexed geography, elsewhere
+-- they fall back to haversine over the lat/lng bounding box
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis') THEN
+		CREATE EXTENSION IF NOT EXISTS postgis;
+		ALTER TABLE address ADD COLUMN geog geography(Point, 4326)
+			GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(lng, lat), 4326)::geography) STORED;
+		CREATE INDEX address_geog_idx ON address USING gist (geog);
+	END IF;
+END
+$$;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS address_primary_key;
+
+ALTER TABLE address
+	DROP COLUMN updated_at,
+	DROP COLUMN opening_hours,
+	DROP COLUMN is_primary;
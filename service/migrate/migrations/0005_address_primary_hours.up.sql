@@ -0,0 +1,13 @@
+ALTER TABLE address
+	ADD COLUMN is_primary    boolean NOT NULL DEFAULT false,
+	ADD COLUMN opening_hours jsonb NOT NULL DEFAULT '[]',
+	ADD COLUMN updated_at    timestamptz NOT NULL DEFAULT now();
+
+-- the oldest address of each doctor is its primary one
+UPDATE address a SET is_primary = true
+WHERE a.deleted_at IS NULL AND a.addr_id = (
+	SELECT min(o.addr_id) FROM address o
+	WHERE o.doct_id = a.doct_id AND o.deleted_at IS NULL
+);
+
+CREATE UNIQUE INDEX address_primary_key ON address (doct_id) WHERE is_primary AND deleted_at IS NULL;
@@ -0,0 +1,3 @@
+DROP TABLE session_schedule;
+DROP TABLE availability_exception;
+DROP TABLE availability;
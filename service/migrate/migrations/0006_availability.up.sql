@@ -0,0 +1,49 @@
+-- weekly recurring hours a doctor attends at an address, in local time
+CREATE TABLE availability (
+	avai_id        uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id        uuid NOT NULL REFERENCES doctor (doct_id),
+	addr_id        integer NOT NULL REFERENCES address (addr_id),
+	weekday        smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+	starts         text NOT NULL CHECK (starts ~ '^([01][0-9]|2[0-3]):[0-5][0-9]$'),
+	ends           text NOT NULL CHECK (ends ~ '^([01][0-9]|2[0-3]):[0-5][0-9]$'),
+	slot_minutes   integer NOT NULL DEFAULT 30 CHECK (slot_minutes > 0),
+	buffer_minutes integer NOT NULL DEFAULT 0 CHECK (buffer_minutes >= 0),
+	timezone       text NOT NULL DEFAULT 'America/Sao_Paulo',
+	created_at     timestamptz NOT NULL DEFAULT now(),
+	deleted_at     timestamptz,
+	CHECK (starts < ends)
+);
+
+CREATE INDEX availability_doct_id_idx ON availability (doct_id) WHERE deleted_at IS NULL;
+
+-- holidays and other intervals a doctor doesn't attend, at an address or
+-- at all of them when addr_id is null
+CREATE TABLE availability_exception (
+	avex_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	addr_id    integer REFERENCES address (addr_id),
+	starts_at  timestamptz NOT NULL,
+	ends_at    timestamptz NOT NULL,
+	reason     text NOT NULL DEFAULT '',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz,
+	CHECK (starts_at < ends_at)
+);
+
+CREATE INDEX availability_exception_doct_id_idx ON availability_exception (doct_id, starts_at) WHERE deleted_at IS NULL;
+
+-- booked slots, match.sesc_id refers to them
+CREATE TABLE session_schedule (
+	sesc_id     uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id     uuid NOT NULL REFERENCES doctor (doct_id),
+	addr_id     integer NOT NULL REFERENCES address (addr_id),
+	pati_id     uuid NOT NULL REFERENCES patient (pati_id),
+	starts_at   timestamptz NOT NULL,
+	ends_at     timestamptz NOT NULL,
+	created_at  timestamptz NOT NULL DEFAULT now(),
+	canceled_at timestamptz,
+	CHECK (starts_at < ends_at)
+);
+
+-- bookings are serialized by locking the doctor row, this is the backstop
+CREATE UNIQUE INDEX session_schedule_slot_key ON session_schedule (doct_id, starts_at) WHERE canceled_at IS NULL;
@@ -0,0 +1,3 @@
+DROP INDEX service_spec_id_idx;
+
+DROP TABLE match_rating;
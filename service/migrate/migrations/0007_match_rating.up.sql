@@ -0,0 +1,12 @@
+-- the score a patient gives a doctor after a match
+CREATE TABLE match_rating (
+	matc_id    uuid PRIMARY KEY REFERENCES match (matc_id),
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	pati_id    uuid NOT NULL REFERENCES patient (pati_id),
+	score      smallint NOT NULL CHECK (score BETWEEN 1 AND 5),
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX match_rating_doct_id_idx ON match_rating (doct_id);
+
+CREATE INDEX service_spec_id_idx ON service (spec_id, doct_id) WHERE deleted_at IS NULL;
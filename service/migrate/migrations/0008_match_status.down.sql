@@ -0,0 +1,11 @@
+DROP TABLE match_history;
+
+DROP INDEX match_pati_id_idx;
+DROP INDEX match_doct_id_idx;
+
+ALTER TABLE match
+	DROP COLUMN updated_at,
+	DROP COLUMN cancel_fee,
+	DROP COLUMN version,
+	DROP COLUMN status,
+	DROP COLUMN addr_id;
@@ -0,0 +1,32 @@
+ALTER TABLE match
+	ADD COLUMN addr_id    integer REFERENCES address (addr_id),
+	ADD COLUMN status     text NOT NULL DEFAULT 'proposed' CHECK (status IN (
+		'proposed', 'confirmed', 'checked-in', 'completed',
+		'canceled-by-patient', 'canceled-by-doctor', 'no-show')),
+	-- bumped on every change, updates of a stale version are refused
+	ADD COLUMN version    integer NOT NULL DEFAULT 1,
+	ADD COLUMN cancel_fee integer NOT NULL DEFAULT 0,
+	ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+
+-- confirming was the only transition, matches not canceled are confirmed
+UPDATE match SET status = CASE
+	WHEN canceled_at IS NULL THEN 'confirmed'
+	ELSE 'canceled-by-patient'
+END;
+
+CREATE INDEX match_doct_id_idx ON match (doct_id, date);
+CREATE INDEX match_pati_id_idx ON match (pati_id, date);
+
+-- every status a match went through, from_status is null when proposed
+CREATE TABLE match_history (
+	mahi_id     uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	matc_id     uuid NOT NULL REFERENCES match (matc_id),
+	from_status text,
+	to_status   text NOT NULL,
+	user_id     uuid REFERENCES "user" (user_id),
+	reason      text NOT NULL DEFAULT '',
+	fee         integer NOT NULL DEFAULT 0,
+	created_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX match_history_matc_id_idx ON match_history (matc_id, created_at);
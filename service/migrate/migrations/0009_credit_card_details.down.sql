@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS credit_card_pati_id_idx;
+DROP INDEX IF EXISTS credit_card_default_key;
+
+ALTER TABLE credit_card
+	DROP COLUMN is_default,
+	DROP COLUMN holder,
+	DROP COLUMN exp_year,
+	DROP COLUMN exp_month,
+	DROP COLUMN last4;
@@ -0,0 +1,18 @@
+ALTER TABLE credit_card
+	ADD COLUMN last4      text NOT NULL DEFAULT '',
+	ADD COLUMN exp_month  smallint NOT NULL DEFAULT 0,
+	ADD COLUMN exp_year   smallint NOT NULL DEFAULT 0,
+	ADD COLUMN holder     text NOT NULL DEFAULT '',
+	ADD COLUMN is_default boolean NOT NULL DEFAULT false;
+
+-- the newest card of each patient is its default one
+UPDATE credit_card c SET is_default = true
+WHERE c.deleted_at IS NULL AND c.crca_id = (
+	SELECT o.crca_id FROM credit_card o
+	WHERE o.pati_id = c.pati_id AND o.deleted_at IS NULL
+	ORDER BY o.created_at DESC, o.crca_id
+	LIMIT 1
+);
+
+CREATE UNIQUE INDEX credit_card_default_key ON credit_card (pati_id) WHERE is_default AND deleted_at IS NULL;
+CREATE INDEX credit_card_pati_id_idx ON credit_card (pati_id) WHERE deleted_at IS NULL;
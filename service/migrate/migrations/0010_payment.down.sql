@@ -0,0 +1,2 @@
+DROP TABLE payment_ledger;
+DROP TABLE payment;
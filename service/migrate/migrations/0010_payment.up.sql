@@ -0,0 +1,34 @@
+-- the payment of a match, amounts in cents. refunded is what went back to
+-- the patient, voided before capture or refunded after it.
+CREATE TABLE payment (
+	paym_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	matc_id    uuid NOT NULL UNIQUE REFERENCES match (matc_id),
+	crca_id    uuid REFERENCES credit_card (crca_id),
+	order_id   text NOT NULL,
+	gateway_id text,
+	status     text NOT NULL DEFAULT 'pending' CHECK (status IN (
+		'pending', 'authorized', 'captured', 'voided', 'refunded', 'declined', 'failed')),
+	amount     integer NOT NULL,
+	captured   integer NOT NULL DEFAULT 0,
+	refunded   integer NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payment_unsettled_idx ON payment (updated_at) WHERE status IN ('pending', 'authorized', 'captured');
+
+-- every call made to the gateway for a payment, successful or not
+CREATE TABLE payment_ledger (
+	pale_id        uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	paym_id        uuid NOT NULL REFERENCES payment (paym_id),
+	operation      text NOT NULL CHECK (operation IN ('authorize', 'capture', 'void')),
+	amount         integer NOT NULL,
+	succeeded      boolean NOT NULL,
+	gateway_status integer,
+	return_code    text NOT NULL DEFAULT '',
+	return_message text NOT NULL DEFAULT '',
+	error          text NOT NULL DEFAULT '',
+	created_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payment_ledger_paym_id_idx ON payment_ledger (paym_id, created_at);
@@ -0,0 +1,8 @@
+DROP TABLE payout_entry;
+DROP TABLE payout;
+
+DROP INDEX IF EXISTS bank_doct_id_key;
+
+ALTER TABLE bank
+	DROP COLUMN pix_key_type,
+	DROP COLUMN pix_key;
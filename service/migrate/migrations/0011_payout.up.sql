@@ -0,0 +1,49 @@
+-- agency, account and pix_key are encrypted by fieldcrypt, rows written
+-- before are still read as plain text until rotated
+ALTER TABLE bank
+	ADD COLUMN pix_key_type text NOT NULL DEFAULT '' CHECK (pix_key_type IN ('', 'cpf', 'cnpj', 'email', 'phone', 'random')),
+	ADD COLUMN pix_key      text NOT NULL DEFAULT '';
+
+-- a doctor has one account, replaced ones are kept for the payouts sent
+-- to them
+UPDATE bank b SET deleted_at = now()
+WHERE b.deleted_at IS NULL AND b.bank_id <> (
+	SELECT o.bank_id FROM bank o
+	WHERE o.doct_id = b.doct_id AND o.deleted_at IS NULL
+	ORDER BY o.created_at DESC, o.bank_id
+	LIMIT 1
+);
+
+CREATE UNIQUE INDEX bank_doct_id_key ON bank (doct_id) WHERE deleted_at IS NULL;
+
+-- a transfer to a doctor of the entries it pays, amounts in cents
+CREATE TABLE payout (
+	payo_id       uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id       uuid NOT NULL REFERENCES doctor (doct_id),
+	bank_id       uuid NOT NULL REFERENCES bank (bank_id),
+	method        text NOT NULL CHECK (method IN ('pix', 'ted')),
+	amount        integer NOT NULL,
+	status        text NOT NULL DEFAULT 'scheduled' CHECK (status IN ('scheduled', 'paid', 'failed')),
+	scheduled_for date NOT NULL,
+	created_at    timestamptz NOT NULL DEFAULT now(),
+	paid_at       timestamptz
+);
+
+CREATE INDEX payout_doct_id_idx ON payout (doct_id, created_at);
+
+-- what a doctor is owed for a charged match, gross less the platform
+-- commission. payo_id is set once a payout pays it.
+CREATE TABLE payout_entry (
+	poen_id    uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id    uuid NOT NULL REFERENCES doctor (doct_id),
+	paym_id    uuid NOT NULL UNIQUE REFERENCES payment (paym_id),
+	matc_id    uuid NOT NULL REFERENCES match (matc_id),
+	gross      integer NOT NULL,
+	commission integer NOT NULL,
+	net        integer NOT NULL,
+	payo_id    uuid REFERENCES payout (payo_id),
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payout_entry_unpaid_idx ON payout_entry (doct_id) WHERE payo_id IS NULL;
+CREATE INDEX payout_entry_payo_id_idx ON payout_entry (payo_id);
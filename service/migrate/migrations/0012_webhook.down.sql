@@ -0,0 +1,10 @@
+DROP TABLE webhook_event;
+DROP INDEX payment_gateway_id_idx;
+DELETE FROM payment_ledger WHERE operation = 'sync';
+ALTER TABLE payment_ledger DROP CONSTRAINT payment_ledger_operation_check;
+ALTER TABLE payment_ledger ADD CONSTRAINT payment_ledger_operation_check CHECK (operation IN (
+	'authorize', 'capture', 'void'));
+UPDATE payment SET status = 'refunded' WHERE status = 'chargeback';
+ALTER TABLE payment DROP CONSTRAINT payment_status_check;
+ALTER TABLE payment ADD CONSTRAINT payment_status_check CHECK (status IN (
+	'pending', 'authorized', 'captured', 'voided', 'refunded', 'declined', 'failed'));
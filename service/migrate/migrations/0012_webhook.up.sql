@@ -0,0 +1,29 @@
+-- chargebacks come only from the gateway, and changes it notifies are
+-- recorded in the ledger as a sync
+ALTER TABLE payment DROP CONSTRAINT payment_status_check;
+ALTER TABLE payment ADD CONSTRAINT payment_status_check CHECK (status IN (
+	'pending', 'authorized', 'captured', 'voided', 'refunded', 'declined', 'failed', 'chargeback'));
+ALTER TABLE payment_ledger DROP CONSTRAINT payment_ledger_operation_check;
+ALTER TABLE payment_ledger ADD CONSTRAINT payment_ledger_operation_check CHECK (operation IN (
+	'authorize', 'capture', 'void', 'sync'));
+
+CREATE INDEX payment_gateway_id_idx ON payment (gateway_id);
+
+-- notifications received from payment gateways, as they came. event_id is
+-- unique only among pending events: a notification repeated before it was
+-- processed is the same event, one coming after is a new change.
+CREATE TABLE webhook_event (
+	wehe_id      uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	provider     text NOT NULL,
+	event_id     text NOT NULL,
+	payload      text NOT NULL,
+	status       text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processed', 'failed')),
+	attempts     integer NOT NULL DEFAULT 0,
+	error        text NOT NULL DEFAULT '',
+	received_at  timestamptz NOT NULL DEFAULT now(),
+	updated_at   timestamptz NOT NULL DEFAULT now(),
+	processed_at timestamptz
+);
+
+CREATE UNIQUE INDEX webhook_event_pending_key ON webhook_event (provider, event_id) WHERE status = 'pending';
+CREATE INDEX webhook_event_pending_idx ON webhook_event (updated_at) WHERE status = 'pending';
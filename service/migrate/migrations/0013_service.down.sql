@@ -0,0 +1,11 @@
+ALTER TABLE match DROP COLUMN serv_version;
+
+DROP TABLE service_price;
+
+DROP INDEX service_doct_id_idx;
+
+ALTER TABLE service
+	DROP CONSTRAINT service_price_min_check,
+	DROP CONSTRAINT service_type_check,
+	DROP COLUMN version,
+	DROP COLUMN proc_id;
@@ -0,0 +1,27 @@
+-- services are of a few types and may be one procedure of their
+-- specialization. The checks hold for rows changed from now on, those from
+-- before keep what they had.
+ALTER TABLE service
+	ADD COLUMN proc_id uuid REFERENCES procedure (proc_id),
+	ADD COLUMN version integer NOT NULL DEFAULT 1,
+	ADD CONSTRAINT service_type_check CHECK (type IN ('in-person', 'telemedicine', 'home-visit')) NOT VALID,
+	ADD CONSTRAINT service_price_min_check CHECK (price_min > 0) NOT VALID;
+
+CREATE INDEX service_doct_id_idx ON service (doct_id) WHERE deleted_at IS NULL;
+
+-- every price a service had, a new version on each change
+CREATE TABLE service_price (
+	serv_id    uuid NOT NULL REFERENCES service (serv_id),
+	version    integer NOT NULL,
+	price_min  integer NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (serv_id, version)
+);
+
+INSERT INTO service_price (serv_id, version, price_min, created_at)
+	SELECT serv_id, 1, price_min, created_at FROM service;
+
+-- the version of the service a match was proposed at, its price is the
+-- one of that version
+ALTER TABLE match ADD COLUMN serv_version integer;
+UPDATE match SET serv_version = 1 WHERE serv_id IS NOT NULL;
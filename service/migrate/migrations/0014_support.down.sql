@@ -0,0 +1,19 @@
+DROP INDEX procedure_name_trgm_idx;
+DROP INDEX procedure_name_key;
+DROP INDEX procedure_tuss_code_key;
+ALTER TABLE procedure
+	DROP COLUMN tuss_code,
+	DROP COLUMN created_at,
+	DROP COLUMN updated_at,
+	DROP COLUMN deleted_at;
+
+DROP INDEX specialization_name_trgm_idx;
+DROP INDEX specialization_name_key;
+ALTER TABLE specialization
+	DROP COLUMN created_at,
+	DROP COLUMN updated_at,
+	DROP COLUMN deleted_at;
+
+DROP FUNCTION f_unaccent(text);
+DROP EXTENSION IF EXISTS pg_trgm;
+DROP EXTENSION IF EXISTS unaccent;
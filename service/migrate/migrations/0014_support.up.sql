@@ -0,0 +1,34 @@
+-- names are searched ignoring accents and case, by prefix of any word
+CREATE EXTENSION IF NOT EXISTS unaccent;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- unaccent is only stable, its dictionary could change under an index.
+-- Pinning the dictionary makes a wrapper safe to declare immutable.
+CREATE FUNCTION f_unaccent(text) RETURNS text AS $$
+	SELECT public.unaccent('public.unaccent', $1)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT;
+
+ALTER TABLE specialization
+	ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN deleted_at timestamptz;
+
+CREATE UNIQUE INDEX specialization_name_key ON specialization (lower(f_unaccent(name)))
+	WHERE deleted_at IS NULL;
+CREATE INDEX specialization_name_trgm_idx ON specialization
+	USING gin (lower(f_unaccent(name)) gin_trgm_ops);
+
+-- procedures may carry their TUSS code, the terminology of the ANS for
+-- procedures billed to health plans
+ALTER TABLE procedure
+	ADD COLUMN tuss_code text CHECK (tuss_code ~ '^[0-9]{8}$'),
+	ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN deleted_at timestamptz;
+
+CREATE UNIQUE INDEX procedure_tuss_code_key ON procedure (tuss_code)
+	WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX procedure_name_key ON procedure (spec_id, lower(f_unaccent(name)))
+	WHERE deleted_at IS NULL;
+CREATE INDEX procedure_name_trgm_idx ON procedure
+	USING gin (lower(f_unaccent(name)) gin_trgm_ops);
@@ -0,0 +1,2 @@
+DROP INDEX match_completed_idx;
+DROP TABLE market_price;
@@ -0,0 +1,20 @@
+-- percentiles of what completed matches charged, refreshed as a whole by a
+-- job. proc_id is null for the whole specialization and region is '' for
+-- the whole country, a row is kept whatever its sample size and readers
+-- skip those too small.
+CREATE TABLE market_price (
+	spec_id      uuid NOT NULL REFERENCES specialization (spec_id),
+	proc_id      uuid REFERENCES procedure (proc_id),
+	region       text NOT NULL DEFAULT '',
+	type         text NOT NULL,
+	price_p10    integer NOT NULL,
+	price_p50    integer NOT NULL,
+	price_p90    integer NOT NULL,
+	samples      integer NOT NULL,
+	refreshed_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX market_price_key ON market_price
+	(spec_id, coalesce(proc_id, '00000000-0000-0000-0000-000000000000'), region, type);
+
+CREATE INDEX match_completed_idx ON match (date) WHERE status = 'completed' AND deleted_at IS NULL;
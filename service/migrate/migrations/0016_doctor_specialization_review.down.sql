@@ -0,0 +1,12 @@
+DROP TABLE doctor_specialization_document;
+
+DROP INDEX doctor_specialization_pending_idx;
+
+ALTER TABLE doctor_specialization
+	DROP COLUMN deleted_at,
+	DROP COLUMN updated_at,
+	DROP COLUMN reviewed_at,
+	DROP COLUMN reviewed_by,
+	DROP COLUMN reason,
+	DROP COLUMN status,
+	DROP COLUMN rqe;
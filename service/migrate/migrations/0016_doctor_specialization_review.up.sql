@@ -0,0 +1,31 @@
+-- doctors claim specializations with their RQE, the registration of
+-- specialists at the CRM, and documents proving it. Admins review the
+-- claims and only approved ones count in search and matching; those made
+-- before the review existed are approved.
+ALTER TABLE doctor_specialization
+	ADD COLUMN rqe         text NOT NULL DEFAULT '',
+	ADD COLUMN status      text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+	ADD COLUMN reason      text NOT NULL DEFAULT '',
+	ADD COLUMN reviewed_by uuid REFERENCES "user" (user_id),
+	ADD COLUMN reviewed_at timestamptz,
+	ADD COLUMN updated_at  timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN deleted_at  timestamptz;
+
+UPDATE doctor_specialization SET status = 'approved';
+
+CREATE INDEX doctor_specialization_pending_idx ON doctor_specialization (updated_at)
+	WHERE status = 'pending' AND deleted_at IS NULL;
+
+CREATE TABLE doctor_specialization_document (
+	dsdo_id      uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	doct_id      uuid NOT NULL,
+	spec_id      uuid NOT NULL,
+	name         text NOT NULL,
+	content_type text NOT NULL,
+	size         integer NOT NULL,
+	content      bytea NOT NULL,
+	created_at   timestamptz NOT NULL DEFAULT now(),
+	FOREIGN KEY (doct_id, spec_id) REFERENCES doctor_specialization (doct_id, spec_id)
+);
+
+CREATE INDEX doctor_specialization_document_idx ON doctor_specialization_document (doct_id, spec_id);
@@ -0,0 +1,3 @@
+UPDATE payment SET refunded = refunded + voided;
+
+ALTER TABLE payment DROP COLUMN voided;
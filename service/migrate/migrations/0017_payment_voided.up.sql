@@ -0,0 +1,15 @@
+-- voided is what was released before capture, refunded only what went back
+-- to the patient after it. Voids recorded before the first capture move
+-- from refunded to voided.
+ALTER TABLE payment ADD COLUMN voided integer NOT NULL DEFAULT 0;
+
+UPDATE payment p SET voided = v.amount, refunded = p.refunded - v.amount
+FROM (
+	SELECT l.paym_id, sum(l.amount) AS amount
+	FROM payment_ledger l
+	WHERE l.operation = 'void' AND l.succeeded AND NOT EXISTS (
+		SELECT 1 FROM payment_ledger c
+		WHERE c.paym_id = l.paym_id AND c.operation = 'capture' AND c.succeeded AND c.created_at < l.created_at)
+	GROUP BY l.paym_id
+) v
+WHERE v.paym_id = p.paym_id;
@@ -0,0 +1,7 @@
+DROP INDEX match_proposed_idx;
+
+UPDATE match SET status = 'canceled-by-patient' WHERE status = 'expired';
+ALTER TABLE match DROP CONSTRAINT match_status_check;
+ALTER TABLE match ADD CONSTRAINT match_status_check CHECK (status IN (
+	'proposed', 'confirmed', 'checked-in', 'completed',
+	'canceled-by-patient', 'canceled-by-doctor', 'no-show'));
@@ -0,0 +1,7 @@
+-- proposals not confirmed in time expire, freeing their slots
+ALTER TABLE match DROP CONSTRAINT match_status_check;
+ALTER TABLE match ADD CONSTRAINT match_status_check CHECK (status IN (
+	'proposed', 'confirmed', 'checked-in', 'completed',
+	'canceled-by-patient', 'canceled-by-doctor', 'no-show', 'expired'));
+
+CREATE INDEX match_proposed_idx ON match (created_at) WHERE status = 'proposed' AND deleted_at IS NULL;
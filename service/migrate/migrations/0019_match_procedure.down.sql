@@ -0,0 +1,2 @@
+-- the backfilled procedures are kept, matches proposed since carry theirs
+SELECT 1;
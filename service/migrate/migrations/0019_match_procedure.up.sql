@@ -0,0 +1,5 @@
+-- matches were proposed without the procedure of their service, market
+-- prices by procedure group on it
+UPDATE match m SET proc_id = s.proc_id
+FROM service s
+WHERE s.serv_id = m.serv_id AND m.proc_id IS NULL AND s.proc_id IS NOT NULL;
@@ -0,0 +1,5 @@
+DELETE FROM payout_entry WHERE reverses IS NOT NULL;
+DROP INDEX payout_entry_paym_id_key;
+ALTER TABLE payout_entry ADD CONSTRAINT payout_entry_paym_id_key UNIQUE (paym_id);
+
+ALTER TABLE payout_entry DROP COLUMN reverses;
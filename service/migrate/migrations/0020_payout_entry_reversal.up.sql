@@ -0,0 +1,6 @@
+-- a chargeback of a payment already paid out books a reversal, the entry
+-- negated, taken from the next payout of the doctor
+ALTER TABLE payout_entry ADD COLUMN reverses uuid UNIQUE REFERENCES payout_entry (poen_id);
+
+ALTER TABLE payout_entry DROP CONSTRAINT payout_entry_paym_id_key;
+CREATE UNIQUE INDEX payout_entry_paym_id_key ON payout_entry (paym_id) WHERE reverses IS NULL;
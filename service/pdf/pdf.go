@@ -0,0 +1,138 @@
+// Package pdf writes plain text documents as PDF, enough for statements
+// and receipts without an external dependency.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Font is one of the standard fonts every PDF reader has, so none is
+// embedded
+type Font int
+
+// Fonts, Courier aligns columns
+const (
+	Helvetica Font = iota
+	HelveticaBold
+	Courier
+)
+
+var fontNames = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+// A4 in points, with the margins text is kept within
+const (
+	pageWidth  = 595
+	pageHeight = 842
+	margin     = 50
+)
+
+type line struct {
+	font Font
+	size float64
+	y    float64
+	text string
+}
+
+// Document is a list of A4 pages of text lines, lines that don't fit on a
+// page go on a new one
+type Document struct {
+	pages [][]line
+	// y is where the next line's baseline goes on the last page
+	y float64
+}
+
+// New creates a Document with an empty page
+func New() *Document {
+	return &Document{pages: [][]line{{}}, y: pageHeight - margin}
+}
+
+// Text adds a line of text in font at size points
+func (d *Document) Text(font Font, size float64, text string) {
+	leading := size * 1.4
+	if d.y-leading < margin {
+		d.pages = append(d.pages, []line{})
+		d.y = pageHeight - margin
+	}
+	d.y -= leading
+	last := len(d.pages) - 1
+	d.pages[last] = append(d.pages[last], line{font: font, size: size, y: d.y, text: text})
+}
+
+// Space skips points of vertical space
+func (d *Document) Space(points float64) {
+	d.y -= points
+}
+
+// Pages is the number of pages of d
+func (d *Document) Pages() int {
+	return len(d.pages)
+}
+
+// WriteTo writes d as a PDF file
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	offsets := []int{}
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// 1 is the catalog, 2 the page tree, then the fonts, then a page and
+	// its content for each page
+	firstPage := 3 + len(fontNames)
+	kids := []string{}
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	fonts := []string{}
+	for i := range fontNames {
+		fonts = append(fonts, fmt.Sprintf("/F%d %d 0 R", i, 3+i))
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, name := range fontNames {
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+	}
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, strings.Join(fonts, " "), firstPage+2*i+1))
+		content := &bytes.Buffer{}
+		for _, l := range p {
+			fmt.Fprintf(content, "BT /F%d %.1f Tf %d %.1f Td (%s) Tj ET\n", l.font, l.size, margin, l.y, escape(l.text))
+		}
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.WriteTo(w)
+}
+
+// escape encodes s in WinAnsi, which matches Latin-1 for accented letters,
+// and escapes the delimiters of PDF strings
+func escape(s string) string {
+	b := &strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r >= 0x20 && r < 0x7f:
+			b.WriteByte(byte(r))
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	d := New()
+	d.Text(HelveticaBold, 14, "Extrato (janeiro)")
+	for i := 0; i < 80; i++ {
+		d.Text(Courier, 9, fmt.Sprintf("%02d  Consulta São Paulo", i))
+	}
+	if d.Pages() != 2 {
+		t.Fatalf("Expected the lines to take 2 pages, got %d", d.Pages())
+	}
+
+	buf := &bytes.Buffer{}
+	_, err := d.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "%PDF-1.4\n") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Errorf("Expected a PDF header and trailer, got %q", out)
+	}
+	if !strings.Contains(out, `(Extrato \(janeiro\)) Tj`) || !strings.Contains(out, `S\343o Paulo`) {
+		t.Errorf("Expected text escaped in WinAnsi, got %q", out)
+	}
+
+	// every xref entry points at its object
+	m := regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(out)
+	xref, _ := strconv.Atoi(m[1])
+	entries := strings.Split(out[xref:], "\n")[3:]
+	checked := 0
+	for i := 1; strings.HasSuffix(entries[i-1], " n "); i++ {
+		checked++
+		off, _ := strconv.Atoi(entries[i-1][:10])
+		if want := fmt.Sprintf("%d 0 obj", i); !strings.HasPrefix(out[off:], want) {
+			t.Errorf("Expected xref entry %d at %q, got %q", i, want, out[off:off+10])
+		}
+	}
+	// catalog, page tree, 3 fonts and a page and content for each page
+	if checked != 9 {
+		t.Errorf("Expected 9 objects, got %d", checked)
+	}
+}
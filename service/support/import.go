@@ -0,0 +1,212 @@
+package support
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/pkg/errors"
+	"gopkg.in/guregu/null.v3"
+)
+
+// ImportRow is a line of a catalog CSV: a specialization and, optionally,
+// one of its procedures with its TUSS code
+type ImportRow struct {
+	Line           int
+	Specialization string
+	Procedure      string
+	TUSSCode       string
+}
+
+// importColumns are the header names of each column, spreadsheets exported
+// in Portuguese are read as well
+var importColumns = map[string][]string{
+	"specialization": {"specialization", "especialidade"},
+	"procedure":      {"procedure", "procedimento"},
+	"tuss_code":      {"tuss_code", "tuss", "codigo_tuss", "código_tuss"},
+}
+
+// ParseCSV reads the rows of a catalog CSV. Its header names the columns
+// specialization, procedure and tuss_code, only the first is required.
+// Fields are separated by commas or, as spreadsheets set to pt-BR export
+// them, semicolons.
+func ParseCSV(r io.Reader) ([]ImportRow, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4096)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "Error reading CSV")
+	}
+	head = bytes.TrimPrefix(head, []byte("\ufeff"))
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	cr := csv.NewReader(br)
+	if bytes.Count(head, []byte(";")) > bytes.Count(head, []byte(",")) {
+		cr.Comma = ';'
+	}
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV is empty")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading CSV header")
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		for name, aliases := range importColumns {
+			for _, a := range aliases {
+				if h == a {
+					col[name] = i
+				}
+			}
+		}
+	}
+	if _, ok := col["specialization"]; !ok {
+		return nil, errors.New("CSV header has no specialization column")
+	}
+	field := func(rec []string, name string) string {
+		i, ok := col[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+
+	rows := []ImportRow{}
+	line := 1
+	for {
+		line++
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading CSV")
+		}
+		row := ImportRow{
+			Line:           line,
+			Specialization: field(rec, "specialization"),
+			Procedure:      field(rec, "procedure"),
+			TUSSCode:       field(rec, "tuss_code"),
+		}
+		if row == (ImportRow{Line: line}) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ImportResult counts what an import changed
+type ImportResult struct {
+	SpecializationsCreated int
+	ProceduresCreated      int
+	ProceduresUpdated      int
+	Unchanged              int
+}
+
+// errDryRun rolls back a dry run
+var errDryRun = errors.New("dry run")
+
+// Importer upserts the catalog from ImportRows
+type Importer struct {
+	Store Store
+	// DryRun rolls the import back once it's done, only counting
+	DryRun bool
+}
+
+// Run upserts rows in one transaction: specializations are matched by name
+// and procedures by TUSS code, or by name within their specialization when
+// they have none or the code is new. Names are matched ignoring accents
+// and case. The first invalid row aborts the import, the error tells its
+// line.
+func (im *Importer) Run(ctx context.Context, rows []ImportRow) (res ImportResult, err error) {
+	ctx, span := tracing.Start(ctx, "support.Importer.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = im.Store.Tx(ctx, func(r Repos) error {
+		res = ImportResult{}
+		for _, row := range rows {
+			err := importRow(ctx, r, row, &res)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Line %d", row.Line))
+			}
+		}
+		if im.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	if err != nil {
+		return ImportResult{}, err
+	}
+	return res, nil
+}
+
+func importRow(ctx context.Context, r Repos, row ImportRow, res *ImportResult) error {
+	s, err := r.Specializations.FromName(ctx, row.Specialization)
+	if _, ok := err.(*auth.NotFoundError); ok {
+		s = &Specialization{Name: row.Specialization}
+		err = validateSpecialization(s)
+		if err != nil {
+			return err
+		}
+		err = r.Specializations.Save(ctx, s)
+		res.SpecializationsCreated++
+	}
+	if err != nil {
+		return err
+	}
+	if len(row.Procedure) == 0 && len(row.TUSSCode) == 0 {
+		return nil
+	}
+
+	p := &Procedure{SpecID: s.SpecID, Name: row.Procedure, TUSSCode: null.NewString(row.TUSSCode, len(row.TUSSCode) > 0)}
+	err = validateProcedure(p)
+	if err != nil {
+		return err
+	}
+	var cur *Procedure
+	if p.TUSSCode.Valid {
+		cur, err = r.Procedures.FromTUSS(ctx, p.TUSSCode.String)
+		if _, ok := err.(*auth.NotFoundError); !ok && err != nil {
+			return err
+		}
+		if cur != nil && cur.SpecID != s.SpecID {
+			return &auth.ConflictError{Message: "TUSS code " + p.TUSSCode.String + " is of a procedure of another specialization"}
+		}
+	}
+	if cur == nil {
+		cur, err = r.Procedures.FromName(ctx, s.SpecID, p.Name)
+		if _, ok := err.(*auth.NotFoundError); ok {
+			res.ProceduresCreated++
+			return r.Procedures.Save(ctx, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cur.Name == p.Name && (!p.TUSSCode.Valid || cur.TUSSCode == p.TUSSCode) {
+		res.Unchanged++
+		return nil
+	}
+	if !p.TUSSCode.Valid {
+		p.TUSSCode = cur.TUSSCode
+	}
+	p.ProcID = cur.ProcID
+	res.ProceduresUpdated++
+	return r.Procedures.Update(ctx, p)
+}
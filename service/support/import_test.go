@@ -0,0 +1,85 @@
+package support
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/pkg/errors"
+)
+
+func TestParseCSV(t *testing.T) {
+	rows, err := ParseCSV(strings.NewReader("\ufeffCódigo_TUSS;Especialidade;Procedimento\n" +
+		"40101010;Cardiologia;Eletrocardiograma\n" +
+		";;\n" +
+		";Dermatologia;\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	want := []ImportRow{
+		{Line: 2, Specialization: "Cardiologia", Procedure: "Eletrocardiograma", TUSSCode: "40101010"},
+		{Line: 4, Specialization: "Dermatologia"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("Expected %d rows, got %+v", len(want), rows)
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], rows[i])
+		}
+	}
+
+	_, err = ParseCSV(strings.NewReader("name,code\nCardiologia,1\n"))
+	if err == nil {
+		t.Error("Expected a CSV without a specialization column refused")
+	}
+}
+
+func TestImporter(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	rows := []ImportRow{
+		{Line: 2, Specialization: "Cardiologia", Procedure: "Eletrocardiograma", TUSSCode: "40101010"},
+		{Line: 3, Specialization: "cardiología", Procedure: "Ecocardiograma"},
+		{Line: 4, Specialization: "Dermatologia"},
+	}
+
+	res, err := (&Importer{Store: s, DryRun: true}).Run(ctx, rows)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if res != (ImportResult{SpecializationsCreated: 2, ProceduresCreated: 2}) {
+		t.Errorf("Expected 2 specializations and 2 procedures counted, got %+v", res)
+	}
+	if _, total, _ := (&SpecializationLister{Store: s}).Run(ctx, Query{}); total != 0 {
+		t.Errorf("Expected the dry run rolled back, got %d specializations", total)
+	}
+
+	_, err = (&Importer{Store: s}).Run(ctx, rows)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	res, err = (&Importer{Store: s}).Run(ctx, []ImportRow{
+		{Line: 2, Specialization: "Cardiologia", Procedure: "ECG", TUSSCode: "4.01.01.01-0"},
+		{Line: 3, Specialization: "Cardiologia", Procedure: "Ecocardiograma", TUSSCode: "40901114"},
+		{Line: 4, Specialization: "Dermatologia"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if res != (ImportResult{ProceduresUpdated: 2}) {
+		t.Errorf("Expected the procedures updated by TUSS code and by name, got %+v", res)
+	}
+
+	_, err = (&Importer{Store: s}).Run(ctx, []ImportRow{
+		{Line: 2, Specialization: "Pediatria"},
+		{Line: 3, Specialization: "Dermatologia", Procedure: "Biópsia", TUSSCode: "40101010"},
+	})
+	if _, ok := errors.Cause(err).(*auth.ConflictError); !ok || !strings.HasPrefix(err.Error(), "Line 3") {
+		t.Errorf("Expected a TUSS code of another specialization refused at line 3, got %v", err)
+	}
+	if _, total, _ := (&SpecializationLister{Store: s}).Run(ctx, Query{Name: "pedi"}); total != 0 {
+		t.Errorf("Expected the failed import rolled back, got %d specializations", total)
+	}
+}
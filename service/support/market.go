@@ -0,0 +1,116 @@
+package support
+
+import (
+	"context"
+	"time"
+
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+// MarketPrice is what the completed matches of a procedure, or of a whole
+// specialization, charged for a type of service, in cents
+type MarketPrice struct {
+	SpecID uuid.UUID  `db:"spec_id" json:"spec_id"`
+	ProcID *uuid.UUID `db:"proc_id" json:"proc_id" swaggertype:"string"`
+	// Region is the UF of the addresses of the matches, empty for the whole
+	// country
+	Region string `db:"region" json:"region" example:"SP"`
+	Type   string `db:"type" json:"type" example:"in-person"`
+	// PriceMin, PriceMedian and PriceMax are the 10th, 50th and 90th
+	// percentiles of the prices
+	PriceMin    int       `db:"price_p10" json:"price_min" example:"15000"`
+	PriceMedian int       `db:"price_p50" json:"price_median" example:"25000"`
+	PriceMax    int       `db:"price_p90" json:"price_max" example:"40000"`
+	Samples     int       `db:"samples" json:"samples" example:"42"`
+	RefreshedAt time.Time `db:"refreshed_at" json:"refreshed_at"`
+}
+
+// MarketQuery picks a MarketPrice: of ProcID when it's set, of the whole
+// SpecID otherwise
+type MarketQuery struct {
+	SpecID uuid.UUID
+	ProcID *uuid.UUID
+	// Region is a UF, the whole country when empty
+	Region string
+	Type   string
+}
+
+// MarketPriceRefresher computes the market prices again
+type MarketPriceRefresher struct {
+	Store Store
+	// Window is how far back completed matches count
+	Window time.Duration
+	Log    *logger.Logger
+}
+
+// Run replaces the market prices with the percentiles of the matches
+// completed in the window, per procedure and per specialization, each per
+// region and for the whole country, and per type of service. It returns
+// how many prices there are.
+func (mr *MarketPriceRefresher) Run(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "support.MarketPriceRefresher.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = mr.Store.Tx(ctx, func(r Repos) error {
+		n, err = r.MarketPrices.Refresh(ctx, time.Now().Add(-mr.Window))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Every refreshes the market prices every interval until ctx is done
+func (mr *MarketPriceRefresher) Every(ctx context.Context, interval time.Duration) {
+	l := mr.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := mr.Run(ctx)
+		if err != nil {
+			l.Error("market price refresh failed", "error", err)
+		} else {
+			l.Info("market price refresh", "prices", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// MarketPriceGetter reads the market prices last refreshed
+type MarketPriceGetter struct {
+	Store Store
+	// MinSamples is how many matches a price needs to be told
+	MinSamples int
+}
+
+// Run returns the market price of q, falling back to the whole country
+// when its region has too few matches. A NotFoundError means there are too
+// few matches for a price.
+func (g *MarketPriceGetter) Run(ctx context.Context, q MarketQuery) (p *MarketPrice, err error) {
+	ctx, span := tracing.Start(ctx, "support.MarketPriceGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		p, err = r.MarketPrices.Get(ctx, q, g.MinSamples)
+		if _, ok := err.(*auth.NotFoundError); ok && len(q.Region) > 0 {
+			q.Region = ""
+			p, err = r.MarketPrices.Get(ctx, q, g.MinSamples)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
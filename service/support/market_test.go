@@ -0,0 +1,59 @@
+package support
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestMarketPrice(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	spec, _ := uuid.NewV4()
+	proc, _ := uuid.NewV4()
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		s.data.completed = append(s.data.completed, completedMatch{SpecID: spec, ProcID: &proc, Region: "SP", Type: "in-person", Price: i * 100, Date: now})
+	}
+	s.data.completed = append(s.data.completed,
+		completedMatch{SpecID: spec, ProcID: &proc, Region: "RJ", Type: "in-person", Price: 5000, Date: now},
+		completedMatch{SpecID: spec, ProcID: &proc, Region: "RJ", Type: "in-person", Price: 5000, Date: now},
+		completedMatch{SpecID: spec, Type: "in-person", Price: 300, Date: now},
+		completedMatch{SpecID: spec, ProcID: &proc, Region: "SP", Type: "in-person", Price: 90000, Date: now.AddDate(-2, 0, 0)},
+		completedMatch{SpecID: spec, ProcID: &proc, Region: "SP", Type: "telemedicine", Price: 100, Date: now},
+	)
+
+	n, err := (&MarketPriceRefresher{Store: s, Window: 365 * 24 * time.Hour}).Run(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	// in-person: procedure in SP, RJ and the country, specialization in
+	// SP, RJ and the country; telemedicine: the same but RJ
+	if n != 10 {
+		t.Errorf("Expected 10 market prices, got %d", n)
+	}
+
+	g := &MarketPriceGetter{Store: s, MinSamples: 5}
+	p, err := g.Run(ctx, MarketQuery{ProcID: &proc, Region: "SP", Type: "in-person"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.Region != "SP" || p.Samples != 10 || p.PriceMin != 190 || p.PriceMedian != 550 || p.PriceMax != 910 {
+		t.Errorf("Expected the percentiles of SP, got %+v", p)
+	}
+	p, err = g.Run(ctx, MarketQuery{ProcID: &proc, Region: "RJ", Type: "in-person"})
+	if err != nil || p.Region != "" || p.Samples != 12 {
+		t.Errorf("Expected RJ to fall back to the whole country, got %+v %v", p, err)
+	}
+	p, err = g.Run(ctx, MarketQuery{SpecID: spec, Type: "in-person"})
+	if err != nil || p.ProcID != nil || p.Samples != 13 {
+		t.Errorf("Expected the specialization counting matches without a procedure, got %+v %v", p, err)
+	}
+	_, err = g.Run(ctx, MarketQuery{ProcID: &proc, Type: "telemedicine"})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected too few matches to be a NotFoundError, got %v", err)
+	}
+}
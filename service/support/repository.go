@@ -0,0 +1,77 @@
+package support
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// SpecializationRepository persists Specializations. Names are unique
+// ignoring accents and case.
+type SpecializationRepository interface {
+	// Save returns a ConflictError when the name is taken
+	Save(ctx context.Context, s *Specialization) error
+	// Update updates the name of s, a NotFoundError when there's no such
+	// specialization and a ConflictError when the name is taken
+	Update(ctx context.Context, s *Specialization) error
+	// FromID returns a NotFoundError when there's no such specialization
+	FromID(ctx context.Context, specID uuid.UUID) (*Specialization, error)
+	// FromName returns a NotFoundError when no specialization has name
+	FromName(ctx context.Context, name string) (*Specialization, error)
+	// Search returns the page of q and how many there are in q ignoring
+	// its limit and offset
+	Search(ctx context.Context, q Query) (Specializations, int, error)
+	// SoftDelete returns a NotFoundError when there's no such
+	// specialization
+	SoftDelete(ctx context.Context, specID uuid.UUID) error
+}
+
+// ProcedureRepository persists Procedures. Names are unique within a
+// specialization ignoring accents and case, TUSS codes are unique.
+type ProcedureRepository interface {
+	// Save returns a ConflictError when the name or TUSS code is taken
+	Save(ctx context.Context, p *Procedure) error
+	// Update updates the name and TUSS code of p, a NotFoundError when its
+	// specialization has no such procedure and a ConflictError when the
+	// name or TUSS code is taken
+	Update(ctx context.Context, p *Procedure) error
+	// FromTUSS returns a NotFoundError when no procedure has code
+	FromTUSS(ctx context.Context, code string) (*Procedure, error)
+	// FromName returns a NotFoundError when specID has no procedure named
+	// name
+	FromName(ctx context.Context, specID uuid.UUID, name string) (*Procedure, error)
+	// Search returns the page of q among the procedures of specID and how
+	// many there are in q ignoring its limit and offset
+	Search(ctx context.Context, specID uuid.UUID, q Query) (Procedures, int, error)
+	// SoftDelete returns a NotFoundError when specID has no such procedure
+	SoftDelete(ctx context.Context, specID, procID uuid.UUID) error
+	// SoftDeleteOf soft deletes the procedures of specID
+	SoftDeleteOf(ctx context.Context, specID uuid.UUID) error
+}
+
+// MarketPriceRepository persists the MarketPrices computed from completed
+// matches
+type MarketPriceRepository interface {
+	// Refresh replaces the market prices with those of the matches
+	// completed since, returning how many there are
+	Refresh(ctx context.Context, since time.Time) (int, error)
+	// Get returns a NotFoundError when q has no market price of at least
+	// minSamples matches
+	Get(ctx context.Context, q MarketQuery, minSamples int) (*MarketPrice, error)
+}
+
+// Repos are the repositories bound to a single unit of work
+type Repos struct {
+	Specializations SpecializationRepository
+	Procedures      ProcedureRepository
+	MarketPrices    MarketPriceRepository
+}
+
+// Store runs units of work against a storage backend
+type Store interface {
+	// Tx runs f with repositories bound to one transaction. The transaction
+	// is committed when f returns nil and rolled back when f returns an
+	// error or panics, in which case the panic is propagated.
+	Tx(ctx context.Context, f func(r Repos) error) error
+}
@@ -0,0 +1,387 @@
+package support
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MemStore is an in-memory Store for tests, each unit of work works on a
+// copy of the data that replaces it when the unit succeeds
+type MemStore struct {
+	mu   sync.Mutex
+	data memData
+}
+
+type memData struct {
+	specializations map[uuid.UUID]Specialization
+	procedures      map[uuid.UUID]Procedure
+	marketPrices    []MarketPrice
+	// completed are the completed matches market prices are computed
+	// from, set by tests as the matches are kept by package user
+	completed []completedMatch
+}
+
+type completedMatch struct {
+	SpecID uuid.UUID
+	ProcID *uuid.UUID
+	Region string
+	Type   string
+	Price  int
+	Date   time.Time
+}
+
+// NewMemStore returns an empty MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{data: memData{}.clone()}
+}
+
+func (d memData) clone() memData {
+	c := memData{
+		specializations: map[uuid.UUID]Specialization{},
+		procedures:      map[uuid.UUID]Procedure{},
+	}
+	for k, v := range d.specializations {
+		c.specializations[k] = v
+	}
+	for k, v := range d.procedures {
+		c.procedures[k] = v
+	}
+	c.marketPrices = append([]MarketPrice{}, d.marketPrices...)
+	c.completed = append([]completedMatch{}, d.completed...)
+	return c
+}
+
+// Tx implements Store. f must not start another Tx on the same MemStore.
+func (s *MemStore) Tx(ctx context.Context, f func(r Repos) error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.data.clone()
+	defer func() {
+		if p := recover(); p != nil {
+			s.data = snapshot
+			panic(p)
+		}
+		if err != nil {
+			s.data = snapshot
+		}
+	}()
+
+	return f(Repos{
+		Specializations: &memSpecializations{s},
+		Procedures:      &memProcedures{s},
+		MarketPrices:    &memMarketPrices{s},
+	})
+}
+
+// fold is what f_unaccent and lower make of the Portuguese names
+var fold = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+)
+
+func folded(name string) string {
+	return fold.Replace(strings.ToLower(cleanName(name)))
+}
+
+// matches reports whether name has a word starting with term, and whether
+// name itself starts with it
+func matches(name, term string) (match, prefix bool) {
+	name, term = folded(name), folded(term)
+	prefix = strings.HasPrefix(name, term)
+	return prefix || strings.Contains(name, " "+term), prefix
+}
+
+// page sorts the names that match q, those starting with q.Name first,
+// returning the indexes of the page of q
+func page(names []string, q Query) []int {
+	type hit struct {
+		i      int
+		prefix bool
+	}
+	hits := []hit{}
+	for i, n := range names {
+		if ok, prefix := matches(n, q.Name); ok {
+			hits = append(hits, hit{i, prefix})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].prefix != hits[j].prefix {
+			return hits[i].prefix
+		}
+		return folded(names[hits[i].i]) < folded(names[hits[j].i])
+	})
+	is := []int{}
+	for k, h := range hits {
+		if k >= q.Offset && (q.Limit == 0 || k < q.Offset+q.Limit) {
+			is = append(is, h.i)
+		}
+	}
+	return is
+}
+
+type memSpecializations struct {
+	s *MemStore
+}
+
+func (r *memSpecializations) taken(s *Specialization) bool {
+	cur, err := r.FromName(context.Background(), s.Name)
+	return err == nil && cur.SpecID != s.SpecID
+}
+
+func (r *memSpecializations) Save(ctx context.Context, s *Specialization) error {
+	if r.taken(s) {
+		return &auth.ConflictError{Message: "There's a specialization named " + s.Name + " already"}
+	}
+	s.SpecID, _ = uuid.NewV4()
+	s.CreatedAt = time.Now()
+	s.UpdatedAt = s.CreatedAt
+	r.s.data.specializations[s.SpecID] = *s
+	return nil
+}
+
+func (r *memSpecializations) Update(ctx context.Context, s *Specialization) error {
+	cur, err := r.FromID(ctx, s.SpecID)
+	if err != nil {
+		return err
+	}
+	if r.taken(s) {
+		return &auth.ConflictError{Message: "There's a specialization named " + s.Name + " already"}
+	}
+	cur.Name = s.Name
+	cur.UpdatedAt = time.Now()
+	r.s.data.specializations[s.SpecID] = *cur
+	*s = *cur
+	return nil
+}
+
+func (r *memSpecializations) FromID(ctx context.Context, specID uuid.UUID) (*Specialization, error) {
+	s, ok := r.s.data.specializations[specID]
+	if !ok || s.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No such specialization"}
+	}
+	return &s, nil
+}
+
+func (r *memSpecializations) FromName(ctx context.Context, name string) (*Specialization, error) {
+	for _, s := range r.s.data.specializations {
+		if !s.DeletedAt.Valid && folded(s.Name) == folded(name) {
+			return &s, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No such specialization"}
+}
+
+func (r *memSpecializations) Search(ctx context.Context, q Query) (Specializations, int, error) {
+	all := Specializations{}
+	names := []string{}
+	for _, s := range r.s.data.specializations {
+		if !s.DeletedAt.Valid {
+			all = append(all, s)
+			names = append(names, s.Name)
+		}
+	}
+	ss := Specializations{}
+	for _, i := range page(names, q) {
+		ss = append(ss, all[i])
+	}
+	total := len(page(names, Query{Name: q.Name}))
+	return ss, total, nil
+}
+
+func (r *memSpecializations) SoftDelete(ctx context.Context, specID uuid.UUID) error {
+	cur, err := r.FromID(ctx, specID)
+	if err != nil {
+		return err
+	}
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.specializations[specID] = *cur
+	return nil
+}
+
+type memProcedures struct {
+	s *MemStore
+}
+
+func (r *memProcedures) conflict(p *Procedure) error {
+	if cur, err := r.FromName(context.Background(), p.SpecID, p.Name); err == nil && cur.ProcID != p.ProcID {
+		return &auth.ConflictError{Message: "The specialization has a procedure named " + p.Name + " already"}
+	}
+	if !p.TUSSCode.Valid {
+		return nil
+	}
+	if cur, err := r.FromTUSS(context.Background(), p.TUSSCode.String); err == nil && cur.ProcID != p.ProcID {
+		return &auth.ConflictError{Message: "There's a procedure with TUSS code " + p.TUSSCode.String + " already"}
+	}
+	return nil
+}
+
+func (r *memProcedures) Save(ctx context.Context, p *Procedure) error {
+	if err := r.conflict(p); err != nil {
+		return err
+	}
+	p.ProcID, _ = uuid.NewV4()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	r.s.data.procedures[p.ProcID] = *p
+	return nil
+}
+
+func (r *memProcedures) Update(ctx context.Context, p *Procedure) error {
+	cur, ok := r.s.data.procedures[p.ProcID]
+	if !ok || cur.SpecID != p.SpecID || cur.DeletedAt.Valid {
+		return &auth.NotFoundError{Message: "No such procedure"}
+	}
+	if err := r.conflict(p); err != nil {
+		return err
+	}
+	cur.Name, cur.TUSSCode = p.Name, p.TUSSCode
+	cur.UpdatedAt = time.Now()
+	r.s.data.procedures[p.ProcID] = cur
+	*p = cur
+	return nil
+}
+
+func (r *memProcedures) FromTUSS(ctx context.Context, code string) (*Procedure, error) {
+	for _, p := range r.s.data.procedures {
+		if !p.DeletedAt.Valid && p.TUSSCode.Valid && p.TUSSCode.String == code {
+			return &p, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No such procedure"}
+}
+
+func (r *memProcedures) FromName(ctx context.Context, specID uuid.UUID, name string) (*Procedure, error) {
+	for _, p := range r.s.data.procedures {
+		if !p.DeletedAt.Valid && p.SpecID == specID && folded(p.Name) == folded(name) {
+			return &p, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No such procedure"}
+}
+
+func (r *memProcedures) Search(ctx context.Context, specID uuid.UUID, q Query) (Procedures, int, error) {
+	all := Procedures{}
+	names := []string{}
+	for _, p := range r.s.data.procedures {
+		if !p.DeletedAt.Valid && p.SpecID == specID {
+			all = append(all, p)
+			names = append(names, p.Name)
+		}
+	}
+	ps := Procedures{}
+	for _, i := range page(names, q) {
+		ps = append(ps, all[i])
+	}
+	total := len(page(names, Query{Name: q.Name}))
+	return ps, total, nil
+}
+
+func (r *memProcedures) SoftDelete(ctx context.Context, specID, procID uuid.UUID) error {
+	cur, ok := r.s.data.procedures[procID]
+	if !ok || cur.SpecID != specID || cur.DeletedAt.Valid {
+		return &auth.NotFoundError{Message: "No such procedure"}
+	}
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.procedures[procID] = cur
+	return nil
+}
+
+func (r *memProcedures) SoftDeleteOf(ctx context.Context, specID uuid.UUID) error {
+	now := time.Now()
+	for id, p := range r.s.data.procedures {
+		if p.SpecID == specID && !p.DeletedAt.Valid {
+			p.DeletedAt = null.TimeFrom(now)
+			r.s.data.procedures[id] = p
+		}
+	}
+	return nil
+}
+
+type memMarketPrices struct {
+	s *MemStore
+}
+
+// percentile interpolates the p percentile of sorted prices the way
+// percentile_cont does
+func percentile(sorted []int, p float64) int {
+	pos := p * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[i]
+	}
+	v := float64(sorted[i]) + (pos-float64(i))*float64(sorted[i+1]-sorted[i])
+	return int(math.Round(v))
+}
+
+func (r *memMarketPrices) Refresh(ctx context.Context, since time.Time) (int, error) {
+	// proc is uuid.Nil for the whole specialization
+	type key struct {
+		spec, proc  uuid.UUID
+		region, typ string
+	}
+	groups := map[key][]int{}
+	for _, m := range r.s.data.completed {
+		if m.Date.Before(since) {
+			continue
+		}
+		procs := []uuid.UUID{uuid.Nil}
+		if m.ProcID != nil {
+			procs = append(procs, *m.ProcID)
+		}
+		regions := []string{""}
+		if len(m.Region) > 0 {
+			regions = append(regions, m.Region)
+		}
+		for _, proc := range procs {
+			for _, region := range regions {
+				k := key{m.SpecID, proc, region, m.Type}
+				groups[k] = append(groups[k], m.Price)
+			}
+		}
+	}
+	now := time.Now()
+	r.s.data.marketPrices = []MarketPrice{}
+	for k, prices := range groups {
+		sort.Ints(prices)
+		p := MarketPrice{
+			SpecID: k.spec, Region: k.region, Type: k.typ,
+			PriceMin:    percentile(prices, 0.1),
+			PriceMedian: percentile(prices, 0.5),
+			PriceMax:    percentile(prices, 0.9),
+			Samples:     len(prices),
+			RefreshedAt: now,
+		}
+		if k.proc != uuid.Nil {
+			proc := k.proc
+			p.ProcID = &proc
+		}
+		r.s.data.marketPrices = append(r.s.data.marketPrices, p)
+	}
+	return len(r.s.data.marketPrices), nil
+}
+
+func (r *memMarketPrices) Get(ctx context.Context, q MarketQuery, minSamples int) (*MarketPrice, error) {
+	for _, p := range r.s.data.marketPrices {
+		if p.Region != q.Region || p.Type != q.Type || p.Samples < minSamples {
+			continue
+		}
+		if (q.ProcID != nil && p.ProcID != nil && *p.ProcID == *q.ProcID) ||
+			(q.ProcID == nil && p.ProcID == nil && p.SpecID == q.SpecID) {
+			return &p, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "Too few completed matches for a market price"}
+}
@@ -0,0 +1,456 @@
+package support
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+var psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+// foldedName is how names are compared, f_unaccent is immutable so the
+// expression is indexed
+const foldedName = "lower(f_unaccent(name))"
+
+// traceSQL starts a span for qSQL; done ends it and logs a failure
+func traceSQL(ctx context.Context, qSQL string) (context.Context, func(error)) {
+	ctx, end := tracing.SQL(ctx, qSQL)
+	return ctx, func(err error) {
+		if err != nil && err != sql.ErrNoRows {
+			logger.FromContext(ctx).Error("sql failed", "error", err, "query", qSQL)
+		}
+		end(err)
+	}
+}
+
+// uniqueViolation reports whether err was caused by the unique index
+// constraint
+func uniqueViolation(err error, constraint string) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+// PgStore is the Postgres Store
+type PgStore struct {
+	DB *sqlx.DB
+}
+
+// Tx implements Store
+func (s *PgStore) Tx(ctx context.Context, f func(r Repos) error) (err error) {
+	tx, err := s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = errors.Wrap(tx.Commit(), "Failed to commit")
+	}()
+
+	return f(Repos{
+		Specializations: &pgSpecializations{q: tx},
+		Procedures:      &pgProcedures{q: tx},
+		MarketPrices:    &pgMarketPrices{q: tx},
+	})
+}
+
+// likeTerm escapes the wildcards of a name searched with LIKE
+func likeTerm(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(cleanName(name))
+}
+
+// search selects the page of q from table into dest, names with a word
+// starting with q.Name, those starting with it first and then the most
+// similar, and counts them
+func search(ctx context.Context, q sqlx.ExtContext, table string, where sq.And, query Query, dest interface{}) (int, error) {
+	term := likeTerm(query.Name)
+	if len(term) > 0 {
+		where = append(where, sq.Expr("("+foldedName+" LIKE lower(f_unaccent(?)) || '%' OR "+
+			foldedName+" LIKE '% ' || lower(f_unaccent(?)) || '%')", term, term))
+	}
+	countSQL, args, err := psql.Select("count(*)").From(table).Where(where).ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error generating "+table+" count sql")
+	}
+	var total int
+	cctx, done := traceSQL(ctx, countSQL)
+	err = sqlx.GetContext(cctx, q, &total, countSQL, args...)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error counting "+table)
+	}
+
+	sel := psql.Select("*").From(table).Where(where)
+	if len(term) > 0 {
+		sel = sel.OrderByClause(foldedName+" LIKE lower(f_unaccent(?)) || '%' DESC", term).
+			OrderByClause("similarity("+foldedName+", lower(f_unaccent(?))) DESC", term)
+	}
+	sel = sel.OrderBy(foldedName)
+	if query.Limit > 0 {
+		sel = sel.Limit(uint64(query.Limit)).Offset(uint64(query.Offset))
+	}
+	qSQL, args, err := sel.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error generating "+table+" sql")
+	}
+	ctx, done = traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, q, dest, qSQL, args...)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error searching "+table)
+	}
+	return total, nil
+}
+
+type pgSpecializations struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts a specialization
+func (r *pgSpecializations) Save(ctx context.Context, s *Specialization) error {
+	query := psql.Insert("specialization").
+		Columns("name").
+		Values(s.Name).
+		Suffix("RETURNING spec_id, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating specialization sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&s.SpecID, &s.CreatedAt, &s.UpdatedAt)
+	done(err)
+	if uniqueViolation(err, "specialization_name_key") {
+		return &auth.ConflictError{Message: "There's a specialization named " + s.Name + " already"}
+	}
+	return errors.Wrap(err, "Error inserting specialization")
+}
+
+// Update renames a specialization
+func (r *pgSpecializations) Update(ctx context.Context, s *Specialization) error {
+	query := psql.Update("specialization").
+		Set("name", s.Name).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"spec_id": s.SpecID, "deleted_at": nil}).
+		Suffix("RETURNING created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating specialization sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&s.CreatedAt, &s.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such specialization"}
+	}
+	if uniqueViolation(err, "specialization_name_key") {
+		return &auth.ConflictError{Message: "There's a specialization named " + s.Name + " already"}
+	}
+	return errors.Wrap(err, "Error updating specialization")
+}
+
+// FromID gets a specialization
+func (r *pgSpecializations) FromID(ctx context.Context, specID uuid.UUID) (*Specialization, error) {
+	return r.get(ctx, sq.Eq{"spec_id": specID, "deleted_at": nil})
+}
+
+// FromName gets a specialization by its name, ignoring accents and case
+func (r *pgSpecializations) FromName(ctx context.Context, name string) (*Specialization, error) {
+	return r.get(ctx, sq.And{sq.Expr(foldedName+" = lower(f_unaccent(?))", cleanName(name)), sq.Eq{"deleted_at": nil}})
+}
+
+func (r *pgSpecializations) get(ctx context.Context, where sq.Sqlizer) (*Specialization, error) {
+	s := Specialization{}
+	query := psql.Select("*").
+		From("specialization").
+		Where(where)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating specialization sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &s, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such specialization"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting specialization")
+	}
+	return &s, nil
+}
+
+// Search specializations by name
+func (r *pgSpecializations) Search(ctx context.Context, q Query) (Specializations, int, error) {
+	ss := Specializations{}
+	total, err := search(ctx, r.q, "specialization", sq.And{sq.Eq{"deleted_at": nil}}, q, &ss)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ss, total, nil
+}
+
+// SoftDelete soft deletes a specialization
+func (r *pgSpecializations) SoftDelete(ctx context.Context, specID uuid.UUID) error {
+	query := psql.Update("specialization").
+		Set("deleted_at", sq.Expr("now()")).
+		Where(sq.Eq{"spec_id": specID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating specialization sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting specialization")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such specialization"}
+	}
+	return nil
+}
+
+type pgProcedures struct {
+	q sqlx.ExtContext
+}
+
+// procedureConflict tells which unique index err violated, if any
+func procedureConflict(err error, p *Procedure) error {
+	switch {
+	case uniqueViolation(err, "procedure_name_key"):
+		return &auth.ConflictError{Message: "The specialization has a procedure named " + p.Name + " already"}
+	case uniqueViolation(err, "procedure_tuss_code_key"):
+		return &auth.ConflictError{Message: "There's a procedure with TUSS code " + p.TUSSCode.String + " already"}
+	}
+	return nil
+}
+
+// Save inserts a procedure
+func (r *pgProcedures) Save(ctx context.Context, p *Procedure) error {
+	query := psql.Insert("procedure").
+		Columns("spec_id", "name", "tuss_code").
+		Values(p.SpecID, p.Name, p.TUSSCode).
+		Suffix("RETURNING proc_id, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating procedure sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&p.ProcID, &p.CreatedAt, &p.UpdatedAt)
+	done(err)
+	if cerr := procedureConflict(err, p); cerr != nil {
+		return cerr
+	}
+	return errors.Wrap(err, "Error inserting procedure")
+}
+
+// Update updates the name and TUSS code of a procedure
+func (r *pgProcedures) Update(ctx context.Context, p *Procedure) error {
+	query := psql.Update("procedure").
+		Set("name", p.Name).
+		Set("tuss_code", p.TUSSCode).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"proc_id": p.ProcID, "spec_id": p.SpecID, "deleted_at": nil}).
+		Suffix("RETURNING created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating procedure sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&p.CreatedAt, &p.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such procedure"}
+	}
+	if cerr := procedureConflict(err, p); cerr != nil {
+		return cerr
+	}
+	return errors.Wrap(err, "Error updating procedure")
+}
+
+// FromTUSS gets a procedure by its TUSS code
+func (r *pgProcedures) FromTUSS(ctx context.Context, code string) (*Procedure, error) {
+	return r.get(ctx, sq.Eq{"tuss_code": code, "deleted_at": nil})
+}
+
+// FromName gets a procedure of a specialization by its name, ignoring
+// accents and case
+func (r *pgProcedures) FromName(ctx context.Context, specID uuid.UUID, name string) (*Procedure, error) {
+	return r.get(ctx, sq.And{
+		sq.Expr(foldedName+" = lower(f_unaccent(?))", cleanName(name)),
+		sq.Eq{"spec_id": specID, "deleted_at": nil},
+	})
+}
+
+func (r *pgProcedures) get(ctx context.Context, where sq.Sqlizer) (*Procedure, error) {
+	p := Procedure{}
+	query := psql.Select("*").
+		From("procedure").
+		Where(where)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating procedure sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such procedure"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting procedure")
+	}
+	return &p, nil
+}
+
+// Search the procedures of a specialization by name
+func (r *pgProcedures) Search(ctx context.Context, specID uuid.UUID, q Query) (Procedures, int, error) {
+	ps := Procedures{}
+	total, err := search(ctx, r.q, "procedure", sq.And{sq.Eq{"spec_id": specID, "deleted_at": nil}}, q, &ps)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ps, total, nil
+}
+
+// SoftDelete soft deletes a procedure of a specialization
+func (r *pgProcedures) SoftDelete(ctx context.Context, specID, procID uuid.UUID) error {
+	n, err := r.softDelete(ctx, sq.Eq{"proc_id": procID, "spec_id": specID, "deleted_at": nil})
+	if err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such procedure"}
+	}
+	return err
+}
+
+// SoftDeleteOf soft deletes the procedures of a specialization
+func (r *pgProcedures) SoftDeleteOf(ctx context.Context, specID uuid.UUID) error {
+	_, err := r.softDelete(ctx, sq.Eq{"spec_id": specID, "deleted_at": nil})
+	return err
+}
+
+func (r *pgProcedures) softDelete(ctx context.Context, where sq.Eq) (int64, error) {
+	query := psql.Update("procedure").
+		Set("deleted_at", sq.Expr("now()")).
+		Where(where)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error generating procedure sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error soft deleting procedure")
+	}
+	return res.RowsAffected()
+}
+
+// marketLockID is the pg_advisory_xact_lock key held while refreshing the
+// market prices, so replicas refreshing together take turns
+const marketLockID = 7305196013
+
+type pgMarketPrices struct {
+	q sqlx.ExtContext
+}
+
+// Refresh recomputes the market prices with one grouping set per level:
+// procedure and specialization, each by region and for the whole country.
+// Sets grouping by procedure or region leave out the matches without one,
+// those would be counted twice as the whole specialization or country.
+func (r *pgMarketPrices) Refresh(ctx context.Context, since time.Time) (int, error) {
+	lctx, done := traceSQL(ctx, "SELECT pg_advisory_xact_lock($1)")
+	_, err := r.q.ExecContext(lctx, "SELECT pg_advisory_xact_lock($1)", marketLockID)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error locking market price")
+	}
+	dSQL := "DELETE FROM market_price"
+	dctx, done := traceSQL(ctx, dSQL)
+	_, err = r.q.ExecContext(dctx, dSQL)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error deleting market price")
+	}
+
+	percentile := func(p string) string {
+		return "round(percentile_cont(" + p + ") WITHIN GROUP (ORDER BY m.price)::numeric)"
+	}
+	sel := psql.Select("m.spec_id", "m.proc_id", "coalesce(a.uf, '')", "m.type",
+		percentile("0.1"), percentile("0.5"), percentile("0.9"), "count(*)").
+		From("match m").
+		LeftJoin("address a ON a.addr_id = m.addr_id").
+		Where(sq.Eq{"m.status": "completed", "m.deleted_at": nil}).
+		Where(sq.NotEq{"m.spec_id": nil}).
+		Where(sq.GtOrEq{"m.date": since}).
+		GroupBy("GROUPING SETS ((m.spec_id, m.proc_id, a.uf, m.type), (m.spec_id, m.proc_id, m.type), " +
+			"(m.spec_id, a.uf, m.type), (m.spec_id, m.type))").
+		Having("(grouping(m.proc_id) = 1 OR m.proc_id IS NOT NULL)").
+		Having("(grouping(a.uf) = 1 OR coalesce(a.uf, '') <> '')")
+	query := psql.Insert("market_price").
+		Columns("spec_id", "proc_id", "region", "type", "price_p10", "price_p50", "price_p90", "samples").
+		Select(sel)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error generating market price sql")
+	}
+	ctx, done = traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error refreshing market price")
+	}
+	n, err := res.RowsAffected()
+	return int(n), errors.Wrap(err, "Error refreshing market price")
+}
+
+// Get reads a market price
+func (r *pgMarketPrices) Get(ctx context.Context, q MarketQuery, minSamples int) (*MarketPrice, error) {
+	query := psql.Select("*").
+		From("market_price").
+		Where(sq.Eq{"region": q.Region, "type": q.Type}).
+		Where(sq.GtOrEq{"samples": minSamples})
+	if q.ProcID != nil {
+		query = query.Where(sq.Eq{"proc_id": *q.ProcID})
+	} else {
+		query = query.Where(sq.Eq{"spec_id": q.SpecID, "proc_id": nil})
+	}
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating market price sql")
+	}
+	p := MarketPrice{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "Too few completed matches for a market price"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting market price")
+	}
+	return &p, nil
+}
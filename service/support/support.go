@@ -0,0 +1,281 @@
+// Package support keeps the reference data the rest of the API refers to:
+// the medical specializations, the procedures of each and what the market
+// charges for them
+package support
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Specialization is a representation of the table specialization
+type Specialization struct {
+	SpecID    uuid.UUID `db:"spec_id" json:"specID"`
+	Name      string    `db:"name" json:"name" example:"Cardiologia"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+	DeletedAt null.Time `db:"deleted_at" json:"-"`
+}
+
+// Specializations is a list of Specialization
+type Specializations []Specialization
+
+// Procedure is a representation of the table procedure, one of a
+// specialization
+type Procedure struct {
+	ProcID uuid.UUID `db:"proc_id" json:"procID"`
+	SpecID uuid.UUID `db:"spec_id" json:"specID"`
+	Name   string    `db:"name" json:"name" example:"Eletrocardiograma"`
+	// TUSSCode is the code of the procedure in the TUSS terminology of
+	// the ANS, 8 digits
+	TUSSCode  null.String `db:"tuss_code" json:"tussCode" swaggertype:"string" example:"40101010"`
+	CreatedAt time.Time   `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time   `db:"updated_at" json:"updatedAt"`
+	DeletedAt null.Time   `db:"deleted_at" json:"-"`
+}
+
+// Procedures is a list of Procedure
+type Procedures []Procedure
+
+// Query is a page of a search by name
+type Query struct {
+	// Name matches names having a word starting with it, ignoring accents
+	// and case. Everything matches when it's empty.
+	Name string
+	// Limit is how many to return, all when 0, after skipping Offset
+	Limit  int
+	Offset int
+}
+
+var tussRe = regexp.MustCompile(`^[0-9]{8}$`)
+
+// cleanName collapses the spaces of a name
+func cleanName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func validateSpecialization(s *Specialization) error {
+	s.Name = cleanName(s.Name)
+	if len(s.Name) == 0 {
+		return &auth.ValidationError{Messages: map[string]string{"name": "Name is required"}}
+	}
+	return nil
+}
+
+func validateProcedure(p *Procedure) error {
+	msgs := map[string]string{}
+	p.Name = cleanName(p.Name)
+	if len(p.Name) == 0 {
+		msgs["name"] = "Name is required"
+	}
+	if p.TUSSCode.Valid {
+		p.TUSSCode.String = strings.Map(func(r rune) rune {
+			if r == '.' || r == '-' || r == ' ' {
+				return -1
+			}
+			return r
+		}, p.TUSSCode.String)
+		p.TUSSCode.Valid = len(p.TUSSCode.String) > 0
+	}
+	if p.TUSSCode.Valid && !tussRe.MatchString(p.TUSSCode.String) {
+		msgs["tussCode"] = "TUSS code must have 8 digits"
+	}
+	if len(msgs) > 0 {
+		return &auth.ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// SpecializationLister searches specializations
+type SpecializationLister struct {
+	Store Store
+}
+
+// Run returns the page of the specializations matching q, those whose name
+// starts with q.Name first, and how many match
+func (l *SpecializationLister) Run(ctx context.Context, q Query) (ss Specializations, total int, err error) {
+	ctx, span := tracing.Start(ctx, "support.SpecializationLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		ss, total, err = r.Specializations.Search(ctx, q)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ss, total, nil
+}
+
+// SpecializationCreator adds a specialization
+type SpecializationCreator struct {
+	Store Store
+}
+
+// Run saves s, a name already taken is a ConflictError
+func (c *SpecializationCreator) Run(ctx context.Context, s *Specialization) (_ *Specialization, err error) {
+	ctx, span := tracing.Start(ctx, "support.SpecializationCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateSpecialization(s)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		return r.Specializations.Save(ctx, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SpecializationUpdater renames a specialization
+type SpecializationUpdater struct {
+	Store Store
+}
+
+// Run stores s, a name already taken is a ConflictError
+func (u *SpecializationUpdater) Run(ctx context.Context, s *Specialization) (_ *Specialization, err error) {
+	ctx, span := tracing.Start(ctx, "support.SpecializationUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateSpecialization(s)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		return r.Specializations.Update(ctx, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SpecializationRemover removes a specialization
+type SpecializationRemover struct {
+	Store Store
+}
+
+// Run soft deletes specID along with its procedures. What refers to them,
+// e.g. services and matches, keeps them.
+func (rm *SpecializationRemover) Run(ctx context.Context, specID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "support.SpecializationRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		err := r.Specializations.SoftDelete(ctx, specID)
+		if err != nil {
+			return err
+		}
+		return r.Procedures.SoftDeleteOf(ctx, specID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Specialization removed", nil
+}
+
+// ProcedureLister searches the procedures of a specialization
+type ProcedureLister struct {
+	Store Store
+}
+
+// Run returns the page of the procedures of specID matching q, those
+// whose name starts with q.Name first, and how many match
+func (l *ProcedureLister) Run(ctx context.Context, specID uuid.UUID, q Query) (ps Procedures, total int, err error) {
+	ctx, span := tracing.Start(ctx, "support.ProcedureLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Specializations.FromID(ctx, specID)
+		if err != nil {
+			return err
+		}
+		ps, total, err = r.Procedures.Search(ctx, specID, q)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ps, total, nil
+}
+
+// ProcedureCreator adds a procedure to a specialization
+type ProcedureCreator struct {
+	Store Store
+}
+
+// Run saves p, a name taken in its specialization or a TUSS code taken is
+// a ConflictError
+func (c *ProcedureCreator) Run(ctx context.Context, p *Procedure) (_ *Procedure, err error) {
+	ctx, span := tracing.Start(ctx, "support.ProcedureCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateProcedure(p)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Specializations.FromID(ctx, p.SpecID)
+		if err != nil {
+			return err
+		}
+		return r.Procedures.Save(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ProcedureUpdater updates a procedure
+type ProcedureUpdater struct {
+	Store Store
+}
+
+// Run stores the name and TUSS code of p, which stays in its
+// specialization
+func (u *ProcedureUpdater) Run(ctx context.Context, p *Procedure) (_ *Procedure, err error) {
+	ctx, span := tracing.Start(ctx, "support.ProcedureUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateProcedure(p)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		return r.Procedures.Update(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ProcedureRemover removes a procedure
+type ProcedureRemover struct {
+	Store Store
+}
+
+// Run soft deletes procID of specID
+func (rm *ProcedureRemover) Run(ctx context.Context, specID, procID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "support.ProcedureRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		return r.Procedures.SoftDelete(ctx, specID, procID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Procedure removed", nil
+}
@@ -0,0 +1,94 @@
+package support
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestCatalog(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	specs := map[string]*Specialization{}
+	for _, name := range []string{"Cirurgia Cardiovascular", "Cardiologia", "Ortopedia e Traumatologia", "Dermatologia"} {
+		sp, err := (&SpecializationCreator{Store: s}).Run(ctx, &Specialization{Name: name})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		specs[name] = sp
+	}
+	_, err := (&SpecializationCreator{Store: s}).Run(ctx, &Specialization{Name: " CARDIOLÓGIA "})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a name differing only in accents and case taken, got %v", err)
+	}
+	_, err = (&SpecializationCreator{Store: s}).Run(ctx, &Specialization{Name: "  "})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected an empty name refused, got %v", err)
+	}
+
+	ss, total, err := (&SpecializationLister{Store: s}).Run(ctx, Query{Name: "cárdio"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if total != 2 || len(ss) != 2 || ss[0].Name != "Cardiologia" || ss[1].Name != "Cirurgia Cardiovascular" {
+		t.Errorf("Expected the names starting with cardio first, got %d %+v", total, ss)
+	}
+	ss, total, _ = (&SpecializationLister{Store: s}).Run(ctx, Query{Limit: 3, Offset: 3})
+	if total != 4 || len(ss) != 1 || ss[0].Name != "Ortopedia e Traumatologia" {
+		t.Errorf("Expected the last of the 4 specializations, got %d %+v", total, ss)
+	}
+
+	card := specs["Cardiologia"]
+	ecg, err := (&ProcedureCreator{Store: s}).Run(ctx, &Procedure{SpecID: card.SpecID, Name: "Eletrocardiograma", TUSSCode: null.StringFrom("4.01.01.01-0")})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if ecg.TUSSCode.String != "40101010" {
+		t.Errorf("Expected the punctuation of the TUSS code stripped, got %s", ecg.TUSSCode.String)
+	}
+	for field, p := range map[string]Procedure{
+		"tussCode": {SpecID: card.SpecID, Name: "Holter", TUSSCode: null.StringFrom("123")},
+		"name":     {SpecID: card.SpecID, TUSSCode: null.StringFrom("40101037")},
+	} {
+		p := p
+		_, err = (&ProcedureCreator{Store: s}).Run(ctx, &p)
+		if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages[field]) == 0 {
+			t.Errorf("Expected %s refused, got %v", field, err)
+		}
+	}
+	_, err = (&ProcedureCreator{Store: s}).Run(ctx, &Procedure{SpecID: specs["Dermatologia"].SpecID, Name: "Biópsia", TUSSCode: null.StringFrom("40101010")})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a TUSS code taken refused, got %v", err)
+	}
+	_, err = (&ProcedureCreator{Store: s}).Run(ctx, &Procedure{SpecID: card.SpecID, Name: "eletrocardiográma"})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a procedure name taken in the specialization refused, got %v", err)
+	}
+	_, err = (&ProcedureCreator{Store: s}).Run(ctx, &Procedure{SpecID: card.SpecID, Name: "Ecocardiograma"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	ps, total, err := (&ProcedureLister{Store: s}).Run(ctx, card.SpecID, Query{Name: "ECO"})
+	if err != nil || total != 1 || ps[0].Name != "Ecocardiograma" {
+		t.Errorf("Expected only Ecocardiograma, got %d %+v %v", total, ps, err)
+	}
+
+	_, err = (&SpecializationRemover{Store: s}).Run(ctx, card.SpecID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, _, err = (&ProcedureLister{Store: s}).Run(ctx, card.SpecID, Query{})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected the removed specialization gone, got %v", err)
+	}
+	_, err = (&ProcedureCreator{Store: s}).Run(ctx, &Procedure{SpecID: specs["Dermatologia"].SpecID, Name: "Biópsia", TUSSCode: null.StringFrom("40101010")})
+	if err != nil {
+		t.Errorf("Expected the TUSS code of a removed procedure free, got %s", err)
+	}
+	_, err = (&SpecializationCreator{Store: s}).Run(ctx, &Specialization{Name: "Cardiologia"})
+	if err != nil {
+		t.Errorf("Expected the name of a removed specialization free, got %s", err)
+	}
+}
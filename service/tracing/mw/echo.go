@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EchoMiddleware starts a server span per request, continuing any trace
+// received in the W3C traceparent header. The span is named after the
+// route template and its trace ID is added to the request logger.
+func EchoMiddleware(service string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			if len(route) == 0 {
+				route = "unmatched"
+			}
+			ctx, span := tracing.Tracer().Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(semconv.NetAttributesFromHTTPRequest("tcp", req)...),
+				trace.WithAttributes(semconv.EndUserAttributesFromHTTPRequest(req)...),
+				trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(service, route, req)...),
+			)
+			defer span.End()
+
+			if sc := span.SpanContext(); sc.HasTraceID() {
+				l := logger.FromContext(ctx).With("trace_id", sc.TraceID().String())
+				ctx = logger.NewContext(ctx, l)
+			}
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				span.RecordError(err)
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+			code, msg := semconv.SpanStatusFromHTTPStatusCode(status)
+			span.SetStatus(code, msg)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/fignocius/echo-api"
+
+// Exporters accepted by Config.Exporter
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config configures the global tracer provider
+type Config struct {
+	Exporter    string
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+	// Writer receives spans when Exporter is stdout, defaults to os.Stdout
+	Writer io.Writer
+	// Sync exports each span as soon as it ends instead of batching
+	Sync bool
+}
+
+// Setup installs the tracer provider and the W3C trace-context propagator
+// globally. The returned func flushes pending spans and must be called on
+// shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		w := cfg.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithInsecure()}
+		if len(cfg.Endpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, errors.New("Unknown trace exporter " + cfg.Exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create trace exporter")
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName))
+	var process sdktrace.TracerProviderOption = sdktrace.WithBatcher(exp)
+	if cfg.Sync {
+		process = sdktrace.WithSyncer(exp)
+	}
+	tp := sdktrace.NewTracerProvider(
+		process,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the application tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span for a service operation
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name)
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SQL starts a span for a squirrel built statement. Only the statement
+// shape (with $n placeholders) is recorded, never its arguments.
+func SQL(ctx context.Context, qSQL string) (context.Context, func(error)) {
+	op := qSQL
+	if i := strings.IndexByte(qSQL, ' '); i > 0 {
+		op = qSQL[:i]
+	}
+	op = strings.ToUpper(op)
+	ctx, span := Tracer().Start(ctx, "sql "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatementKey.String(qSQL),
+			semconv.DBOperationKey.String(op),
+		),
+	)
+	return ctx, func(err error) {
+		if err == sql.ErrNoRows {
+			span.SetAttributes(attribute.Bool("db.no_rows", true))
+			err = nil
+		}
+		End(span, err)
+	}
+}
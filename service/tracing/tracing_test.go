@@ -0,0 +1,64 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	tmw "github.com/fignocius/echo-api/service/tracing/mw"
+	"github.com/labstack/echo"
+)
+
+func TestPropagationAndSQLSpans(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    tracing.ExporterStdout,
+		ServiceName: "test",
+		SampleRatio: 1,
+		Writer:      b,
+		Sync:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to setup tracing %s", err)
+	}
+	defer shutdown(context.Background())
+
+	e := echo.New()
+	e.Use(tmw.EchoMiddleware("test"))
+	e.GET("/patients/:pati_id", func(c echo.Context) error {
+		ctx, span := tracing.Start(c.Request().Context(), "user.PatientGeter.Run")
+		_, done := tracing.SQL(ctx, `SELECT * FROM patient WHERE pati_id = $1`)
+		done(nil)
+		tracing.End(span, nil)
+		return c.String(http.StatusOK, "ok")
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/patients/9a0b2c", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	out := b.String()
+	expected := []string{
+		`"Name":"GET /patients/:pati_id"`,
+		`"Name":"user.PatientGeter.Run"`,
+		`"Name":"sql SELECT"`,
+		`SELECT * FROM patient WHERE pati_id = $1`,
+	}
+	for _, s := range expected {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected exported spans to contain %s", s)
+		}
+	}
+	if strings.Count(out, traceID) < 3 {
+		t.Errorf("Expected every span to continue trace %s\n%s", traceID, out)
+	}
+	if strings.Contains(out, `"Name":"GET /patients/9a0b2c"`) {
+		t.Errorf("Expected raw URL params to stay out of span names")
+	}
+}
@@ -0,0 +1,372 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Address is a representation of the table address, a place a doctor
+// attends at
+type Address struct {
+	AddrID      int       `db:"addr_id" json:"addrID"`
+	DoctID      uuid.UUID `db:"doct_id" json:"doctID"`
+	Description string    `db:"description" json:"description"`
+	// Location is the free-form location from before structured addresses
+	Location string     `db:"location" json:"location"`
+	CEP      string     `db:"cep" json:"cep"`
+	Street   string     `db:"street" json:"street"`
+	Number   string     `db:"number" json:"number"`
+	District string     `db:"district" json:"district"`
+	City     string     `db:"city" json:"city"`
+	UF       string     `db:"uf" json:"uf"`
+	Lat      null.Float `db:"lat" json:"lat"`
+	Lng      null.Float `db:"lng" json:"lng"`
+	// Primary is the address shown first, each doctor has one
+	Primary      bool         `db:"is_primary" json:"primary"`
+	OpeningHours OpeningHours `db:"opening_hours" json:"openingHours"`
+	CreatedAt    time.Time    `db:"created_at" json:"createdAt"`
+	UpdatedAt    time.Time    `db:"updated_at" json:"updatedAt"`
+	DeletedAt    null.Time    `db:"deleted_at" json:"deletedAt"`
+}
+
+// Addresses is a list of Address
+type Addresses []Address
+
+// OpeningHour is a weekly interval an address is open at, in local time
+type OpeningHour struct {
+	// Weekday is 0 for sunday up to 6 for saturday
+	Weekday time.Weekday `json:"weekday"`
+	Opens   string       `json:"opens" example:"08:00"`
+	Closes  string       `json:"closes" example:"18:00"`
+}
+
+// OpeningHours of an address, stored as JSON
+type OpeningHours []OpeningHour
+
+// validateOpeningHours checks the intervals are well formed and those of
+// the same weekday don't overlap
+func validateOpeningHours(hs OpeningHours) error {
+	type interval struct{ opens, closes time.Time }
+	days := map[time.Weekday][]interval{}
+	for _, h := range hs {
+		if h.Weekday < time.Sunday || h.Weekday > time.Saturday {
+			return &auth.ValidationError{
+				Messages: map[string]string{"openingHours": "Weekday must be between 0 and 6"},
+			}
+		}
+		opens, err1 := time.Parse("15:04", h.Opens)
+		closes, err2 := time.Parse("15:04", h.Closes)
+		if err1 != nil || err2 != nil || !opens.Before(closes) {
+			return &auth.ValidationError{
+				Messages: map[string]string{"openingHours": "Hours must be HH:MM and open before closing"},
+			}
+		}
+		for _, o := range days[h.Weekday] {
+			if opens.Before(o.closes) && o.opens.Before(closes) {
+				return &auth.ValidationError{
+					Messages: map[string]string{"openingHours": "Overlapping hours on " + h.Weekday.String()},
+				}
+			}
+		}
+		days[h.Weekday] = append(days[h.Weekday], interval{opens, closes})
+	}
+	return nil
+}
+
+// Point is where the address is, if it was placed
+func (a Address) Point() (geo.Point, bool) {
+	return geo.Point{Lat: a.Lat.Float64, Lng: a.Lng.Float64}, a.Lat.Valid && a.Lng.Valid
+}
+
+// validateAddress normalizes the address and places it with g when it
+// came without coordinates
+func validateAddress(ctx context.Context, a *Address, g geo.Geocoder) error {
+	if a.OpeningHours == nil {
+		a.OpeningHours = OpeningHours{}
+	}
+	err := validateOpeningHours(a.OpeningHours)
+	if err != nil {
+		return err
+	}
+	a.CEP = geo.NormalizeCEP(a.CEP)
+	if len(a.CEP) == 0 {
+		return &auth.ValidationError{
+			Messages: map[string]string{"cep": "CEP must have 8 digits"},
+		}
+	}
+	a.UF = strings.ToUpper(strings.TrimSpace(a.UF))
+	if len(a.UF) > 0 && !ufs[a.UF] {
+		return &auth.ValidationError{
+			Messages: map[string]string{"uf": "Unknown UF " + a.UF},
+		}
+	}
+	if a.Lat.Valid != a.Lng.Valid {
+		return &auth.ValidationError{
+			Messages: map[string]string{"lat": "Latitude and longitude go together"},
+		}
+	}
+	if p, ok := a.Point(); ok {
+		if !p.Valid() {
+			return &auth.ValidationError{
+				Messages: map[string]string{"lat": "Invalid coordinates"},
+			}
+		}
+		return nil
+	}
+	if g == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "geo.Geocode")
+	p, err := g.Geocode(ctx, geo.Query{CEP: a.CEP, Street: a.Street, Number: a.Number, City: a.City, UF: a.UF})
+	tracing.End(span, err)
+	if err == geo.ErrNotFound {
+		return &auth.ValidationError{
+			Messages: map[string]string{"cep": "Couldn't find the address"},
+		}
+	}
+	if err != nil {
+		return err
+	}
+	a.Lat, a.Lng = null.FloatFrom(p.Lat), null.FloatFrom(p.Lng)
+	return nil
+}
+
+// AddressCreator adds an address to a doctor
+type AddressCreator struct {
+	Store Store
+	// Geocoder places addresses sent without coordinates, they are kept
+	// unplaced when nil
+	Geocoder geo.Geocoder
+}
+
+// Run validates, places and saves a. The first address of a doctor is
+// its primary one, a new primary address takes the flag from the old one.
+func (c *AddressCreator) Run(ctx context.Context, a *Address) (addr *Address, err error) {
+	ctx, span := tracing.Start(ctx, "user.AddressCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateAddress(ctx, a, c.Geocoder)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, a.DoctID)
+		if err != nil {
+			return err
+		}
+		as, err := r.Addresses.List(ctx, a.DoctID)
+		if err != nil {
+			return err
+		}
+		if len(*as) == 0 {
+			a.Primary = true
+		} else if a.Primary {
+			err = r.Addresses.ClearPrimary(ctx, a.DoctID)
+			if err != nil {
+				return err
+			}
+		}
+		return r.Addresses.Save(ctx, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AddressLister lists the addresses of a doctor
+type AddressLister struct {
+	Store Store
+}
+
+// Run returns the addresses of doctID
+func (l *AddressLister) Run(ctx context.Context, doctID uuid.UUID) (as *Addresses, err error) {
+	ctx, span := tracing.Start(ctx, "user.AddressLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		as, err = r.Addresses.List(ctx, doctID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// AddressGetter gets an address of a doctor
+type AddressGetter struct {
+	Store Store
+}
+
+// Run returns the address addrID of doctID
+func (g *AddressGetter) Run(ctx context.Context, doctID uuid.UUID, addrID int) (a *Address, err error) {
+	ctx, span := tracing.Start(ctx, "user.AddressGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		a, err = r.Addresses.FromID(ctx, doctID, addrID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AddressUpdater updates an address of a doctor
+type AddressUpdater struct {
+	Store Store
+	// Geocoder places addresses sent without coordinates, they are kept
+	// unplaced when nil
+	Geocoder geo.Geocoder
+}
+
+// Run replaces the address a.AddrID of a.DoctID with a. Making it primary
+// takes the flag from the old primary address; the primary address stays
+// so until another one is made primary.
+func (u *AddressUpdater) Run(ctx context.Context, a *Address) (addr *Address, err error) {
+	ctx, span := tracing.Start(ctx, "user.AddressUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateAddress(ctx, a, u.Geocoder)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		cur, err := r.Addresses.FromID(ctx, a.DoctID, a.AddrID)
+		if err != nil {
+			return err
+		}
+		if a.Primary && !cur.Primary {
+			err = r.Addresses.ClearPrimary(ctx, a.DoctID)
+			if err != nil {
+				return err
+			}
+		}
+		a.Primary = a.Primary || cur.Primary
+		a.CreatedAt = cur.CreatedAt
+		return r.Addresses.Update(ctx, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AddressRemover removes an address of a doctor
+type AddressRemover struct {
+	Store Store
+}
+
+// Run soft deletes a.AddrID of a.DoctID. It refuses while the address has
+// active services, unless cascade is set and they are removed with it.
+// Removing the primary address makes the oldest remaining one primary.
+func (rm *AddressRemover) Run(ctx context.Context, a *Address, cascade bool) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.AddressRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		cur, err := r.Addresses.FromID(ctx, a.DoctID, a.AddrID)
+		if err != nil {
+			return err
+		}
+		n, err := r.Addresses.Services(ctx, a.AddrID)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if !cascade {
+				return &auth.ConflictError{
+					Message: fmt.Sprintf("Address has %d active services, remove them first or use cascade", n),
+				}
+			}
+			err = r.Addresses.RemoveServices(ctx, a.AddrID)
+			if err != nil {
+				return err
+			}
+		}
+		err = r.Addresses.SoftDelete(ctx, a.DoctID, a.AddrID)
+		if err != nil {
+			return err
+		}
+		if !cur.Primary {
+			return nil
+		}
+		as, err := r.Addresses.List(ctx, a.DoctID)
+		if err != nil || len(*as) == 0 {
+			return err
+		}
+		next := (*as)[0]
+		next.Primary = true
+		return r.Addresses.Update(ctx, &next)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Address removed", nil
+}
+
+// NearQuery searches doctors around a point
+type NearQuery struct {
+	Point    geo.Point
+	RadiusKm float64
+	// SpecID restricts the search to doctors with the specialization
+	SpecID *uuid.UUID
+	Limit  uint64
+}
+
+// DoctorDistance is a doctor and its address nearest to the searched point
+type DoctorDistance struct {
+	DoctID     uuid.UUID `db:"doct_id" json:"doctID"`
+	Name       string    `db:"name" json:"name"`
+	CRM        string    `db:"crm" json:"crm"`
+	Address    Address   `db:"address" json:"address"`
+	DistanceKm float64   `db:"distance_km" json:"distanceKm"`
+}
+
+// DoctorSearcher ranks doctors by distance
+type DoctorSearcher struct {
+	Store Store
+}
+
+// maxRadiusKm bounds searches so they stay cheap
+const maxRadiusKm = 200
+
+// Run returns the doctors with an address within q.RadiusKm of q.Point,
+// nearest first
+func (s *DoctorSearcher) Run(ctx context.Context, q NearQuery) (ds []DoctorDistance, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorSearcher.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if !q.Point.Valid() {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"lat": "Invalid coordinates"},
+		}
+	}
+	if q.RadiusKm <= 0 || q.RadiusKm > maxRadiusKm {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"radiusKm": "Radius must be between 0 and 200km"},
+		}
+	}
+	if q.Limit == 0 || q.Limit > 100 {
+		q.Limit = 50
+	}
+	err = s.Store.Tx(ctx, func(r Repos) error {
+		ds, err = r.Doctors.Near(ctx, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
@@ -0,0 +1,210 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"gopkg.in/guregu/null.v3"
+)
+
+var testCEPs = geo.CEPTable{
+	"01310100": {Lat: -23.5614, Lng: -46.6559}, // Av. Paulista
+	"01001000": {Lat: -23.5505, Lng: -46.6333}, // Praça da Sé
+	"20040":    {Lat: -22.9068, Lng: -43.1729}, // Rio de Janeiro, centro
+}
+
+func TestAddressCreatorGeocodes(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	c := &AddressCreator{Store: s, Geocoder: testCEPs}
+	a, err := c.Run(ctx, &Address{DoctID: d.DoctID, CEP: "20040-020", UF: "rj"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if a.CEP != "20040020" || a.UF != "RJ" || a.Lat.Float64 != -22.9068 || a.AddrID == 0 {
+		t.Errorf("Expected a normalized and placed address, got %+v", a)
+	}
+
+	_, err = c.Run(ctx, &Address{DoctID: d.DoctID, CEP: "99999-999"})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected an unknown CEP to be a ValidationError, got %v", err)
+	}
+	_, err = c.Run(ctx, &Address{DoctID: d.DoctID, CEP: "01310100", Lat: null.FloatFrom(91), Lng: null.FloatFrom(0)})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected invalid coordinates to be a ValidationError, got %v", err)
+	}
+}
+
+func TestDoctorSearcherRanksByNearestAddress(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	dc := &DoctorCreator{Store: s}
+	ac := &AddressCreator{Store: s, Geocoder: testCEPs}
+	near, _ := dc.Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "house@mail.com"}, "123123")
+	far, _ := dc.Run(ctx, &Doctor{Name: "Dr. Wilson", CRM: "654321/SP", Email: "wilson@mail.com"}, "123123")
+	for _, a := range []Address{
+		{DoctID: near.DoctID, CEP: "01310100"},
+		{DoctID: near.DoctID, CEP: "20040020"},
+		{DoctID: far.DoctID, CEP: "01001000"},
+		{DoctID: far.DoctID, CEP: "20040020"},
+	} {
+		a := a
+		if _, err := ac.Run(ctx, &a); err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+	}
+
+	ds, err := (&DoctorSearcher{Store: s}).Run(ctx, NearQuery{
+		Point:    geo.Point{Lat: -23.5629, Lng: -46.6544},
+		RadiusKm: 10,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(ds) != 2 || ds[0].DoctID != near.DoctID || ds[1].DoctID != far.DoctID {
+		t.Fatalf("Expected doctors nearest first, got %+v", ds)
+	}
+	if ds[0].Address.CEP != "01310100" || ds[0].DistanceKm > 1 {
+		t.Errorf("Expected the nearest address of a doctor, got %+v", ds[0])
+	}
+
+	_, err = (&DoctorSearcher{Store: s}).Run(ctx, NearQuery{Point: geo.Point{Lat: -23.5, Lng: -46.6}, RadiusKm: 500})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a too large radius to be a ValidationError, got %v", err)
+	}
+}
+
+func TestPgNearFallsBackToHaversine(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT \* FROM \(SELECT DISTINCT ON \(d.doct_id\) (.*)asin(.*) AS distance_km FROM address a (.*)a.lat BETWEEN (.*)\) AS near WHERE distance_km <= \$(.*) ORDER BY distance_km LIMIT 5`).
+		WillReturnRows(sqlmock.NewRows([]string{"doct_id", "name", "crm", "address.addr_id", "address.cep", "distance_km"}).
+			AddRow("5d3b5a3e-7c1c-4d6f-9a70-1f0b1d2f6c11", "Dr. House", "123456/SP", 1, "01310100", 0.3))
+
+	r := &pgDoctors{q: sqlx.NewDb(mockDB, "sqlmock")}
+	ds, err := r.Near(context.Background(), NearQuery{Point: geo.Point{Lat: -23.56, Lng: -46.65}, RadiusKm: 5, Limit: 5})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(ds) != 1 || ds[0].Address.AddrID != 1 || ds[0].DistanceKm != 0.3 {
+		t.Errorf("Unexpected doctors %+v", ds)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestValidateOpeningHours(t *testing.T) {
+	valid := OpeningHours{
+		{Weekday: time.Monday, Opens: "08:00", Closes: "12:00"},
+		{Weekday: time.Monday, Opens: "14:00", Closes: "18:00"},
+		{Weekday: time.Tuesday, Opens: "08:00", Closes: "18:00"},
+	}
+	if err := validateOpeningHours(valid); err != nil {
+		t.Errorf("Expected valid hours, got %s", err)
+	}
+	for _, hs := range []OpeningHours{
+		{{Weekday: 7, Opens: "08:00", Closes: "12:00"}},
+		{{Weekday: time.Monday, Opens: "8h", Closes: "12:00"}},
+		{{Weekday: time.Monday, Opens: "12:00", Closes: "08:00"}},
+		{{Weekday: time.Monday, Opens: "08:00", Closes: "12:00"}, {Weekday: time.Monday, Opens: "11:00", Closes: "13:00"}},
+	} {
+		if _, ok := validateOpeningHours(hs).(*auth.ValidationError); !ok {
+			t.Errorf("Expected %+v to be a ValidationError", hs)
+		}
+	}
+}
+
+func TestAddressPrimaryFlag(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	c := &AddressCreator{Store: s, Geocoder: testCEPs}
+	first, _ := c.Run(ctx, &Address{DoctID: d.DoctID, CEP: "01310100"})
+	second, _ := c.Run(ctx, &Address{DoctID: d.DoctID, CEP: "01001000"})
+	if !first.Primary || second.Primary {
+		t.Fatalf("Expected the first address to be primary, got %v %v", first.Primary, second.Primary)
+	}
+
+	second.Primary = true
+	_, err = (&AddressUpdater{Store: s, Geocoder: testCEPs}).Run(ctx, second)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	as, _ := (&AddressLister{Store: s}).Run(ctx, d.DoctID)
+	if (*as)[0].Primary || !(*as)[1].Primary {
+		t.Errorf("Expected the primary flag to move, got %+v", *as)
+	}
+
+	_, err = (&AddressRemover{Store: s}).Run(ctx, &Address{DoctID: d.DoctID, AddrID: second.AddrID}, false)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	as, _ = (&AddressLister{Store: s}).Run(ctx, d.DoctID)
+	if len(*as) != 1 || !(*as)[0].Primary {
+		t.Errorf("Expected the remaining address to become primary, got %+v", *as)
+	}
+}
+
+func TestAddressRemoverRefusesActiveServices(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	doctID := "5d3b5a3e-7c1c-4d6f-9a70-1f0b1d2f6c11"
+	addrRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"addr_id", "doct_id", "is_primary", "opening_hours"}).
+			AddRow(3, doctID, false, `[]`)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.*) FROM address WHERE`).WillReturnRows(addrRow())
+	mock.ExpectQuery(`SELECT count\(\*\) FROM service`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.*) FROM address WHERE`).WillReturnRows(addrRow())
+	mock.ExpectQuery(`SELECT count\(\*\) FROM service`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(`UPDATE service SET deleted_at = now\(\), updated_at = now\(\) WHERE`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE address SET is_primary = \$1, deleted_at = \$2 WHERE`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rm := &AddressRemover{Store: &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}}
+	a := &Address{DoctID: uuid.FromStringOrNil(doctID), AddrID: 3}
+	_, err = rm.Run(context.Background(), a, false)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a ConflictError, got %v", err)
+	}
+	_, err = rm.Run(context.Background(), a, true)
+	if err != nil {
+		t.Errorf("Expected cascade to remove, got %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -1,15 +1,16 @@
 package user
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
-	sq "github.com/Masterminds/squirrel"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/fignocius/echo-api/service"
 	"github.com/fignocius/echo-api/service/mailer"
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/tracing"
 	"github.com/fignocius/echo-api/service/user/auth"
-	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -24,7 +25,7 @@ type AuthResponse struct {
 }
 
 type Authenticator struct {
-	DB        *sqlx.DB
+	Store     Store
 	JWTConfig JWTConfig
 }
 
@@ -34,13 +35,28 @@ type JWTConfig struct {
 	SigningMethod   *jwt.SigningMethodHMAC
 }
 
-func (u *Authenticator) Run(email, password string) (a *AuthResponse, err error) {
-	usr, err := fromEmail(u.DB, email)
-	if err != nil {
-		return nil, err
-	}
-
-	p, d, err := getPatientOrDoctor(u.DB, usr.UserID)
+func (u *Authenticator) Run(ctx context.Context, email, password string) (a *AuthResponse, err error) {
+	ctx, span := tracing.Start(ctx, "user.Authenticator.Run")
+	defer func() {
+		tracing.End(span, err)
+		if err != nil {
+			metrics.SignIns.WithLabelValues(metrics.SignInFailed).Inc()
+			return
+		}
+		metrics.SignIns.WithLabelValues(metrics.SignInSucceeded).Inc()
+	}()
+
+	var usr *User
+	var p *Patient
+	var d *Doctor
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		usr, err = r.Users.FromEmail(ctx, email)
+		if err != nil {
+			return err
+		}
+		p, d, err = getPatientOrDoctor(ctx, r, usr.UserID)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -50,12 +66,12 @@ func (u *Authenticator) Run(email, password string) (a *AuthResponse, err error)
 
 	var docid *string
 	if d != nil {
-		s := d.ID.String()
+		s := d.DoctID.String()
 		docid = &s
 	}
 	var patid *string
 	if p != nil {
-		s := p.ID.String()
+		s := p.PatiID.String()
 		patid = &s
 	}
 
@@ -67,7 +83,9 @@ func (u *Authenticator) Run(email, password string) (a *AuthResponse, err error)
 		jwtConfig: u.JWTConfig,
 	}
 
+	_, bspan := tracing.Start(ctx, "bcrypt.compare")
 	jwt, err := authenticate(opts)
+	bspan.End()
 	if err != nil {
 		return nil, err
 	}
@@ -75,18 +93,13 @@ func (u *Authenticator) Run(email, password string) (a *AuthResponse, err error)
 	return a, err
 }
 
-func getPatientOrDoctor(db *sqlx.DB, userID uuid.UUID) (*Patient, *Doctor, error) {
-	tx, err := db.Beginx()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	d, err := getDoctorByUserID(tx, userID)
+func getPatientOrDoctor(ctx context.Context, r Repos, userID uuid.UUID) (*Patient, *Doctor, error) {
+	d, err := r.Doctors.FromUserID(ctx, userID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, nil, err
 	}
 
-	p, err := getPatientByUserID(tx, userID)
+	p, err := r.Patients.FromUserID(ctx, userID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, nil, err
 	}
@@ -128,34 +141,33 @@ func authenticate(c authOptions) (jwttoken string, err error) {
 
 // PwdRecoverer starts an User`s password reset flow
 type PwdRecoverer struct {
-	DB     *sqlx.DB
+	Store  Store
 	Config *service.ServicesConfig
+	Mailer *mailer.Mailer
 }
 
-func (p *PwdRecoverer) Run(email string) error {
-	u, err := fromEmail(p.DB, email)
-	if err != nil {
-		return errors.Wrap(err, "Failed to retrieve user for email "+email)
-	}
+func (p *PwdRecoverer) Run(ctx context.Context, email string) (err error) {
+	ctx, span := tracing.Start(ctx, "user.PwdRecoverer.Run")
+	defer func() { tracing.End(span, err) }()
 
-	ac, secret, err := newActConfirmation(u.UserID, vPwd)
-	if err != nil {
-		return errors.Wrap(err, "Failed to create action confirmation")
-	}
+	var ac *ActionConfirmation
+	var secret string
+	err = p.Store.Tx(ctx, func(r Repos) error {
+		u, err := r.Users.FromEmail(ctx, email)
+		if err != nil {
+			return errors.Wrap(err, "Failed to retrieve user for email "+email)
+		}
 
-	tx, err := p.DB.Beginx()
-	if err != nil {
-		return errors.Wrap(err, "Failed to begin transaction")
-	}
+		ac, secret, err = newActConfirmation(u.UserID, vPwd)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create action confirmation")
+		}
 
-	err = confirmationSave(tx, ac)
-	if err != nil {
+		err = r.Confirmations.Save(ctx, ac)
 		return errors.Wrap(err, "Failed to insert action confirmation")
-	}
-
-	err = tx.Commit()
+	})
 	if err != nil {
-		return errors.Wrap(err, "Failed to commit")
+		return err
 	}
 
 	e := struct {
@@ -174,51 +186,46 @@ func (p *PwdRecoverer) Run(email string) error {
 
 // PwdReseter resets an User`s password
 type PwdReseter struct {
-	DB     *sqlx.DB
+	Store  Store
 	Mailer *mailer.Mailer
 }
 
-func (p *PwdReseter) Run(acveID, verification, password string) error {
-	tx, err := p.DB.Beginx()
-	if err != nil {
-		return err
-	}
+func (p *PwdReseter) Run(ctx context.Context, acveID, verification, password string) (err error) {
+	ctx, span := tracing.Start(ctx, "user.PwdReseter.Run")
+	defer func() { tracing.End(span, err) }()
 
-	psrt, err := confirmationFromID(tx, acveID)
-	if err != nil {
-		return err
-	}
+	err = p.Store.Tx(ctx, func(r Repos) error {
+		psrt, err := r.Confirmations.FromID(ctx, acveID)
+		if err != nil {
+			return err
+		}
 
-	// validate verification
-	err = bcrypt.CompareHashAndPassword([]byte(psrt.Verification), []byte(verification))
-	if err != nil {
-		return &auth.ValidationError{
-			Messages: map[string]string{"verification": "Invalid verification id"},
+		// validate verification
+		err = bcrypt.CompareHashAndPassword([]byte(psrt.Verification), []byte(verification))
+		if err != nil {
+			return &auth.ValidationError{
+				Messages: map[string]string{"verification": "Invalid verification id"},
+			}
 		}
-	}
 
-	// update user password
-	passHash, err := auth.PasswordGen(password)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	err = updatePassword(tx, psrt.UserID, passHash)
-	if err != nil {
-		tx.Rollback()
-		return errors.Wrap(err, "Failed to update user password")
-	}
+		// update user password
+		_, bspan := tracing.Start(ctx, "bcrypt.hash")
+		passHash, err := auth.PasswordGen(password)
+		bspan.End()
+		if err != nil {
+			return err
+		}
+		err = r.Users.UpdatePassword(ctx, psrt.UserID, passHash)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update user password")
+		}
 
-	// remove verification
-	err = confirmationDelete(tx, &psrt)
-	if err != nil {
-		tx.Rollback()
+		// remove verification
+		err = r.Confirmations.Delete(ctx, psrt)
 		return errors.Wrap(err, "Failed to update user password")
-	}
-
-	err = tx.Commit()
+	})
 	if err != nil {
-		return errors.Wrap(err, "Failed to commit password reset")
+		return err
 	}
 
 	// TODO: send user name, email
@@ -228,20 +235,3 @@ func (p *PwdReseter) Run(acveID, verification, password string) error {
 	}
 	return nil
 }
-
-func updatePassword(tx *sqlx.Tx, userID uuid.UUID, pass []byte) error {
-	query := psql.Update(`"user"`).
-		Set("password", pass).
-		Where(sq.Eq{"user_id": userID})
-
-	qSQL, args, err := query.ToSql()
-	if err != nil {
-		return errors.Wrap(err, "Error generating user password update sql")
-	}
-
-	_, err = tx.Exec(qSQL, args...)
-	if err != nil {
-		return errors.Wrap(err, "Error updating user password")
-	}
-	return nil
-}
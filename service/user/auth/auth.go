@@ -1,10 +1,17 @@
 package auth
 
 import (
+	"time"
+
+	"github.com/fignocius/echo-api/service/metrics"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // PasswordGen generates the password hash
 func PasswordGen(pass string) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		metrics.PasswordHashDuration.Observe(time.Since(start).Seconds())
+	}()
 	return bcrypt.GenerateFromPassword([]byte(pass), 12)
 }
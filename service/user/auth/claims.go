@@ -24,6 +24,8 @@ func (p Permissions) Can(perm ...string) bool {
 // Claims is the claims for a JWT
 type Claims struct {
 	UserID string  `json:"userID"`
+	DoctID *string `json:"doctID,omitempty"`
+	PatiID *string `json:"patiID,omitempty"`
 	Email  string  `json:"email"`
 	jwt.StandardClaims
 }
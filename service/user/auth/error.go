@@ -10,6 +10,18 @@ type UserNotFoundError struct {
 	Message string
 }
 
+// NotFoundError is an error for when a resource other than an user is not
+// found in the database
+type NotFoundError struct {
+	Message string
+}
+
+// ConflictError is an error for when a change conflicts with the current
+// state of a resource, e.g. removing something still in use
+type ConflictError struct {
+	Message string
+}
+
 // PwdResetInvalidError is an error for when a password reset id is not found in the database
 type PwdResetInvalidError struct {
 	Message string
@@ -26,6 +38,14 @@ func (e UserNotFoundError) Error() string {
 	return e.Message
 }
 
+func (e NotFoundError) Error() string {
+	return e.Message
+}
+
+func (e ConflictError) Error() string {
+	return e.Message
+}
+
 func (e PwdResetInvalidError) Error() string {
 	return e.Message
 }
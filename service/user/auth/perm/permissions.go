@@ -2,6 +2,8 @@ package perm
 
 // Permission constants
 var (
-	Admin  = "admin"
-	User = "user"
+	Admin   = "admin"
+	User    = "user"
+	Doctor  = "doctor"
+	Patient = "patient"
 )
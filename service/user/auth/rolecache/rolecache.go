@@ -76,3 +76,10 @@ func (r *RoleCache) updateRoles(userID string, roles []string) error {
 
 	return err
 }
+
+// Ping checks that the cache storage is open and readable
+func (r *RoleCache) Ping() error {
+	return r.DB.View(func(tx *buntdb.Tx) error {
+		return nil
+	})
+}
@@ -0,0 +1,319 @@
+package user
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nhanderu/brdoc"
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Bank account types
+const (
+	BankChecking = "checking"
+	BankSavings  = "savings"
+)
+
+// PIX key types
+const (
+	PixCPF    = "cpf"
+	PixCNPJ   = "cnpj"
+	PixEmail  = "email"
+	PixPhone  = "phone"
+	PixRandom = "random"
+)
+
+// Bank is a representation of the table bank, the account a doctor is
+// paid in. Agency, account and PIX key are encrypted at rest. Payouts go
+// by PIX when there's a key and by TED to the account otherwise.
+type Bank struct {
+	BankID uuid.UUID `db:"bank_id" json:"bankID"`
+	DoctID uuid.UUID `db:"doct_id" json:"doctID"`
+	// Bank is the FEBRABAN code of the bank
+	Bank string `db:"bank" json:"bank" example:"341"`
+	// Agency and Account have their check digit after a dash, when the
+	// bank uses one
+	Agency     fieldcrypt.String `db:"agency" json:"agency" example:"2545"`
+	Account    fieldcrypt.String `db:"account" json:"account" example:"02366-1"`
+	Type       string            `db:"type" json:"type" example:"checking"`
+	Name       string            `db:"name" json:"name"`
+	PixKeyType string            `db:"pix_key_type" json:"pixKeyType" example:"email"`
+	PixKey     fieldcrypt.String `db:"pix_key" json:"pixKey"`
+	CreatedAt  time.Time         `db:"created_at" json:"createdAt"`
+	DeletedAt  null.Time         `db:"deleted_at" json:"deletedAt"`
+}
+
+// BankNames are the banks accepted, by FEBRABAN code
+var BankNames = map[string]string{
+	"001": "Banco do Brasil",
+	"003": "Banco da Amazônia",
+	"004": "Banco do Nordeste",
+	"021": "Banestes",
+	"033": "Santander",
+	"037": "Banpará",
+	"041": "Banrisul",
+	"047": "Banese",
+	"070": "BRB",
+	"077": "Inter",
+	"085": "Ailos",
+	"104": "Caixa Econômica Federal",
+	"208": "BTG Pactual",
+	"212": "Original",
+	"237": "Bradesco",
+	"260": "Nu Pagamentos",
+	"290": "PagSeguro",
+	"323": "Mercado Pago",
+	"336": "C6 Bank",
+	"341": "Itaú",
+	"380": "PicPay",
+	"422": "Safra",
+	"655": "Votorantim",
+	"745": "Citibank",
+	"748": "Sicredi",
+	"756": "Sicoob",
+}
+
+// bankDigits computes the check digits of the banks known to use one,
+// empty when the bank has none for agencies
+type bankDigits struct {
+	agency  func(agency string) string
+	account func(agency, account string) string
+	// accountLen is the length of accounts without the digit, 0 when it
+	// varies
+	accountLen int
+}
+
+var checkDigits = map[string]bankDigits{
+	"001": {
+		agency:  func(ag string) string { return mod11Digit(ag, 9, "X") },
+		account: func(_, acc string) string { return mod11Digit(acc, 9, "X") },
+	},
+	"237": {
+		agency:     func(ag string) string { return mod11Digit(ag, 7, "P") },
+		account:    func(_, acc string) string { return mod11Digit(acc, 7, "P") },
+		accountLen: 7,
+	},
+	"341": {
+		agency: func(string) string { return "" },
+		account: func(ag, acc string) string {
+			for d := '0'; d <= '9'; d++ {
+				if luhn(ag + acc + string(d)) {
+					return string(d)
+				}
+			}
+			return ""
+		},
+		accountLen: 5,
+	},
+}
+
+// mod11Digit is the modulo 11 check digit of number, weighted from 2 up to
+// max from its last digit. A remainder of 1 is ten, 0 is zero.
+func mod11Digit(number string, max int, ten string) string {
+	sum := 0
+	for i := range number {
+		sum += int(number[len(number)-1-i]-'0') * (2 + i%(max-1))
+	}
+	switch r := 11 - sum%11; r {
+	case 10:
+		return ten
+	case 11:
+		return "0"
+	default:
+		return strconv.Itoa(r)
+	}
+}
+
+var (
+	agencyRe  = regexp.MustCompile(`^(\d{1,4})(?:-([0-9XP]))?$`)
+	accountRe = regexp.MustCompile(`^(\d{1,12})-?([0-9XP])$`)
+	phoneRe   = regexp.MustCompile(`^\+55\d{10,11}$`)
+	emailRe   = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// validateBank normalizes b, checking its bank code, the check digits of
+// its agency and account when the bank is known to use them and its PIX
+// key, if any
+func validateBank(b *Bank) error {
+	msgs := map[string]string{}
+	b.Bank = strings.TrimSpace(b.Bank)
+	if n, err := strconv.Atoi(b.Bank); err == nil {
+		b.Bank = strconv.Itoa(1000 + n)[1:]
+	}
+	b.Name = strings.Join(strings.Fields(b.Name), " ")
+	if _, ok := BankNames[b.Bank]; !ok {
+		msgs["bank"] = "Unknown bank code"
+	}
+	if b.Type != BankChecking && b.Type != BankSavings {
+		msgs["type"] = "Type must be checking or savings"
+	}
+	if len(b.Name) == 0 {
+		msgs["name"] = "Account holder name is required"
+	}
+
+	ag := agencyRe.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(string(b.Agency))))
+	acc := accountRe.FindStringSubmatch(strings.ToUpper(strings.Replace(strings.TrimSpace(string(b.Account)), " ", "", -1)))
+	if ag == nil {
+		msgs["agency"] = "Agency must be 4 digits and its check digit, if any, e.g. 1234-5"
+	}
+	if acc == nil || len(strings.TrimLeft(acc[1], "0")) == 0 {
+		acc = nil
+		msgs["account"] = "Account must be its number and check digit, e.g. 12345-6"
+	}
+	if ag != nil && acc != nil {
+		agency := strings.Repeat("0", 4-len(ag[1])) + ag[1]
+		account := strings.TrimLeft(acc[1], "0")
+		bd, known := checkDigits[b.Bank]
+		if known && bd.accountLen > 0 {
+			account = strings.Repeat("0", bd.accountLen) + account
+			account = account[len(account)-bd.accountLen:]
+			if len(strings.TrimLeft(acc[1], "0")) > bd.accountLen {
+				msgs["account"] = "Account number too long for this bank"
+			}
+		}
+		if known && len(ag[2]) > 0 && ag[2] != bd.agency(agency) {
+			msgs["agency"] = "Invalid agency check digit"
+		}
+		if known && acc[2] != bd.account(agency, account) {
+			msgs["account"] = "Invalid account check digit"
+		}
+		b.Agency = fieldcrypt.String(agency)
+		if len(ag[2]) > 0 {
+			b.Agency += fieldcrypt.String("-" + ag[2])
+		}
+		b.Account = fieldcrypt.String(account + "-" + acc[2])
+	}
+
+	if len(b.PixKey) > 0 || len(b.PixKeyType) > 0 {
+		key, msg := normalizePixKey(b.PixKeyType, strings.TrimSpace(string(b.PixKey)))
+		if len(msg) > 0 {
+			msgs["pixKey"] = msg
+		}
+		b.PixKey = fieldcrypt.String(key)
+	}
+	if len(msgs) > 0 {
+		return &auth.ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// normalizePixKey validates a PIX key of kind, returning it as the
+// central bank registers it or why it's invalid
+func normalizePixKey(kind, key string) (string, string) {
+	switch kind {
+	case PixCPF:
+		if d := digits(key); brdoc.IsCPF(d) {
+			return d, ""
+		}
+		return key, "Invalid CPF"
+	case PixCNPJ:
+		if d := digits(key); brdoc.IsCNPJ(d) {
+			return d, ""
+		}
+		return key, "Invalid CNPJ"
+	case PixEmail:
+		if k := strings.ToLower(key); len(k) <= 77 && emailRe.MatchString(k) {
+			return k, ""
+		}
+		return key, "Invalid email"
+	case PixPhone:
+		k := "+" + digits(key)
+		if !strings.HasPrefix(key, "+") {
+			k = "+55" + digits(key)
+		}
+		if phoneRe.MatchString(k) {
+			return k, ""
+		}
+		return key, "Phone must be a brazilian number with area code, e.g. +5511987654321"
+	case PixRandom:
+		if id, err := uuid.FromString(key); err == nil {
+			return id.String(), ""
+		}
+		return key, "Random keys are UUIDs"
+	}
+	return key, "PIX key type must be cpf, cnpj, email, phone or random"
+}
+
+// BankGetter gets the account of a doctor
+type BankGetter struct {
+	Store Store
+}
+
+// Run returns the active account of doctID
+func (g *BankGetter) Run(ctx context.Context, doctID uuid.UUID) (b *Bank, err error) {
+	ctx, span := tracing.Start(ctx, "user.BankGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		b, err = r.Banks.FromDoctor(ctx, doctID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BankCreator registers the account of a doctor
+type BankCreator struct {
+	Store Store
+}
+
+// Run validates and saves b, a doctor with an account already has to
+// update it instead
+func (c *BankCreator) Run(ctx context.Context, b *Bank) (_ *Bank, err error) {
+	ctx, span := tracing.Start(ctx, "user.BankCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateBank(b)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, b.DoctID)
+		if err != nil {
+			return err
+		}
+		return r.Banks.Save(ctx, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BankUpdater replaces the account of a doctor
+type BankUpdater struct {
+	Store Store
+}
+
+// Run validates b and makes it the account of its doctor. The old one is
+// soft deleted rather than changed, payouts already scheduled to it still
+// show where they went.
+func (u *BankUpdater) Run(ctx context.Context, b *Bank) (_ *Bank, err error) {
+	ctx, span := tracing.Start(ctx, "user.BankUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateBank(b)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		err := r.Banks.SoftDelete(ctx, b.DoctID)
+		if err != nil {
+			return err
+		}
+		return r.Banks.Save(ctx, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,378 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MaxCreditCards is how many cards a patient keeps at once
+const MaxCreditCards = 5
+
+// CreditCard is a representation of the table credit_card, a card a
+// patient saved to pay with. Only the gateway token is kept, encrypted at
+// rest, never the card number.
+type CreditCard struct {
+	CrcaID    uuid.UUID         `db:"crca_id" json:"crcaID"`
+	PatiID    uuid.UUID         `db:"pati_id" json:"patiID"`
+	Token     fieldcrypt.String `db:"token" json:"-"`
+	Brand     string            `db:"brand" json:"brand" example:"Visa"`
+	Last4     string            `db:"last4" json:"last4" example:"2931"`
+	ExpMonth  int               `db:"exp_month" json:"expMonth" example:"12"`
+	ExpYear   int               `db:"exp_year" json:"expYear" example:"2030"`
+	Holder    string            `db:"holder" json:"holder"`
+	Default   bool              `db:"is_default" json:"default"`
+	CreatedAt time.Time         `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time         `db:"updated_at" json:"updatedAt"`
+	DeletedAt null.Time         `db:"deleted_at" json:"deletedAt"`
+}
+
+// Expired reports whether c expired before now, cards are valid through
+// the last day of their month
+func (c CreditCard) Expired(now time.Time) bool {
+	return !now.Before(time.Date(c.ExpYear, time.Month(c.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// NewCard is a card as sent by a patient, before tokenization. It formats
+// masked so the number doesn't end up in logs.
+type NewCard struct {
+	PatiID uuid.UUID
+	Number string
+	Holder string
+	// Expiry is MM/YYYY
+	Expiry  string
+	Default bool
+}
+
+func (c NewCard) String() string {
+	return fmt.Sprintf("{%s %s %s %s %t}", c.PatiID, maskTail(c.Number, 4), c.Holder, c.Expiry, c.Default)
+}
+
+// GoString masks %#v too
+func (c NewCard) GoString() string {
+	return "user.NewCard" + c.String()
+}
+
+// CardVault keeps card numbers at the payment gateway, handing out tokens
+// to pay with. *cielo.Ecommerce is one.
+type CardVault interface {
+	Tokenize(ctx context.Context, c cielo.Card) (string, error)
+	RemoveCard(ctx context.Context, token string) error
+}
+
+// cardBrand is a brand and the prefixes of its BINs, the first digits of
+// its card numbers
+type cardBrand struct {
+	name     string
+	prefixes []string
+	// ranges are inclusive BIN ranges of six digits
+	ranges [][2]int
+}
+
+// cardBrands by the names Cielo knows them, Elo and Hipercard first as
+// their BINs fall inside the ranges of other brands
+var cardBrands = []cardBrand{
+	{name: "Elo", prefixes: []string{"401178", "401179", "431274", "438935", "451416", "457393", "457631", "457632", "504175", "627780", "636297", "636368"},
+		ranges: [][2]int{{506699, 506778}, {509000, 509999}, {650031, 650033}, {650035, 650051}, {650405, 650439}, {650485, 650538}, {650541, 650598},
+			{650700, 650718}, {650720, 650727}, {650901, 650920}, {651652, 651679}, {655000, 655019}, {655021, 655058}}},
+	{name: "Hipercard", prefixes: []string{"606282", "3841"}},
+	{name: "Amex", prefixes: []string{"34", "37"}},
+	{name: "Diners", prefixes: []string{"300", "301", "302", "303", "304", "305", "36", "38"}},
+	{name: "JCB", ranges: [][2]int{{352800, 358999}}},
+	{name: "Discover", prefixes: []string{"6011", "65"}},
+	{name: "Master", prefixes: []string{"51", "52", "53", "54", "55"}, ranges: [][2]int{{222100, 272099}}},
+	{name: "Aura", prefixes: []string{"50"}},
+	{name: "Visa", prefixes: []string{"4"}},
+}
+
+// CardBrand detects the brand of a card number from its BIN, empty when
+// unknown
+func CardBrand(number string) string {
+	bin := 0
+	if len(number) >= 6 {
+		bin, _ = strconv.Atoi(number[:6])
+	}
+	for _, b := range cardBrands {
+		for _, p := range b.prefixes {
+			if strings.HasPrefix(number, p) {
+				return b.name
+			}
+		}
+		for _, r := range b.ranges {
+			if bin >= r[0] && bin <= r[1] {
+				return b.name
+			}
+		}
+	}
+	return ""
+}
+
+// luhn reports whether the check digit of number is right
+func luhn(number string) bool {
+	sum := 0
+	for i := range number {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validateNewCard normalizes the number and holder of c, returning the
+// card saved for it, not yet tokenized
+func validateNewCard(c *NewCard, now time.Time) (*CreditCard, error) {
+	msgs := map[string]string{}
+	c.Number = strings.NewReplacer(" ", "", "-", "", ".", "").Replace(c.Number)
+	c.Holder = strings.ToUpper(strings.Join(strings.Fields(c.Holder), " "))
+	cc := &CreditCard{PatiID: c.PatiID, Holder: c.Holder, Default: c.Default}
+
+	switch {
+	case len(c.Number) < 13 || len(c.Number) > 19 || strings.Trim(c.Number, "0123456789") != "":
+		msgs["number"] = "Card number must have 13 to 19 digits"
+	case !luhn(c.Number):
+		msgs["number"] = "Invalid card number"
+	default:
+		cc.Brand, cc.Last4 = CardBrand(c.Number), c.Number[len(c.Number)-4:]
+		if len(cc.Brand) == 0 {
+			msgs["number"] = "Card brand not accepted"
+		}
+	}
+	exp, err := time.Parse("01/2006", strings.TrimSpace(c.Expiry))
+	if err != nil {
+		msgs["expiry"] = "Expiry must be MM/YYYY"
+	} else {
+		cc.ExpMonth, cc.ExpYear = int(exp.Month()), exp.Year()
+		if cc.Expired(now) {
+			msgs["expiry"] = "Card expired"
+		}
+	}
+	if len(c.Holder) == 0 {
+		msgs["holder"] = "Holder name is required"
+	}
+	if len(msgs) > 0 {
+		return nil, &auth.ValidationError{Messages: msgs}
+	}
+	return cc, nil
+}
+
+// CardCreator saves cards of patients
+type CardCreator struct {
+	Store Store
+	Vault CardVault
+}
+
+// Run validates c and tokenizes it at the vault, saving the token and what
+// identifies the card to the patient: brand, last digits and expiry. The
+// first card of a patient is its default one, a new default card takes the
+// flag from the old one.
+func (cr *CardCreator) Run(ctx context.Context, c NewCard) (card *CreditCard, err error) {
+	ctx, span := tracing.Start(ctx, "user.CardCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	card, err = validateNewCard(&c, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	err = cr.Store.Tx(ctx, func(r Repos) error {
+		return canAddCard(ctx, r, c.PatiID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the vault is called outside of units of work, not to hold them while
+	// waiting on the gateway
+	tctx, tspan := tracing.Start(ctx, "cielo.Tokenize")
+	token, err := cr.Vault.Tokenize(tctx, cielo.Card{
+		CustomerName: card.Holder,
+		Number:       c.Number,
+		Holder:       card.Holder,
+		Expiration:   fmt.Sprintf("%02d/%d", card.ExpMonth, card.ExpYear),
+		Brand:        card.Brand,
+	})
+	tracing.End(tspan, err)
+	if err != nil {
+		return nil, err
+	}
+	card.Token = fieldcrypt.String(token)
+
+	err = cr.Store.Tx(ctx, func(r Repos) error {
+		// checked again, another card may have been added meanwhile
+		err := canAddCard(ctx, r, c.PatiID)
+		if err != nil {
+			return err
+		}
+		cs, err := r.CreditCards.List(ctx, c.PatiID)
+		if err != nil {
+			return err
+		}
+		if len(cs) == 0 {
+			card.Default = true
+		} else if card.Default {
+			err = r.CreditCards.ClearDefault(ctx, c.PatiID)
+			if err != nil {
+				return err
+			}
+		}
+		return r.CreditCards.Save(ctx, card)
+	})
+	if err != nil {
+		// the token is useless without the card
+		cr.Vault.RemoveCard(context.Background(), token)
+		return nil, err
+	}
+	return card, nil
+}
+
+// canAddCard checks the patient exists and is under MaxCreditCards
+func canAddCard(ctx context.Context, r Repos, patiID uuid.UUID) error {
+	_, err := r.Patients.FromID(ctx, patiID)
+	if err != nil {
+		return err
+	}
+	cs, err := r.CreditCards.List(ctx, patiID)
+	if err != nil {
+		return err
+	}
+	if len(cs) >= MaxCreditCards {
+		return &auth.ConflictError{
+			Message: fmt.Sprintf("Patients keep up to %d cards, remove one first", MaxCreditCards),
+		}
+	}
+	return nil
+}
+
+// CardLister lists the cards of a patient
+type CardLister struct {
+	Store Store
+}
+
+// Run returns the cards of patiID, the default one first
+func (l *CardLister) Run(ctx context.Context, patiID uuid.UUID) (cs []CreditCard, err error) {
+	ctx, span := tracing.Start(ctx, "user.CardLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		cs, err = r.CreditCards.List(ctx, patiID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// CardGetter gets a card of a patient
+type CardGetter struct {
+	Store Store
+}
+
+// Run returns the card crcaID of patiID
+func (g *CardGetter) Run(ctx context.Context, patiID, crcaID uuid.UUID) (c *CreditCard, err error) {
+	ctx, span := tracing.Start(ctx, "user.CardGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		c, err = r.CreditCards.FromID(ctx, patiID, crcaID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CardDefaulter picks the card patients pay with by default
+type CardDefaulter struct {
+	Store Store
+}
+
+// Run makes crcaID the default card of patiID, taking the flag from the
+// old default card
+func (d *CardDefaulter) Run(ctx context.Context, patiID, crcaID uuid.UUID) (c *CreditCard, err error) {
+	ctx, span := tracing.Start(ctx, "user.CardDefaulter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = d.Store.Tx(ctx, func(r Repos) error {
+		c, err = r.CreditCards.FromID(ctx, patiID, crcaID)
+		if err != nil || c.Default {
+			return err
+		}
+		err = r.CreditCards.ClearDefault(ctx, patiID)
+		if err != nil {
+			return err
+		}
+		c.Default = true
+		return r.CreditCards.Update(ctx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CardRemover removes cards of patients
+type CardRemover struct {
+	Store Store
+	Vault CardVault
+}
+
+// Run soft deletes crcaID of patiID and then removes its token from the
+// vault, a token the vault fails to remove is logged and left there.
+// Removing the default card makes the newest remaining one default.
+func (rm *CardRemover) Run(ctx context.Context, patiID, crcaID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.CardRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	var cur *CreditCard
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		cur, err = r.CreditCards.FromID(ctx, patiID, crcaID)
+		if err != nil {
+			return err
+		}
+		err = r.CreditCards.SoftDelete(ctx, patiID, crcaID)
+		if err != nil {
+			return err
+		}
+		if cur.Default {
+			cs, err := r.CreditCards.List(ctx, patiID)
+			if err != nil {
+				return err
+			}
+			if len(cs) > 0 {
+				next := cs[0]
+				next.Default = true
+				return r.CreditCards.Update(ctx, &next)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// the vault is called outside of units of work, once the card is gone
+	tctx, tspan := tracing.Start(ctx, "cielo.RemoveCard")
+	verr := rm.Vault.RemoveCard(tctx, string(cur.Token))
+	tracing.End(tspan, verr)
+	if verr != nil {
+		logger.FromContext(ctx).Error("card token removal failed", "crca_id", crcaID, "error", verr)
+	}
+	return "Card removed", nil
+}
@@ -0,0 +1,144 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestCardBrand(t *testing.T) {
+	cases := map[string]string{
+		"4024007197692931": "Visa",
+		"5448280000000007": "Master",
+		"2223000048400011": "Master",
+		"378282246310005":  "Amex",
+		"36259600000004":   "Diners",
+		"6362970000457013": "Elo",
+		"5067224275805500": "Elo",
+		"6062825624254001": "Hipercard",
+		"6011000990139424": "Discover",
+		"3566002020360505": "JCB",
+		"9999999999999995": "",
+	}
+	for number, want := range cases {
+		if got := CardBrand(number); got != want {
+			t.Errorf("%s: expected %q, got %q", number, want, got)
+		}
+	}
+}
+
+func TestValidateNewCard(t *testing.T) {
+	now := time.Date(2030, 6, 15, 0, 0, 0, 0, time.UTC)
+	c := NewCard{Number: "4024 0071 9769 2931", Holder: " maria  silva ", Expiry: "06/2030"}
+	cc, err := validateNewCard(&c, now)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if cc.Brand != "Visa" || cc.Last4 != "2931" || cc.ExpMonth != 6 || cc.ExpYear != 2030 || cc.Holder != "MARIA SILVA" {
+		t.Errorf("Expected the card normalized, got %+v", cc)
+	}
+
+	c = NewCard{Number: "4024007197692932", Holder: "", Expiry: "05/2030"}
+	_, err = validateNewCard(&c, now)
+	v, ok := err.(*auth.ValidationError)
+	if !ok || len(v.Messages["number"]) == 0 || v.Messages["expiry"] != "Card expired" || len(v.Messages["holder"]) == 0 {
+		t.Errorf("Expected the check digit, expiry and holder refused, got %v", err)
+	}
+
+	if s := fmt.Sprint(NewCard{Number: "4024007197692931"}); s != fmt.Sprintf("{%s ************2931   false}", uuid.Nil) {
+		t.Errorf("Expected the number masked, got %s", s)
+	}
+}
+
+func TestCardLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStore()
+	f := cielo.NewFake()
+	vault := f.Ecommerce()
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{Name: "Maria", CPF: "12345678909", Email: "maria@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	cr := &CardCreator{Store: s, Vault: vault}
+	newCard := func(number string, def bool) *CreditCard {
+		c, err := cr.Run(ctx, NewCard{PatiID: p.PatiID, Number: number, Holder: "Maria Silva", Expiry: "12/2099", Default: def})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		return c
+	}
+
+	first := newCard("4024007197692931", false)
+	if !first.Default || len(first.Token) == 0 {
+		t.Errorf("Expected the first card tokenized and default, got %+v", first)
+	}
+	second := newCard("5448280000000007", true)
+	newCard("378282246310005", false)
+
+	cs, err := (&CardLister{Store: s}).Run(ctx, p.PatiID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(cs) != 3 || cs[0].CrcaID != second.CrcaID || cs[1].Default || cs[2].Default {
+		t.Errorf("Expected only the second card default and listed first, got %+v", cs)
+	}
+
+	_, err = (&CardDefaulter{Store: s}).Run(ctx, p.PatiID, first.CrcaID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&CardRemover{Store: s, Vault: vault}).Run(ctx, p.PatiID, first.CrcaID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	cs, _ = (&CardLister{Store: s}).Run(ctx, p.PatiID)
+	if len(cs) != 2 || !cs[0].Default || cs[0].Brand != "Amex" {
+		t.Errorf("Expected the newest card to become default, got %+v", cs)
+	}
+	// the token is gone from the gateway
+	matcID, _ := uuid.NewV4()
+	_, err = vault.Authorize(ctx, cielo.Authorization{OrderID: cielo.OrderID(matcID), Amount: 100, CardToken: string(first.Token)})
+	if d, ok := err.(*cielo.DeclinedError); !ok || d.ReturnCode != "14" {
+		t.Errorf("Expected the removed token declined, got %v", err)
+	}
+
+	// a vault failing doesn't bring the card back
+	third := newCard("4024007197692931", false)
+	_, err = (&CardRemover{Store: s, Vault: brokenVault{vault}}).Run(ctx, p.PatiID, third.CrcaID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&CardGetter{Store: s}).Run(ctx, p.PatiID, third.CrcaID)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected the card removed despite the vault, got %v", err)
+	}
+
+	newCard("4024007197692931", false)
+	newCard("4024007197692931", false)
+	newCard("4024007197692931", false)
+	_, err = cr.Run(ctx, NewCard{PatiID: p.PatiID, Number: "4024007197692931", Holder: "Maria", Expiry: "12/2099"})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a ConflictError over %d cards, got %v", MaxCreditCards, err)
+	}
+
+	other, _ := uuid.NewV4()
+	_, err = (&CardGetter{Store: s}).Run(ctx, other, second.CrcaID)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected a NotFoundError for another patient, got %v", err)
+	}
+}
+
+// brokenVault fails to remove cards
+type brokenVault struct {
+	CardVault
+}
+
+func (brokenVault) RemoveCard(ctx context.Context, token string) error {
+	return errors.New("vault unavailable")
+}
@@ -0,0 +1,191 @@
+package user
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Documents maps a document kind (e.g. "crm", "diploma") to where its copy
+// is stored, stored as JSON
+type Documents map[string]string
+
+// Doctor is a representation of the table doctor, joined with the
+// email, info and role of its user
+type Doctor struct {
+	DoctID    uuid.UUID `db:"doct_id" json:"doctID"`
+	UserID    uuid.UUID `db:"user_id" json:"userID"`
+	Name      string    `db:"name" json:"name"`
+	CRM       string    `db:"crm" json:"crm"`
+	Documents Documents `db:"documents" json:"documents"`
+	Email     string    `db:"email" json:"email"`
+	Info      Info      `db:"info" json:"info"`
+	Role      Role      `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	DeletedAt null.Time `db:"deleted_at" json:"deletedAt"`
+}
+
+// ufs are the brazilian states, each with its own regional council (CRM)
+var ufs = map[string]bool{
+	"AC": true, "AL": true, "AP": true, "AM": true, "BA": true, "CE": true,
+	"DF": true, "ES": true, "GO": true, "MA": true, "MT": true, "MS": true,
+	"MG": true, "PA": true, "PB": true, "PR": true, "PE": true, "PI": true,
+	"RJ": true, "RN": true, "RS": true, "RO": true, "RR": true, "SC": true,
+	"SP": true, "SE": true, "TO": true,
+}
+
+var crmRe = regexp.MustCompile(`^(?:CRM)?[\s/-]*([A-Z]{2})?[\s/-]*(\d{1,7})[\s/-]*([A-Z]{2})?$`)
+
+// NormalizeCRM validates a CRM registration, a number and the UF of the
+// council that issued it, in the forms "123456/SP", "123456-SP",
+// "CRM/SP 123456" or "SP123456", and returns it as "123456/SP"
+func NormalizeCRM(crm string) (string, error) {
+	invalid := &auth.ValidationError{
+		Messages: map[string]string{"crm": "CRM must be a number followed by the UF, e.g. 123456/SP"},
+	}
+	m := crmRe.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(crm)))
+	if m == nil || (len(m[1]) > 0) == (len(m[3]) > 0) {
+		return "", invalid
+	}
+	uf := m[1] + m[3]
+	if !ufs[uf] {
+		return "", &auth.ValidationError{
+			Messages: map[string]string{"crm": "Unknown UF " + uf},
+		}
+	}
+	number := strings.TrimLeft(m[2], "0")
+	if len(number) == 0 {
+		return "", invalid
+	}
+	return number + "/" + uf, nil
+}
+
+// DoctorCreator onboards a doctor, creating its user too
+type DoctorCreator struct {
+	Store Store
+}
+
+// Run creates the user with d.Email and password and the doctor in a
+// single transaction
+func (c *DoctorCreator) Run(ctx context.Context, d *Doctor, password string) (doc *Doctor, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	d.CRM, err = NormalizeCRM(d.CRM)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(d.Name)) == 0 {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"name": "Name is required"},
+		}
+	}
+	if d.Documents == nil {
+		d.Documents = Documents{}
+	}
+
+	_, bspan := tracing.Start(ctx, "bcrypt.hash")
+	u, err := newUser(&User{Email: d.Email, Role: Role{perm.User, perm.Doctor}, Info: d.Info}, password)
+	bspan.End()
+	if err != nil {
+		return nil, err
+	}
+	d.DoctID, err = uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor uuid")
+	}
+	d.UserID = u.UserID
+	d.Role = u.Role
+
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, u)
+		if err != nil {
+			return err
+		}
+		return r.Doctors.Save(ctx, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.Onboardings.WithLabelValues(perm.Doctor).Inc()
+	return d, nil
+}
+
+// DoctorGetter gets a doctor profile
+type DoctorGetter struct {
+	Store Store
+}
+
+// Run returns the doctor with doctID
+func (g *DoctorGetter) Run(ctx context.Context, doctID uuid.UUID) (d *Doctor, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		d, err = r.Doctors.FromID(ctx, doctID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DoctorUpdater updates a doctor profile
+type DoctorUpdater struct {
+	Store Store
+}
+
+// Run updates the name, CRM, documents and the user info of d.DoctID,
+// documents and info left out are kept
+func (u *DoctorUpdater) Run(ctx context.Context, d *Doctor) (doc *Doctor, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	d.CRM, err = NormalizeCRM(d.CRM)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(d.Name)) == 0 {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"name": "Name is required"},
+		}
+	}
+
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		cur, err := r.Doctors.FromID(ctx, d.DoctID)
+		if err != nil {
+			return err
+		}
+		cur.Name, cur.CRM = d.Name, d.CRM
+		if d.Documents != nil {
+			cur.Documents = d.Documents
+		}
+		if d.Info != (Info{}) {
+			cur.Info = d.Info
+		}
+		err = r.Doctors.Update(ctx, cur)
+		if err != nil {
+			return err
+		}
+		err = r.Users.UpdateInfo(ctx, cur.UserID, cur.Info)
+		if err != nil {
+			return err
+		}
+		doc = cur
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,141 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestNormalizeCRM(t *testing.T) {
+	valid := map[string]string{
+		"123456/SP":     "123456/SP",
+		"123456-sp":     "123456/SP",
+		" 0123456 SP ":  "123456/SP",
+		"CRM/SP 123456": "123456/SP",
+		"crm-rj 98765":  "98765/RJ",
+		"MG123":         "123/MG",
+	}
+	for in, want := range valid {
+		got, err := NormalizeCRM(in)
+		if err != nil || got != want {
+			t.Errorf("NormalizeCRM(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "123456", "SP", "123456/XX", "SP 123456/SP", "0/SP", "12a45/SP"} {
+		_, err := NormalizeCRM(in)
+		if _, ok := err.(*auth.ValidationError); !ok {
+			t.Errorf("Expected NormalizeCRM(%q) to be a ValidationError, got %v", in, err)
+		}
+	}
+}
+
+func TestDoctorCreatorInsertsUserAndDoctor(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "user" (.*) VALUES (.*) RETURNING \*`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "password", "role", "info", "created_at", "deleted_at"}).
+			AddRow("5d3b5a3e-7c1c-4d6f-9a70-1f0b1d2f6c11", "doc@mail.com", []byte("hash"), `["user","doctor"]`, `{}`, time.Now(), nil))
+	mock.ExpectQuery(`INSERT INTO doctor \(doct_id,user_id,name,crm,documents\) VALUES (.*) RETURNING created_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectCommit()
+
+	c := &DoctorCreator{Store: &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}}
+	d, err := c.Run(context.Background(), &Doctor{
+		Name:  "Dr. House",
+		CRM:   "123456-sp",
+		Email: "doc@mail.com",
+	}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if d.CRM != "123456/SP" || d.Documents == nil || d.CreatedAt.IsZero() {
+		t.Errorf("Unexpected doctor %+v", d)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestDoctorCreatorRollsBackUser(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "user"`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "password", "role", "info", "created_at", "deleted_at"}).
+			AddRow("5d3b5a3e-7c1c-4d6f-9a70-1f0b1d2f6c11", "doc@mail.com", []byte("hash"), `["user","doctor"]`, `{}`, time.Now(), nil))
+	mock.ExpectQuery(`INSERT INTO doctor`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	c := &DoctorCreator{Store: &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}}
+	_, err = c.Run(context.Background(), &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err == nil {
+		t.Errorf("Expected the doctor insert error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestDoctorUpdater(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	c := &DoctorCreator{Store: s}
+	d, err := c.Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = c.Run(ctx, &Doctor{Name: "Dr. Wilson", CRM: "654321/SP", Email: "wilson@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	u := &DoctorUpdater{Store: s}
+	_, err = u.Run(ctx, &Doctor{DoctID: d.DoctID, Name: "Dr. House", CRM: "654321/SP"})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a duplicate CRM to be a ValidationError, got %v", err)
+	}
+
+	up, err := u.Run(ctx, &Doctor{
+		DoctID:    d.DoctID,
+		Name:      "Gregory House",
+		CRM:       "RJ 1",
+		Documents: Documents{"crm": "s3://docs/crm.pdf"},
+		Info:      Info{City: "Princeton"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	got, err := (&DoctorGetter{Store: s}).Run(ctx, d.DoctID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if got.Name != up.Name || got.CRM != "1/RJ" || got.Info.City != "Princeton" ||
+		got.Email != "doc@mail.com" || got.Documents["crm"] != "s3://docs/crm.pdf" {
+		t.Errorf("Unexpected updated doctor %+v", got)
+	}
+
+	// leaving documents and info out keeps them
+	_, err = u.Run(ctx, &Doctor{DoctID: d.DoctID, Name: "Gregory House", CRM: "1/RJ"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	got, _ = (&DoctorGetter{Store: s}).Run(ctx, d.DoctID)
+	if got.Info.City != "Princeton" || got.Documents["crm"] != "s3://docs/crm.pdf" {
+		t.Errorf("Expected documents and info kept, got %+v", got)
+	}
+}
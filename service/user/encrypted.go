@@ -0,0 +1,40 @@
+package user
+
+import (
+	"encoding/json"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+)
+
+// EncryptedColumns are the columns holding values encrypted by fieldcrypt,
+// kept under the current master key by a fieldcrypt.Rotator
+var EncryptedColumns = []fieldcrypt.Column{
+	{Table: "patient", Key: "pati_id", Name: "cpf", New: newString, Derived: []string{"cpf_index"}, Derive: cpfIndex},
+	{Table: "patient", Key: "pati_id", Name: "rg", New: newString},
+	{Table: "credit_card", Key: "crca_id", Name: "token", New: newString},
+	{Table: "bank", Key: "bank_id", Name: "agency", New: newString},
+	{Table: "bank", Key: "bank_id", Name: "account", New: newString},
+	{Table: "bank", Key: "bank_id", Name: "pix_key", New: newString},
+	{Table: `"user"`, Key: "user_id", Name: "info", New: func() fieldcrypt.Field { return &Info{} }, Stale: infoStale},
+}
+
+func newString() fieldcrypt.Field {
+	s := fieldcrypt.String("")
+	return &s
+}
+
+// cpfIndex is the blind index of a CPF, of its digits as PatientCreator
+// indexes it. Rows from before encryption get theirs when rotated.
+func cpfIndex(f fieldcrypt.Field) ([]interface{}, error) {
+	index, err := fieldcrypt.Index(digits(string(*f.(*fieldcrypt.String))))
+	return []interface{}{index}, err
+}
+
+// infoStale reports whether the birthdate inside an info needs rotation
+func infoStale(raw string) bool {
+	i := struct {
+		Birthdate string `json:"birthdate"`
+	}{}
+	err := json.Unmarshal([]byte(raw), &i)
+	return err == nil && len(i.Birthdate) > 0 && fieldcrypt.Stale(i.Birthdate)
+}
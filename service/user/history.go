@@ -0,0 +1,255 @@
+package user
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/pdf"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MatchHistory is a match as listed to one of its sides, patients see the
+// doctor and where, doctors see the patient
+type MatchHistory struct {
+	MatcID uuid.UUID  `db:"matc_id" json:"matcID"`
+	SpecID *uuid.UUID `db:"spec_id" json:"specID" swaggertype:"string"`
+	Date   time.Time  `db:"date" json:"date"`
+	Time   string     `db:"time" json:"time" example:"09:00"`
+	Price  int        `db:"price" json:"price"`
+	Type   string     `db:"type" json:"type"`
+	// Description is the name of the service
+	Description string      `db:"description" json:"description"`
+	Status      MatchStatus `db:"status" json:"status"`
+	// StatusAt is when the match got its status, from its history
+	StatusAt  null.Time `db:"status_at" json:"statusAt" swaggertype:"string"`
+	CancelFee int       `db:"cancel_fee" json:"cancelFee"`
+	Doctor    string    `db:"doctor" json:"doctor,omitempty"`
+	Location  string    `db:"-" json:"location,omitempty"`
+	Patient   string    `db:"patient" json:"patient,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	// Address is where, Location is shown instead
+	Address Address `db:"address" json:"-"`
+}
+
+// Line is a one line description of a, e.g. for listings
+func (a Address) Line() string {
+	parts := []string{}
+	if street := strings.TrimSpace(a.Street + " " + a.Number); len(street) > 0 {
+		parts = append(parts, street)
+	}
+	if len(a.District) > 0 {
+		parts = append(parts, a.District)
+	}
+	if len(a.City) > 0 {
+		parts = append(parts, strings.TrimSuffix(a.City+"/"+a.UF, "/"))
+	}
+	if len(parts) == 0 {
+		return a.Location
+	}
+	return strings.Join(parts, ", ")
+}
+
+// MatchHistoryQuery filters the matches of a patient or of a doctor, the
+// one set
+type MatchHistoryQuery struct {
+	PatiID *uuid.UUID
+	DoctID *uuid.UUID
+	// From and To are the first and last dates, inclusive
+	From     time.Time
+	To       time.Time
+	Statuses []MatchStatus
+	SpecID   *uuid.UUID
+	// PriceMin and PriceMax bound the price in cents, unbounded when 0
+	PriceMin int
+	PriceMax int
+	// Limit is how many to return, all when 0, after skipping Offset
+	Limit  int
+	Offset int
+}
+
+// maxHistoryRange is the longest period a history is listed for
+const maxHistoryRange = 366 * 24 * time.Hour
+
+// MatchHistoryLister lists the history of matches of patients and doctors
+type MatchHistoryLister struct {
+	Store Store
+}
+
+// Run returns the page of the matches of q, latest first, and the total of
+// matches in q. role is the side listing them, perm.Patient or perm.Doctor.
+func (l *MatchHistoryLister) Run(ctx context.Context, q MatchHistoryQuery, role string) (hs []MatchHistory, total int, err error) {
+	ctx, span := tracing.Start(ctx, "user.MatchHistoryLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateHistoryQuery(&q)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		hs, total, err = r.Matches.List(ctx, q)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range hs {
+		hs[i].Location = hs[i].Address.Line()
+		if role == perm.Doctor {
+			hs[i].Doctor, hs[i].Location = "", ""
+		} else {
+			hs[i].Patient = ""
+		}
+	}
+	return hs, total, nil
+}
+
+func validateHistoryQuery(q *MatchHistoryQuery) error {
+	msgs := map[string]string{}
+	if (q.PatiID == nil) == (q.DoctID == nil) {
+		msgs["user"] = "History is of either a patient or a doctor"
+	}
+	if q.To.Before(q.From) {
+		msgs["dateEnd"] = "End date must not be before the start date"
+	} else if q.To.Sub(q.From) > maxHistoryRange {
+		msgs["dateEnd"] = "History is listed for up to a year"
+	}
+	if q.PriceMin < 0 || q.PriceMax < 0 || q.PriceMax > 0 && q.PriceMax < q.PriceMin {
+		msgs["price"] = "Invalid price range"
+	}
+	for _, s := range q.Statuses {
+		if _, ok := matchStatuses[s]; !ok {
+			msgs["status"] = "Unknown status " + string(s)
+		}
+	}
+	if len(msgs) > 0 {
+		return &auth.ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// matchStatuses are all the statuses
+var matchStatuses = map[MatchStatus]bool{
+	MatchProposed: true, MatchConfirmed: true, MatchCheckedIn: true, MatchCompleted: true,
+	MatchCanceledByPatient: true, MatchCanceledByDoctor: true, MatchNoShow: true, MatchExpired: true,
+}
+
+// Statement is what a doctor earned in a month: completed matches and the
+// fees of late cancellations and no-shows
+type Statement struct {
+	Doctor Doctor
+	// Month is the first day of the month
+	Month time.Time
+	Lines []MatchHistory
+	Total int
+}
+
+// Amount is what a line adds to the statement
+func (h MatchHistory) Amount() int {
+	if h.Status == MatchCompleted {
+		return h.Price
+	}
+	return h.CancelFee
+}
+
+// StatementMaker makes the monthly statements of doctors
+type StatementMaker struct {
+	Store Store
+}
+
+// Run returns the statement of doctID for the month of month
+func (sm *StatementMaker) Run(ctx context.Context, doctID uuid.UUID, month time.Time) (s *Statement, err error) {
+	ctx, span := tracing.Start(ctx, "user.StatementMaker.Run")
+	defer func() { tracing.End(span, err) }()
+
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	s = &Statement{Month: first}
+	err = sm.Store.Tx(ctx, func(r Repos) error {
+		d, err := r.Doctors.FromID(ctx, doctID)
+		if err != nil {
+			return err
+		}
+		s.Doctor = *d
+		hs, _, err := r.Matches.List(ctx, MatchHistoryQuery{
+			DoctID:   &doctID,
+			From:     first,
+			To:       first.AddDate(0, 1, -1),
+			Statuses: []MatchStatus{MatchCompleted, MatchNoShow, MatchCanceledByPatient},
+		})
+		if err != nil {
+			return err
+		}
+		// the list is latest first, statements read oldest first
+		for i := len(hs) - 1; i >= 0; i-- {
+			if hs[i].Amount() > 0 {
+				s.Lines = append(s.Lines, hs[i])
+				s.Total += hs[i].Amount()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// statusLabels are the statuses as shown in statements
+var statusLabels = map[MatchStatus]string{
+	MatchCompleted:         "Realizada",
+	MatchNoShow:            "Não compareceu",
+	MatchCanceledByPatient: "Cancelada com multa",
+}
+
+// money formats cents as reais, e.g. 1234567 as 12.345,67
+func money(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	reais := fmt.Sprint(cents / 100)
+	for i := len(reais) - 3; i > 0; i -= 3 {
+		reais = reais[:i] + "." + reais[i:]
+	}
+	return fmt.Sprintf("%s%s,%02d", sign, reais, cents%100)
+}
+
+// WriteCSV writes s as CSV, amounts in cents
+func (s *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "time", "patient", "service", "status", "amount"})
+	for _, l := range s.Lines {
+		cw.Write([]string{
+			l.Date.Format("2006-01-02"), l.Time, l.Patient, l.Description, string(l.Status), fmt.Sprint(l.Amount()),
+		})
+	}
+	cw.Write([]string{"", "", "", "", "total", fmt.Sprint(s.Total)})
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePDF writes s as a printable PDF
+func (s *Statement) WritePDF(w io.Writer) error {
+	d := pdf.New()
+	d.Text(pdf.HelveticaBold, 16, "Extrato mensal "+s.Month.Format("01/2006"))
+	d.Text(pdf.Helvetica, 11, s.Doctor.Name+" - CRM "+s.Doctor.CRM)
+	d.Space(12)
+	row := "%-10s %-5s %-22.22s %-22.22s %-19.19s %12s"
+	d.Text(pdf.Courier, 8, fmt.Sprintf(row, "Data", "Hora", "Paciente", "Serviço", "Situação", "Valor (R$)"))
+	for _, l := range s.Lines {
+		d.Text(pdf.Courier, 8, fmt.Sprintf(row,
+			l.Date.Format("02/01/2006"), l.Time, l.Patient, l.Description, statusLabels[l.Status], money(l.Amount())))
+	}
+	d.Space(6)
+	d.Text(pdf.HelveticaBold, 11, fmt.Sprintf("Total: R$ %s em %d atendimentos", money(s.Total), len(s.Lines)))
+	_, err := d.WriteTo(w)
+	return err
+}
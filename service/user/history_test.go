@@ -0,0 +1,108 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestMatchHistoryLister(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	m, patient, doctor := proposedMatch(t, s)
+	l := &MatchHistoryLister{Store: s}
+	q := MatchHistoryQuery{From: m.Date.AddDate(0, 0, -1), To: m.Date, Limit: 10}
+
+	pq := q
+	pq.PatiID = &patient.PatiID
+	hs, total, err := l.Run(ctx, pq, perm.Patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if total != 1 || hs[0].Doctor != "Dr. House" || hs[0].Patient != "" || hs[0].Location != "Av. Paulista 1000, São Paulo/SP" || !hs[0].StatusAt.Valid {
+		t.Errorf("Expected the patient to see the doctor and where, got %+v", hs)
+	}
+
+	dq := q
+	dq.DoctID = &doctor.DoctID
+	hs, _, err = l.Run(ctx, dq, perm.Doctor)
+	if err != nil || len(hs) != 1 || hs[0].Patient != "Maria" || hs[0].Doctor != "" {
+		t.Errorf("Expected the doctor to see the patient, got %+v %v", hs, err)
+	}
+
+	dq.Statuses = []MatchStatus{MatchCompleted}
+	hs, total, err = l.Run(ctx, dq, perm.Doctor)
+	if err != nil || total != 0 || len(hs) != 0 {
+		t.Errorf("Expected no completed match, got %+v %v", hs, err)
+	}
+	dq.Statuses, dq.PriceMin = nil, 30000
+	if _, total, _ = l.Run(ctx, dq, perm.Doctor); total != 0 {
+		t.Errorf("Expected the price range to filter the match out")
+	}
+
+	for _, inv := range []MatchHistoryQuery{
+		q,
+		{PatiID: &patient.PatiID, DoctID: &doctor.DoctID, From: q.From, To: q.To},
+		{PatiID: &patient.PatiID, From: q.To, To: q.From},
+		{PatiID: &patient.PatiID, From: q.From, To: q.To, Statuses: []MatchStatus{"lost"}},
+	} {
+		if _, _, err := l.Run(ctx, inv, perm.Patient); err == nil {
+			t.Errorf("Expected %+v to be invalid", inv)
+		} else if _, ok := err.(*auth.ValidationError); !ok {
+			t.Errorf("Expected a ValidationError, got %v", err)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{Name: "José Conceição", CPF: "12345678909", Email: "jose@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	for _, m := range []Match{
+		{Date: time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC), Time: "09:00", Price: 20000, Status: MatchCompleted},
+		{Date: time.Date(2030, 1, 9, 0, 0, 0, 0, time.UTC), Time: "10:00", Price: 15000, Status: MatchNoShow, CancelFee: 15000},
+		{Date: time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC), Time: "10:00", Price: 15000, Status: MatchCanceledByPatient},
+		{Date: time.Date(2030, 1, 11, 0, 0, 0, 0, time.UTC), Time: "10:00", Price: 15000, Status: MatchConfirmed},
+		{Date: time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC), Time: "10:00", Price: 15000, Status: MatchCompleted},
+	} {
+		m.MatcID, _ = uuid.NewV4()
+		m.DoctID, m.PatiID = d.DoctID, p.PatiID
+		s.data.matches[m.MatcID] = m
+	}
+
+	st, err := (&StatementMaker{Store: s}).Run(ctx, d.DoctID, time.Date(2030, 1, 15, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(st.Lines) != 2 || st.Total != 35000 || st.Lines[0].Status != MatchCompleted {
+		t.Fatalf("Expected the completed match and the no-show fee, oldest first, got %+v", st)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := st.WriteCSV(buf); err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if !strings.Contains(buf.String(), "2030-01-07,09:00,José Conceição,,completed,20000\n") || !strings.HasSuffix(buf.String(), ",total,35000\n") {
+		t.Errorf("Expected a line per match and the total, got %q", buf)
+	}
+	buf.Reset()
+	if err := st.WritePDF(buf); err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if !strings.HasPrefix(buf.String(), "%PDF") || !strings.Contains(buf.String(), "R$ 350,00") {
+		t.Errorf("Expected a PDF with the total, got %q", buf)
+	}
+}
@@ -0,0 +1,534 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MatchStatus is a state of the lifecycle of a Match
+type MatchStatus string
+
+// Match statuses, a match is proposed when a patient holds a slot and
+// confirmed when the patient commits to it. A proposal not confirmed in
+// time expires.
+const (
+	MatchProposed          MatchStatus = "proposed"
+	MatchConfirmed         MatchStatus = "confirmed"
+	MatchCheckedIn         MatchStatus = "checked-in"
+	MatchCompleted         MatchStatus = "completed"
+	MatchCanceledByPatient MatchStatus = "canceled-by-patient"
+	MatchCanceledByDoctor  MatchStatus = "canceled-by-doctor"
+	MatchNoShow            MatchStatus = "no-show"
+	MatchExpired           MatchStatus = "expired"
+)
+
+// matchTransitions are the statuses a match moves to from each status and
+// the role that moves it, the other statuses are final
+var matchTransitions = map[MatchStatus]map[MatchStatus]string{
+	MatchProposed: {
+		MatchConfirmed:         perm.Patient,
+		MatchCanceledByPatient: perm.Patient,
+		MatchCanceledByDoctor:  perm.Doctor,
+	},
+	MatchConfirmed: {
+		MatchCheckedIn:         perm.Doctor,
+		MatchNoShow:            perm.Doctor,
+		MatchCanceledByPatient: perm.Patient,
+		MatchCanceledByDoctor:  perm.Doctor,
+	},
+	MatchCheckedIn: {
+		MatchCompleted: perm.Doctor,
+	},
+}
+
+const (
+	// checkInEarly is how long before the start a patient is checked in
+	checkInEarly = time.Hour
+	// noShowGrace is how long after the start a patient is a no-show
+	noShowGrace = 15 * time.Minute
+)
+
+// Canceled reports whether s is one of the canceled statuses
+func (s MatchStatus) Canceled() bool {
+	return s == MatchCanceledByPatient || s == MatchCanceledByDoctor
+}
+
+// Match is a representation of the table match, a session of a patient
+// with a doctor
+type Match struct {
+	MatcID uuid.UUID  `db:"matc_id" json:"matcID"`
+	PatiID uuid.UUID  `db:"pati_id" json:"patiID"`
+	DoctID uuid.UUID  `db:"doct_id" json:"doctID"`
+	SpecID *uuid.UUID `db:"spec_id" json:"specID" swaggertype:"string"`
+	ProcID *uuid.UUID `db:"proc_id" json:"procID" swaggertype:"string"`
+	ServID *uuid.UUID `db:"serv_id" json:"servID" swaggertype:"string"`
+	// ServVersion is the version of the service the match was proposed
+	// at, Price is its price then
+	ServVersion null.Int   `db:"serv_version" json:"servVersion" swaggertype:"integer"`
+	SescID      *uuid.UUID `db:"sesc_id" json:"sescID" swaggertype:"string"`
+	AddrID      null.Int   `db:"addr_id" json:"addrID" swaggertype:"integer"`
+	// Date and Time are when the session starts, in DefaultTimezone
+	Date  time.Time `db:"date" json:"date"`
+	Time  string    `db:"time" json:"time" example:"09:00"`
+	Price int       `db:"price" json:"price"`
+	// Type is the type of the service, e.g. in-person
+	Type   string      `db:"type" json:"type"`
+	Status MatchStatus `db:"status" json:"status" example:"proposed"`
+	// Version is bumped on every change, changes must send the version
+	// they were decided on
+	Version int `db:"version" json:"version"`
+	// CancelFee is what the patient owes for canceling late, in cents
+	CancelFee  int       `db:"cancel_fee" json:"cancelFee"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updatedAt"`
+	CanceledAt null.Time `db:"canceled_at" json:"canceledAt"`
+	DeletedAt  null.Time `db:"deleted_at" json:"deletedAt"`
+	// History are the status changes of the match, oldest first
+	History []MatchStatusChange `db:"-" json:"history,omitempty"`
+}
+
+// StartsAt is when the session of m starts
+func (m Match) StartsAt() (time.Time, error) {
+	loc, err := time.LoadLocation(DefaultTimezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	mins, err := clockMinutes(m.Time)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "Invalid match time")
+	}
+	y, mo, d := m.Date.Date()
+	return time.Date(y, mo, d, 0, 0, 0, 0, loc).Add(time.Duration(mins) * time.Minute), nil
+}
+
+// MatchStatusChange is a representation of the table match_history, a
+// status a match went through
+type MatchStatusChange struct {
+	MahiID uuid.UUID   `db:"mahi_id" json:"mahiID"`
+	MatcID uuid.UUID   `db:"matc_id" json:"matcID"`
+	From   null.String `db:"from_status" json:"from" swaggertype:"string"`
+	To     MatchStatus `db:"to_status" json:"to"`
+	// UserID is who changed the status, null when it was the system
+	UserID    *uuid.UUID `db:"user_id" json:"userID" swaggertype:"string"`
+	Reason    string     `db:"reason" json:"reason"`
+	Fee       int        `db:"fee" json:"fee"`
+	CreatedAt time.Time  `db:"created_at" json:"createdAt"`
+}
+
+// MatchActor is who changes a match, the patient or doctor ids are those of
+// the user when they are one
+type MatchActor struct {
+	UserID uuid.UUID
+	PatiID uuid.UUID
+	DoctID uuid.UUID
+}
+
+// role is the role a acts in on m, a NotFoundError when a isn't part of it
+// so others don't learn the match exists
+func (a MatchActor) role(m *Match) (string, error) {
+	switch {
+	case a.PatiID != uuid.Nil && a.PatiID == m.PatiID:
+		return perm.Patient, nil
+	case a.DoctID != uuid.Nil && a.DoctID == m.DoctID:
+		return perm.Doctor, nil
+	}
+	return "", &auth.NotFoundError{Message: "No match with this id: " + m.MatcID.String()}
+}
+
+// CancelPolicy is what a patient pays for canceling a confirmed match late
+type CancelPolicy struct {
+	// FreeWindow is how long before the start a patient cancels for free
+	FreeWindow time.Duration
+	// FeePercent is the share of the price charged after FreeWindow
+	FeePercent int
+}
+
+// DefaultCancelPolicy charges half the price within a day of the start
+var DefaultCancelPolicy = CancelPolicy{FreeWindow: 24 * time.Hour, FeePercent: 50}
+
+// Fee is what the patient owes when m moves to status to at now, no-shows
+// pay the whole price
+func (p CancelPolicy) Fee(m *Match, to MatchStatus, startsAt, now time.Time) int {
+	switch {
+	case to == MatchNoShow:
+		return m.Price
+	case to == MatchCanceledByPatient && m.Status == MatchConfirmed && startsAt.Sub(now) < p.FreeWindow:
+		return m.Price * p.FeePercent / 100
+	}
+	return 0
+}
+
+// MatchEvent is emitted after a match changes status
+type MatchEvent struct {
+	Match  Match
+	Change MatchStatusChange
+}
+
+// MatchListener reacts to a MatchEvent, e.g. charging or notifying. It runs
+// after the change is committed, so it can't undo it.
+type MatchListener func(ctx context.Context, e MatchEvent)
+
+// emit counts and logs e, then passes it to each of ls
+func emit(ctx context.Context, ls []MatchListener, e MatchEvent) {
+	metrics.MatchTransitions.WithLabelValues(string(e.Change.To)).Inc()
+	if e.Change.To == MatchConfirmed {
+		metrics.MatchesConfirmed.Inc()
+	}
+	logger.FromContext(ctx).Info("match status changed",
+		"matc_id", e.Match.MatcID, "from", e.Change.From.String, "to", e.Change.To, "fee", e.Change.Fee)
+	for _, l := range ls {
+		l(ctx, e)
+	}
+}
+
+// newChange builds the history entry of m moving to its current status
+func newChange(m *Match, from null.String, a MatchActor, reason string, fee int) (*MatchStatusChange, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating match history uuid")
+	}
+	c := &MatchStatusChange{MahiID: id, MatcID: m.MatcID, From: from, To: m.Status, Reason: reason, Fee: fee}
+	if a.UserID != uuid.Nil {
+		userID := a.UserID
+		c.UserID = &userID
+	}
+	return c, nil
+}
+
+// MatchProposal is a patient holding a slot of a doctor in a specialization
+type MatchProposal struct {
+	PatiID   uuid.UUID
+	DoctID   uuid.UUID
+	SpecID   uuid.UUID
+	AddrID   int
+	StartsAt time.Time
+}
+
+// MatchProposer proposes matches
+type MatchProposer struct {
+	Store     Store
+	Listeners []MatchListener
+}
+
+// Run books the slot of p and proposes a match for it at the price of the
+// cheapest service of the doctor in the specialization at the address of
+// the slot
+func (mp *MatchProposer) Run(ctx context.Context, p MatchProposal, a MatchActor) (m *Match, err error) {
+	ctx, span := tracing.Start(ctx, "user.MatchProposer.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if p.StartsAt.Before(time.Now()) {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"startsAt": "Can't book a slot in the past"},
+		}
+	}
+	loc, err := time.LoadLocation(DefaultTimezone)
+	if err != nil {
+		return nil, err
+	}
+	var c *MatchStatusChange
+	err = mp.Store.Tx(ctx, func(r Repos) error {
+		offers, err := r.Matchmaking.Offers(ctx, p.SpecID, []uuid.UUID{p.DoctID})
+		if err != nil {
+			return err
+		}
+		var o *DoctorOffer
+		for i := range offers {
+			if offers[i].AddrID == p.AddrID {
+				o = &offers[i]
+			}
+		}
+		if o == nil {
+			return &auth.ValidationError{
+				Messages: map[string]string{"specID": "The doctor offers no service in this specialization at this address"},
+			}
+		}
+		s := &SessionSchedule{DoctID: p.DoctID, AddrID: p.AddrID, PatiID: p.PatiID, StartsAt: p.StartsAt}
+		err = bookSlot(ctx, r, s)
+		if err != nil {
+			return err
+		}
+
+		local := s.StartsAt.In(loc)
+		m = &Match{
+			PatiID:      p.PatiID,
+			DoctID:      p.DoctID,
+			SpecID:      &p.SpecID,
+			ProcID:      o.ProcID,
+			ServID:      &o.ServID,
+			ServVersion: null.NewInt(int64(o.ServVersion), o.ServVersion > 0),
+			SescID:      &s.SescID,
+			AddrID:      null.IntFrom(int64(s.AddrID)),
+			Date:        time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC),
+			Time:        local.Format("15:04"),
+			Price:       o.PriceMin,
+			Type:        o.Type,
+			Status:      MatchProposed,
+		}
+		m.MatcID, err = uuid.NewV4()
+		if err != nil {
+			return errors.Wrap(err, "Error generating match uuid")
+		}
+		err = r.Matches.Save(ctx, m)
+		if err != nil {
+			return err
+		}
+		c, err = newChange(m, null.String{}, a, "", 0)
+		if err != nil {
+			return err
+		}
+		return r.Matches.AddChange(ctx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.History = []MatchStatusChange{*c}
+	emit(ctx, mp.Listeners, MatchEvent{Match: *m, Change: *c})
+	return m, nil
+}
+
+// MatchTransition asks to move a match to a status
+type MatchTransition struct {
+	MatcID uuid.UUID
+	To     MatchStatus
+	// Version is the version of the match the change was decided on
+	Version int
+	Reason  string
+}
+
+// MatchTransitioner moves matches through their lifecycle
+type MatchTransitioner struct {
+	Store     Store
+	Policy    CancelPolicy
+	Listeners []MatchListener
+}
+
+// Run moves a match to t.To when a may move it there now. A match changed
+// since t.Version is a ConflictError, the change must be decided again.
+func (mt *MatchTransitioner) Run(ctx context.Context, t MatchTransition, a MatchActor) (m *Match, err error) {
+	ctx, span := tracing.Start(ctx, "user.MatchTransitioner.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if t.Version <= 0 {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"version": "Version of the match is required"},
+		}
+	}
+	var c *MatchStatusChange
+	err = mt.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		m, err = r.Matches.FromID(ctx, t.MatcID)
+		if err != nil {
+			return err
+		}
+		role, err := a.role(m)
+		if err != nil {
+			return err
+		}
+		if m.Version != t.Version {
+			return &auth.ConflictError{Message: "Match was changed since, reload it"}
+		}
+		by, ok := matchTransitions[m.Status][t.To]
+		if !ok {
+			return &auth.ValidationError{
+				Messages: map[string]string{"status": fmt.Sprintf("A %s match can't be %s", m.Status, t.To)},
+			}
+		}
+		if by != role {
+			return &auth.ValidationError{
+				Messages: map[string]string{"status": fmt.Sprintf("Only the %s can set a match %s", by, t.To)},
+			}
+		}
+		startsAt, err := m.StartsAt()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if msg := tooSoonOrLate(t.To, startsAt, now); len(msg) > 0 {
+			return &auth.ValidationError{
+				Messages: map[string]string{"status": msg},
+			}
+		}
+
+		fee := mt.Policy.Fee(m, t.To, startsAt, now)
+		from := null.StringFrom(string(m.Status))
+		m.Status = t.To
+		if t.To.Canceled() {
+			m.CanceledAt = null.TimeFrom(now)
+			m.CancelFee = fee
+			if m.SescID != nil {
+				err = r.Schedules.CancelSession(ctx, *m.SescID)
+				if err != nil {
+					return err
+				}
+			}
+		} else if t.To == MatchNoShow {
+			m.CancelFee = fee
+		}
+		err = r.Matches.UpdateStatus(ctx, m, t.Version)
+		if err != nil {
+			return err
+		}
+		c, err = newChange(m, from, a, t.Reason, fee)
+		if err != nil {
+			return err
+		}
+		err = r.Matches.AddChange(ctx, c)
+		if err != nil {
+			return err
+		}
+		m.History, err = r.Matches.History(ctx, m.MatcID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	emit(ctx, mt.Listeners, MatchEvent{Match: *m, Change: *c})
+	return m, nil
+}
+
+// tooSoonOrLate explains why a match starting at startsAt can't move to
+// status to at now, empty when it can
+func tooSoonOrLate(to MatchStatus, startsAt, now time.Time) string {
+	switch to {
+	case MatchConfirmed, MatchCanceledByPatient, MatchCanceledByDoctor:
+		if !now.Before(startsAt) {
+			return "The session already started"
+		}
+	case MatchCheckedIn:
+		if now.Before(startsAt.Add(-checkInEarly)) {
+			return "Too early to check in"
+		}
+	case MatchNoShow:
+		if now.Before(startsAt.Add(noShowGrace)) {
+			return "Too early for a no-show"
+		}
+	}
+	return ""
+}
+
+// MatchExpirer expires the proposals patients didn't confirm in time, so
+// their slots are free again
+type MatchExpirer struct {
+	Store Store
+	// TTL is how long a proposal holds its slot
+	TTL       time.Duration
+	BatchSize int
+	Listeners []MatchListener
+	Log       *logger.Logger
+}
+
+// Run expires a batch of proposals older than TTL, returning how many it
+// expired. A proposal changed meanwhile is left alone.
+func (me *MatchExpirer) Run(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "user.MatchExpirer.Run")
+	defer func() { tracing.End(span, err) }()
+
+	size := me.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	var ms []Match
+	err = me.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		ms, err = r.Matches.Expirable(ctx, time.Now().Add(-me.TTL), size)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range ms {
+		m := &ms[i]
+		var c *MatchStatusChange
+		err = me.Store.Tx(ctx, func(r Repos) error {
+			version := m.Version
+			m.Status = MatchExpired
+			if m.SescID != nil {
+				err := r.Schedules.CancelSession(ctx, *m.SescID)
+				if err != nil {
+					return err
+				}
+			}
+			err := r.Matches.UpdateStatus(ctx, m, version)
+			if err != nil {
+				return err
+			}
+			c, err = newChange(m, null.StringFrom(string(MatchProposed)), MatchActor{}, "Not confirmed in time", 0)
+			if err != nil {
+				return err
+			}
+			return r.Matches.AddChange(ctx, c)
+		})
+		if _, ok := err.(*auth.ConflictError); ok {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		emit(ctx, me.Listeners, MatchEvent{Match: *m, Change: *c})
+	}
+	return n, nil
+}
+
+// Every expires proposals every interval until ctx is done
+func (me *MatchExpirer) Every(ctx context.Context, interval time.Duration) {
+	l := me.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := me.Run(ctx)
+		if err != nil {
+			l.Error("match expiry failed", "error", err)
+		} else if n > 0 {
+			l.Info("matches expired", "matches", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// MatchGetter gets matches
+type MatchGetter struct {
+	Store Store
+}
+
+// Run returns a match of a with its history
+func (g *MatchGetter) Run(ctx context.Context, matcID uuid.UUID, a MatchActor) (m *Match, err error) {
+	ctx, span := tracing.Start(ctx, "user.MatchGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		m, err = r.Matches.FromID(ctx, matcID)
+		if err != nil {
+			return err
+		}
+		_, err = a.role(m)
+		if err != nil {
+			return err
+		}
+		m.History, err = r.Matches.History(ctx, matcID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// proposedMatch proposes a match for tomorrow at 08:00, returning it with
+// its patient and doctor as actors
+func proposedMatch(t *testing.T, s *MemStore, ls ...MatchListener) (*Match, MatchActor, MatchActor) {
+	t.Helper()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	a, err := (&AddressCreator{Store: s, Geocoder: testCEPs}).Run(ctx, &Address{
+		DoctID: d.DoctID, CEP: "01310100", Street: "Av. Paulista", Number: "1000", City: "São Paulo", UF: "SP",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{Name: "Maria", CPF: "12345678909", Email: "maria@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+	_, err = (&AvailabilityCreator{Store: s}).Run(ctx, &Availability{
+		DoctID: d.DoctID, AddrID: a.AddrID, Weekday: tomorrow.Weekday(), Starts: "08:00", Ends: "09:00",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	spec, _ := uuid.NewV4()
+	serv, _ := uuid.NewV4()
+	s.data.offers[spec] = map[int]DoctorOffer{
+		a.AddrID: {DoctID: d.DoctID, ServID: serv, AddrID: a.AddrID, PriceMin: 20000, ServVersion: 1, Type: "in-person"},
+	}
+	s.data.doctorSpecs[d.DoctID] = map[uuid.UUID]Specialization{spec: {DoctID: d.DoctID, SpecID: spec, Status: SpecApproved}}
+
+	patient := MatchActor{UserID: p.UserID, PatiID: p.PatiID}
+	doctor := MatchActor{UserID: d.UserID, DoctID: d.DoctID}
+	m, err := (&MatchProposer{Store: s, Listeners: ls}).Run(ctx, MatchProposal{
+		PatiID:   p.PatiID,
+		DoctID:   d.DoctID,
+		SpecID:   spec,
+		AddrID:   a.AddrID,
+		StartsAt: time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 8, 0, 0, 0, sp),
+	}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	return m, patient, doctor
+}
+
+func TestMatchLifecycle(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	events := []MatchEvent{}
+	listen := func(ctx context.Context, e MatchEvent) { events = append(events, e) }
+	m, patient, doctor := proposedMatch(t, s, listen)
+	if m.Status != MatchProposed || m.Version != 1 || m.Price != 20000 || m.ServVersion.Int64 != 1 || m.Time != "08:00" || m.SescID == nil {
+		t.Fatalf("Expected a proposed match for the cheapest service, got %+v", m)
+	}
+
+	mt := &MatchTransitioner{Store: s, Listeners: []MatchListener{listen}}
+	_, err := mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: 1}, doctor)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected the doctor confirming to be a ValidationError, got %v", err)
+	}
+	other, _ := uuid.NewV4()
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: 1}, MatchActor{PatiID: other})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected another patient to be a NotFoundError, got %v", err)
+	}
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCompleted, Version: 1}, doctor)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected skipping statuses to be a ValidationError, got %v", err)
+	}
+
+	m, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: 1}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if m.Status != MatchConfirmed || m.Version != 2 || len(m.History) != 2 || m.History[1].From.String != string(MatchProposed) {
+		t.Errorf("Expected a confirmed match with its history, got %+v", m)
+	}
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByDoctor, Version: 1}, doctor)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a stale version to be a ConflictError, got %v", err)
+	}
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchNoShow, Version: 2}, doctor)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a no-show before the session to be a ValidationError, got %v", err)
+	}
+
+	m, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByDoctor, Version: 2, Reason: "Sick"}, doctor)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if !m.CanceledAt.Valid || m.CancelFee != 0 || m.History[2].Reason != "Sick" {
+		t.Errorf("Expected a free cancellation by the doctor, got %+v", m)
+	}
+	if ss := s.data.schedules.sessions[*m.SescID]; !ss.CanceledAt.Valid {
+		t.Errorf("Expected the cancellation to free the slot, got %+v", ss)
+	}
+	if len(events) != 3 || events[2].Change.To != MatchCanceledByDoctor {
+		t.Errorf("Expected an event for each change, got %+v", events)
+	}
+
+	got, err := (&MatchGetter{Store: s}).Run(ctx, m.MatcID, patient)
+	if err != nil || len(got.History) != 3 {
+		t.Errorf("Expected the match with its history, got %+v %v", got, err)
+	}
+}
+
+func TestMatchLateCancelFee(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	m, patient, _ := proposedMatch(t, s)
+
+	mt := &MatchTransitioner{Store: s, Policy: CancelPolicy{FreeWindow: 72 * time.Hour, FeePercent: 50}}
+	m, err := mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	m, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByPatient, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if m.CancelFee != 10000 || m.History[2].Fee != 10000 {
+		t.Errorf("Expected half the price charged within the window, got %+v", m)
+	}
+}
+
+func TestMatchProposerPricesTheAddress(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	m, patient, _ := proposedMatch(t, s)
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+	b, err := (&AddressCreator{Store: s, Geocoder: testCEPs}).Run(ctx, &Address{DoctID: m.DoctID, CEP: "01001000"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&AvailabilityCreator{Store: s}).Run(ctx, &Availability{
+		DoctID: m.DoctID, AddrID: b.AddrID, Weekday: tomorrow.Weekday(), Starts: "10:00", Ends: "11:00",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	mp := &MatchProposer{Store: s}
+	at := func(hour, min int) time.Time {
+		return time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), hour, min, 0, 0, sp)
+	}
+	_, err = mp.Run(ctx, MatchProposal{PatiID: patient.PatiID, DoctID: m.DoctID, SpecID: *m.SpecID, AddrID: b.AddrID, StartsAt: at(10, 0)}, patient)
+	if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["specID"]) == 0 {
+		t.Errorf("Expected an address without a service refused, got %v", err)
+	}
+
+	serv, _ := uuid.NewV4()
+	proc, _ := uuid.NewV4()
+	s.data.offers[*m.SpecID][b.AddrID] = DoctorOffer{DoctID: m.DoctID, ServID: serv, AddrID: b.AddrID, PriceMin: 5000, ServVersion: 1, Type: "in-person", ProcID: &proc}
+	got, err := mp.Run(ctx, MatchProposal{PatiID: patient.PatiID, DoctID: m.DoctID, SpecID: *m.SpecID, AddrID: int(m.AddrID.Int64), StartsAt: at(8, 30)}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if got.Price != 20000 || *got.ServID != *m.ServID {
+		t.Errorf("Expected the service of the booked address, got %+v", got)
+	}
+	got, err = mp.Run(ctx, MatchProposal{PatiID: patient.PatiID, DoctID: m.DoctID, SpecID: *m.SpecID, AddrID: b.AddrID, StartsAt: at(10, 0)}, patient)
+	if err != nil || got.Price != 5000 || *got.ServID != serv || got.ProcID == nil || *got.ProcID != proc {
+		t.Errorf("Expected the service and procedure of the other address, got %+v %v", got, err)
+	}
+}
+
+func TestMatchProposerRefusesThePast(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	m, patient, _ := proposedMatch(t, s)
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	// the availability is on the weekday of tomorrow, a week ago too
+	lastWeek := time.Now().In(sp).AddDate(0, 0, -6)
+
+	_, err := (&MatchProposer{Store: s}).Run(ctx, MatchProposal{
+		PatiID:   patient.PatiID,
+		DoctID:   m.DoctID,
+		SpecID:   *m.SpecID,
+		AddrID:   int(m.AddrID.Int64),
+		StartsAt: time.Date(lastWeek.Year(), lastWeek.Month(), lastWeek.Day(), 8, 30, 0, 0, sp),
+	}, patient)
+	if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["startsAt"]) == 0 {
+		t.Errorf("Expected a slot in the past to be a ValidationError, got %v", err)
+	}
+}
+
+func TestMatchProposerNeedsTheSpecialization(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	m, patient, _ := proposedMatch(t, s)
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+
+	_, err := (&DoctorSpecRemover{Store: s}).Run(ctx, m.DoctID, *m.SpecID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&MatchProposer{Store: s}).Run(ctx, MatchProposal{
+		PatiID:   patient.PatiID,
+		DoctID:   m.DoctID,
+		SpecID:   *m.SpecID,
+		AddrID:   int(m.AddrID.Int64),
+		StartsAt: time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 8, 30, 0, 0, sp),
+	}, patient)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a removed specialization to be a ValidationError, got %v", err)
+	}
+}
+
+func TestMatchExpirer(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	events := []MatchEvent{}
+	m, patient, _ := proposedMatch(t, s)
+
+	me := &MatchExpirer{Store: s, TTL: time.Hour, Listeners: []MatchListener{func(ctx context.Context, e MatchEvent) { events = append(events, e) }}}
+	n, err := me.Run(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("Expected a fresh proposal left alone, got %d %v", n, err)
+	}
+	me.TTL = 0
+	n, err = me.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected the proposal expired, got %d %v", n, err)
+	}
+	got, _ := (&MatchGetter{Store: s}).Run(ctx, m.MatcID, patient)
+	if got.Status != MatchExpired || got.Version != 2 || len(got.History) != 2 || got.History[1].UserID != nil {
+		t.Errorf("Expected the match expired by the system, got %+v", got)
+	}
+	if ss := s.data.schedules.sessions[*m.SescID]; !ss.CanceledAt.Valid {
+		t.Errorf("Expected the expiry to free the slot, got %+v", ss)
+	}
+	if len(events) != 1 || events[0].Change.To != MatchExpired {
+		t.Errorf("Expected an event for the expiry, got %+v", events)
+	}
+	_, err = (&MatchTransitioner{Store: s}).Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: got.Version}, patient)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected confirming an expired match to be a ValidationError, got %v", err)
+	}
+	if n, _ = me.Run(ctx); n != 0 {
+		t.Errorf("Expected nothing left to expire, got %d", n)
+	}
+}
+
+func TestCancelPolicyFee(t *testing.T) {
+	p := CancelPolicy{FreeWindow: 24 * time.Hour, FeePercent: 30}
+	now := time.Now()
+	for _, c := range []struct {
+		from, to MatchStatus
+		startsIn time.Duration
+		fee      int
+	}{
+		{MatchConfirmed, MatchCanceledByPatient, 48 * time.Hour, 0},
+		{MatchConfirmed, MatchCanceledByPatient, 2 * time.Hour, 3000},
+		{MatchProposed, MatchCanceledByPatient, 2 * time.Hour, 0},
+		{MatchConfirmed, MatchCanceledByDoctor, 2 * time.Hour, 0},
+		{MatchConfirmed, MatchNoShow, -time.Hour, 10000},
+	} {
+		m := &Match{Status: c.from, Price: 10000}
+		if fee := p.Fee(m, c.to, now.Add(c.startsIn), now); fee != c.fee {
+			t.Errorf("Expected a fee of %d from %s to %s, got %d", c.fee, c.from, c.to, fee)
+		}
+	}
+}
+
+func TestPgUpdateStatusStaleVersion(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery(`UPDATE match SET (.*) WHERE (.*)version = (.*) RETURNING version, updated_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "updated_at"}))
+
+	r := &pgMatches{q: sqlx.NewDb(mockDB, "sqlmock")}
+	err = r.UpdateStatus(context.Background(), &Match{Status: MatchConfirmed}, 1)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a stale version to be a ConflictError, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
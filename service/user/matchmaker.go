@@ -0,0 +1,302 @@
+package user
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MatchRequest is what a patient looks for: a doctor of a specialization
+// near Point with a free slot on Date between Starts and Ends, HH:MM in
+// DefaultTimezone, charging up to Price cents
+type MatchRequest struct {
+	SpecID   uuid.UUID
+	Point    geo.Point
+	RadiusKm float64
+	Date     time.Time
+	Starts   string
+	Ends     string
+	// Price is the most the patient pays, any when 0
+	Price int
+	Limit int
+}
+
+// MatchWeights weight the factors of a candidate score, they are relative
+// to each other
+type MatchWeights struct {
+	Distance     float64
+	Price        float64
+	Rating       float64
+	ResponseRate float64
+}
+
+// DefaultMatchWeights favor near doctors, then cheaper ones
+var DefaultMatchWeights = MatchWeights{Distance: 0.4, Price: 0.3, Rating: 0.2, ResponseRate: 0.1}
+
+// DoctorOffer is the cheapest service of a doctor in a specialization at
+// one of its addresses
+type DoctorOffer struct {
+	DoctID   uuid.UUID `db:"doct_id" json:"doctID"`
+	ServID   uuid.UUID `db:"serv_id" json:"servID"`
+	AddrID   int       `db:"addr_id" json:"addrID"`
+	PriceMin int       `db:"price_min" json:"priceMin"`
+	// ServVersion is the version of the service PriceMin is of
+	ServVersion int `db:"serv_version" json:"servVersion"`
+	// Type is the type of the service, e.g. in-person
+	Type string `db:"type" json:"type"`
+	// ProcID is the procedure the service is, if any
+	ProcID *uuid.UUID `db:"proc_id" json:"procID" swaggertype:"string"`
+}
+
+// DoctorStats are the track record of a doctor, null while unknown
+type DoctorStats struct {
+	DoctID uuid.UUID `db:"doct_id"`
+	// Rating is the average score of the doctor, 1 to 5
+	Rating null.Float `db:"rating"`
+	// ResponseRate is the share of matches the doctor went on with
+	ResponseRate null.Float `db:"response_rate"`
+}
+
+// ScoreTerm explains how a factor adds to the score of a candidate
+type ScoreTerm struct {
+	// Factor is one of distance, price, rating or responseRate
+	Factor string `json:"factor" example:"distance"`
+	// Value is the measure, e.g. the distance in km, null when unknown
+	Value null.Float `json:"value" swaggertype:"number"`
+	// Score is how good Value is among the candidates, from 0 to 1
+	Score  float64 `json:"score"`
+	Weight float64 `json:"weight"`
+}
+
+// MatchCandidate is a doctor that fits a MatchRequest
+type MatchCandidate struct {
+	DoctID      uuid.UUID   `json:"doctID"`
+	Name        string      `json:"name"`
+	CRM         string      `json:"crm"`
+	Address     Address     `json:"address"`
+	DistanceKm  float64     `json:"distanceKm"`
+	Offer       DoctorOffer `json:"offer"`
+	Slots       []Slot      `json:"slots"`
+	Score       float64     `json:"score"`
+	Explanation []ScoreTerm `json:"explanation"`
+}
+
+// nearestOffer makes d a candidate at its nearest address within the
+// radius of req that has an offer within the price and free slots. The
+// offer and the slots are those of that address only.
+func nearestOffer(d DoctorDistance, as Addresses, offers map[int]DoctorOffer, slots []Slot, req MatchRequest) (MatchCandidate, bool) {
+	var best *MatchCandidate
+	for _, a := range as {
+		o, ok := offers[a.AddrID]
+		p, placed := a.Point()
+		if !ok || !placed || req.Price > 0 && o.PriceMin > req.Price {
+			continue
+		}
+		km := geo.Haversine(req.Point, p)
+		if a.AddrID == d.Address.AddrID {
+			km = d.DistanceKm
+		}
+		if km > req.RadiusKm || best != nil && best.DistanceKm <= km {
+			continue
+		}
+		at := []Slot{}
+		for _, s := range slots {
+			if s.AddrID == a.AddrID {
+				at = append(at, s)
+			}
+		}
+		if len(at) == 0 {
+			continue
+		}
+		best = &MatchCandidate{DoctID: d.DoctID, Name: d.Name, CRM: d.CRM, Address: a, DistanceKm: km, Offer: o, Slots: at}
+	}
+	if best == nil {
+		return MatchCandidate{}, false
+	}
+	return *best, true
+}
+
+// unknownScore is the score of a factor without data, e.g. the rating of a
+// new doctor, so it neither helps nor hurts much
+const unknownScore = 0.5
+
+// rank scores cs with w, best first
+func rank(cs []MatchCandidate, stats map[uuid.UUID]DoctorStats, radiusKm float64, w MatchWeights) []MatchCandidate {
+	cheapest := math.MaxInt64
+	for _, c := range cs {
+		if c.Offer.PriceMin < cheapest {
+			cheapest = c.Offer.PriceMin
+		}
+	}
+	total := w.Distance + w.Price + w.Rating + w.ResponseRate
+	if total <= 0 {
+		w, total = DefaultMatchWeights, 1
+	}
+
+	for i := range cs {
+		c := &cs[i]
+		st := stats[c.DoctID]
+
+		price := 1.0
+		if c.Offer.PriceMin > 0 {
+			price = float64(cheapest) / float64(c.Offer.PriceMin)
+		}
+		rating := unknownScore
+		if st.Rating.Valid {
+			rating = (st.Rating.Float64 - 1) / 4
+		}
+		response := unknownScore
+		if st.ResponseRate.Valid {
+			response = st.ResponseRate.Float64
+		}
+		c.Explanation = []ScoreTerm{
+			{Factor: "distance", Value: null.FloatFrom(c.DistanceKm), Score: clamp01(1 - c.DistanceKm/radiusKm), Weight: w.Distance / total},
+			{Factor: "price", Value: null.FloatFrom(float64(c.Offer.PriceMin)), Score: clamp01(price), Weight: w.Price / total},
+			{Factor: "rating", Value: st.Rating, Score: clamp01(rating), Weight: w.Rating / total},
+			{Factor: "responseRate", Value: st.ResponseRate, Score: clamp01(response), Weight: w.ResponseRate / total},
+		}
+		c.Score = 0
+		for _, t := range c.Explanation {
+			c.Score += t.Score * t.Weight
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].Score == cs[j].Score {
+			return cs[i].DistanceKm < cs[j].DistanceKm
+		}
+		return cs[i].Score > cs[j].Score
+	})
+	return cs
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// Matchmaker ranks the doctors fitting a patient request
+type Matchmaker struct {
+	Store   Store
+	Weights MatchWeights
+}
+
+// window is when req wants to be seen
+func (req MatchRequest) window() (time.Time, time.Time, error) {
+	starts, err1 := clockMinutes(req.Starts)
+	ends, err2 := clockMinutes(req.Ends)
+	if err1 != nil || err2 != nil || starts >= ends {
+		return time.Time{}, time.Time{}, &auth.ValidationError{
+			Messages: map[string]string{"schedule": "Schedule must be HH:MM-HH:MM"},
+		}
+	}
+	loc, err := time.LoadLocation(DefaultTimezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	y, m, d := req.Date.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return day.Add(time.Duration(starts) * time.Minute), day.Add(time.Duration(ends) * time.Minute), nil
+}
+
+// Run returns up to req.Limit doctors of req.SpecID within req.RadiusKm
+// of req.Point with a free slot in the requested window and a service
+// within req.Price, best scored first
+func (mm *Matchmaker) Run(ctx context.Context, req MatchRequest) (cs []MatchCandidate, err error) {
+	ctx, span := tracing.Start(ctx, "user.Matchmaker.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if !req.Point.Valid() {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"location": "Invalid coordinates"},
+		}
+	}
+	if req.RadiusKm == 0 {
+		req.RadiusKm = 10
+	}
+	if req.RadiusKm < 0 || req.RadiusKm > maxRadiusKm {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"distance": "Distance must be between 0 and 200km"},
+		}
+	}
+	if req.Price < 0 {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"price": "Price can't be negative"},
+		}
+	}
+	if req.Limit <= 0 || req.Limit > 50 {
+		req.Limit = 10
+	}
+	from, to, err := req.window()
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); !to.After(now) {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"date": "Date must not be in the past"},
+		}
+	} else if from.Before(now) {
+		from = now
+	}
+
+	stats := map[uuid.UUID]DoctorStats{}
+	err = mm.Store.Tx(ctx, func(r Repos) error {
+		near, err := r.Doctors.Near(ctx, NearQuery{Point: req.Point, RadiusKm: req.RadiusKm, SpecID: &req.SpecID, Limit: 100})
+		if err != nil {
+			return err
+		}
+		ids := make([]uuid.UUID, 0, len(near))
+		for _, d := range near {
+			ids = append(ids, d.DoctID)
+		}
+		offers, err := r.Matchmaking.Offers(ctx, req.SpecID, ids)
+		if err != nil {
+			return err
+		}
+		byAddress := map[int]DoctorOffer{}
+		for _, o := range offers {
+			byAddress[o.AddrID] = o
+		}
+		sts, err := r.Matchmaking.Stats(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, st := range sts {
+			stats[st.DoctID] = st
+		}
+
+		cs = []MatchCandidate{}
+		for _, d := range near {
+			as, err := r.Addresses.List(ctx, d.DoctID)
+			if err != nil {
+				return err
+			}
+			slots, err := freeSlots(ctx, r, d.DoctID, from, to)
+			if err != nil {
+				return err
+			}
+			if c, ok := nearestOffer(d, *as, byAddress, slots, req); ok {
+				cs = append(cs, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := mm.Weights
+	if w == (MatchWeights{}) {
+		w = DefaultMatchWeights
+	}
+	cs = rank(cs, stats, req.RadiusKm, w)
+	if len(cs) > req.Limit {
+		cs = cs[:req.Limit]
+	}
+	return cs, nil
+}
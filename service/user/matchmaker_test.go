@@ -0,0 +1,179 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestRank(t *testing.T) {
+	near, _ := uuid.NewV4()
+	cheap, _ := uuid.NewV4()
+	rated, _ := uuid.NewV4()
+	cs := []MatchCandidate{
+		{DoctID: near, DistanceKm: 0.5, Offer: DoctorOffer{PriceMin: 20000}},
+		{DoctID: cheap, DistanceKm: 5, Offer: DoctorOffer{PriceMin: 10000}},
+		{DoctID: rated, DistanceKm: 5, Offer: DoctorOffer{PriceMin: 20000}},
+	}
+	stats := map[uuid.UUID]DoctorStats{
+		rated: {DoctID: rated, Rating: null.FloatFrom(5), ResponseRate: null.FloatFrom(1)},
+	}
+
+	ranked := rank(append([]MatchCandidate{}, cs...), stats, 10, MatchWeights{Distance: 1})
+	if ranked[0].DoctID != near {
+		t.Errorf("Expected the nearest first when only distance weights, got %+v", ranked[0])
+	}
+	ranked = rank(append([]MatchCandidate{}, cs...), stats, 10, MatchWeights{Price: 1})
+	if ranked[0].DoctID != cheap || ranked[0].Score != 1 {
+		t.Errorf("Expected the cheapest first when only price weights, got %+v", ranked[0])
+	}
+	ranked = rank(append([]MatchCandidate{}, cs...), stats, 10, MatchWeights{Rating: 1, ResponseRate: 1})
+	if ranked[0].DoctID != rated {
+		t.Errorf("Expected the best rated first, got %+v", ranked[0])
+	}
+
+	ranked = rank(append([]MatchCandidate{}, cs...), stats, 10, DefaultMatchWeights)
+	for _, c := range ranked {
+		if len(c.Explanation) != 4 {
+			t.Fatalf("Expected every factor explained, got %+v", c.Explanation)
+		}
+		sum, weights := 0.0, 0.0
+		for _, term := range c.Explanation {
+			sum += term.Score * term.Weight
+			weights += term.Weight
+		}
+		if sum != c.Score || weights < 0.999 || weights > 1.001 {
+			t.Errorf("Expected the explanation to add up to the score, got %+v", c)
+		}
+	}
+	for _, c := range ranked {
+		term := c.Explanation[2]
+		if c.DoctID != rated && (term.Value.Valid || term.Score != unknownScore) {
+			t.Errorf("Expected an unknown rating to score neutral, got %+v", term)
+		}
+	}
+}
+
+func TestMatchmakerFilters(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	dc := &DoctorCreator{Store: s}
+	ac := &AddressCreator{Store: s, Geocoder: testCEPs}
+	avc := &AvailabilityCreator{Store: s}
+	spec, _ := uuid.NewV4()
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+
+	doctor := func(crm, email, cep, starts, ends, status string, price int) uuid.UUID {
+		d, err := dc.Run(ctx, &Doctor{Name: "Dr. " + email, CRM: crm, Email: email}, "123123")
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		a, err := ac.Run(ctx, &Address{DoctID: d.DoctID, CEP: cep})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		_, err = avc.Run(ctx, &Availability{DoctID: d.DoctID, AddrID: a.AddrID, Weekday: tomorrow.Weekday(), Starts: starts, Ends: ends})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		if price > 0 {
+			if s.data.offers[spec] == nil {
+				s.data.offers[spec] = map[int]DoctorOffer{}
+			}
+			s.data.offers[spec][a.AddrID] = DoctorOffer{DoctID: d.DoctID, AddrID: a.AddrID, PriceMin: price}
+			s.data.doctorSpecs[d.DoctID] = map[uuid.UUID]Specialization{spec: {DoctID: d.DoctID, SpecID: spec, Status: status}}
+		}
+		return d.DoctID
+	}
+	fits := doctor("111111/SP", "fits@mail.com", "01310100", "09:00", "10:00", SpecApproved, 15000)
+	doctor("222222/SP", "expensive@mail.com", "01310100", "09:00", "10:00", SpecApproved, 50000)
+	doctor("333333/SP", "afternoon@mail.com", "01001000", "14:00", "15:00", SpecApproved, 15000)
+	doctor("444444/SP", "nospec@mail.com", "01001000", "09:00", "10:00", "", 0)
+	doctor("555555/RJ", "far@mail.com", "20040020", "09:00", "10:00", SpecApproved, 15000)
+	doctor("666666/SP", "pending@mail.com", "01310100", "09:00", "10:00", SpecPending, 15000)
+
+	mm := &Matchmaker{Store: s}
+	cs, err := mm.Run(ctx, MatchRequest{
+		SpecID: spec,
+		Point:  geo.Point{Lat: -23.5629, Lng: -46.6544},
+		Date:   tomorrow,
+		Starts: "08:00",
+		Ends:   "12:00",
+		Price:  20000,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(cs) != 1 || cs[0].DoctID != fits || len(cs[0].Slots) != 2 {
+		t.Fatalf("Expected only the fitting doctor, got %+v", cs)
+	}
+
+	_, err = mm.Run(ctx, MatchRequest{SpecID: spec, Point: geo.Point{Lat: -23.5, Lng: -46.6}, Date: tomorrow.AddDate(0, 0, -2), Starts: "08:00", Ends: "12:00"})
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a past date to be a ValidationError, got %v", err)
+	}
+}
+
+func TestMatchmakerTwoAddresses(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	spec, _ := uuid.NewV4()
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	s.data.doctorSpecs[d.DoctID] = map[uuid.UUID]Specialization{spec: {DoctID: d.DoctID, SpecID: spec, Status: SpecApproved}}
+	s.data.offers[spec] = map[int]DoctorOffer{}
+
+	// the cheaper service is in Rio, out of the radius, and Sé offers none
+	address := func(cep, starts, ends string, price int) int {
+		a, err := (&AddressCreator{Store: s, Geocoder: testCEPs}).Run(ctx, &Address{DoctID: d.DoctID, CEP: cep})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		_, err = (&AvailabilityCreator{Store: s}).Run(ctx, &Availability{DoctID: d.DoctID, AddrID: a.AddrID, Weekday: tomorrow.Weekday(), Starts: starts, Ends: ends})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		if price > 0 {
+			s.data.offers[spec][a.AddrID] = DoctorOffer{DoctID: d.DoctID, AddrID: a.AddrID, PriceMin: price}
+		}
+		return a.AddrID
+	}
+	address("20040020", "07:00", "08:00", 10000)
+	address("01001000", "10:00", "11:00", 0)
+	paulista := address("01310100", "09:00", "10:00", 30000)
+
+	cs, err := (&Matchmaker{Store: s}).Run(ctx, MatchRequest{
+		SpecID: spec,
+		Point:  geo.Point{Lat: -23.5505, Lng: -46.6333},
+		Date:   tomorrow,
+		Starts: "07:00",
+		Ends:   "12:00",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(cs) != 1 || cs[0].Address.AddrID != paulista || cs[0].Offer.AddrID != paulista || cs[0].Offer.PriceMin != 30000 {
+		t.Fatalf("Expected the doctor at the near address offering the service, got %+v", cs)
+	}
+	if cs[0].DistanceKm < 2 || cs[0].DistanceKm > 3 {
+		t.Errorf("Expected the distance to Paulista, got %f", cs[0].DistanceKm)
+	}
+	for _, slot := range cs[0].Slots {
+		if slot.AddrID != paulista {
+			t.Errorf("Expected only the slots at Paulista, got %+v", cs[0].Slots)
+		}
+	}
+	if len(cs[0].Slots) != 2 {
+		t.Errorf("Expected the 2 slots at Paulista, got %+v", cs[0].Slots)
+	}
+}
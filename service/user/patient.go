@@ -0,0 +1,279 @@
+package user
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Nhanderu/brdoc"
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/fignocius/echo-api/service/user/auth/perm"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// PatiAddress is the patient home address, stored as JSON
+type PatiAddress struct {
+	CEP        string `json:"cep"`
+	Street     string `json:"street"`
+	Number     string `json:"number"`
+	Complement string `json:"complement"`
+	District   string `json:"district"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+}
+
+// Patient is a representation of the table patient, joined with the
+// email, info and role of its user. CPF and RG are encrypted at rest and
+// CPFIndex is the blind index that keeps CPFs unique.
+type Patient struct {
+	PatiID    uuid.UUID         `db:"pati_id" json:"patiID"`
+	UserID    uuid.UUID         `db:"user_id" json:"userID"`
+	Name      string            `db:"name" json:"name"`
+	CPF       fieldcrypt.String `db:"cpf" json:"cpf"`
+	CPFIndex  string            `db:"cpf_index" json:"-"`
+	RG        fieldcrypt.String `db:"rg" json:"rg"`
+	Address   PatiAddress       `db:"address" json:"address"`
+	Documents Documents         `db:"documents" json:"documents"`
+	Email     string            `db:"email" json:"email"`
+	Info      Info              `db:"info" json:"info"`
+	Role      Role              `db:"role" json:"role"`
+	CreatedAt time.Time         `db:"created_at" json:"createdAt"`
+	DeletedAt null.Time         `db:"deleted_at" json:"deletedAt"`
+}
+
+// Masked is a copy of p safe to show to anyone but the patient, e.g. a
+// doctor: CPF and RG are partially hidden, documents, address, email and
+// info left out
+func (p Patient) Masked() *Patient {
+	p.CPF = fieldcrypt.String(MaskCPF(string(p.CPF)))
+	p.RG = fieldcrypt.String(maskTail(string(p.RG), 2))
+	p.Documents = nil
+	p.Address = PatiAddress{}
+	p.Email = ""
+	p.Info = Info{}
+	return &p
+}
+
+// MaskCPF hides all but the middle six digits: ***.456.789-**
+func MaskCPF(cpf string) string {
+	d := digits(cpf)
+	if len(d) != 11 {
+		return maskTail(cpf, 0)
+	}
+	return "***." + d[3:6] + "." + d[6:9] + "-**"
+}
+
+// maskTail replaces all but the last n characters with *
+func maskTail(s string, n int) string {
+	r := []rune(s)
+	for i := 0; i < len(r)-n; i++ {
+		r[i] = '*'
+	}
+	return string(r)
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// NormalizeCPF validates a CPF, with or without punctuation, and returns
+// its 11 digits
+func NormalizeCPF(cpf string) (string, error) {
+	d := digits(cpf)
+	if !brdoc.IsCPF(d) {
+		return "", &auth.ValidationError{
+			Messages: map[string]string{"cpf": "Invalid CPF"},
+		}
+	}
+	return d, nil
+}
+
+// normalizeRG keeps the letters and digits of a RG, its format varies
+// between states
+func normalizeRG(rg string) (string, error) {
+	n := strings.ToUpper(strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, rg))
+	if len(n) > 14 {
+		return "", &auth.ValidationError{
+			Messages: map[string]string{"rg": "Invalid RG"},
+		}
+	}
+	return n, nil
+}
+
+// validatePatient normalizes the patient documents and sets the CPF index
+func validatePatient(p *Patient) error {
+	if len(strings.TrimSpace(p.Name)) == 0 {
+		return &auth.ValidationError{
+			Messages: map[string]string{"name": "Name is required"},
+		}
+	}
+	cpf, err := NormalizeCPF(string(p.CPF))
+	if err != nil {
+		return err
+	}
+	rg, err := normalizeRG(string(p.RG))
+	if err != nil {
+		return err
+	}
+	p.CPF, p.RG = fieldcrypt.String(cpf), fieldcrypt.String(rg)
+	p.CPFIndex, err = fieldcrypt.Index(cpf)
+	return err
+}
+
+// PatientCreator onboards a patient, creating its user too
+type PatientCreator struct {
+	Store Store
+}
+
+// Run creates the user with p.Email and password and the patient in a
+// single transaction
+func (c *PatientCreator) Run(ctx context.Context, p *Patient, password string) (pat *Patient, err error) {
+	ctx, span := tracing.Start(ctx, "user.PatientCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validatePatient(p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Documents == nil {
+		p.Documents = Documents{}
+	}
+
+	_, bspan := tracing.Start(ctx, "bcrypt.hash")
+	u, err := newUser(&User{Email: p.Email, Role: Role{perm.User, perm.Patient}, Info: p.Info}, password)
+	bspan.End()
+	if err != nil {
+		return nil, err
+	}
+	p.PatiID, err = uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating patient uuid")
+	}
+	p.UserID = u.UserID
+	p.Role = u.Role
+
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, u)
+		if err != nil {
+			return err
+		}
+		return r.Patients.Save(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.Onboardings.WithLabelValues(perm.Patient).Inc()
+	return p, nil
+}
+
+// PatientGeter gets a patient profile
+type PatientGeter struct {
+	Store Store
+}
+
+// Run returns the patient with patiID
+func (g *PatientGeter) Run(ctx context.Context, patiID uuid.UUID) (p *Patient, err error) {
+	ctx, span := tracing.Start(ctx, "user.PatientGeter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		p, err = r.Patients.FromID(ctx, patiID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PatientFinder finds a patient by CPF
+type PatientFinder struct {
+	Store Store
+}
+
+// Run returns the patient with cpf, with or without punctuation
+func (f *PatientFinder) Run(ctx context.Context, cpf string) (p *Patient, err error) {
+	ctx, span := tracing.Start(ctx, "user.PatientFinder.Run")
+	defer func() { tracing.End(span, err) }()
+
+	cpf, err = NormalizeCPF(cpf)
+	if err != nil {
+		return nil, err
+	}
+	index, err := fieldcrypt.Index(cpf)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Store.Tx(ctx, func(r Repos) error {
+		p, err = r.Patients.FromCPFIndex(ctx, index)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PatientUpdater updates a patient profile
+type PatientUpdater struct {
+	Store Store
+}
+
+// Run updates the name, documents, address and the user info of
+// p.PatiID, documents, address and info left out are kept
+func (u *PatientUpdater) Run(ctx context.Context, p *Patient) (pat *Patient, err error) {
+	ctx, span := tracing.Start(ctx, "user.PatientUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validatePatient(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		cur, err := r.Patients.FromID(ctx, p.PatiID)
+		if err != nil {
+			return err
+		}
+		cur.Name, cur.CPF, cur.CPFIndex, cur.RG = p.Name, p.CPF, p.CPFIndex, p.RG
+		if p.Documents != nil {
+			cur.Documents = p.Documents
+		}
+		if p.Address != (PatiAddress{}) {
+			cur.Address = p.Address
+		}
+		if p.Info != (Info{}) {
+			cur.Info = p.Info
+		}
+		err = r.Patients.Update(ctx, cur)
+		if err != nil {
+			return err
+		}
+		err = r.Users.UpdateInfo(ctx, cur.UserID, cur.Info)
+		if err != nil {
+			return err
+		}
+		pat = cur
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pat, nil
+}
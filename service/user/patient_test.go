@@ -0,0 +1,188 @@
+package user
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestNormalizeCPF(t *testing.T) {
+	for _, in := range []string{"123.456.789-09", "12345678909", " 123 456 789 09 "} {
+		got, err := NormalizeCPF(in)
+		if err != nil || got != "12345678909" {
+			t.Errorf("NormalizeCPF(%q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "123.456.789-00", "111.111.111-11", "1234567890"} {
+		_, err := NormalizeCPF(in)
+		if _, ok := err.(*auth.ValidationError); !ok {
+			t.Errorf("Expected NormalizeCPF(%q) to be a ValidationError, got %v", in, err)
+		}
+	}
+}
+
+func TestMasked(t *testing.T) {
+	p := Patient{
+		CPF:       "12345678909",
+		RG:        "123456789",
+		Documents: Documents{"rg": "s3://rg.pdf"},
+		Address:   PatiAddress{CEP: "01310-100", Street: "Av. Paulista", Number: "1000"},
+		Email:     "maria@mail.com",
+		Info:      Info{Birthdate: "1990-05-17", City: "São Paulo", State: "SP"},
+	}
+	m := p.Masked()
+	if m.CPF != "***.456.789-**" || m.RG != "*******89" || m.Documents != nil {
+		t.Errorf("Unexpected masked patient %+v", m)
+	}
+	if m.Address != (PatiAddress{}) || m.Email != "" || m.Info.Birthdate != "" {
+		t.Errorf("Expected a stranger to get no address, email or birthdate, got %+v", m)
+	}
+	if p.CPF != "12345678909" {
+		t.Errorf("Masked must not change the patient")
+	}
+}
+
+// notContaining matches an argument that doesn't reveal s
+type notContaining string
+
+func (n notContaining) Match(v driver.Value) bool {
+	b, ok := v.(string)
+	return ok && !strings.Contains(b, string(n))
+}
+
+func TestPatientCreatorEncryptsDocuments(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	index, _ := fieldcrypt.Index("12345678909")
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "user"`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "password", "role", "info", "created_at", "deleted_at"}).
+			AddRow("5d3b5a3e-7c1c-4d6f-9a70-1f0b1d2f6c11", "pat@mail.com", []byte("hash"), `["user","patient"]`, `{}`, time.Now(), nil))
+	mock.ExpectQuery(`INSERT INTO patient \(pati_id,user_id,name,cpf,cpf_index,rg,address,documents\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Maria", notContaining("456789"), index, notContaining("1234567"), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectCommit()
+
+	c := &PatientCreator{Store: &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}}
+	p, err := c.Run(context.Background(), &Patient{
+		Name:  "Maria",
+		CPF:   "123.456.789-09",
+		RG:    "12.345.678-9",
+		Email: "pat@mail.com",
+	}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.CPF != "12345678909" || p.RG != "123456789" {
+		t.Errorf("Expected normalized documents, got %q %q", p.CPF, p.RG)
+	}
+	// a legacy CPF is indexed as when it's created
+	legacy := fieldcrypt.String("123.456.789-09")
+	if vs, err := cpfIndex(&legacy); err != nil || vs[0] != index {
+		t.Errorf("Expected the legacy CPF indexed as the created one, got %v %v", vs, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestPatientCPFIsUnique(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	c := &PatientCreator{Store: s}
+	_, err := c.Run(ctx, &Patient{Name: "Maria", CPF: "12345678909", Email: "maria@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = c.Run(ctx, &Patient{Name: "Joana", CPF: "123.456.789-09", Email: "joana@mail.com"}, "123123")
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected a duplicate CPF to be a ValidationError, got %v", err)
+	}
+	err = s.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.FromEmail(ctx, "joana@mail.com")
+		return err
+	})
+	if _, ok := err.(*auth.UserNotFoundError); !ok {
+		t.Errorf("Expected the user of the refused patient to be rolled back, got %v", err)
+	}
+}
+
+func TestPatientFinder(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{Name: "Maria", CPF: "12345678909", Email: "maria@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	f := &PatientFinder{Store: s}
+	got, err := f.Run(ctx, "123.456.789-09")
+	if err != nil || got.PatiID != p.PatiID {
+		t.Errorf("Expected to find %s by CPF, got %v %v", p.PatiID, got, err)
+	}
+	_, err = f.Run(ctx, unknownCPF)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected an unknown CPF to be a NotFoundError, got %v", err)
+	}
+}
+
+func TestPatientUpdaterKeepsOmittedFields(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{
+		Name:    "Maria",
+		CPF:     "12345678909",
+		Email:   "maria@mail.com",
+		Address: PatiAddress{CEP: "01310100", City: "São Paulo"},
+		Info:    Info{Birthdate: "1990-01-31"},
+	}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	_, err = (&PatientUpdater{Store: s}).Run(ctx, &Patient{PatiID: p.PatiID, Name: "Maria Silva", CPF: "12345678909"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	got, err := (&PatientGeter{Store: s}).Run(ctx, p.PatiID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if got.Name != "Maria Silva" || got.Address.City != "São Paulo" || got.Info.Birthdate != "1990-01-31" {
+		t.Errorf("Expected the address and info kept, got %+v", got)
+	}
+}
+
+// unknownCPF is a valid CPF no test patient uses
+const unknownCPF = "52998224725"
+
+func TestInfoBirthdateIsEncrypted(t *testing.T) {
+	v, err := Info{Birthdate: "1990-01-31", City: "Curitiba"}.Value()
+	if err != nil {
+		t.Fatalf("Value failed: %s", err)
+	}
+	raw := string(v.([]byte))
+	if strings.Contains(raw, "1990-01-31") || !strings.Contains(raw, "Curitiba") {
+		t.Errorf("Expected only the birthdate encrypted, got %s", raw)
+	}
+	if infoStale(raw) || !infoStale(`{"birthdate":"1990-01-31"}`) || infoStale(`{"city":"Curitiba"}`) {
+		t.Errorf("Unexpected staleness of info")
+	}
+
+	i := Info{}
+	err = i.Scan(raw)
+	if err != nil || i.Birthdate != "1990-01-31" {
+		t.Errorf("Expected to decrypt the birthdate, got %+v %v", i, err)
+	}
+}
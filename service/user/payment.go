@@ -0,0 +1,457 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/metrics"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// PaymentStatus is where the payment of a match is at
+type PaymentStatus string
+
+// Payment statuses
+const (
+	// PaymentPending was sent for authorization without an answer yet, the
+	// reconciler asks again
+	PaymentPending    PaymentStatus = "pending"
+	PaymentAuthorized PaymentStatus = "authorized"
+	// PaymentCaptured has Captured charged, some of which may be refunded,
+	// and the rest of the authorization released
+	PaymentCaptured PaymentStatus = "captured"
+	PaymentVoided   PaymentStatus = "voided"
+	PaymentRefunded PaymentStatus = "refunded"
+	PaymentDeclined PaymentStatus = "declined"
+	// PaymentFailed couldn't be sent, e.g. the patient had no card
+	PaymentFailed PaymentStatus = "failed"
+	// PaymentChargeback was disputed by the patient with the issuer, the
+	// gateway notifies it
+	PaymentChargeback PaymentStatus = "chargeback"
+)
+
+// Payment operations, as recorded in the ledger
+const (
+	PaymentAuthorize = "authorize"
+	PaymentCapture   = "capture"
+	PaymentVoid      = "void"
+	// PaymentSync is a change the gateway notified, not a call
+	PaymentSync = "sync"
+)
+
+// Payment is a representation of the table payment, what a patient pays
+// for a match, in cents
+type Payment struct {
+	PaymID  uuid.UUID  `db:"paym_id" json:"paymID"`
+	MatcID  uuid.UUID  `db:"matc_id" json:"matcID"`
+	CrcaID  *uuid.UUID `db:"crca_id" json:"crcaID" swaggertype:"string"`
+	OrderID string     `db:"order_id" json:"orderID"`
+	// GatewayID is the id of the payment at the gateway once authorized
+	GatewayID null.String   `db:"gateway_id" json:"-"`
+	Status    PaymentStatus `db:"status" json:"status"`
+	Amount    int           `db:"amount" json:"amount"`
+	Captured  int           `db:"captured" json:"captured"`
+	// Voided was released before capture, never charged
+	Voided int `db:"voided" json:"voided"`
+	// Refunded went back to the patient after capture
+	Refunded  int            `db:"refunded" json:"refunded"`
+	CreatedAt time.Time      `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time      `db:"updated_at" json:"updatedAt"`
+	Ledger    []PaymentEntry `db:"-" json:"ledger,omitempty"`
+}
+
+// PaymentEntry is a representation of the table payment_ledger, a call
+// made to the gateway for a payment
+type PaymentEntry struct {
+	PaleID        uuid.UUID `db:"pale_id" json:"paleID"`
+	PaymID        uuid.UUID `db:"paym_id" json:"paymID"`
+	Operation     string    `db:"operation" json:"operation"`
+	Amount        int       `db:"amount" json:"amount"`
+	Succeeded     bool      `db:"succeeded" json:"succeeded"`
+	GatewayStatus null.Int  `db:"gateway_status" json:"gatewayStatus" swaggertype:"integer"`
+	ReturnCode    string    `db:"return_code" json:"returnCode"`
+	ReturnMessage string    `db:"return_message" json:"returnMessage"`
+	Error         string    `db:"error" json:"error"`
+	CreatedAt     time.Time `db:"created_at" json:"createdAt"`
+}
+
+// PaymentGateway charges tokenized cards. *cielo.Ecommerce is one.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, a cielo.Authorization) (*cielo.Payment, error)
+	Capture(ctx context.Context, paymentID string, amount int) (*cielo.Payment, error)
+	Cancel(ctx context.Context, paymentID string, amount int) (*cielo.Payment, error)
+}
+
+// Payments charges patients for their matches: the price is authorized on
+// the default card when the match is confirmed and captured once it is
+// completed. Canceling voids it, or captures only the fee when there is
+// one and the gateway releases the rest. Gateway calls happen outside of
+// units of work and each one is recorded in the ledger.
+type Payments struct {
+	Store   Store
+	Gateway PaymentGateway
+	// SoftDescriptor is shown in card statements
+	SoftDescriptor string
+}
+
+// OnMatch is a MatchListener, failures are left for the reconciler
+func (ps *Payments) OnMatch(ctx context.Context, e MatchEvent) {
+	var err error
+	switch {
+	case e.Change.To == MatchConfirmed:
+		_, err = ps.Authorize(ctx, e.Match.MatcID)
+	case e.Change.To == MatchCompleted, e.Change.To == MatchNoShow, e.Change.To.Canceled():
+		_, err = ps.Settle(ctx, e.Match.MatcID)
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("payment failed", "matc_id", e.Match.MatcID, "error", err)
+	}
+}
+
+// Authorize authorizes the price of matcID on the default card of its
+// patient. It's idempotent, a payment already authorized is returned as it
+// is and a pending one is asked again under the same order. Nothing is
+// held for a match that isn't confirmed or checked in anymore, its
+// payment is left pending. A declined card is a *cielo.DeclinedError.
+func (ps *Payments) Authorize(ctx context.Context, matcID uuid.UUID) (p *Payment, err error) {
+	ctx, span := tracing.Start(ctx, "user.Payments.Authorize")
+	defer func() { tracing.End(span, err) }()
+
+	var a cielo.Authorization
+	var failure string
+	held := true
+	err = ps.Store.Tx(ctx, func(r Repos) error {
+		m, err := r.Matches.FromID(ctx, matcID)
+		if err != nil {
+			return err
+		}
+		p, err = r.Payments.FromMatch(ctx, matcID)
+		if _, ok := err.(*auth.NotFoundError); ok {
+			p = &Payment{MatcID: matcID, OrderID: cielo.OrderID(matcID), Status: PaymentPending, Amount: m.Price}
+			cs, err := r.CreditCards.List(ctx, m.PatiID)
+			if err != nil {
+				return err
+			}
+			if len(cs) > 0 {
+				p.CrcaID = &cs[0].CrcaID
+			}
+			err = r.Payments.Save(ctx, p)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if p.Status != PaymentPending {
+			return nil
+		}
+		if m.Status != MatchConfirmed && m.Status != MatchCheckedIn {
+			held = false
+			return nil
+		}
+
+		if p.CrcaID == nil {
+			failure = "Patient has no credit card"
+			return nil
+		}
+		c, err := r.CreditCards.FromID(ctx, m.PatiID, *p.CrcaID)
+		if _, ok := err.(*auth.NotFoundError); ok {
+			failure = "Credit card was removed"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pa, err := r.Patients.FromID(ctx, m.PatiID)
+		if err != nil {
+			return err
+		}
+		a = cielo.Authorization{
+			OrderID:        p.OrderID,
+			CustomerName:   pa.Name,
+			Amount:         p.Amount,
+			CardToken:      string(c.Token),
+			Brand:          c.Brand,
+			SoftDescriptor: ps.SoftDescriptor,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(failure) > 0 {
+		p.Status = PaymentFailed
+		err = ps.record(ctx, p, PaymentEntry{Operation: PaymentAuthorize, Amount: p.Amount, Error: failure})
+		if err != nil {
+			return nil, err
+		}
+		return p, &auth.ValidationError{Messages: map[string]string{"payment": failure}}
+	}
+	if p.Status != PaymentPending || !held {
+		return p, nil
+	}
+
+	err = ps.call(ctx, p, PaymentAuthorize, p.Amount, func(ctx context.Context) (*cielo.Payment, error) {
+		return ps.Gateway.Authorize(ctx, a)
+	})
+	return p, err
+}
+
+// Settle takes what the patient owes for matcID once it ended: the price
+// when completed, the fee when canceled or a no-show. Only that is
+// captured, the rest of the authorization is released, or refunded when
+// already captured. Nothing owed voids the authorization. Matches
+// without a payment, or not ended yet, are left alone.
+func (ps *Payments) Settle(ctx context.Context, matcID uuid.UUID) (p *Payment, err error) {
+	ctx, span := tracing.Start(ctx, "user.Payments.Settle")
+	defer func() { tracing.End(span, err) }()
+
+	var m *Match
+	err = ps.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		m, err = r.Matches.FromID(ctx, matcID)
+		if err != nil {
+			return err
+		}
+		p, err = r.Payments.FromMatch(ctx, matcID)
+		return err
+	})
+	if _, ok := err.(*auth.NotFoundError); ok && m != nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	owed := 0
+	switch {
+	case m.Status == MatchCompleted:
+		owed = m.Price
+	case m.Status == MatchNoShow, m.Status.Canceled():
+		owed = m.CancelFee
+	default:
+		return p, nil
+	}
+	if owed > p.Amount {
+		owed = p.Amount
+	}
+
+	switch p.Status {
+	case PaymentAuthorized:
+		if owed == 0 {
+			left := p.Amount - p.Voided
+			err = ps.call(ctx, p, PaymentVoid, left, func(ctx context.Context) (*cielo.Payment, error) {
+				return ps.Gateway.Cancel(ctx, p.GatewayID.String, left)
+			})
+			return p, err
+		}
+		err = ps.call(ctx, p, PaymentCapture, owed, func(ctx context.Context) (*cielo.Payment, error) {
+			return ps.Gateway.Capture(ctx, p.GatewayID.String, owed)
+		})
+	case PaymentCaptured:
+		if held := p.Captured - p.Refunded; owed < held {
+			err = ps.call(ctx, p, PaymentVoid, held-owed, func(ctx context.Context) (*cielo.Payment, error) {
+				return ps.Gateway.Cancel(ctx, p.GatewayID.String, held-owed)
+			})
+		}
+	}
+	return p, err
+}
+
+// call runs op for amount at the gateway, applies its outcome to p and
+// records both
+func (ps *Payments) call(ctx context.Context, p *Payment, op string, amount int, f func(ctx context.Context) (*cielo.Payment, error)) error {
+	tctx, span := tracing.Start(ctx, "cielo."+op)
+	gp, err := f(tctx)
+	tracing.End(span, err)
+
+	e := PaymentEntry{Operation: op, Amount: amount, Succeeded: err == nil}
+	if gp != nil {
+		e.GatewayStatus = null.IntFrom(int64(gp.Status))
+		e.ReturnCode, e.ReturnMessage = gp.ReturnCode, gp.ReturnMessage
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	declined, _ := err.(*cielo.DeclinedError)
+	switch {
+	case err == nil:
+		applyOutcome(p, op, amount, gp)
+	case declined != nil && !declined.Temporary():
+		p.Status = PaymentDeclined
+	}
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	metrics.Payments.WithLabelValues(op, result).Inc()
+	logger.FromContext(ctx).Info("payment "+op, "matc_id", p.MatcID, "amount", amount, "result", result, "status", p.Status)
+
+	rerr := ps.record(ctx, p, e)
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// applyOutcome moves p after op succeeded for amount
+func applyOutcome(p *Payment, op string, amount int, gp *cielo.Payment) {
+	switch op {
+	case PaymentAuthorize:
+		p.GatewayID = null.StringFrom(gp.PaymentID)
+		p.Status = PaymentAuthorized
+		if gp.Status == cielo.PaymentConfirmed {
+			p.Status, p.Captured, p.Voided = PaymentCaptured, gp.CapturedAmount, p.Amount-gp.CapturedAmount
+		}
+	case PaymentCapture:
+		p.Status, p.Captured, p.Voided = PaymentCaptured, amount, p.Amount-amount
+	case PaymentVoid:
+		switch p.Status {
+		case PaymentAuthorized:
+			p.Voided += amount
+			if p.Voided >= p.Amount {
+				p.Status = PaymentVoided
+			}
+		case PaymentCaptured:
+			p.Refunded += amount
+			if p.Refunded >= p.Captured {
+				p.Status = PaymentRefunded
+			}
+		}
+	}
+}
+
+// record stores p and adds e to its ledger
+func (ps *Payments) record(ctx context.Context, p *Payment, e PaymentEntry) error {
+	e.PaymID = p.PaymID
+	err := ps.Store.Tx(ctx, func(r Repos) error {
+		err := r.Payments.Update(ctx, p)
+		if err != nil {
+			return err
+		}
+		return r.Payments.AddEntry(ctx, &e)
+	})
+	return errors.Wrap(err, "Failed to record payment "+e.Operation)
+}
+
+// PaymentGetter gets the payment of a match
+type PaymentGetter struct {
+	Store Store
+}
+
+// Run returns the payment of matcID with its ledger, to either side of it
+func (g *PaymentGetter) Run(ctx context.Context, matcID uuid.UUID, a MatchActor) (p *Payment, err error) {
+	ctx, span := tracing.Start(ctx, "user.PaymentGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		m, err := r.Matches.FromID(ctx, matcID)
+		if err != nil {
+			return err
+		}
+		_, err = a.role(m)
+		if err != nil {
+			return err
+		}
+		p, err = r.Payments.FromMatch(ctx, matcID)
+		if err != nil {
+			return err
+		}
+		p.Ledger, err = r.Payments.Ledger(ctx, p.PaymID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PaymentReconciler finishes payments left behind, e.g. by a gateway
+// timeout: pending payments are authorized again and those of ended
+// matches settled
+type PaymentReconciler struct {
+	Payments *Payments
+	// Grace is how long a payment is left to the request handling it
+	Grace     time.Duration
+	BatchSize int
+	Log       *logger.Logger
+}
+
+// Run reconciles a batch of payments, returning how many it went through.
+// Each payment is claimed first, so replicas don't reconcile it twice.
+func (rc *PaymentReconciler) Run(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "user.PaymentReconciler.Run")
+	defer func() { tracing.End(span, err) }()
+
+	l := rc.Log
+	if l == nil {
+		l = logger.Default
+	}
+	size := rc.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	var ps []Payment
+	err = rc.Payments.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		ps, err = r.Payments.Unsettled(ctx, time.Now().Add(-rc.Grace), size)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range ps {
+		claimed := false
+		err = rc.Payments.Store.Tx(ctx, func(r Repos) error {
+			var err error
+			claimed, err = r.Payments.Claim(ctx, p.PaymID, p.UpdatedAt)
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+		if !claimed {
+			continue
+		}
+		n++
+		if p.Status == PaymentPending {
+			if _, err := rc.Payments.Authorize(ctx, p.MatcID); err != nil {
+				l.Error("payment reconciliation failed", "matc_id", p.MatcID, "error", err)
+				continue
+			}
+		}
+		if _, err := rc.Payments.Settle(ctx, p.MatcID); err != nil {
+			l.Error("payment reconciliation failed", "matc_id", p.MatcID, "error", err)
+		}
+	}
+	return n, nil
+}
+
+// Every reconciles payments every interval until ctx is done
+func (rc *PaymentReconciler) Every(ctx context.Context, interval time.Duration) {
+	l := rc.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := rc.Run(ctx)
+		if err != nil {
+			l.Error("payment reconciliation failed", "error", err)
+		} else if n > 0 {
+			l.Info("payment reconciliation", "payments", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	uuid "github.com/satori/go.uuid"
+)
+
+// paidMatch proposes a match for a patient with a saved card and confirms
+// it, with ps listening
+func paidMatch(t *testing.T, s *MemStore, ps *Payments, number string, policy CancelPolicy) (*Match, MatchActor, *MatchTransitioner) {
+	t.Helper()
+	ctx := context.Background()
+	m, patient, _ := proposedMatch(t, s)
+	if len(number) > 0 {
+		_, err := (&CardCreator{Store: s, Vault: ps.Gateway.(*cielo.Ecommerce)}).Run(ctx, NewCard{
+			PatiID: patient.PatiID, Number: number, Holder: "Maria Silva", Expiry: "12/2099",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+	}
+	mt := &MatchTransitioner{Store: s, Policy: policy, Listeners: []MatchListener{ps.OnMatch}}
+	m, err := mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchConfirmed, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	return m, patient, mt
+}
+
+func TestPaymentCompleted(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ps := &Payments{Store: s, Gateway: cielo.NewFake().Ecommerce(), SoftDescriptor: "ECHOAPI"}
+	m, patient, _ := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{})
+
+	p, err := (&PaymentGetter{Store: s}).Run(ctx, m.MatcID, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.Status != PaymentAuthorized || p.Amount != 20000 || !p.GatewayID.Valid || len(p.Ledger) != 1 {
+		t.Errorf("Expected the price authorized on confirmation, got %+v", p)
+	}
+
+	// the session happened, completing it goes through check-in times
+	stored := s.data.matches[m.MatcID]
+	stored.Status = MatchCompleted
+	s.data.matches[m.MatcID] = stored
+	p, err = ps.Settle(ctx, m.MatcID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if p.Status != PaymentCaptured || p.Captured != 20000 || p.Voided != 0 || p.Refunded != 0 {
+		t.Errorf("Expected the price captured, got %+v", p)
+	}
+	p, err = ps.Settle(ctx, m.MatcID)
+	if err != nil || p.Captured != 20000 || len(s.data.paymentLedger[p.PaymID]) != 2 {
+		t.Errorf("Expected settling again to do nothing, got %+v %v", p, err)
+	}
+}
+
+func TestPaymentCanceled(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ps := &Payments{Store: s, Gateway: cielo.NewFake().Ecommerce()}
+
+	m, patient, mt := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{FreeWindow: time.Hour})
+	_, err := mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByPatient, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p := s.data.payments[paymentOf(s, m)]
+	if p.Status != PaymentVoided || p.Captured != 0 || p.Voided != 20000 || p.Refunded != 0 {
+		t.Errorf("Expected a free cancellation voided, got %+v", p)
+	}
+
+	s = NewMemStore()
+	ps.Store = s
+	m, patient, mt = paidMatch(t, s, ps, "4024007197692931", CancelPolicy{FreeWindow: 72 * time.Hour, FeePercent: 50})
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByPatient, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p = s.data.payments[paymentOf(s, m)]
+	if p.Status != PaymentCaptured || p.Captured != 10000 || p.Voided != 10000 || p.Refunded != 0 {
+		t.Errorf("Expected the fee captured and the rest released, got %+v", p)
+	}
+	ops := []string{}
+	for _, e := range s.data.paymentLedger[p.PaymID] {
+		ops = append(ops, e.Operation)
+	}
+	if len(ops) != 2 || ops[0] != PaymentAuthorize || ops[1] != PaymentCapture {
+		t.Errorf("Expected authorize and capture in the ledger, got %v", ops)
+	}
+}
+
+func TestPaymentFailures(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ps := &Payments{Store: s, Gateway: cielo.NewFake().Ecommerce()}
+
+	m, _, _ := paidMatch(t, s, ps, "", CancelPolicy{})
+	p := s.data.payments[paymentOf(s, m)]
+	e := s.data.paymentLedger[p.PaymID]
+	if p.Status != PaymentFailed || len(e) != 1 || e[0].Error != "Patient has no credit card" {
+		t.Errorf("Expected the payment failed without a card, got %+v %+v", p, e)
+	}
+	got, err := ps.Authorize(ctx, m.MatcID)
+	if err != nil || got.Status != PaymentFailed {
+		t.Errorf("Expected a failed payment left alone, got %+v %v", got, err)
+	}
+
+	s = NewMemStore()
+	ps.Store = s
+	m, _, _ = paidMatch(t, s, ps, "4024007197692832", CancelPolicy{})
+	p = s.data.payments[paymentOf(s, m)]
+	e = s.data.paymentLedger[p.PaymID]
+	if p.Status != PaymentDeclined || len(e) != 1 || e[0].Succeeded || e[0].ReturnCode != "05" {
+		t.Errorf("Expected the card declined and recorded, got %+v %+v", p, e)
+	}
+}
+
+func TestPaymentReconciler(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	f := cielo.NewFake()
+	ps := &Payments{Store: s, Gateway: f.Ecommerce()}
+
+	f.LoseNext = true
+	m, _, _ := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{})
+	p := s.data.payments[paymentOf(s, m)]
+	if p.Status != PaymentPending {
+		t.Fatalf("Expected a lost answer to leave the payment pending, got %+v", p)
+	}
+
+	rc := &PaymentReconciler{Payments: ps, Grace: time.Hour}
+	n, err := rc.Run(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("Expected payments within the grace left alone, got %d %v", n, err)
+	}
+	rc.Grace = 0
+	n, err = rc.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected a payment reconciled, got %d %v", n, err)
+	}
+	p = s.data.payments[p.PaymID]
+	if p.Status != PaymentAuthorized || !p.GatewayID.Valid {
+		t.Errorf("Expected the earlier authorization found, got %+v", p)
+	}
+	n, _ = rc.Run(ctx)
+	if n != 0 {
+		t.Errorf("Expected nothing left to reconcile, got %d", n)
+	}
+}
+
+func TestPaymentPendingOfEndedMatch(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ps := &Payments{Store: s, Gateway: cielo.NewFake().Ecommerce()}
+	m, patient, mt := paidMatch(t, s, ps, "", CancelPolicy{})
+	// the patient adds a card while the payment waits, then cancels
+	_, err := (&CardCreator{Store: s, Vault: ps.Gateway.(*cielo.Ecommerce)}).Run(ctx, NewCard{
+		PatiID: patient.PatiID, Number: "4024007197692931", Holder: "Maria Silva", Expiry: "12/2099",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p := s.data.payments[paymentOf(s, m)]
+	p.Status = PaymentPending
+	for id := range s.data.creditCards {
+		id := id
+		p.CrcaID = &id
+	}
+	s.data.payments[p.PaymID] = p
+	_, err = mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByPatient, Version: m.Version}, patient)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	got, err := ps.Authorize(ctx, m.MatcID)
+	if err != nil || got.Status != PaymentPending || got.GatewayID.Valid || len(s.data.paymentLedger[p.PaymID]) != 1 {
+		t.Errorf("Expected nothing held for a canceled match, got %+v %v", got, err)
+	}
+	n, err := (&PaymentReconciler{Payments: ps}).Run(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("Expected the pending payment of a canceled match left out, got %d %v", n, err)
+	}
+}
+
+func paymentOf(s *MemStore, m *Match) uuid.UUID {
+	for _, p := range s.data.payments {
+		if p.MatcID == m.MatcID {
+			return p.PaymID
+		}
+	}
+	return uuid.Nil
+}
@@ -0,0 +1,300 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Payout statuses, transfers are sent by the finance team and marked paid
+// or failed by them with a PayoutMarker
+const (
+	PayoutScheduled = "scheduled"
+	PayoutPaid      = "paid"
+	PayoutFailed    = "failed"
+)
+
+// Payout methods
+const (
+	PayoutPix = "pix"
+	PayoutTED = "ted"
+)
+
+// Payout is a representation of the table payout, a transfer to a doctor
+// of what its entries are owed, in cents
+type Payout struct {
+	PayoID uuid.UUID `db:"payo_id" json:"payoID"`
+	DoctID uuid.UUID `db:"doct_id" json:"doctID"`
+	BankID uuid.UUID `db:"bank_id" json:"bankID"`
+	// Method is pix when the account had a PIX key, ted otherwise
+	Method       string        `db:"method" json:"method" example:"pix"`
+	Amount       int           `db:"amount" json:"amount"`
+	Status       string        `db:"status" json:"status" example:"scheduled"`
+	ScheduledFor time.Time     `db:"scheduled_for" json:"scheduledFor" format:"date"`
+	CreatedAt    time.Time     `db:"created_at" json:"createdAt"`
+	PaidAt       null.Time     `db:"paid_at" json:"paidAt" swaggertype:"string"`
+	Entries      []PayoutEntry `db:"-" json:"entries"`
+}
+
+// PayoutEntry is a representation of the table payout_entry, what a
+// doctor is owed for a charged match: what the patient paid less the
+// platform commission
+type PayoutEntry struct {
+	PoenID     uuid.UUID  `db:"poen_id" json:"poenID"`
+	DoctID     uuid.UUID  `db:"doct_id" json:"doctID"`
+	PaymID     uuid.UUID  `db:"paym_id" json:"paymID"`
+	MatcID     uuid.UUID  `db:"matc_id" json:"matcID"`
+	Gross      int        `db:"gross" json:"gross"`
+	Commission int        `db:"commission" json:"commission"`
+	Net        int        `db:"net" json:"net"`
+	PayoID     *uuid.UUID `db:"payo_id" json:"payoID" swaggertype:"string"`
+	// Reverses is the entry a chargeback took back once it was paid, the
+	// amounts of a reversal are those of the entry negated
+	Reverses  *uuid.UUID `db:"reverses" json:"reverses" swaggertype:"string"`
+	CreatedAt time.Time  `db:"created_at" json:"createdAt"`
+}
+
+// Commission is percent of gross, rounded to the nearest cent
+func Commission(gross, percent int) int {
+	return (gross*percent + 50) / 100
+}
+
+// nextBusinessDay is the first weekday after the day of now in
+// DefaultTimezone, holidays aren't skipped
+func nextBusinessDay(now time.Time) time.Time {
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	d := now.In(sp)
+	d = time.Date(d.Year(), d.Month(), d.Day()+1, 0, 0, 0, 0, time.UTC)
+	for d.Weekday() == time.Saturday || d.Weekday() == time.Sunday {
+		d = d.AddDate(0, 0, 1)
+	}
+	return d
+}
+
+// PayoutBatcher pays doctors for their matches: each match charged is
+// booked in the payout ledger once it's past Hold, and the entries not
+// paid yet of each doctor are grouped in a payout to its account
+type PayoutBatcher struct {
+	Store Store
+	// CommissionPercent is the share of each match kept by the platform
+	CommissionPercent int
+	// Hold is how long a payment is left out after it was last changed
+	Hold      time.Duration
+	BatchSize int
+	Log       *logger.Logger
+}
+
+// Run books the payments past the hold and schedules a payout to every
+// doctor owed with an account, returning how many it scheduled. Doctors
+// without an account keep their entries until they register one.
+func (b *PayoutBatcher) Run(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "user.PayoutBatcher.Run")
+	defer func() { tracing.End(span, err) }()
+
+	l := b.Log
+	if l == nil {
+		l = logger.Default
+	}
+	size := b.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	now := time.Now()
+	err = b.Store.Tx(ctx, func(r Repos) error {
+		es, err := r.Payouts.Bookable(ctx, now.Add(-b.Hold), size)
+		if err != nil {
+			return err
+		}
+		for i := range es {
+			e := &es[i]
+			e.Commission = Commission(e.Gross, b.CommissionPercent)
+			e.Net = e.Gross - e.Commission
+			err = r.Payouts.AddEntry(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var doctIDs []uuid.UUID
+	err = b.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		doctIDs, err = r.Payouts.Payees(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, doctID := range doctIDs {
+		var p *Payout
+		err = b.Store.Tx(ctx, func(r Repos) error {
+			var err error
+			p, err = schedulePayout(ctx, r, doctID, now)
+			return err
+		})
+		switch err.(type) {
+		case nil:
+		case *auth.NotFoundError:
+			l.Info("payout postponed", "doct_id", doctID, "reason", err.Error())
+			continue
+		case *auth.ConflictError:
+			// another replica scheduled it
+			continue
+		default:
+			return n, err
+		}
+		if p != nil {
+			n++
+			l.Info("payout scheduled", "doct_id", doctID, "payo_id", p.PayoID, "amount", p.Amount, "method", p.Method)
+		}
+	}
+	return n, nil
+}
+
+// schedulePayout groups the entries not paid yet of doctID in a payout to
+// its account, nil when there's nothing to pay. A ConflictError means some
+// of the entries were paid meanwhile.
+func schedulePayout(ctx context.Context, r Repos, doctID uuid.UUID, now time.Time) (*Payout, error) {
+	bank, err := r.Banks.FromDoctor(ctx, doctID)
+	if err != nil {
+		return nil, err
+	}
+	es, err := r.Payouts.Unpaid(ctx, doctID)
+	if err != nil {
+		return nil, err
+	}
+	p := &Payout{DoctID: doctID, BankID: bank.BankID, Method: PayoutTED, Status: PayoutScheduled, ScheduledFor: nextBusinessDay(now)}
+	if len(bank.PixKey) > 0 {
+		p.Method = PayoutPix
+	}
+	ids := make([]uuid.UUID, len(es))
+	for i, e := range es {
+		p.Amount += e.Net
+		ids[i] = e.PoenID
+	}
+	if p.Amount <= 0 {
+		return nil, nil
+	}
+	err = r.Payouts.Save(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Payouts.Assign(ctx, p.PayoID, ids)
+	if err != nil {
+		return nil, err
+	}
+	p.Entries = es
+	return p, nil
+}
+
+// Every runs b every interval until ctx is done
+func (b *PayoutBatcher) Every(ctx context.Context, interval time.Duration) {
+	l := b.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := b.Run(ctx)
+		if err != nil {
+			l.Error("payout batch failed", "error", err)
+		} else if n > 0 {
+			l.Info("payout batch", "payouts", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// PayoutStatement is what a doctor was paid and is owed
+type PayoutStatement struct {
+	// Pending are the entries not in a payout yet, oldest first
+	Pending    []PayoutEntry `json:"pending"`
+	PendingNet int           `json:"pendingNet"`
+	// Payouts are a page of the payouts of the doctor, latest first
+	Payouts      []Payout `json:"payouts"`
+	TotalPayouts int      `json:"totalPayouts"`
+}
+
+// PayoutMarker records how the transfer of a payout went
+type PayoutMarker struct {
+	Store Store
+}
+
+// Run marks the scheduled payout payoID paid or failed. The entries of a
+// failed payout are owed again and the next batch pays them, e.g. to an
+// account the doctor fixed meanwhile.
+func (pm *PayoutMarker) Run(ctx context.Context, payoID uuid.UUID, status string) (p *Payout, err error) {
+	ctx, span := tracing.Start(ctx, "user.PayoutMarker.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if status != PayoutPaid && status != PayoutFailed {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"status": "Status must be paid or failed"},
+		}
+	}
+	p = &Payout{PayoID: payoID, Status: status}
+	err = pm.Store.Tx(ctx, func(r Repos) error {
+		return r.Payouts.SetStatus(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.FromContext(ctx).Info("payout marked", "payo_id", payoID, "doct_id", p.DoctID, "status", status)
+	return p, nil
+}
+
+// PayoutLister lists the payouts of a doctor
+type PayoutLister struct {
+	Store Store
+}
+
+// Run returns the entries owed to doctID and a page of its payouts with
+// the entries they paid
+func (pl *PayoutLister) Run(ctx context.Context, doctID uuid.UUID, limit, offset int) (s *PayoutStatement, err error) {
+	ctx, span := tracing.Start(ctx, "user.PayoutLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	s = &PayoutStatement{}
+	err = pl.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, doctID)
+		if err != nil {
+			return err
+		}
+		s.Pending, err = r.Payouts.Unpaid(ctx, doctID)
+		if err != nil {
+			return err
+		}
+		for _, e := range s.Pending {
+			s.PendingNet += e.Net
+		}
+		s.Payouts, s.TotalPayouts, err = r.Payouts.List(ctx, doctID, limit, offset)
+		if err != nil {
+			return err
+		}
+		for i := range s.Payouts {
+			s.Payouts[i].Entries, err = r.Payouts.Entries(ctx, s.Payouts[i].PayoID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,205 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/fieldcrypt"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestValidateBank(t *testing.T) {
+	for _, c := range []struct {
+		bank, agency, account string
+		wantAgency, wantAcc   string
+		invalid               string
+	}{
+		{"1", "1584-9", "210169-6", "1584-9", "210169-6", ""},
+		{"001", "1584-8", "210169-6", "", "", "agency"},
+		{"001", "1584", "210169-5", "", "", "account"},
+		{"341", "2545", "2366-1", "2545", "02366-1", ""},
+		{"341", "2545", "02366-2", "", "", "account"},
+		{"237", "1425-7", "238069-2", "1425-7", "0238069-2", ""},
+		{"237", "1425-7", "0238069-3", "", "", "account"},
+		{"260", "1", "1234567-8", "0001", "1234567-8", ""},
+		{"999", "0001", "1234-5", "", "", "bank"},
+	} {
+		b := &Bank{Bank: c.bank, Agency: fieldcrypt.String(c.agency), Account: fieldcrypt.String(c.account), Type: BankChecking, Name: " Dr.  House "}
+		err := validateBank(b)
+		if len(c.invalid) > 0 {
+			v, ok := err.(*auth.ValidationError)
+			if !ok || len(v.Messages[c.invalid]) == 0 {
+				t.Errorf("%s %s %s: expected %s refused, got %v", c.bank, c.agency, c.account, c.invalid, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s %s: expected no error, got %s", c.bank, c.agency, c.account, err)
+			continue
+		}
+		if string(b.Agency) != c.wantAgency || string(b.Account) != c.wantAcc || b.Name != "Dr. House" {
+			t.Errorf("%s: expected %s %s, got %+v", c.bank, c.wantAgency, c.wantAcc, b)
+		}
+	}
+
+	for _, c := range []struct {
+		kind, key, want string
+	}{
+		{PixCPF, "123.456.789-09", "12345678909"},
+		{PixCNPJ, "11.222.333/0001-81", "11222333000181"},
+		{PixEmail, "Doc@Mail.com", "doc@mail.com"},
+		{PixPhone, "(11) 98765-4321", "+5511987654321"},
+		{PixRandom, "123E4567-E89B-12D3-A456-426614174000", "123e4567-e89b-12d3-a456-426614174000"},
+		{PixCPF, "123.456.789-00", ""},
+		{PixPhone, "+1 555 0100", ""},
+		{"iban", "x", ""},
+	} {
+		b := &Bank{Bank: "341", Agency: "2545", Account: "02366-1", Type: BankSavings, Name: "Dr. House", PixKeyType: c.kind, PixKey: fieldcrypt.String(c.key)}
+		err := validateBank(b)
+		if len(c.want) == 0 {
+			if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["pixKey"]) == 0 {
+				t.Errorf("%s %s: expected the key refused, got %v", c.kind, c.key, err)
+			}
+		} else if err != nil || string(b.PixKey) != c.want {
+			t.Errorf("%s %s: expected %s, got %s %v", c.kind, c.key, c.want, b.PixKey, err)
+		}
+	}
+}
+
+func TestPayoutBatch(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ps := &Payments{Store: s, Gateway: cielo.NewFake().Ecommerce()}
+	m, _, _ := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{})
+	stored := s.data.matches[m.MatcID]
+	stored.Status = MatchCompleted
+	s.data.matches[m.MatcID] = stored
+	_, err := ps.Settle(ctx, m.MatcID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	pb := &PayoutBatcher{Store: s, CommissionPercent: 15, Hold: time.Hour}
+	n, err := pb.Run(ctx)
+	if err != nil || n != 0 || len(s.data.payoutEntries) != 0 {
+		t.Errorf("Expected payments within the hold left out, got %d %v", n, err)
+	}
+
+	pb.Hold = 0
+	n, err = pb.Run(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("Expected no payout without a bank account, got %d %v", n, err)
+	}
+	st, err := (&PayoutLister{Store: s}).Run(ctx, m.DoctID, 20, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(st.Pending) != 1 || st.Pending[0].Gross != 20000 || st.Pending[0].Commission != 3000 || st.PendingNet != 17000 {
+		t.Errorf("Expected the match booked net of commission, got %+v", st)
+	}
+
+	_, err = (&BankCreator{Store: s}).Run(ctx, &Bank{
+		DoctID: m.DoctID, Bank: "341", Agency: "2545", Account: "02366-1", Type: BankChecking, Name: "Dr. House",
+		PixKeyType: PixEmail, PixKey: "doc@mail.com",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&BankCreator{Store: s}).Run(ctx, &Bank{
+		DoctID: m.DoctID, Bank: "341", Agency: "2545", Account: "02366-1", Type: BankChecking, Name: "Dr. House",
+	})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a second account to be a ConflictError, got %v", err)
+	}
+
+	n, err = pb.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected a payout scheduled, got %d %v", n, err)
+	}
+	if n, _ = pb.Run(ctx); n != 0 {
+		t.Errorf("Expected nothing left to pay, got %d payouts", n)
+	}
+	st, _ = (&PayoutLister{Store: s}).Run(ctx, m.DoctID, 20, 0)
+	if len(st.Pending) != 0 || st.TotalPayouts != 1 {
+		t.Fatalf("Expected the entry paid, got %+v", st)
+	}
+	p := st.Payouts[0]
+	if p.Amount != 17000 || p.Method != PayoutPix || p.Status != PayoutScheduled || len(p.Entries) != 1 || p.ScheduledFor.Weekday() == time.Sunday {
+		t.Errorf("Expected a PIX payout of the net amount, got %+v", p)
+	}
+
+	// a failed transfer is paid again by the next batch
+	pm := &PayoutMarker{Store: s}
+	_, err = pm.Run(ctx, p.PayoID, PayoutScheduled)
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected marking scheduled to be a ValidationError, got %v", err)
+	}
+	failed, err := pm.Run(ctx, p.PayoID, PayoutFailed)
+	if err != nil || failed.Status != PayoutFailed || failed.PaidAt.Valid {
+		t.Fatalf("Expected the payout failed, got %+v %v", failed, err)
+	}
+	_, err = pm.Run(ctx, p.PayoID, PayoutPaid)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected marking a failed payout to be a ConflictError, got %v", err)
+	}
+	n, err = pb.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected the entry paid again, got %d %v", n, err)
+	}
+	st, _ = (&PayoutLister{Store: s}).Run(ctx, m.DoctID, 20, 0)
+	retry := st.Payouts[0]
+	if retry.PayoID == p.PayoID {
+		retry = st.Payouts[1]
+	}
+	if st.TotalPayouts != 2 || retry.Status != PayoutScheduled || retry.Amount != 17000 || len(retry.Entries) != 1 {
+		t.Fatalf("Expected a second payout of the entry, got %+v", st)
+	}
+	paid, err := pm.Run(ctx, retry.PayoID, PayoutPaid)
+	if err != nil || paid.Status != PayoutPaid || !paid.PaidAt.Valid {
+		t.Errorf("Expected the payout paid, got %+v %v", paid, err)
+	}
+	unknown, _ := uuid.NewV4()
+	_, err = pm.Run(ctx, unknown, PayoutPaid)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected an unknown payout to be a NotFoundError, got %v", err)
+	}
+
+	// the doctor keeps what the patient paid for canceling late or not
+	// showing up
+	for _, c := range []struct {
+		name  string
+		ended func(s *MemStore, m *Match, patient MatchActor, mt *MatchTransitioner)
+		gross int
+	}{
+		{"late cancellation", func(s *MemStore, m *Match, patient MatchActor, mt *MatchTransitioner) {
+			_, err := mt.Run(ctx, MatchTransition{MatcID: m.MatcID, To: MatchCanceledByPatient, Version: m.Version}, patient)
+			if err != nil {
+				t.Fatalf("Expected no error, but got %s instead", err)
+			}
+		}, 10000},
+		{"no-show", func(s *MemStore, m *Match, patient MatchActor, mt *MatchTransitioner) {
+			stored := s.data.matches[m.MatcID]
+			stored.Status, stored.CancelFee = MatchNoShow, stored.Price
+			s.data.matches[m.MatcID] = stored
+			if _, err := ps.Settle(ctx, m.MatcID); err != nil {
+				t.Fatalf("Expected no error, but got %s instead", err)
+			}
+		}, 20000},
+	} {
+		s := NewMemStore()
+		ps.Store = s
+		m, patient, mt := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{FreeWindow: 72 * time.Hour, FeePercent: 50})
+		c.ended(s, m, patient, mt)
+		_, err = (&PayoutBatcher{Store: s, CommissionPercent: 15}).Run(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		st, _ = (&PayoutLister{Store: s}).Run(ctx, m.DoctID, 20, 0)
+		if len(st.Pending) != 1 || st.Pending[0].Gross != c.gross || st.Pending[0].Net != c.gross*85/100 {
+			t.Errorf("%s: expected the fee of %d booked, got %+v", c.name, c.gross, st)
+		}
+	}
+}
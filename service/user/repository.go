@@ -0,0 +1,311 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// UserRepository persists Users
+type UserRepository interface {
+	Save(ctx context.Context, u *User) (*User, error)
+	Update(ctx context.Context, u *User) (*User, error)
+	UpdateEmail(ctx context.Context, userID uuid.UUID, email string) error
+	UpdatePassword(ctx context.Context, userID uuid.UUID, pass []byte) error
+	UpdateInfo(ctx context.Context, userID uuid.UUID, info Info) error
+	FromID(ctx context.Context, userID uuid.UUID) (*User, error)
+	FromEmail(ctx context.Context, email string) (*User, error)
+	SoftDelete(ctx context.Context, userID uuid.UUID) error
+}
+
+// ConfirmationRepository persists ActionConfirmations
+type ConfirmationRepository interface {
+	Save(ctx context.Context, c *ActionConfirmation) error
+	Delete(ctx context.Context, c *ActionConfirmation) error
+	FromID(ctx context.Context, acveID string) (*ActionConfirmation, error)
+}
+
+// DoctorRepository persists Doctors, reading them joined with their user
+type DoctorRepository interface {
+	// Save inserts d, a CRM already registered is a ValidationError
+	Save(ctx context.Context, d *Doctor) error
+	// Update updates the name, CRM and documents of d
+	Update(ctx context.Context, d *Doctor) error
+	// FromID returns a NotFoundError when there's no such doctor
+	FromID(ctx context.Context, doctID uuid.UUID) (*Doctor, error)
+	// Near ranks doctors by the distance of their nearest placed address
+	Near(ctx context.Context, q NearQuery) ([]DoctorDistance, error)
+	// FromUserID returns sql.ErrNoRows when the user isn't a doctor
+	FromUserID(ctx context.Context, userID uuid.UUID) (*Doctor, error)
+}
+
+// PatientRepository persists Patients, reading them joined with their user
+type PatientRepository interface {
+	// Save inserts p, a CPF already registered is a ValidationError
+	Save(ctx context.Context, p *Patient) error
+	// Update updates the name, documents and address of p
+	Update(ctx context.Context, p *Patient) error
+	// FromID returns a NotFoundError when there's no such patient
+	FromID(ctx context.Context, patiID uuid.UUID) (*Patient, error)
+	// FromCPFIndex finds a patient by the blind index of its CPF, a
+	// NotFoundError when there's none
+	FromCPFIndex(ctx context.Context, index string) (*Patient, error)
+	// FromUserID returns sql.ErrNoRows when the user isn't a patient
+	FromUserID(ctx context.Context, userID uuid.UUID) (*Patient, error)
+}
+
+// AddressRepository persists the Addresses of doctors
+type AddressRepository interface {
+	Save(ctx context.Context, a *Address) error
+	Update(ctx context.Context, a *Address) error
+	// FromID returns a NotFoundError when doctID has no such address
+	FromID(ctx context.Context, doctID uuid.UUID, addrID int) (*Address, error)
+	// List returns the active addresses of doctID, oldest first
+	List(ctx context.Context, doctID uuid.UUID) (*Addresses, error)
+	// ClearPrimary unsets the primary flag of the addresses of doctID
+	ClearPrimary(ctx context.Context, doctID uuid.UUID) error
+	// Services counts the active services offered at an address
+	Services(ctx context.Context, addrID int) (int, error)
+	// RemoveServices soft deletes the services offered at an address
+	RemoveServices(ctx context.Context, addrID int) error
+	// SoftDelete returns a NotFoundError when doctID has no such address
+	SoftDelete(ctx context.Context, doctID uuid.UUID, addrID int) error
+}
+
+// ScheduleRepository persists the availabilities of doctors and the
+// sessions booked with them
+type ScheduleRepository interface {
+	SaveAvailability(ctx context.Context, av *Availability) error
+	// Availabilities returns the active availabilities of doctID, those of
+	// removed addresses left out
+	Availabilities(ctx context.Context, doctID uuid.UUID) ([]Availability, error)
+	// RemoveAvailability returns a NotFoundError when doctID has no such
+	// availability
+	RemoveAvailability(ctx context.Context, doctID, avaiID uuid.UUID) error
+	SaveException(ctx context.Context, e *AvailabilityException) error
+	// Exceptions returns the active exceptions of doctID overlapping from
+	// and to
+	Exceptions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]AvailabilityException, error)
+	// RemoveException returns a NotFoundError when doctID has no such
+	// exception
+	RemoveException(ctx context.Context, doctID, avexID uuid.UUID) error
+	// Sessions returns the sessions of doctID not canceled overlapping from
+	// and to
+	Sessions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]SessionSchedule, error)
+	// LockDoctor locks doctID until the unit of work ends, serializing
+	// bookings with it
+	LockDoctor(ctx context.Context, doctID uuid.UUID) error
+	// Book returns a ConflictError when the slot is already booked
+	Book(ctx context.Context, s *SessionSchedule) error
+	// CancelSession frees the slot of a session
+	CancelSession(ctx context.Context, sescID uuid.UUID) error
+}
+
+// MatchmakingRepository reads what the Matchmaker scores doctors by
+type MatchmakingRepository interface {
+	// Offers returns the cheapest active service in specID at each address
+	// of each of doctIDs offering one, with specID approved and not removed
+	Offers(ctx context.Context, specID uuid.UUID, doctIDs []uuid.UUID) ([]DoctorOffer, error)
+	// Stats returns the stats of each of doctIDs
+	Stats(ctx context.Context, doctIDs []uuid.UUID) ([]DoctorStats, error)
+}
+
+// MatchRepository persists Matches and the history of their statuses
+type MatchRepository interface {
+	Save(ctx context.Context, m *Match) error
+	// FromID returns a NotFoundError when there's no such match
+	FromID(ctx context.Context, matcID uuid.UUID) (*Match, error)
+	// UpdateStatus stores the status and cancellation of m and bumps its
+	// version, a ConflictError when m isn't at version anymore
+	UpdateStatus(ctx context.Context, m *Match, version int) error
+	AddChange(ctx context.Context, c *MatchStatusChange) error
+	// Expirable returns up to limit matches still proposed since before,
+	// oldest first
+	Expirable(ctx context.Context, before time.Time, limit int) ([]Match, error)
+	// History returns the status changes of a match, oldest first
+	History(ctx context.Context, matcID uuid.UUID) ([]MatchStatusChange, error)
+	// List returns the matches of q latest first and how many there are
+	// in q ignoring its limit and offset
+	List(ctx context.Context, q MatchHistoryQuery) ([]MatchHistory, int, error)
+}
+
+// CreditCardRepository persists the CreditCards of patients
+type CreditCardRepository interface {
+	Save(ctx context.Context, c *CreditCard) error
+	// Update updates the default flag of c
+	Update(ctx context.Context, c *CreditCard) error
+	// FromID returns a NotFoundError when patiID has no such card
+	FromID(ctx context.Context, patiID, crcaID uuid.UUID) (*CreditCard, error)
+	// List returns the active cards of patiID, the default one first and
+	// then the newest
+	List(ctx context.Context, patiID uuid.UUID) ([]CreditCard, error)
+	// ClearDefault unsets the default flag of the cards of patiID
+	ClearDefault(ctx context.Context, patiID uuid.UUID) error
+	// SoftDelete returns a NotFoundError when patiID has no such card
+	SoftDelete(ctx context.Context, patiID, crcaID uuid.UUID) error
+}
+
+// PaymentRepository persists the Payments of matches and their ledger
+type PaymentRepository interface {
+	Save(ctx context.Context, p *Payment) error
+	// Update stores the gateway id, status and amounts of p
+	Update(ctx context.Context, p *Payment) error
+	// FromMatch returns a NotFoundError when matcID has no payment
+	FromMatch(ctx context.Context, matcID uuid.UUID) (*Payment, error)
+	// FromGateway returns a NotFoundError when no payment has gatewayID
+	FromGateway(ctx context.Context, gatewayID string) (*Payment, error)
+	AddEntry(ctx context.Context, e *PaymentEntry) error
+	// Ledger returns the entries of a payment, oldest first
+	Ledger(ctx context.Context, paymID uuid.UUID) ([]PaymentEntry, error)
+	// Unsettled returns up to limit payments not updated since before that
+	// are pending for a match confirmed or checked in, or authorized or
+	// captured for a match that ended and owes less, least recently updated
+	// first
+	Unsettled(ctx context.Context, before time.Time, limit int) ([]Payment, error)
+	// Claim bumps the update time of paymID if it's still updatedAt,
+	// reporting whether it was
+	Claim(ctx context.Context, paymID uuid.UUID, updatedAt time.Time) (bool, error)
+}
+
+// BankRepository persists the Banks of doctors
+type BankRepository interface {
+	// Save returns a ConflictError when the doctor already has an account
+	Save(ctx context.Context, b *Bank) error
+	// FromDoctor returns a NotFoundError when doctID has no account
+	FromDoctor(ctx context.Context, doctID uuid.UUID) (*Bank, error)
+	// SoftDelete returns a NotFoundError when doctID has no account
+	SoftDelete(ctx context.Context, doctID uuid.UUID) error
+}
+
+// PayoutRepository persists the payout ledger and the Payouts paying it
+type PayoutRepository interface {
+	// Bookable returns up to limit entries for payments not booked yet,
+	// with the doctor, payment, match and gross filled in: those captured
+	// for a completed match, or for the fee of one canceled or a no-show,
+	// not updated since before
+	Bookable(ctx context.Context, before time.Time, limit int) ([]PayoutEntry, error)
+	// AddEntry does nothing when the payment of e is already booked
+	AddEntry(ctx context.Context, e *PayoutEntry) error
+	// Reverse takes back the entry of paymID: it's deleted while no payout
+	// pays it, a reversal is booked otherwise. It does nothing when the
+	// payment wasn't booked or was reversed already.
+	Reverse(ctx context.Context, paymID uuid.UUID) error
+	// Payees returns the doctors with entries not paid yet
+	Payees(ctx context.Context) ([]uuid.UUID, error)
+	// Unpaid returns the entries of doctID not paid yet, oldest first
+	Unpaid(ctx context.Context, doctID uuid.UUID) ([]PayoutEntry, error)
+	Save(ctx context.Context, p *Payout) error
+	// Assign sets the payout of entries, a ConflictError when some were
+	// already paid
+	Assign(ctx context.Context, payoID uuid.UUID, poenIDs []uuid.UUID) error
+	// List returns the payouts of doctID latest first and how many there
+	// are ignoring limit and offset
+	List(ctx context.Context, doctID uuid.UUID, limit, offset int) ([]Payout, int, error)
+	// SetStatus moves the scheduled payout p.PayoID to p.Status and reads
+	// it back into p, setting when it was paid or releasing its entries
+	// when it failed. A payout not scheduled anymore is a ConflictError.
+	SetStatus(ctx context.Context, p *Payout) error
+	// Entries returns the entries paid by payoID, oldest first
+	Entries(ctx context.Context, payoID uuid.UUID) ([]PayoutEntry, error)
+}
+
+// WebhookRepository persists the WebhookEvents gateways notify
+type WebhookRepository interface {
+	// Save stores e, unless an event with its id is pending: that one is
+	// touched instead, so it's processed again, and Save reports false
+	Save(ctx context.Context, e *WebhookEvent) (bool, error)
+	// Pending returns up to limit pending events, least recently updated
+	// first
+	Pending(ctx context.Context, limit int) ([]WebhookEvent, error)
+	// Claim bumps the update time of e if it's still e.UpdatedAt,
+	// reporting whether it was
+	Claim(ctx context.Context, e *WebhookEvent) (bool, error)
+	// Finish stores the status, attempts and error of e if it's still
+	// pending and wasn't updated since e.UpdatedAt, reporting whether it
+	// wasn't
+	Finish(ctx context.Context, e *WebhookEvent) (bool, error)
+	// Replay makes weheID pending again, a NotFoundError when there's no
+	// such event and a ConflictError when another with its id is pending
+	Replay(ctx context.Context, weheID uuid.UUID) (*WebhookEvent, error)
+}
+
+// ServiceRepository persists the Services of doctors and the history of
+// their prices
+type ServiceRepository interface {
+	// Save inserts s at version 1 along with its first price
+	Save(ctx context.Context, s *Service) error
+	// Update stores s and, when its version moved, its new price, a
+	// ConflictError when it isn't at version anymore
+	Update(ctx context.Context, s *Service, version int) error
+	// FromID returns a NotFoundError when doctID has no such service
+	FromID(ctx context.Context, doctID, servID uuid.UUID) (*Service, error)
+	// List returns the active services of doctID, oldest first
+	List(ctx context.Context, doctID uuid.UUID) (Services, error)
+	// Prices returns the prices servID had, latest first
+	Prices(ctx context.Context, servID uuid.UUID) ([]ServicePrice, error)
+	// SoftDelete returns a NotFoundError when doctID has no such service
+	SoftDelete(ctx context.Context, doctID, servID uuid.UUID) error
+	// Specialized reports whether specID is one of the approved
+	// specializations of doctID
+	Specialized(ctx context.Context, doctID, specID uuid.UUID) (bool, error)
+	// ProcedureSpec returns the specialization of procID, a NotFoundError
+	// when there's no such procedure
+	ProcedureSpec(ctx context.Context, procID uuid.UUID) (uuid.UUID, error)
+}
+
+// SpecializationRepository persists the Specializations of doctors and
+// their SpecDocuments
+type SpecializationRepository interface {
+	// Add inserts s pending review, or makes s pending again when it was
+	// removed or rejected. A NotFoundError when the catalog has no such
+	// specialization, a ConflictError when s is pending or approved.
+	Add(ctx context.Context, s *Specialization) error
+	// FromID returns a NotFoundError when doctID has no such specialization
+	FromID(ctx context.Context, doctID, specID uuid.UUID) (*Specialization, error)
+	// List returns the specializations of doctID in statuses, all when
+	// statuses is empty, by name
+	List(ctx context.Context, doctID uuid.UUID, statuses []string) (Specializations, error)
+	// Pending returns a page of the specializations pending review, oldest
+	// first, and how many there are
+	Pending(ctx context.Context, limit, offset int) (Specializations, int, error)
+	// Review stores the status, reason and reviewer of s, a NotFoundError
+	// when there's no such specialization and a ConflictError when it isn't
+	// pending
+	Review(ctx context.Context, s *Specialization) error
+	// Remove returns a NotFoundError when doctID has no such specialization
+	Remove(ctx context.Context, doctID, specID uuid.UUID) error
+	SaveDocument(ctx context.Context, d *SpecDocument) error
+	// Documents returns the documents of a specialization without their
+	// content, oldest first
+	Documents(ctx context.Context, doctID, specID uuid.UUID) ([]SpecDocument, error)
+	// Document returns a NotFoundError when there's no such document
+	Document(ctx context.Context, dsdoID uuid.UUID) (*SpecDocument, error)
+}
+
+// Repos are the repositories bound to a single unit of work
+type Repos struct {
+	Users           UserRepository
+	Confirmations   ConfirmationRepository
+	Doctors         DoctorRepository
+	Patients        PatientRepository
+	Addresses       AddressRepository
+	Schedules       ScheduleRepository
+	Matchmaking     MatchmakingRepository
+	Matches         MatchRepository
+	CreditCards     CreditCardRepository
+	Payments        PaymentRepository
+	Banks           BankRepository
+	Payouts         PayoutRepository
+	Webhooks        WebhookRepository
+	Services        ServiceRepository
+	Specializations SpecializationRepository
+}
+
+// Store runs units of work against a storage backend
+type Store interface {
+	// Tx runs f with repositories bound to one transaction. The transaction
+	// is committed when f returns nil and rolled back when f returns an
+	// error or panics, in which case the panic is propagated.
+	Tx(ctx context.Context, f func(r Repos) error) error
+}
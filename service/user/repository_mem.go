@@ -0,0 +1,1510 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fignocius/echo-api/service/geo"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MemStore is an in-memory Store for unit tests. Units of work are
+// serialized and a failed one restores the state it started from.
+type MemStore struct {
+	mu   sync.Mutex
+	data memData
+}
+
+type memData struct {
+	users         map[uuid.UUID]User
+	confirmations map[uuid.UUID]ActionConfirmation
+	doctors       map[uuid.UUID]Doctor
+	patients      map[uuid.UUID]Patient
+	addresses     map[int]Address
+	schedules     memSchedulesData
+	matches       map[uuid.UUID]Match
+	matchHistory  map[uuid.UUID][]MatchStatusChange
+	creditCards   map[uuid.UUID]CreditCard
+	payments      map[uuid.UUID]Payment
+	paymentLedger map[uuid.UUID][]PaymentEntry
+	banks         map[uuid.UUID]Bank
+	payouts       map[uuid.UUID]Payout
+	payoutEntries map[uuid.UUID]PayoutEntry
+	webhooks      map[uuid.UUID]WebhookEvent
+	services      map[uuid.UUID]Service
+	servicePrices map[uuid.UUID][]ServicePrice
+	// doctorSpecs are the specializations of each doctor by spec_id
+	doctorSpecs map[uuid.UUID]map[uuid.UUID]Specialization
+	specDocs    map[uuid.UUID]SpecDocument
+	// offers by specialization and address, stats, the names of the
+	// specializations and the specialization of procedures are fixtures,
+	// never written by units of work
+	offers          map[uuid.UUID]map[int]DoctorOffer
+	stats           map[uuid.UUID]DoctorStats
+	specializations map[uuid.UUID]string
+	procedures      map[uuid.UUID]uuid.UUID
+}
+
+type memSchedulesData struct {
+	availabilities map[uuid.UUID]Availability
+	exceptions     map[uuid.UUID]AvailabilityException
+	sessions       map[uuid.UUID]SessionSchedule
+}
+
+func (d memSchedulesData) clone() memSchedulesData {
+	c := memSchedulesData{
+		availabilities: map[uuid.UUID]Availability{},
+		exceptions:     map[uuid.UUID]AvailabilityException{},
+		sessions:       map[uuid.UUID]SessionSchedule{},
+	}
+	for k, v := range d.availabilities {
+		c.availabilities[k] = v
+	}
+	for k, v := range d.exceptions {
+		c.exceptions[k] = v
+	}
+	for k, v := range d.sessions {
+		c.sessions[k] = v
+	}
+	return c
+}
+
+// NewMemStore creates an empty MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{data: memData{
+		users:           map[uuid.UUID]User{},
+		confirmations:   map[uuid.UUID]ActionConfirmation{},
+		doctors:         map[uuid.UUID]Doctor{},
+		patients:        map[uuid.UUID]Patient{},
+		addresses:       map[int]Address{},
+		schedules:       memSchedulesData{}.clone(),
+		matches:         map[uuid.UUID]Match{},
+		matchHistory:    map[uuid.UUID][]MatchStatusChange{},
+		creditCards:     map[uuid.UUID]CreditCard{},
+		payments:        map[uuid.UUID]Payment{},
+		paymentLedger:   map[uuid.UUID][]PaymentEntry{},
+		banks:           map[uuid.UUID]Bank{},
+		payouts:         map[uuid.UUID]Payout{},
+		payoutEntries:   map[uuid.UUID]PayoutEntry{},
+		webhooks:        map[uuid.UUID]WebhookEvent{},
+		services:        map[uuid.UUID]Service{},
+		servicePrices:   map[uuid.UUID][]ServicePrice{},
+		doctorSpecs:     map[uuid.UUID]map[uuid.UUID]Specialization{},
+		specDocs:        map[uuid.UUID]SpecDocument{},
+		offers:          map[uuid.UUID]map[int]DoctorOffer{},
+		stats:           map[uuid.UUID]DoctorStats{},
+		specializations: map[uuid.UUID]string{},
+		procedures:      map[uuid.UUID]uuid.UUID{},
+	}}
+}
+
+func (d memData) clone() memData {
+	c := memData{
+		users:           map[uuid.UUID]User{},
+		confirmations:   map[uuid.UUID]ActionConfirmation{},
+		doctors:         map[uuid.UUID]Doctor{},
+		patients:        map[uuid.UUID]Patient{},
+		addresses:       map[int]Address{},
+		schedules:       d.schedules.clone(),
+		matches:         map[uuid.UUID]Match{},
+		matchHistory:    map[uuid.UUID][]MatchStatusChange{},
+		creditCards:     map[uuid.UUID]CreditCard{},
+		payments:        map[uuid.UUID]Payment{},
+		paymentLedger:   map[uuid.UUID][]PaymentEntry{},
+		banks:           map[uuid.UUID]Bank{},
+		payouts:         map[uuid.UUID]Payout{},
+		payoutEntries:   map[uuid.UUID]PayoutEntry{},
+		webhooks:        map[uuid.UUID]WebhookEvent{},
+		services:        map[uuid.UUID]Service{},
+		servicePrices:   map[uuid.UUID][]ServicePrice{},
+		doctorSpecs:     map[uuid.UUID]map[uuid.UUID]Specialization{},
+		specDocs:        map[uuid.UUID]SpecDocument{},
+		offers:          d.offers,
+		stats:           d.stats,
+		specializations: d.specializations,
+		procedures:      d.procedures,
+	}
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+	for k, v := range d.confirmations {
+		c.confirmations[k] = v
+	}
+	for k, v := range d.doctors {
+		c.doctors[k] = v
+	}
+	for k, v := range d.patients {
+		c.patients[k] = v
+	}
+	for k, v := range d.addresses {
+		c.addresses[k] = v
+	}
+	for k, v := range d.matches {
+		c.matches[k] = v
+	}
+	for k, v := range d.matchHistory {
+		c.matchHistory[k] = append([]MatchStatusChange{}, v...)
+	}
+	for k, v := range d.creditCards {
+		c.creditCards[k] = v
+	}
+	for k, v := range d.payments {
+		c.payments[k] = v
+	}
+	for k, v := range d.paymentLedger {
+		c.paymentLedger[k] = append([]PaymentEntry{}, v...)
+	}
+	for k, v := range d.banks {
+		c.banks[k] = v
+	}
+	for k, v := range d.payouts {
+		c.payouts[k] = v
+	}
+	for k, v := range d.payoutEntries {
+		c.payoutEntries[k] = v
+	}
+	for k, v := range d.webhooks {
+		c.webhooks[k] = v
+	}
+	for k, v := range d.services {
+		c.services[k] = v
+	}
+	for k, v := range d.servicePrices {
+		c.servicePrices[k] = append([]ServicePrice{}, v...)
+	}
+	for k, v := range d.doctorSpecs {
+		c.doctorSpecs[k] = map[uuid.UUID]Specialization{}
+		for spec, s := range v {
+			c.doctorSpecs[k][spec] = s
+		}
+	}
+	for k, v := range d.specDocs {
+		c.specDocs[k] = v
+	}
+	return c
+}
+
+// Tx implements Store. f must not start another Tx on the same MemStore.
+func (s *MemStore) Tx(ctx context.Context, f func(r Repos) error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.data.clone()
+	defer func() {
+		if p := recover(); p != nil {
+			s.data = snapshot
+			panic(p)
+		}
+		if err != nil {
+			s.data = snapshot
+		}
+	}()
+
+	return f(Repos{
+		Users:           &memUsers{s},
+		Confirmations:   &memConfirmations{s},
+		Doctors:         &memDoctors{s},
+		Patients:        &memPatients{s},
+		Addresses:       &memAddresses{s},
+		Schedules:       &memSchedules{s},
+		Matchmaking:     &memMatchmaking{s},
+		Matches:         &memMatches{s},
+		CreditCards:     &memCreditCards{s},
+		Payments:        &memPayments{s},
+		Banks:           &memBanks{s},
+		Payouts:         &memPayouts{s},
+		Webhooks:        &memWebhooks{s},
+		Services:        &memServices{s},
+		Specializations: &memSpecializations{s},
+	})
+}
+
+type memUsers struct {
+	s *MemStore
+}
+
+func (r *memUsers) Save(ctx context.Context, u *User) (*User, error) {
+	if _, err := r.FromEmail(ctx, u.Email); err == nil {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"email": "Email already registered"},
+		}
+	}
+	u.CreatedAt = time.Now()
+	r.s.data.users[u.UserID] = *u
+	return u, nil
+}
+
+func (r *memUsers) Update(ctx context.Context, u *User) (*User, error) {
+	cur, ok := r.s.data.users[u.UserID]
+	if !ok {
+		return nil, errors.Wrap(sql.ErrNoRows, "Error user update sql")
+	}
+	cur.Role = u.Role
+	r.s.data.users[u.UserID] = cur
+	*u = cur
+	return u, nil
+}
+
+func (r *memUsers) UpdateEmail(ctx context.Context, userID uuid.UUID, email string) error {
+	cur, ok := r.s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	cur.Email = email
+	r.s.data.users[userID] = cur
+	return nil
+}
+
+func (r *memUsers) UpdatePassword(ctx context.Context, userID uuid.UUID, pass []byte) error {
+	cur, ok := r.s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	cur.Password = pass
+	r.s.data.users[userID] = cur
+	return nil
+}
+
+func (r *memUsers) UpdateInfo(ctx context.Context, userID uuid.UUID, info Info) error {
+	cur, ok := r.s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	cur.Info = info
+	r.s.data.users[userID] = cur
+	return nil
+}
+
+func (r *memUsers) FromID(ctx context.Context, userID uuid.UUID) (*User, error) {
+	u, ok := r.s.data.users[userID]
+	if !ok || u.DeletedAt.Valid {
+		return &User{}, &auth.UserNotFoundError{
+			Message: "No user whit this id: " + userID.String(),
+		}
+	}
+	return &u, nil
+}
+
+func (r *memUsers) FromEmail(ctx context.Context, email string) (*User, error) {
+	for _, u := range r.s.data.users {
+		if strings.EqualFold(u.Email, email) && !u.DeletedAt.Valid {
+			return &u, nil
+		}
+	}
+	return &User{}, &auth.UserNotFoundError{
+		Message: "No user with this email: " + email,
+	}
+}
+
+func (r *memUsers) SoftDelete(ctx context.Context, userID uuid.UUID) error {
+	cur, ok := r.s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.users[userID] = cur
+	return nil
+}
+
+type memConfirmations struct {
+	s *MemStore
+}
+
+func (r *memConfirmations) Save(ctx context.Context, c *ActionConfirmation) error {
+	c.CreatedAt = time.Now()
+	r.s.data.confirmations[c.AcveID] = *c
+	return nil
+}
+
+func (r *memConfirmations) Delete(ctx context.Context, c *ActionConfirmation) error {
+	cur, ok := r.s.data.confirmations[c.AcveID]
+	if !ok || cur.UserID != c.UserID {
+		return nil
+	}
+	now := time.Now()
+	cur.DeletedAt = &now
+	r.s.data.confirmations[c.AcveID] = cur
+	return nil
+}
+
+func (r *memConfirmations) FromID(ctx context.Context, acveID string) (*ActionConfirmation, error) {
+	id, err := uuid.FromString(acveID)
+	c, ok := r.s.data.confirmations[id]
+	if err != nil || !ok || c.DeletedAt != nil {
+		return &ActionConfirmation{}, &auth.PwdResetInvalidError{
+			Message: "No such reset token: " + acveID,
+		}
+	}
+	return &c, nil
+}
+
+type memDoctors struct {
+	s *MemStore
+}
+
+func (r *memDoctors) Save(ctx context.Context, d *Doctor) error {
+	for _, o := range r.s.data.doctors {
+		if o.CRM == d.CRM && !o.DeletedAt.Valid {
+			return &auth.ValidationError{
+				Messages: map[string]string{"crm": "CRM already registered"},
+			}
+		}
+	}
+	d.CreatedAt = time.Now()
+	r.s.data.doctors[d.DoctID] = *d
+	return nil
+}
+
+func (r *memDoctors) Update(ctx context.Context, d *Doctor) error {
+	cur, ok := r.s.data.doctors[d.DoctID]
+	if !ok {
+		return nil
+	}
+	for _, o := range r.s.data.doctors {
+		if o.CRM == d.CRM && o.DoctID != d.DoctID && !o.DeletedAt.Valid {
+			return &auth.ValidationError{
+				Messages: map[string]string{"crm": "CRM already registered"},
+			}
+		}
+	}
+	cur.Name, cur.CRM, cur.Documents = d.Name, d.CRM, d.Documents
+	r.s.data.doctors[d.DoctID] = cur
+	return nil
+}
+
+// withUser fills the user columns a doctor is read with
+func (r *memDoctors) withUser(d Doctor) *Doctor {
+	u := r.s.data.users[d.UserID]
+	d.Email, d.Info, d.Role = u.Email, u.Info, u.Role
+	return &d
+}
+
+func (r *memDoctors) FromID(ctx context.Context, doctID uuid.UUID) (*Doctor, error) {
+	d, ok := r.s.data.doctors[doctID]
+	if !ok || d.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{
+			Message: "No doctor with this id: " + doctID.String(),
+		}
+	}
+	return r.withUser(d), nil
+}
+
+func (r *memDoctors) FromUserID(ctx context.Context, userID uuid.UUID) (*Doctor, error) {
+	for _, d := range r.s.data.doctors {
+		if d.UserID == userID && !d.DeletedAt.Valid {
+			return r.withUser(d), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *memDoctors) Near(ctx context.Context, q NearQuery) ([]DoctorDistance, error) {
+	nearest := map[uuid.UUID]DoctorDistance{}
+	for _, a := range r.s.data.addresses {
+		d, ok := r.s.data.doctors[a.DoctID]
+		p, placed := a.Point()
+		if !ok || !placed || d.DeletedAt.Valid || a.DeletedAt.Valid {
+			continue
+		}
+		if q.SpecID != nil {
+			sp, ok := r.s.data.doctorSpecs[d.DoctID][*q.SpecID]
+			if !ok || sp.Status != SpecApproved || sp.DeletedAt.Valid {
+				continue
+			}
+		}
+		km := geo.Haversine(q.Point, p)
+		if cur, ok := nearest[d.DoctID]; km > q.RadiusKm || ok && cur.DistanceKm <= km {
+			continue
+		}
+		nearest[d.DoctID] = DoctorDistance{DoctID: d.DoctID, Name: d.Name, CRM: d.CRM, Address: a, DistanceKm: km}
+	}
+	ds := []DoctorDistance{}
+	for _, d := range nearest {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].DistanceKm < ds[j].DistanceKm })
+	if q.Limit > 0 && uint64(len(ds)) > q.Limit {
+		ds = ds[:q.Limit]
+	}
+	return ds, nil
+}
+
+type memPatients struct {
+	s *MemStore
+}
+
+func (r *memPatients) Save(ctx context.Context, p *Patient) error {
+	for _, o := range r.s.data.patients {
+		if o.CPFIndex == p.CPFIndex && !o.DeletedAt.Valid {
+			return &auth.ValidationError{
+				Messages: map[string]string{"cpf": "CPF already registered"},
+			}
+		}
+	}
+	p.CreatedAt = time.Now()
+	r.s.data.patients[p.PatiID] = *p
+	return nil
+}
+
+func (r *memPatients) Update(ctx context.Context, p *Patient) error {
+	cur, ok := r.s.data.patients[p.PatiID]
+	if !ok {
+		return nil
+	}
+	for _, o := range r.s.data.patients {
+		if o.CPFIndex == p.CPFIndex && o.PatiID != p.PatiID && !o.DeletedAt.Valid {
+			return &auth.ValidationError{
+				Messages: map[string]string{"cpf": "CPF already registered"},
+			}
+		}
+	}
+	cur.Name, cur.CPF, cur.CPFIndex, cur.RG = p.Name, p.CPF, p.CPFIndex, p.RG
+	cur.Address, cur.Documents = p.Address, p.Documents
+	r.s.data.patients[p.PatiID] = cur
+	return nil
+}
+
+// withUser fills the user columns a patient is read with
+func (r *memPatients) withUser(p Patient) *Patient {
+	u := r.s.data.users[p.UserID]
+	p.Email, p.Info, p.Role = u.Email, u.Info, u.Role
+	return &p
+}
+
+func (r *memPatients) FromID(ctx context.Context, patiID uuid.UUID) (*Patient, error) {
+	p, ok := r.s.data.patients[patiID]
+	if !ok || p.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{
+			Message: "No patient with this id: " + patiID.String(),
+		}
+	}
+	return r.withUser(p), nil
+}
+
+func (r *memPatients) FromCPFIndex(ctx context.Context, index string) (*Patient, error) {
+	for _, p := range r.s.data.patients {
+		if p.CPFIndex == index && !p.DeletedAt.Valid {
+			return r.withUser(p), nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No patient with this CPF"}
+}
+
+func (r *memPatients) FromUserID(ctx context.Context, userID uuid.UUID) (*Patient, error) {
+	for _, p := range r.s.data.patients {
+		if p.UserID == userID && !p.DeletedAt.Valid {
+			return r.withUser(p), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+type memAddresses struct {
+	s *MemStore
+}
+
+func (r *memAddresses) Save(ctx context.Context, a *Address) error {
+	a.AddrID = len(r.s.data.addresses) + 1
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = a.CreatedAt
+	r.s.data.addresses[a.AddrID] = *a
+	return nil
+}
+
+func (r *memAddresses) Update(ctx context.Context, a *Address) error {
+	cur, err := r.FromID(ctx, a.DoctID, a.AddrID)
+	if err != nil {
+		return err
+	}
+	a.CreatedAt, a.UpdatedAt = cur.CreatedAt, time.Now()
+	r.s.data.addresses[a.AddrID] = *a
+	return nil
+}
+
+func (r *memAddresses) FromID(ctx context.Context, doctID uuid.UUID, addrID int) (*Address, error) {
+	a, ok := r.s.data.addresses[addrID]
+	if !ok || a.DoctID != doctID || a.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No such address"}
+	}
+	return &a, nil
+}
+
+func (r *memAddresses) List(ctx context.Context, doctID uuid.UUID) (*Addresses, error) {
+	as := Addresses{}
+	for _, a := range r.s.data.addresses {
+		if a.DoctID == doctID && !a.DeletedAt.Valid {
+			as = append(as, a)
+		}
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].AddrID < as[j].AddrID })
+	return &as, nil
+}
+
+func (r *memAddresses) ClearPrimary(ctx context.Context, doctID uuid.UUID) error {
+	for id, a := range r.s.data.addresses {
+		if a.DoctID == doctID && a.Primary {
+			a.Primary = false
+			r.s.data.addresses[id] = a
+		}
+	}
+	return nil
+}
+
+func (r *memAddresses) Services(ctx context.Context, addrID int) (int, error) {
+	n := 0
+	for _, s := range r.s.data.services {
+		if s.AddrID == addrID && !s.DeletedAt.Valid {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memAddresses) RemoveServices(ctx context.Context, addrID int) error {
+	now := time.Now()
+	for id, s := range r.s.data.services {
+		if s.AddrID == addrID && !s.DeletedAt.Valid {
+			s.DeletedAt = null.TimeFrom(now)
+			s.UpdatedAt = now
+			r.s.data.services[id] = s
+		}
+	}
+	return nil
+}
+
+func (r *memAddresses) SoftDelete(ctx context.Context, doctID uuid.UUID, addrID int) error {
+	cur, err := r.FromID(ctx, doctID, addrID)
+	if err != nil {
+		return err
+	}
+	cur.Primary = false
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.addresses[addrID] = *cur
+	return nil
+}
+
+type memSchedules struct {
+	s *MemStore
+}
+
+func (r *memSchedules) SaveAvailability(ctx context.Context, av *Availability) error {
+	av.CreatedAt = time.Now()
+	r.s.data.schedules.availabilities[av.AvaiID] = *av
+	return nil
+}
+
+func (r *memSchedules) Availabilities(ctx context.Context, doctID uuid.UUID) ([]Availability, error) {
+	avs := []Availability{}
+	for _, av := range r.s.data.schedules.availabilities {
+		a, ok := r.s.data.addresses[av.AddrID]
+		if av.DoctID == doctID && !av.DeletedAt.Valid && ok && !a.DeletedAt.Valid {
+			avs = append(avs, av)
+		}
+	}
+	sort.Slice(avs, func(i, j int) bool {
+		if avs[i].Weekday == avs[j].Weekday {
+			return avs[i].Starts < avs[j].Starts
+		}
+		return avs[i].Weekday < avs[j].Weekday
+	})
+	return avs, nil
+}
+
+func (r *memSchedules) RemoveAvailability(ctx context.Context, doctID, avaiID uuid.UUID) error {
+	av, ok := r.s.data.schedules.availabilities[avaiID]
+	if !ok || av.DoctID != doctID || av.DeletedAt.Valid {
+		return &auth.NotFoundError{Message: "No such availability"}
+	}
+	av.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.schedules.availabilities[avaiID] = av
+	return nil
+}
+
+func (r *memSchedules) SaveException(ctx context.Context, e *AvailabilityException) error {
+	e.CreatedAt = time.Now()
+	r.s.data.schedules.exceptions[e.AvexID] = *e
+	return nil
+}
+
+func (r *memSchedules) Exceptions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]AvailabilityException, error) {
+	exs := []AvailabilityException{}
+	for _, e := range r.s.data.schedules.exceptions {
+		if e.DoctID == doctID && !e.DeletedAt.Valid && overlaps(e.StartsAt, e.EndsAt, from, to) {
+			exs = append(exs, e)
+		}
+	}
+	return exs, nil
+}
+
+func (r *memSchedules) RemoveException(ctx context.Context, doctID, avexID uuid.UUID) error {
+	e, ok := r.s.data.schedules.exceptions[avexID]
+	if !ok || e.DoctID != doctID || e.DeletedAt.Valid {
+		return &auth.NotFoundError{Message: "No such exception"}
+	}
+	e.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.schedules.exceptions[avexID] = e
+	return nil
+}
+
+func (r *memSchedules) Sessions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]SessionSchedule, error) {
+	ss := []SessionSchedule{}
+	for _, s := range r.s.data.schedules.sessions {
+		if s.DoctID == doctID && !s.CanceledAt.Valid && overlaps(s.StartsAt, s.EndsAt, from, to) {
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+// LockDoctor has nothing to do, units of work are already serialized
+func (r *memSchedules) LockDoctor(ctx context.Context, doctID uuid.UUID) error {
+	d, ok := r.s.data.doctors[doctID]
+	if !ok || d.DeletedAt.Valid {
+		return &auth.NotFoundError{Message: "No doctor with this id: " + doctID.String()}
+	}
+	return nil
+}
+
+func (r *memSchedules) Book(ctx context.Context, s *SessionSchedule) error {
+	for _, o := range r.s.data.schedules.sessions {
+		if o.DoctID == s.DoctID && o.StartsAt.Equal(s.StartsAt) && !o.CanceledAt.Valid {
+			return &auth.ConflictError{Message: "Slot is not available"}
+		}
+	}
+	s.CreatedAt = time.Now()
+	r.s.data.schedules.sessions[s.SescID] = *s
+	return nil
+}
+
+func (r *memSchedules) CancelSession(ctx context.Context, sescID uuid.UUID) error {
+	ss, ok := r.s.data.schedules.sessions[sescID]
+	if ok && !ss.CanceledAt.Valid {
+		ss.CanceledAt = null.TimeFrom(time.Now())
+		r.s.data.schedules.sessions[sescID] = ss
+	}
+	return nil
+}
+
+// memMatchmaking reads the offers and stats fixtures of the MemStore
+type memMatchmaking struct {
+	s *MemStore
+}
+
+func (r *memMatchmaking) Offers(ctx context.Context, specID uuid.UUID, doctIDs []uuid.UUID) ([]DoctorOffer, error) {
+	ids := map[uuid.UUID]bool{}
+	for _, id := range doctIDs {
+		ids[id] = true
+	}
+	offers := []DoctorOffer{}
+	for _, o := range r.s.data.offers[specID] {
+		sp, ok := r.s.data.doctorSpecs[o.DoctID][specID]
+		if ids[o.DoctID] && ok && sp.Status == SpecApproved && !sp.DeletedAt.Valid {
+			offers = append(offers, o)
+		}
+	}
+	return offers, nil
+}
+
+func (r *memMatchmaking) Stats(ctx context.Context, doctIDs []uuid.UUID) ([]DoctorStats, error) {
+	sts := []DoctorStats{}
+	for _, id := range doctIDs {
+		st, ok := r.s.data.stats[id]
+		if !ok {
+			st = DoctorStats{DoctID: id}
+		}
+		sts = append(sts, st)
+	}
+	return sts, nil
+}
+
+type memMatches struct {
+	s *MemStore
+}
+
+func (r *memMatches) Save(ctx context.Context, m *Match) error {
+	m.Version = 1
+	m.CreatedAt = time.Now()
+	m.UpdatedAt = m.CreatedAt
+	stored := *m
+	stored.History = nil
+	r.s.data.matches[m.MatcID] = stored
+	return nil
+}
+
+func (r *memMatches) FromID(ctx context.Context, matcID uuid.UUID) (*Match, error) {
+	m, ok := r.s.data.matches[matcID]
+	if !ok || m.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No match with this id: " + matcID.String()}
+	}
+	return &m, nil
+}
+
+func (r *memMatches) UpdateStatus(ctx context.Context, m *Match, version int) error {
+	stored, ok := r.s.data.matches[m.MatcID]
+	if !ok || stored.DeletedAt.Valid || stored.Version != version {
+		return &auth.ConflictError{Message: "Match was changed since, reload it"}
+	}
+	stored.Status = m.Status
+	stored.CancelFee = m.CancelFee
+	stored.CanceledAt = m.CanceledAt
+	stored.Version++
+	stored.UpdatedAt = time.Now()
+	r.s.data.matches[m.MatcID] = stored
+	m.Version, m.UpdatedAt = stored.Version, stored.UpdatedAt
+	return nil
+}
+
+func (r *memMatches) Expirable(ctx context.Context, before time.Time, limit int) ([]Match, error) {
+	ms := []Match{}
+	for _, m := range r.s.data.matches {
+		if m.Status == MatchProposed && !m.DeletedAt.Valid && m.CreatedAt.Before(before) {
+			ms = append(ms, m)
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].CreatedAt.Before(ms[j].CreatedAt) })
+	if len(ms) > limit {
+		ms = ms[:limit]
+	}
+	return ms, nil
+}
+
+func (r *memMatches) AddChange(ctx context.Context, c *MatchStatusChange) error {
+	c.CreatedAt = time.Now()
+	r.s.data.matchHistory[c.MatcID] = append(r.s.data.matchHistory[c.MatcID], *c)
+	return nil
+}
+
+func (r *memMatches) History(ctx context.Context, matcID uuid.UUID) ([]MatchStatusChange, error) {
+	return append([]MatchStatusChange{}, r.s.data.matchHistory[matcID]...), nil
+}
+
+func (r *memMatches) List(ctx context.Context, q MatchHistoryQuery) ([]MatchHistory, int, error) {
+	statuses := map[MatchStatus]bool{}
+	for _, st := range q.Statuses {
+		statuses[st] = true
+	}
+	from, to := q.From.Format("2006-01-02"), q.To.Format("2006-01-02")
+	hs := []MatchHistory{}
+	for _, m := range r.s.data.matches {
+		date := m.Date.Format("2006-01-02")
+		switch {
+		case m.DeletedAt.Valid, date < from, date > to,
+			q.PatiID != nil && m.PatiID != *q.PatiID,
+			q.DoctID != nil && m.DoctID != *q.DoctID,
+			len(statuses) > 0 && !statuses[m.Status],
+			q.SpecID != nil && (m.SpecID == nil || *m.SpecID != *q.SpecID),
+			q.PriceMin > 0 && m.Price < q.PriceMin,
+			q.PriceMax > 0 && m.Price > q.PriceMax:
+			continue
+		}
+		h := MatchHistory{
+			MatcID:    m.MatcID,
+			SpecID:    m.SpecID,
+			Date:      m.Date,
+			Time:      m.Time,
+			Price:     m.Price,
+			Type:      m.Type,
+			Status:    m.Status,
+			CancelFee: m.CancelFee,
+			Doctor:    r.s.data.doctors[m.DoctID].Name,
+			Patient:   r.s.data.patients[m.PatiID].Name,
+			CreatedAt: m.CreatedAt,
+		}
+		if changes := r.s.data.matchHistory[m.MatcID]; len(changes) > 0 {
+			h.StatusAt = null.TimeFrom(changes[len(changes)-1].CreatedAt)
+		}
+		if m.AddrID.Valid {
+			h.Address = r.s.data.addresses[int(m.AddrID.Int64)]
+		}
+		hs = append(hs, h)
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if !hs[i].Date.Equal(hs[j].Date) {
+			return hs[i].Date.After(hs[j].Date)
+		}
+		return hs[i].Time > hs[j].Time
+	})
+	total := len(hs)
+	if q.Offset > len(hs) {
+		q.Offset = len(hs)
+	}
+	hs = hs[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(hs) {
+		hs = hs[:q.Limit]
+	}
+	return hs, total, nil
+}
+
+type memCreditCards struct {
+	s *MemStore
+}
+
+func (r *memCreditCards) Save(ctx context.Context, c *CreditCard) error {
+	c.CrcaID, _ = uuid.NewV4()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	r.s.data.creditCards[c.CrcaID] = *c
+	return nil
+}
+
+func (r *memCreditCards) Update(ctx context.Context, c *CreditCard) error {
+	cur, err := r.FromID(ctx, c.PatiID, c.CrcaID)
+	if err != nil {
+		return err
+	}
+	cur.Default = c.Default
+	cur.UpdatedAt = time.Now()
+	c.UpdatedAt = cur.UpdatedAt
+	r.s.data.creditCards[c.CrcaID] = *cur
+	return nil
+}
+
+func (r *memCreditCards) FromID(ctx context.Context, patiID, crcaID uuid.UUID) (*CreditCard, error) {
+	c, ok := r.s.data.creditCards[crcaID]
+	if !ok || c.PatiID != patiID || c.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No such credit card"}
+	}
+	return &c, nil
+}
+
+func (r *memCreditCards) List(ctx context.Context, patiID uuid.UUID) ([]CreditCard, error) {
+	cs := []CreditCard{}
+	for _, c := range r.s.data.creditCards {
+		if c.PatiID == patiID && !c.DeletedAt.Valid {
+			cs = append(cs, c)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Default != cs[j].Default {
+			return cs[i].Default
+		}
+		return cs[i].CreatedAt.After(cs[j].CreatedAt)
+	})
+	return cs, nil
+}
+
+func (r *memCreditCards) ClearDefault(ctx context.Context, patiID uuid.UUID) error {
+	for id, c := range r.s.data.creditCards {
+		if c.PatiID == patiID && c.Default {
+			c.Default = false
+			r.s.data.creditCards[id] = c
+		}
+	}
+	return nil
+}
+
+func (r *memCreditCards) SoftDelete(ctx context.Context, patiID, crcaID uuid.UUID) error {
+	cur, err := r.FromID(ctx, patiID, crcaID)
+	if err != nil {
+		return err
+	}
+	cur.Default = false
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.creditCards[crcaID] = *cur
+	return nil
+}
+
+type memPayments struct {
+	s *MemStore
+}
+
+func (r *memPayments) Save(ctx context.Context, p *Payment) error {
+	for _, o := range r.s.data.payments {
+		if o.MatcID == p.MatcID {
+			return &auth.ConflictError{Message: "Match already has a payment"}
+		}
+	}
+	p.PaymID, _ = uuid.NewV4()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	stored := *p
+	stored.Ledger = nil
+	r.s.data.payments[p.PaymID] = stored
+	return nil
+}
+
+func (r *memPayments) Update(ctx context.Context, p *Payment) error {
+	stored, ok := r.s.data.payments[p.PaymID]
+	if !ok {
+		return &auth.NotFoundError{Message: "No such payment"}
+	}
+	stored.GatewayID, stored.Status = p.GatewayID, p.Status
+	stored.Captured, stored.Voided, stored.Refunded = p.Captured, p.Voided, p.Refunded
+	stored.UpdatedAt = time.Now()
+	p.UpdatedAt = stored.UpdatedAt
+	r.s.data.payments[p.PaymID] = stored
+	return nil
+}
+
+func (r *memPayments) FromMatch(ctx context.Context, matcID uuid.UUID) (*Payment, error) {
+	for _, p := range r.s.data.payments {
+		if p.MatcID == matcID {
+			return &p, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No payment for this match: " + matcID.String()}
+}
+
+func (r *memPayments) FromGateway(ctx context.Context, gatewayID string) (*Payment, error) {
+	for _, p := range r.s.data.payments {
+		if p.GatewayID.Valid && p.GatewayID.String == gatewayID {
+			return &p, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No payment with this gateway id: " + gatewayID}
+}
+
+func (r *memPayments) AddEntry(ctx context.Context, e *PaymentEntry) error {
+	e.PaleID, _ = uuid.NewV4()
+	e.CreatedAt = time.Now()
+	r.s.data.paymentLedger[e.PaymID] = append(r.s.data.paymentLedger[e.PaymID], *e)
+	return nil
+}
+
+func (r *memPayments) Ledger(ctx context.Context, paymID uuid.UUID) ([]PaymentEntry, error) {
+	return append([]PaymentEntry{}, r.s.data.paymentLedger[paymID]...), nil
+}
+
+func (r *memPayments) Unsettled(ctx context.Context, before time.Time, limit int) ([]Payment, error) {
+	ps := []Payment{}
+	for _, p := range r.s.data.payments {
+		m := r.s.data.matches[p.MatcID]
+		ended := m.Status == MatchCompleted || m.Status == MatchNoShow || m.Status.Canceled()
+		owes := p.Status == PaymentPending && (m.Status == MatchConfirmed || m.Status == MatchCheckedIn) ||
+			p.Status == PaymentAuthorized && ended ||
+			p.Status == PaymentCaptured && ended && m.Status != MatchCompleted && p.Captured-p.Refunded > m.CancelFee
+		if owes && p.UpdatedAt.Before(before) {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].UpdatedAt.Before(ps[j].UpdatedAt) })
+	if len(ps) > limit {
+		ps = ps[:limit]
+	}
+	return ps, nil
+}
+
+func (r *memPayments) Claim(ctx context.Context, paymID uuid.UUID, updatedAt time.Time) (bool, error) {
+	p, ok := r.s.data.payments[paymID]
+	if !ok || !p.UpdatedAt.Equal(updatedAt) {
+		return false, nil
+	}
+	p.UpdatedAt = time.Now()
+	r.s.data.payments[paymID] = p
+	return true, nil
+}
+
+type memBanks struct {
+	s *MemStore
+}
+
+func (r *memBanks) Save(ctx context.Context, b *Bank) error {
+	if _, err := r.FromDoctor(ctx, b.DoctID); err == nil {
+		return &auth.ConflictError{Message: "Doctor already has a bank account, update it instead"}
+	}
+	b.BankID, _ = uuid.NewV4()
+	b.CreatedAt = time.Now()
+	r.s.data.banks[b.BankID] = *b
+	return nil
+}
+
+func (r *memBanks) FromDoctor(ctx context.Context, doctID uuid.UUID) (*Bank, error) {
+	for _, b := range r.s.data.banks {
+		if b.DoctID == doctID && !b.DeletedAt.Valid {
+			return &b, nil
+		}
+	}
+	return nil, &auth.NotFoundError{Message: "No bank account for this doctor: " + doctID.String()}
+}
+
+func (r *memBanks) SoftDelete(ctx context.Context, doctID uuid.UUID) error {
+	b, err := r.FromDoctor(ctx, doctID)
+	if err != nil {
+		return err
+	}
+	b.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.banks[b.BankID] = *b
+	return nil
+}
+
+type memPayouts struct {
+	s *MemStore
+}
+
+func (r *memPayouts) Bookable(ctx context.Context, before time.Time, limit int) ([]PayoutEntry, error) {
+	booked := map[uuid.UUID]bool{}
+	for _, e := range r.s.data.payoutEntries {
+		booked[e.PaymID] = true
+	}
+	ps := []Payment{}
+	for _, p := range r.s.data.payments {
+		m := r.s.data.matches[p.MatcID]
+		gross := p.Captured - p.Refunded
+		settled := m.Status == MatchCompleted ||
+			(m.Status == MatchNoShow || m.Status.Canceled()) && gross <= m.CancelFee
+		if !booked[p.PaymID] && p.Status == PaymentCaptured && gross > 0 && settled && p.UpdatedAt.Before(before) {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].UpdatedAt.Before(ps[j].UpdatedAt) })
+	if len(ps) > limit {
+		ps = ps[:limit]
+	}
+	es := []PayoutEntry{}
+	for _, p := range ps {
+		es = append(es, PayoutEntry{
+			DoctID: r.s.data.matches[p.MatcID].DoctID,
+			PaymID: p.PaymID,
+			MatcID: p.MatcID,
+			Gross:  p.Captured - p.Refunded,
+		})
+	}
+	return es, nil
+}
+
+func (r *memPayouts) AddEntry(ctx context.Context, e *PayoutEntry) error {
+	for _, o := range r.s.data.payoutEntries {
+		if o.PaymID == e.PaymID && o.Reverses == nil {
+			return nil
+		}
+	}
+	e.PoenID, _ = uuid.NewV4()
+	e.CreatedAt = time.Now()
+	r.s.data.payoutEntries[e.PoenID] = *e
+	return nil
+}
+
+func (r *memPayouts) Reverse(ctx context.Context, paymID uuid.UUID) error {
+	var booked *PayoutEntry
+	for _, o := range r.s.data.payoutEntries {
+		if o.PaymID == paymID && o.Reverses != nil {
+			return nil
+		}
+		if o.PaymID == paymID {
+			o := o
+			booked = &o
+		}
+	}
+	if booked == nil {
+		return nil
+	}
+	if booked.PayoID == nil {
+		delete(r.s.data.payoutEntries, booked.PoenID)
+		return nil
+	}
+	rev := PayoutEntry{
+		DoctID:     booked.DoctID,
+		PaymID:     booked.PaymID,
+		MatcID:     booked.MatcID,
+		Gross:      -booked.Gross,
+		Commission: -booked.Commission,
+		Net:        -booked.Net,
+		Reverses:   &booked.PoenID,
+		CreatedAt:  time.Now(),
+	}
+	rev.PoenID, _ = uuid.NewV4()
+	r.s.data.payoutEntries[rev.PoenID] = rev
+	return nil
+}
+
+func (r *memPayouts) Payees(ctx context.Context) ([]uuid.UUID, error) {
+	seen := map[uuid.UUID]bool{}
+	ids := []uuid.UUID{}
+	for _, e := range r.s.data.payoutEntries {
+		if e.PayoID == nil && !seen[e.DoctID] {
+			seen[e.DoctID] = true
+			ids = append(ids, e.DoctID)
+		}
+	}
+	return ids, nil
+}
+
+func (r *memPayouts) Unpaid(ctx context.Context, doctID uuid.UUID) ([]PayoutEntry, error) {
+	return r.entries(func(e PayoutEntry) bool { return e.DoctID == doctID && e.PayoID == nil }), nil
+}
+
+func (r *memPayouts) Entries(ctx context.Context, payoID uuid.UUID) ([]PayoutEntry, error) {
+	return r.entries(func(e PayoutEntry) bool { return e.PayoID != nil && *e.PayoID == payoID }), nil
+}
+
+func (r *memPayouts) entries(match func(e PayoutEntry) bool) []PayoutEntry {
+	es := []PayoutEntry{}
+	for _, e := range r.s.data.payoutEntries {
+		if match(e) {
+			es = append(es, e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].CreatedAt.Before(es[j].CreatedAt) })
+	return es
+}
+
+func (r *memPayouts) Save(ctx context.Context, p *Payout) error {
+	p.PayoID, _ = uuid.NewV4()
+	p.CreatedAt = time.Now()
+	stored := *p
+	stored.Entries = nil
+	r.s.data.payouts[p.PayoID] = stored
+	return nil
+}
+
+func (r *memPayouts) Assign(ctx context.Context, payoID uuid.UUID, poenIDs []uuid.UUID) error {
+	for _, id := range poenIDs {
+		e, ok := r.s.data.payoutEntries[id]
+		if !ok || e.PayoID != nil {
+			return &auth.ConflictError{Message: "Payout entries already paid"}
+		}
+		e.PayoID = &payoID
+		r.s.data.payoutEntries[id] = e
+	}
+	return nil
+}
+
+func (r *memPayouts) SetStatus(ctx context.Context, p *Payout) error {
+	cur, ok := r.s.data.payouts[p.PayoID]
+	if !ok {
+		return &auth.NotFoundError{Message: "No such payout"}
+	}
+	if cur.Status != PayoutScheduled {
+		return &auth.ConflictError{Message: "The payout is " + cur.Status + " already"}
+	}
+	cur.Status = p.Status
+	if p.Status == PayoutPaid {
+		cur.PaidAt = null.TimeFrom(time.Now())
+	}
+	if p.Status == PayoutFailed {
+		for id, e := range r.s.data.payoutEntries {
+			if e.PayoID != nil && *e.PayoID == p.PayoID {
+				e.PayoID = nil
+				r.s.data.payoutEntries[id] = e
+			}
+		}
+	}
+	r.s.data.payouts[p.PayoID] = cur
+	*p = cur
+	return nil
+}
+
+func (r *memPayouts) List(ctx context.Context, doctID uuid.UUID, limit, offset int) ([]Payout, int, error) {
+	ps := []Payout{}
+	for _, p := range r.s.data.payouts {
+		if p.DoctID == doctID {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].CreatedAt.After(ps[j].CreatedAt) })
+	total := len(ps)
+	if limit > 0 {
+		if offset > len(ps) {
+			offset = len(ps)
+		}
+		ps = ps[offset:]
+		if len(ps) > limit {
+			ps = ps[:limit]
+		}
+	}
+	return ps, total, nil
+}
+
+type memWebhooks struct {
+	s *MemStore
+}
+
+func (r *memWebhooks) pending(provider, eventID string) (WebhookEvent, bool) {
+	for _, e := range r.s.data.webhooks {
+		if e.Provider == provider && e.EventID == eventID && e.Status == WebhookPending {
+			return e, true
+		}
+	}
+	return WebhookEvent{}, false
+}
+
+func (r *memWebhooks) Save(ctx context.Context, e *WebhookEvent) (bool, error) {
+	if o, ok := r.pending(e.Provider, e.EventID); ok {
+		o.UpdatedAt = time.Now()
+		r.s.data.webhooks[o.WeheID] = o
+		*e = o
+		return false, nil
+	}
+	e.WeheID, _ = uuid.NewV4()
+	e.Status = WebhookPending
+	e.ReceivedAt = time.Now()
+	e.UpdatedAt = e.ReceivedAt
+	r.s.data.webhooks[e.WeheID] = *e
+	return true, nil
+}
+
+func (r *memWebhooks) Pending(ctx context.Context, limit int) ([]WebhookEvent, error) {
+	es := []WebhookEvent{}
+	for _, e := range r.s.data.webhooks {
+		if e.Status == WebhookPending {
+			es = append(es, e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].UpdatedAt.Before(es[j].UpdatedAt) })
+	if len(es) > limit {
+		es = es[:limit]
+	}
+	return es, nil
+}
+
+func (r *memWebhooks) Claim(ctx context.Context, e *WebhookEvent) (bool, error) {
+	stored, ok := r.s.data.webhooks[e.WeheID]
+	if !ok || !stored.UpdatedAt.Equal(e.UpdatedAt) {
+		return false, nil
+	}
+	stored.UpdatedAt = time.Now()
+	r.s.data.webhooks[e.WeheID] = stored
+	e.UpdatedAt = stored.UpdatedAt
+	return true, nil
+}
+
+func (r *memWebhooks) Finish(ctx context.Context, e *WebhookEvent) (bool, error) {
+	stored, ok := r.s.data.webhooks[e.WeheID]
+	if !ok || stored.Status != WebhookPending || !stored.UpdatedAt.Equal(e.UpdatedAt) {
+		return false, nil
+	}
+	stored.Status, stored.Attempts, stored.Error = e.Status, e.Attempts, e.Error
+	stored.UpdatedAt = time.Now()
+	if stored.Status != WebhookPending {
+		stored.ProcessedAt = null.TimeFrom(stored.UpdatedAt)
+	}
+	r.s.data.webhooks[e.WeheID] = stored
+	e.UpdatedAt, e.ProcessedAt = stored.UpdatedAt, stored.ProcessedAt
+	return true, nil
+}
+
+func (r *memWebhooks) Replay(ctx context.Context, weheID uuid.UUID) (*WebhookEvent, error) {
+	e, ok := r.s.data.webhooks[weheID]
+	if !ok {
+		return nil, &auth.NotFoundError{Message: "No webhook event with this id: " + weheID.String()}
+	}
+	if o, ok := r.pending(e.Provider, e.EventID); ok && o.WeheID != weheID {
+		return nil, &auth.ConflictError{Message: "The same change was notified again and is pending"}
+	}
+	e.Status, e.Attempts, e.Error, e.ProcessedAt = WebhookPending, 0, "", null.Time{}
+	e.UpdatedAt = time.Now()
+	r.s.data.webhooks[weheID] = e
+	return &e, nil
+}
+
+type memServices struct {
+	s *MemStore
+}
+
+func (r *memServices) Save(ctx context.Context, s *Service) error {
+	s.ServID, _ = uuid.NewV4()
+	s.Version = 1
+	s.CreatedAt = time.Now()
+	s.UpdatedAt = s.CreatedAt
+	r.s.data.services[s.ServID] = *s
+	r.addPrice(s)
+	return nil
+}
+
+func (r *memServices) Update(ctx context.Context, s *Service, version int) error {
+	cur, err := r.FromID(ctx, s.DoctID, s.ServID)
+	if err != nil {
+		return err
+	}
+	if cur.Version != version {
+		return &auth.ConflictError{Message: "Service was changed since, reload it"}
+	}
+	s.UpdatedAt = time.Now()
+	stored := *s
+	stored.Prices = nil
+	r.s.data.services[s.ServID] = stored
+	if s.Version != version {
+		r.addPrice(s)
+	}
+	return nil
+}
+
+func (r *memServices) addPrice(s *Service) {
+	r.s.data.servicePrices[s.ServID] = append(r.s.data.servicePrices[s.ServID], ServicePrice{
+		ServID: s.ServID, Version: s.Version, PriceMin: s.PriceMin, CreatedAt: s.UpdatedAt,
+	})
+}
+
+func (r *memServices) FromID(ctx context.Context, doctID, servID uuid.UUID) (*Service, error) {
+	s, ok := r.s.data.services[servID]
+	if !ok || s.DoctID != doctID || s.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No such service"}
+	}
+	return &s, nil
+}
+
+func (r *memServices) List(ctx context.Context, doctID uuid.UUID) (Services, error) {
+	ss := Services{}
+	for _, s := range r.s.data.services {
+		if s.DoctID == doctID && !s.DeletedAt.Valid {
+			ss = append(ss, s)
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].CreatedAt.Before(ss[j].CreatedAt) })
+	return ss, nil
+}
+
+func (r *memServices) Prices(ctx context.Context, servID uuid.UUID) ([]ServicePrice, error) {
+	ps := []ServicePrice{}
+	for _, p := range r.s.data.servicePrices[servID] {
+		ps = append([]ServicePrice{p}, ps...)
+	}
+	return ps, nil
+}
+
+func (r *memServices) SoftDelete(ctx context.Context, doctID, servID uuid.UUID) error {
+	cur, err := r.FromID(ctx, doctID, servID)
+	if err != nil {
+		return err
+	}
+	cur.DeletedAt = null.TimeFrom(time.Now())
+	r.s.data.services[servID] = *cur
+	return nil
+}
+
+func (r *memServices) Specialized(ctx context.Context, doctID, specID uuid.UUID) (bool, error) {
+	sp, ok := r.s.data.doctorSpecs[doctID][specID]
+	return ok && sp.Status == SpecApproved && !sp.DeletedAt.Valid, nil
+}
+
+func (r *memServices) ProcedureSpec(ctx context.Context, procID uuid.UUID) (uuid.UUID, error) {
+	specID, ok := r.s.data.procedures[procID]
+	if !ok {
+		return uuid.Nil, &auth.NotFoundError{Message: "No such procedure"}
+	}
+	return specID, nil
+}
+
+type memSpecializations struct {
+	s *MemStore
+}
+
+func (r *memSpecializations) Add(ctx context.Context, s *Specialization) error {
+	name, ok := r.s.data.specializations[s.SpecID]
+	if !ok {
+		return &auth.NotFoundError{Message: "No such specialization"}
+	}
+	now := time.Now()
+	cur, ok := r.s.data.doctorSpecs[s.DoctID][s.SpecID]
+	switch {
+	case !ok:
+		s.CreatedAt = now
+	case cur.DeletedAt.Valid || cur.Status == SpecRejected:
+		s.CreatedAt = cur.CreatedAt
+	default:
+		return &auth.ConflictError{Message: "The doctor has the specialization already"}
+	}
+	s.Name, s.Status, s.UpdatedAt = name, SpecPending, now
+	s.Reason, s.ReviewedBy, s.ReviewedAt, s.DeletedAt = "", nil, null.Time{}, null.Time{}
+	if r.s.data.doctorSpecs[s.DoctID] == nil {
+		r.s.data.doctorSpecs[s.DoctID] = map[uuid.UUID]Specialization{}
+	}
+	r.s.data.doctorSpecs[s.DoctID][s.SpecID] = *s
+	return nil
+}
+
+func (r *memSpecializations) FromID(ctx context.Context, doctID, specID uuid.UUID) (*Specialization, error) {
+	s, ok := r.s.data.doctorSpecs[doctID][specID]
+	if !ok || s.DeletedAt.Valid {
+		return nil, &auth.NotFoundError{Message: "No such specialization"}
+	}
+	return &s, nil
+}
+
+func (r *memSpecializations) List(ctx context.Context, doctID uuid.UUID, statuses []string) (Specializations, error) {
+	ss := Specializations{}
+	for _, s := range r.s.data.doctorSpecs[doctID] {
+		if s.DeletedAt.Valid {
+			continue
+		}
+		in := len(statuses) == 0
+		for _, st := range statuses {
+			in = in || s.Status == st
+		}
+		if in {
+			ss = append(ss, s)
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+	return ss, nil
+}
+
+func (r *memSpecializations) Pending(ctx context.Context, limit, offset int) (Specializations, int, error) {
+	pending := Specializations{}
+	for _, specs := range r.s.data.doctorSpecs {
+		for _, s := range specs {
+			if s.Status == SpecPending && !s.DeletedAt.Valid {
+				pending = append(pending, s)
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].UpdatedAt.Before(pending[j].UpdatedAt) })
+	ss := Specializations{}
+	for i, s := range pending {
+		if i >= offset && i < offset+limit {
+			ss = append(ss, s)
+		}
+	}
+	return ss, len(pending), nil
+}
+
+func (r *memSpecializations) Review(ctx context.Context, s *Specialization) error {
+	cur, err := r.FromID(ctx, s.DoctID, s.SpecID)
+	if err != nil {
+		return err
+	}
+	if cur.Status != SpecPending {
+		return &auth.ConflictError{Message: "The specialization is " + cur.Status + " already"}
+	}
+	now := time.Now()
+	cur.Status, cur.Reason, cur.ReviewedBy = s.Status, s.Reason, s.ReviewedBy
+	cur.ReviewedAt, cur.UpdatedAt = null.TimeFrom(now), now
+	r.s.data.doctorSpecs[s.DoctID][s.SpecID] = *cur
+	*s = *cur
+	return nil
+}
+
+func (r *memSpecializations) Remove(ctx context.Context, doctID, specID uuid.UUID) error {
+	cur, err := r.FromID(ctx, doctID, specID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	cur.DeletedAt, cur.UpdatedAt = null.TimeFrom(now), now
+	r.s.data.doctorSpecs[doctID][specID] = *cur
+	return nil
+}
+
+func (r *memSpecializations) SaveDocument(ctx context.Context, d *SpecDocument) error {
+	d.DsdoID, _ = uuid.NewV4()
+	d.CreatedAt = time.Now()
+	r.s.data.specDocs[d.DsdoID] = *d
+	return nil
+}
+
+func (r *memSpecializations) Documents(ctx context.Context, doctID, specID uuid.UUID) ([]SpecDocument, error) {
+	ds := []SpecDocument{}
+	for _, d := range r.s.data.specDocs {
+		if d.DoctID == doctID && d.SpecID == specID {
+			d.Content = nil
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].CreatedAt.Before(ds[j].CreatedAt) })
+	return ds, nil
+}
+
+func (r *memSpecializations) Document(ctx context.Context, dsdoID uuid.UUID) (*SpecDocument, error) {
+	d, ok := r.s.data.specDocs[dsdoID]
+	if !ok {
+		return nil, &auth.NotFoundError{Message: "No such document"}
+	}
+	return &d, nil
+}
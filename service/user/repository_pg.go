@@ -0,0 +1,2514 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// PgStore is the Postgres Store
+type PgStore struct {
+	DB *sqlx.DB
+}
+
+// Tx implements Store
+func (s *PgStore) Tx(ctx context.Context, f func(r Repos) error) (err error) {
+	tx, err := s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = errors.Wrap(tx.Commit(), "Failed to commit")
+	}()
+
+	return f(pgRepos(tx))
+}
+
+// PgTxStore runs each unit of work as a savepoint inside an existing
+// transaction, e.g. one a test rolls back when it ends
+type PgTxStore struct {
+	Parent *sqlx.Tx
+}
+
+// Tx implements Store
+func (s *PgTxStore) Tx(ctx context.Context, f func(r Repos) error) (err error) {
+	_, err = s.Parent.ExecContext(ctx, `SAVEPOINT unit_of_work`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create savepoint")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			s.Parent.ExecContext(ctx, `ROLLBACK TO SAVEPOINT unit_of_work`)
+			panic(p)
+		}
+		if err != nil {
+			s.Parent.ExecContext(ctx, `ROLLBACK TO SAVEPOINT unit_of_work`)
+			return
+		}
+		_, err = s.Parent.ExecContext(ctx, `RELEASE SAVEPOINT unit_of_work`)
+		err = errors.Wrap(err, "Failed to release savepoint")
+	}()
+
+	return f(pgRepos(s.Parent))
+}
+
+// uniqueViolation reports whether err was caused by the unique index
+// constraint
+func uniqueViolation(err error, constraint string) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+func pgRepos(q sqlx.ExtContext) Repos {
+	return Repos{
+		Users:           &pgUsers{q: q},
+		Confirmations:   &pgConfirmations{q: q},
+		Doctors:         &pgDoctors{q: q},
+		Patients:        &pgPatients{q: q},
+		Addresses:       &pgAddresses{q: q},
+		Schedules:       &pgSchedules{q: q},
+		Matchmaking:     &pgMatchmaking{q: q},
+		Matches:         &pgMatches{q: q},
+		CreditCards:     &pgCreditCards{q: q},
+		Payments:        &pgPayments{q: q},
+		Banks:           &pgBanks{q: q},
+		Payouts:         &pgPayouts{q: q},
+		Webhooks:        &pgWebhooks{q: q},
+		Services:        &pgServices{q: q},
+		Specializations: &pgSpecializations{q: q},
+	}
+}
+
+type pgUsers struct {
+	q sqlx.ExtContext
+}
+
+// Save a user in the database
+func (r *pgUsers) Save(ctx context.Context, u *User) (*User, error) {
+
+	query := psql.Insert(`"user"`).
+		Columns("user_id", "email", "password", "role", "info").
+		Values(u.UserID, u.Email, u.Password, u.Role, u.Info).
+		Suffix("RETURNING *")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating user sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, u, qSQL, args...)
+	done(err)
+	if uniqueViolation(err, "user_email_key") {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"email": "Email already registered"},
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error inserting user")
+	}
+	return u, nil
+}
+
+// Update updates a user in the database
+func (r *pgUsers) Update(ctx context.Context, u *User) (*User, error) {
+
+	query := psql.Update(`"user"`).
+		Set("role", u.Role).
+		Suffix("RETURNING *")
+
+	query = query.Where(sq.Eq{"user_id": u.UserID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating user update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, u, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error user update sql")
+	}
+
+	return u, nil
+}
+
+// UpdateEmail updates the user email in the database
+func (r *pgUsers) UpdateEmail(ctx context.Context, userID uuid.UUID, email string) error {
+
+	query := psql.Update(`"user"`).
+		Set("email", email)
+
+	query = query.Where(sq.Eq{"user_id": userID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating user email update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error user email update sql")
+}
+
+// UpdatePassword replaces the user password hash
+func (r *pgUsers) UpdatePassword(ctx context.Context, userID uuid.UUID, pass []byte) error {
+	query := psql.Update(`"user"`).
+		Set("password", pass).
+		Where(sq.Eq{"user_id": userID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating user password update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error updating user password")
+	}
+	return nil
+}
+
+// UpdateInfo replaces the user info
+func (r *pgUsers) UpdateInfo(ctx context.Context, userID uuid.UUID, info Info) error {
+	query := psql.Update(`"user"`).
+		Set("info", info).
+		Where(sq.Eq{"user_id": userID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating user info update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error updating user info")
+}
+
+// FromID get an User from the database
+func (r *pgUsers) FromID(ctx context.Context, userID uuid.UUID) (usr *User, err error) {
+	usr = &User{}
+	query := psql.Select("*").From(`"user"`).Where(sq.Eq{"user_id": userID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return usr, err
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, usr, qSQL, args...)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return usr, &auth.UserNotFoundError{
+				Message: "No user whit this id: " + userID.String(),
+			}
+		}
+		return usr, err
+	}
+	return usr, err
+}
+
+// FromEmail get an User from the database by email
+func (r *pgUsers) FromEmail(ctx context.Context, email string) (usr *User, err error) {
+	usr = &User{}
+	query := psql.Select("*").From(`"user"`).Where(sq.Eq{"email": email, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return usr, err
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, usr, qSQL, args...)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return usr, &auth.UserNotFoundError{
+				Message: "No user with this email: " + email,
+			}
+		}
+		return usr, err
+	}
+	return usr, err
+}
+
+// SoftDelete soft deletes the user in the database
+func (r *pgUsers) SoftDelete(ctx context.Context, userID uuid.UUID) error {
+	query := psql.Update(`"user"`).Set("deleted_at", time.Now()).Where(sq.Eq{"user_id": userID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating user sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error soft deleting user")
+}
+
+type pgConfirmations struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts an action confirmation
+func (r *pgConfirmations) Save(ctx context.Context, c *ActionConfirmation) error {
+
+	ins := psql.Insert("action_verification").
+		Columns(
+			"acve_id",
+			"user_id",
+			"verification",
+			"type",
+			"created_at").
+		Values(
+			c.AcveID,
+			c.UserID,
+			c.Verification,
+			c.Type,
+			time.Now())
+
+	qSQL, args, err := ins.ToSql()
+	if err != nil {
+		return err
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return err
+}
+
+// Delete soft deletes an action confirmation
+func (r *pgConfirmations) Delete(ctx context.Context, c *ActionConfirmation) error {
+	del := psql.Update("action_verification").
+		Set("deleted_at", time.Now()).
+		Where(sq.Eq{"acve_id": c.AcveID, "user_id": c.UserID})
+
+	qSQL, args, err := del.ToSql()
+	if err != nil {
+		return err
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return err
+}
+
+// FromID returns a pending action confirmation
+func (r *pgConfirmations) FromID(ctx context.Context, acveID string) (*ActionConfirmation, error) {
+	psrt := &ActionConfirmation{}
+	query := psql.Select("*").
+		From("action_verification").
+		Where(sq.Eq{"acve_id": acveID, "deleted_at": nil})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return psrt, errors.Wrap(err, "Error generating action confirmation sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, psrt, qSQL, args...)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return psrt, &auth.PwdResetInvalidError{
+				Message: "No such reset token: " + acveID,
+			}
+		}
+		return psrt, err
+	}
+	return psrt, nil
+}
+
+type pgDoctors struct {
+	q sqlx.ExtContext
+}
+
+// selectDoctors reads doctors joined with the user columns they expose
+func selectDoctors() sq.SelectBuilder {
+	return psql.Select("d.*", "u.email", "u.info", "u.role").
+		From("doctor d").
+		Join(`"user" u USING (user_id)`)
+}
+
+// Save inserts a doctor
+func (r *pgDoctors) Save(ctx context.Context, d *Doctor) error {
+	query := psql.Insert("doctor").
+		Columns("doct_id", "user_id", "name", "crm", "documents").
+		Values(d.DoctID, d.UserID, d.Name, d.CRM, d.Documents).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &d.CreatedAt, qSQL, args...)
+	done(err)
+	if uniqueViolation(err, "doctor_crm_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"crm": "CRM already registered"},
+		}
+	}
+	return errors.Wrap(err, "Error inserting doctor")
+}
+
+// Update updates the doctor name, CRM and documents
+func (r *pgDoctors) Update(ctx context.Context, d *Doctor) error {
+	query := psql.Update("doctor").
+		Set("name", d.Name).
+		Set("crm", d.CRM).
+		Set("documents", d.Documents).
+		Where(sq.Eq{"doct_id": d.DoctID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if uniqueViolation(err, "doctor_crm_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"crm": "CRM already registered"},
+		}
+	}
+	return errors.Wrap(err, "Error updating doctor")
+}
+
+// FromID get a Doctor from the database
+func (r *pgDoctors) FromID(ctx context.Context, doctID uuid.UUID) (*Doctor, error) {
+	d := &Doctor{}
+	query := selectDoctors().Where(sq.Eq{"d.doct_id": doctID, "d.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, d, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{
+			Message: "No doctor with this id: " + doctID.String(),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Near ranks doctors by distance, with PostGIS when address.geog exists
+// and haversine over a bounding box otherwise
+func (r *pgDoctors) Near(ctx context.Context, q NearQuery) ([]DoctorDistance, error) {
+	var postgis bool
+	err := sqlx.GetContext(ctx, r.q, &postgis, `SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'address' AND column_name = 'geog')`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error detecting PostGIS")
+	}
+
+	lat, lng := q.Point.Lat, q.Point.Lng
+	cols := []string{"d.doct_id", "d.name", "d.crm"}
+	for _, c := range addressColumns {
+		cols = append(cols, "a."+c+` AS "address.`+c+`"`)
+	}
+	inner := psql.Select(cols...).
+		Options("DISTINCT ON (d.doct_id)").
+		From("address a").
+		Join("doctor d ON d.doct_id = a.doct_id").
+		Where(sq.Eq{"a.deleted_at": nil, "d.deleted_at": nil}).
+		OrderBy("d.doct_id", "distance_km")
+	if postgis {
+		inner = inner.
+			Column("ST_Distance(a.geog, ST_MakePoint(?, ?)::geography) / 1000 AS distance_km", lng, lat).
+			Where("ST_DWithin(a.geog, ST_MakePoint(?, ?)::geography, ?)", lng, lat, q.RadiusKm*1000)
+	} else {
+		// 111.045km per degree of latitude
+		dLat := q.RadiusKm / 111.045
+		dLng := q.RadiusKm / (111.045 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+		inner = inner.
+			Column(`6371 * 2 * asin(least(1, sqrt(
+				power(sin(radians(a.lat - ?) / 2), 2) +
+				cos(radians(?)) * cos(radians(a.lat)) * power(sin(radians(a.lng - ?) / 2), 2)))) AS distance_km`, lat, lat, lng).
+			Where("a.lat BETWEEN ? AND ?", lat-dLat, lat+dLat).
+			Where("a.lng BETWEEN ? AND ?", lng-dLng, lng+dLng)
+	}
+	if q.SpecID != nil {
+		inner = inner.Where(`EXISTS (SELECT 1 FROM doctor_specialization ds
+			WHERE ds.doct_id = d.doct_id AND ds.spec_id = ?
+			AND ds.status = 'approved' AND ds.deleted_at IS NULL)`, *q.SpecID)
+	}
+
+	query := psql.Select("*").
+		FromSelect(inner, "near").
+		Where("distance_km <= ?", q.RadiusKm).
+		OrderBy("distance_km").
+		Limit(q.Limit)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor search sql")
+	}
+
+	ds := []DoctorDistance{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ds, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error searching doctors")
+	}
+	return ds, nil
+}
+
+// FromUserID get the Doctor of an User
+func (r *pgDoctors) FromUserID(ctx context.Context, userID uuid.UUID) (*Doctor, error) {
+	d := &Doctor{}
+	query := selectDoctors().Where(sq.Eq{"d.user_id": userID, "d.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, d, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+type pgPatients struct {
+	q sqlx.ExtContext
+}
+
+// selectPatients reads patients joined with the user columns they expose
+func selectPatients() sq.SelectBuilder {
+	return psql.Select("p.*", "u.email", "u.info", "u.role").
+		From("patient p").
+		Join(`"user" u USING (user_id)`)
+}
+
+// Save inserts a patient
+func (r *pgPatients) Save(ctx context.Context, p *Patient) error {
+	query := psql.Insert("patient").
+		Columns("pati_id", "user_id", "name", "cpf", "cpf_index", "rg", "address", "documents").
+		Values(p.PatiID, p.UserID, p.Name, p.CPF, p.CPFIndex, p.RG, p.Address, p.Documents).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating patient sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &p.CreatedAt, qSQL, args...)
+	done(err)
+	if uniqueViolation(err, "patient_cpf_index_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"cpf": "CPF already registered"},
+		}
+	}
+	return errors.Wrap(err, "Error inserting patient")
+}
+
+// Update updates the patient name, documents and address
+func (r *pgPatients) Update(ctx context.Context, p *Patient) error {
+	query := psql.Update("patient").
+		Set("name", p.Name).
+		Set("cpf", p.CPF).
+		Set("cpf_index", p.CPFIndex).
+		Set("rg", p.RG).
+		Set("address", p.Address).
+		Set("documents", p.Documents).
+		Where(sq.Eq{"pati_id": p.PatiID})
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating patient update sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if uniqueViolation(err, "patient_cpf_index_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"cpf": "CPF already registered"},
+		}
+	}
+	return errors.Wrap(err, "Error updating patient")
+}
+
+// FromID get a Patient from the database
+func (r *pgPatients) FromID(ctx context.Context, patiID uuid.UUID) (*Patient, error) {
+	p := &Patient{}
+	query := selectPatients().Where(sq.Eq{"p.pati_id": patiID, "p.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating patient sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{
+			Message: "No patient with this id: " + patiID.String(),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FromCPFIndex get a Patient from the database by its CPF blind index
+func (r *pgPatients) FromCPFIndex(ctx context.Context, index string) (*Patient, error) {
+	p := &Patient{}
+	query := selectPatients().Where(sq.Eq{"p.cpf_index": index, "p.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating patient sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No patient with this CPF"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FromUserID get the Patient of an User
+func (r *pgPatients) FromUserID(ctx context.Context, userID uuid.UUID) (*Patient, error) {
+	p := &Patient{}
+	query := selectPatients().Where(sq.Eq{"p.user_id": userID, "p.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, p, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type pgAddresses struct {
+	q sqlx.ExtContext
+}
+
+// addressColumns are read explicitly, address may have a PostGIS column
+var addressColumns = []string{
+	"addr_id", "doct_id", "description", "location", "cep", "street", "number",
+	"district", "city", "uf", "lat", "lng", "is_primary", "opening_hours",
+	"created_at", "updated_at", "deleted_at",
+}
+
+// Save inserts an address
+func (r *pgAddresses) Save(ctx context.Context, a *Address) error {
+	query := psql.Insert("address").
+		Columns("doct_id", "description", "location", "cep", "street", "number", "district", "city", "uf",
+			"lat", "lng", "is_primary", "opening_hours").
+		Values(a.DoctID, a.Description, a.Location, a.CEP, a.Street, a.Number, a.District, a.City, a.UF,
+			a.Lat, a.Lng, a.Primary, a.OpeningHours).
+		Suffix("RETURNING addr_id, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating address sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&a.AddrID, &a.CreatedAt, &a.UpdatedAt)
+	done(err)
+	if uniqueViolation(err, "address_primary_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"primary": "Another address was made primary"},
+		}
+	}
+	return errors.Wrap(err, "Error inserting address")
+}
+
+// Update updates an address of a doctor
+func (r *pgAddresses) Update(ctx context.Context, a *Address) error {
+	query := psql.Update("address").
+		SetMap(map[string]interface{}{
+			"description":   a.Description,
+			"location":      a.Location,
+			"cep":           a.CEP,
+			"street":        a.Street,
+			"number":        a.Number,
+			"district":      a.District,
+			"city":          a.City,
+			"uf":            a.UF,
+			"lat":           a.Lat,
+			"lng":           a.Lng,
+			"is_primary":    a.Primary,
+			"opening_hours": a.OpeningHours,
+			"updated_at":    sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"addr_id": a.AddrID, "doct_id": a.DoctID, "deleted_at": nil}).
+		Suffix("RETURNING updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating address sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&a.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such address"}
+	}
+	if uniqueViolation(err, "address_primary_key") {
+		return &auth.ValidationError{
+			Messages: map[string]string{"primary": "Another address was made primary"},
+		}
+	}
+	return errors.Wrap(err, "Error updating address")
+}
+
+// FromID gets an address of a doctor
+func (r *pgAddresses) FromID(ctx context.Context, doctID uuid.UUID, addrID int) (*Address, error) {
+	a := Address{}
+	query := psql.Select(addressColumns...).
+		From("address").
+		Where(sq.Eq{"addr_id": addrID, "doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating address sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &a, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such address"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting address")
+	}
+	return &a, nil
+}
+
+// List the addresses of a doctor
+func (r *pgAddresses) List(ctx context.Context, doctID uuid.UUID) (*Addresses, error) {
+	as := Addresses{}
+	query := psql.Select(addressColumns...).
+		From("address").
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil}).
+		OrderBy("addr_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating address sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &as, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing addresses")
+	}
+	return &as, nil
+}
+
+// ClearPrimary unsets the primary address of a doctor
+func (r *pgAddresses) ClearPrimary(ctx context.Context, doctID uuid.UUID) error {
+	query := psql.Update("address").
+		Set("is_primary", false).
+		Where(sq.Eq{"doct_id": doctID, "is_primary": true})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating address sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error clearing primary address")
+}
+
+// Services counts the active services at an address
+func (r *pgAddresses) Services(ctx context.Context, addrID int) (int, error) {
+	n := 0
+	query := psql.Select("count(*)").
+		From("service").
+		Where(sq.Eq{"addr_id": addrID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error generating service sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &n, qSQL, args...)
+	done(err)
+	return n, errors.Wrap(err, "Error counting address services")
+}
+
+// RemoveServices soft deletes the services at an address
+func (r *pgAddresses) RemoveServices(ctx context.Context, addrID int) error {
+	query := psql.Update("service").
+		Set("deleted_at", sq.Expr("now()")).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"addr_id": addrID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating service sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error removing address services")
+}
+
+// SoftDelete soft deletes an address of a doctor
+func (r *pgAddresses) SoftDelete(ctx context.Context, doctID uuid.UUID, addrID int) error {
+	query := psql.Update("address").
+		Set("is_primary", false).
+		Set("deleted_at", time.Now()).
+		Where(sq.Eq{"addr_id": addrID, "doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating address sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting address")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such address"}
+	}
+	return nil
+}
+
+type pgSchedules struct {
+	q sqlx.ExtContext
+}
+
+// SaveAvailability inserts an availability
+func (r *pgSchedules) SaveAvailability(ctx context.Context, av *Availability) error {
+	query := psql.Insert("availability").
+		Columns("avai_id", "doct_id", "addr_id", "weekday", "starts", "ends", "slot_minutes", "buffer_minutes", "timezone").
+		Values(av.AvaiID, av.DoctID, av.AddrID, int(av.Weekday), av.Starts, av.Ends, av.SlotMinutes, av.BufferMinutes, av.Timezone).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating availability sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&av.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting availability")
+}
+
+// Availabilities lists the availabilities of a doctor at its active
+// addresses
+func (r *pgSchedules) Availabilities(ctx context.Context, doctID uuid.UUID) ([]Availability, error) {
+	avs := []Availability{}
+	query := psql.Select("av.*").
+		From("availability av").
+		Join("address a ON a.addr_id = av.addr_id AND a.deleted_at IS NULL").
+		Where(sq.Eq{"av.doct_id": doctID, "av.deleted_at": nil}).
+		OrderBy("av.weekday", "av.starts")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating availability sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &avs, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing availabilities")
+	}
+	return avs, nil
+}
+
+// RemoveAvailability soft deletes an availability of a doctor
+func (r *pgSchedules) RemoveAvailability(ctx context.Context, doctID, avaiID uuid.UUID) error {
+	return r.softDelete(ctx, "availability", sq.Eq{"avai_id": avaiID, "doct_id": doctID}, "No such availability")
+}
+
+// SaveException inserts an exception
+func (r *pgSchedules) SaveException(ctx context.Context, e *AvailabilityException) error {
+	query := psql.Insert("availability_exception").
+		Columns("avex_id", "doct_id", "addr_id", "starts_at", "ends_at", "reason").
+		Values(e.AvexID, e.DoctID, e.AddrID, e.StartsAt, e.EndsAt, e.Reason).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating exception sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&e.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting exception")
+}
+
+// Exceptions lists the exceptions of a doctor overlapping from and to
+func (r *pgSchedules) Exceptions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]AvailabilityException, error) {
+	exs := []AvailabilityException{}
+	query := psql.Select("*").
+		From("availability_exception").
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil}).
+		Where(sq.Lt{"starts_at": to}).
+		Where(sq.Gt{"ends_at": from}).
+		OrderBy("starts_at")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating exception sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &exs, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing exceptions")
+	}
+	return exs, nil
+}
+
+// RemoveException soft deletes an exception of a doctor
+func (r *pgSchedules) RemoveException(ctx context.Context, doctID, avexID uuid.UUID) error {
+	return r.softDelete(ctx, "availability_exception", sq.Eq{"avex_id": avexID, "doct_id": doctID}, "No such exception")
+}
+
+func (r *pgSchedules) softDelete(ctx context.Context, table string, where sq.Eq, notFound string) error {
+	where["deleted_at"] = nil
+	query := psql.Update(table).
+		Set("deleted_at", time.Now()).
+		Where(where)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating "+table+" sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting "+table)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: notFound}
+	}
+	return nil
+}
+
+// Sessions lists the sessions of a doctor overlapping from and to
+func (r *pgSchedules) Sessions(ctx context.Context, doctID uuid.UUID, from, to time.Time) ([]SessionSchedule, error) {
+	ss := []SessionSchedule{}
+	query := psql.Select("*").
+		From("session_schedule").
+		Where(sq.Eq{"doct_id": doctID, "canceled_at": nil}).
+		Where(sq.Lt{"starts_at": to}).
+		Where(sq.Gt{"ends_at": from}).
+		OrderBy("starts_at")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating session sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ss, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing sessions")
+	}
+	return ss, nil
+}
+
+// LockDoctor locks the doctor row until the transaction ends
+func (r *pgSchedules) LockDoctor(ctx context.Context, doctID uuid.UUID) error {
+	query := psql.Select("doct_id").
+		From("doctor").
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil}).
+		Suffix("FOR UPDATE")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor lock sql")
+	}
+	var id uuid.UUID
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &id, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No doctor with this id: " + doctID.String()}
+	}
+	return errors.Wrap(err, "Error locking doctor")
+}
+
+// Book inserts a session
+func (r *pgSchedules) Book(ctx context.Context, s *SessionSchedule) error {
+	query := psql.Insert("session_schedule").
+		Columns("sesc_id", "doct_id", "addr_id", "pati_id", "starts_at", "ends_at").
+		Values(s.SescID, s.DoctID, s.AddrID, s.PatiID, s.StartsAt, s.EndsAt).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating session sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&s.CreatedAt)
+	done(err)
+	if uniqueViolation(err, "session_schedule_slot_key") {
+		return &auth.ConflictError{Message: "Slot is not available"}
+	}
+	return errors.Wrap(err, "Error booking session")
+}
+
+// CancelSession sets a session canceled
+func (r *pgSchedules) CancelSession(ctx context.Context, sescID uuid.UUID) error {
+	query := psql.Update("session_schedule").
+		Set("canceled_at", time.Now()).
+		Where(sq.Eq{"sesc_id": sescID, "canceled_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating session sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error canceling session")
+}
+
+type pgMatchmaking struct {
+	q sqlx.ExtContext
+}
+
+// Offers gets the cheapest service at each address of the doctors
+// approved in a specialization
+func (r *pgMatchmaking) Offers(ctx context.Context, specID uuid.UUID, doctIDs []uuid.UUID) ([]DoctorOffer, error) {
+	offers := []DoctorOffer{}
+	if len(doctIDs) == 0 {
+		return offers, nil
+	}
+	query := psql.Select("s.doct_id", "s.serv_id", "s.addr_id", "s.price_min", "s.version AS serv_version", "s.type", "s.proc_id").
+		Options("DISTINCT ON (s.doct_id, s.addr_id)").
+		From("service s").
+		Join(`doctor_specialization ds ON ds.doct_id = s.doct_id AND ds.spec_id = s.spec_id
+			AND ds.status = 'approved' AND ds.deleted_at IS NULL`).
+		Where(sq.Eq{"s.spec_id": specID, "s.doct_id": doctIDs, "s.deleted_at": nil}).
+		OrderBy("s.doct_id", "s.addr_id", "s.price_min")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating offers sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &offers, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing offers")
+	}
+	return offers, nil
+}
+
+// Stats gets the average rating and the response rate of the last 90
+// days of doctors
+func (r *pgMatchmaking) Stats(ctx context.Context, doctIDs []uuid.UUID) ([]DoctorStats, error) {
+	sts := []DoctorStats{}
+	if len(doctIDs) == 0 {
+		return sts, nil
+	}
+	query := psql.Select("d.doct_id",
+		"(SELECT avg(mr.score) FROM match_rating mr WHERE mr.doct_id = d.doct_id) AS rating",
+		`(SELECT avg(CASE WHEN m.status = 'canceled-by-doctor' THEN 0 ELSE 1 END) FROM match m
+			WHERE m.doct_id = d.doct_id AND m.status NOT IN ('proposed', 'canceled-by-patient')
+			AND m.created_at > now() - interval '90 days') AS response_rate`).
+		From("doctor d").
+		Where(sq.Eq{"d.doct_id": doctIDs})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor stats sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &sts, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting doctor stats")
+	}
+	return sts, nil
+}
+
+type pgMatches struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts a match
+func (r *pgMatches) Save(ctx context.Context, m *Match) error {
+	query := psql.Insert("match").
+		Columns("matc_id", "pati_id", "doct_id", "spec_id", "proc_id", "serv_id", "serv_version", "sesc_id", "addr_id",
+			"date", "time", "price", "type", "status").
+		Values(m.MatcID, m.PatiID, m.DoctID, m.SpecID, m.ProcID, m.ServID, m.ServVersion, m.SescID, m.AddrID,
+			m.Date.Format("2006-01-02"), m.Time, m.Price, m.Type, m.Status).
+		Suffix("RETURNING version, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating match sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&m.Version, &m.CreatedAt, &m.UpdatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting match")
+}
+
+// FromID gets a match
+func (r *pgMatches) FromID(ctx context.Context, matcID uuid.UUID) (*Match, error) {
+	m := Match{}
+	query := psql.Select("*").
+		From("match").
+		Where(sq.Eq{"matc_id": matcID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating match sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &m, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No match with this id: " + matcID.String()}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting match")
+	}
+	return &m, nil
+}
+
+// UpdateStatus updates the status of a match still at version
+func (r *pgMatches) UpdateStatus(ctx context.Context, m *Match, version int) error {
+	query := psql.Update("match").
+		SetMap(map[string]interface{}{
+			"status":      m.Status,
+			"cancel_fee":  m.CancelFee,
+			"canceled_at": m.CanceledAt,
+			"version":     sq.Expr("version + 1"),
+			"updated_at":  sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"matc_id": m.MatcID, "version": version, "deleted_at": nil}).
+		Suffix("RETURNING version, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating match sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&m.Version, &m.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.ConflictError{Message: "Match was changed since, reload it"}
+	}
+	return errors.Wrap(err, "Error updating match")
+}
+
+// Expirable lists the matches proposed before a time still waiting for
+// the patient
+func (r *pgMatches) Expirable(ctx context.Context, before time.Time, limit int) ([]Match, error) {
+	ms := []Match{}
+	query := psql.Select("*").
+		From("match").
+		Where(sq.Eq{"status": MatchProposed, "deleted_at": nil}).
+		Where(sq.Lt{"created_at": before}).
+		OrderBy("created_at").
+		Limit(uint64(limit))
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating match sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ms, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing expirable matches")
+	}
+	return ms, nil
+}
+
+// AddChange inserts a status change of a match
+func (r *pgMatches) AddChange(ctx context.Context, c *MatchStatusChange) error {
+	query := psql.Insert("match_history").
+		Columns("mahi_id", "matc_id", "from_status", "to_status", "user_id", "reason", "fee").
+		Values(c.MahiID, c.MatcID, c.From, c.To, c.UserID, c.Reason, c.Fee).
+		Suffix("RETURNING created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating match history sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&c.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting match history")
+}
+
+// History lists the status changes of a match
+func (r *pgMatches) History(ctx context.Context, matcID uuid.UUID) ([]MatchStatusChange, error) {
+	cs := []MatchStatusChange{}
+	query := psql.Select("*").
+		From("match_history").
+		Where(sq.Eq{"matc_id": matcID}).
+		OrderBy("created_at", "mahi_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating match history sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &cs, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing match history")
+	}
+	return cs, nil
+}
+
+// historyFilter is the where clause of q
+func historyFilter(q MatchHistoryQuery) sq.And {
+	where := sq.And{
+		sq.Eq{"m.deleted_at": nil},
+		sq.GtOrEq{"m.date": q.From.Format("2006-01-02")},
+		sq.LtOrEq{"m.date": q.To.Format("2006-01-02")},
+	}
+	if q.PatiID != nil {
+		where = append(where, sq.Eq{"m.pati_id": *q.PatiID})
+	}
+	if q.DoctID != nil {
+		where = append(where, sq.Eq{"m.doct_id": *q.DoctID})
+	}
+	if len(q.Statuses) > 0 {
+		statuses := make([]string, 0, len(q.Statuses))
+		for _, st := range q.Statuses {
+			statuses = append(statuses, string(st))
+		}
+		where = append(where, sq.Eq{"m.status": statuses})
+	}
+	if q.SpecID != nil {
+		where = append(where, sq.Eq{"m.spec_id": *q.SpecID})
+	}
+	if q.PriceMin > 0 {
+		where = append(where, sq.GtOrEq{"m.price": q.PriceMin})
+	}
+	if q.PriceMax > 0 {
+		where = append(where, sq.LtOrEq{"m.price": q.PriceMax})
+	}
+	return where
+}
+
+// List lists the matches of a patient or doctor with the names of both and
+// where
+func (r *pgMatches) List(ctx context.Context, q MatchHistoryQuery) ([]MatchHistory, int, error) {
+	hs := []MatchHistory{}
+	where := historyFilter(q)
+
+	countSQL, args, err := psql.Select("count(*)").From("match m").Where(where).ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating match history count sql")
+	}
+	var total int
+	cctx, done := traceSQL(ctx, countSQL)
+	err = sqlx.GetContext(cctx, r.q, &total, countSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error counting match history")
+	}
+
+	query := psql.Select("m.matc_id", "m.spec_id", "m.date", "m.time", "m.price", "m.type", "m.status",
+		"m.cancel_fee", "m.created_at",
+		"COALESCE(s.name, '') AS description",
+		"(SELECT max(h.created_at) FROM match_history h WHERE h.matc_id = m.matc_id) AS status_at",
+		"d.name AS doctor", "p.name AS patient",
+		`COALESCE(a.street, '') AS "address.street"`, `COALESCE(a.number, '') AS "address.number"`,
+		`COALESCE(a.district, '') AS "address.district"`, `COALESCE(a.city, '') AS "address.city"`,
+		`COALESCE(a.uf, '') AS "address.uf"`, `COALESCE(a.location, '') AS "address.location"`).
+		From("match m").
+		Join("doctor d ON d.doct_id = m.doct_id").
+		Join("patient p ON p.pati_id = m.pati_id").
+		LeftJoin("service s ON s.serv_id = m.serv_id").
+		LeftJoin("address a ON a.addr_id = m.addr_id").
+		Where(where).
+		OrderBy("m.date DESC", "m.time DESC", "m.matc_id")
+	if q.Limit > 0 {
+		query = query.Limit(uint64(q.Limit)).Offset(uint64(q.Offset))
+	}
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating match history sql")
+	}
+	ctx, done = traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &hs, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error listing match history")
+	}
+	return hs, total, nil
+}
+
+type pgCreditCards struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts a card of a patient
+func (r *pgCreditCards) Save(ctx context.Context, c *CreditCard) error {
+	query := psql.Insert("credit_card").
+		Columns("pati_id", "token", "brand", "last4", "exp_month", "exp_year", "holder", "is_default").
+		Values(c.PatiID, c.Token, c.Brand, c.Last4, c.ExpMonth, c.ExpYear, c.Holder, c.Default).
+		Suffix("RETURNING crca_id, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating credit card sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&c.CrcaID, &c.CreatedAt, &c.UpdatedAt)
+	done(err)
+	if uniqueViolation(err, "credit_card_default_key") {
+		return &auth.ConflictError{Message: "Another card was made default"}
+	}
+	return errors.Wrap(err, "Error inserting credit card")
+}
+
+// Update updates the default flag of a card
+func (r *pgCreditCards) Update(ctx context.Context, c *CreditCard) error {
+	query := psql.Update("credit_card").
+		Set("is_default", c.Default).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"crca_id": c.CrcaID, "pati_id": c.PatiID, "deleted_at": nil}).
+		Suffix("RETURNING updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating credit card sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&c.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such credit card"}
+	}
+	if uniqueViolation(err, "credit_card_default_key") {
+		return &auth.ConflictError{Message: "Another card was made default"}
+	}
+	return errors.Wrap(err, "Error updating credit card")
+}
+
+// FromID gets a card of a patient
+func (r *pgCreditCards) FromID(ctx context.Context, patiID, crcaID uuid.UUID) (*CreditCard, error) {
+	c := CreditCard{}
+	query := psql.Select("*").
+		From("credit_card").
+		Where(sq.Eq{"crca_id": crcaID, "pati_id": patiID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating credit card sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &c, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such credit card"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting credit card")
+	}
+	return &c, nil
+}
+
+// List the cards of a patient
+func (r *pgCreditCards) List(ctx context.Context, patiID uuid.UUID) ([]CreditCard, error) {
+	cs := []CreditCard{}
+	query := psql.Select("*").
+		From("credit_card").
+		Where(sq.Eq{"pati_id": patiID, "deleted_at": nil}).
+		OrderBy("is_default DESC", "created_at DESC", "crca_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating credit card sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &cs, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing credit cards")
+	}
+	return cs, nil
+}
+
+// ClearDefault unsets the default card of a patient
+func (r *pgCreditCards) ClearDefault(ctx context.Context, patiID uuid.UUID) error {
+	query := psql.Update("credit_card").
+		Set("is_default", false).
+		Where(sq.Eq{"pati_id": patiID, "is_default": true})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating credit card sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error clearing default credit card")
+}
+
+// SoftDelete soft deletes a card of a patient
+func (r *pgCreditCards) SoftDelete(ctx context.Context, patiID, crcaID uuid.UUID) error {
+	query := psql.Update("credit_card").
+		Set("is_default", false).
+		Set("deleted_at", time.Now()).
+		Where(sq.Eq{"crca_id": crcaID, "pati_id": patiID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating credit card sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting credit card")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such credit card"}
+	}
+	return nil
+}
+
+type pgPayments struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts the payment of a match
+func (r *pgPayments) Save(ctx context.Context, p *Payment) error {
+	query := psql.Insert("payment").
+		Columns("matc_id", "crca_id", "order_id", "status", "amount").
+		Values(p.MatcID, p.CrcaID, p.OrderID, p.Status, p.Amount).
+		Suffix("RETURNING paym_id, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payment sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&p.PaymID, &p.CreatedAt, &p.UpdatedAt)
+	done(err)
+	if uniqueViolation(err, "payment_matc_id_key") {
+		return &auth.ConflictError{Message: "Match already has a payment"}
+	}
+	return errors.Wrap(err, "Error inserting payment")
+}
+
+// Update stores the outcome of a gateway call on a payment
+func (r *pgPayments) Update(ctx context.Context, p *Payment) error {
+	query := psql.Update("payment").
+		SetMap(map[string]interface{}{
+			"gateway_id": p.GatewayID,
+			"status":     p.Status,
+			"captured":   p.Captured,
+			"voided":     p.Voided,
+			"refunded":   p.Refunded,
+			"updated_at": sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"paym_id": p.PaymID}).
+		Suffix("RETURNING updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payment sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&p.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such payment"}
+	}
+	return errors.Wrap(err, "Error updating payment")
+}
+
+// FromMatch gets the payment of a match
+func (r *pgPayments) FromMatch(ctx context.Context, matcID uuid.UUID) (*Payment, error) {
+	p := Payment{}
+	query := psql.Select("*").
+		From("payment").
+		Where(sq.Eq{"matc_id": matcID})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payment sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No payment for this match: " + matcID.String()}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting payment")
+	}
+	return &p, nil
+}
+
+// FromGateway gets a payment by its id at the gateway
+func (r *pgPayments) FromGateway(ctx context.Context, gatewayID string) (*Payment, error) {
+	p := Payment{}
+	query := psql.Select("*").
+		From("payment").
+		Where(sq.Eq{"gateway_id": gatewayID})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payment sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No payment with this gateway id: " + gatewayID}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting payment")
+	}
+	return &p, nil
+}
+
+// AddEntry adds a gateway call to the ledger
+func (r *pgPayments) AddEntry(ctx context.Context, e *PaymentEntry) error {
+	query := psql.Insert("payment_ledger").
+		Columns("paym_id", "operation", "amount", "succeeded", "gateway_status", "return_code", "return_message", "error").
+		Values(e.PaymID, e.Operation, e.Amount, e.Succeeded, e.GatewayStatus, e.ReturnCode, e.ReturnMessage, e.Error).
+		Suffix("RETURNING pale_id, created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payment ledger sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&e.PaleID, &e.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting payment ledger entry")
+}
+
+// Ledger lists the gateway calls of a payment
+func (r *pgPayments) Ledger(ctx context.Context, paymID uuid.UUID) ([]PaymentEntry, error) {
+	es := []PaymentEntry{}
+	query := psql.Select("*").
+		From("payment_ledger").
+		Where(sq.Eq{"paym_id": paymID}).
+		OrderBy("created_at", "pale_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payment ledger sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &es, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing payment ledger")
+	}
+	return es, nil
+}
+
+// Unsettled lists the payments the reconciler has to go through
+func (r *pgPayments) Unsettled(ctx context.Context, before time.Time, limit int) ([]Payment, error) {
+	ps := []Payment{}
+	ended := []MatchStatus{MatchCompleted, MatchNoShow, MatchCanceledByPatient, MatchCanceledByDoctor}
+	query := psql.Select("p.*").
+		From("payment p").
+		Join("match m ON m.matc_id = p.matc_id").
+		Where(sq.Lt{"p.updated_at": before}).
+		Where(sq.Or{
+			sq.Eq{"p.status": PaymentPending, "m.status": []MatchStatus{MatchConfirmed, MatchCheckedIn}},
+			sq.And{sq.Eq{"p.status": PaymentAuthorized, "m.status": ended}},
+			sq.And{
+				sq.Eq{"p.status": PaymentCaptured, "m.status": ended[1:]},
+				sq.Expr("p.captured - p.refunded > m.cancel_fee"),
+			},
+		}).
+		OrderBy("p.updated_at").
+		Limit(uint64(limit))
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payment sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ps, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing unsettled payments")
+	}
+	return ps, nil
+}
+
+// Claim bumps the update time of a payment not updated since updatedAt
+func (r *pgPayments) Claim(ctx context.Context, paymID uuid.UUID, updatedAt time.Time) (bool, error) {
+	query := psql.Update("payment").
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"paym_id": paymID, "updated_at": updatedAt})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "Error generating payment sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return false, errors.Wrap(err, "Error claiming payment")
+	}
+	n, err := res.RowsAffected()
+	return n == 1, errors.Wrap(err, "Error claiming payment")
+}
+
+type pgBanks struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts the account of a doctor
+func (r *pgBanks) Save(ctx context.Context, b *Bank) error {
+	query := psql.Insert("bank").
+		Columns("doct_id", "bank", "agency", "account", "type", "name", "pix_key_type", "pix_key").
+		Values(b.DoctID, b.Bank, b.Agency, b.Account, b.Type, b.Name, b.PixKeyType, b.PixKey).
+		Suffix("RETURNING bank_id, created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating bank sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&b.BankID, &b.CreatedAt)
+	done(err)
+	if uniqueViolation(err, "bank_doct_id_key") {
+		return &auth.ConflictError{Message: "Doctor already has a bank account, update it instead"}
+	}
+	return errors.Wrap(err, "Error inserting bank")
+}
+
+// FromDoctor gets the active account of a doctor
+func (r *pgBanks) FromDoctor(ctx context.Context, doctID uuid.UUID) (*Bank, error) {
+	b := Bank{}
+	query := psql.Select("*").
+		From("bank").
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating bank sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &b, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No bank account for this doctor: " + doctID.String()}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting bank")
+	}
+	return &b, nil
+}
+
+// SoftDelete soft deletes the active account of a doctor
+func (r *pgBanks) SoftDelete(ctx context.Context, doctID uuid.UUID) error {
+	query := psql.Update("bank").
+		Set("deleted_at", time.Now()).
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating bank sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting bank")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No bank account for this doctor: " + doctID.String()}
+	}
+	return nil
+}
+
+type pgPayouts struct {
+	q sqlx.ExtContext
+}
+
+// Bookable lists the payments to add to the payout ledger, their gross is
+// what was kept of the capture, releases before it never were charged
+func (r *pgPayouts) Bookable(ctx context.Context, before time.Time, limit int) ([]PayoutEntry, error) {
+	es := []PayoutEntry{}
+	query := psql.Select("m.doct_id", "p.paym_id", "p.matc_id", "p.captured - p.refunded AS gross").
+		From("payment p").
+		Join("match m ON m.matc_id = p.matc_id").
+		LeftJoin("payout_entry e ON e.paym_id = p.paym_id").
+		Where(sq.Eq{"e.poen_id": nil, "p.status": PaymentCaptured}).
+		Where(sq.Lt{"p.updated_at": before}).
+		Where("p.captured > p.refunded").
+		Where(sq.Or{
+			sq.Eq{"m.status": MatchCompleted},
+			sq.And{
+				sq.Eq{"m.status": []MatchStatus{MatchNoShow, MatchCanceledByPatient, MatchCanceledByDoctor}},
+				sq.Expr("p.captured - p.refunded <= m.cancel_fee"),
+			},
+		}).
+		OrderBy("p.updated_at").
+		Limit(uint64(limit))
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &es, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing bookable payments")
+	}
+	return es, nil
+}
+
+// AddEntry adds a payment to the payout ledger, once
+func (r *pgPayouts) AddEntry(ctx context.Context, e *PayoutEntry) error {
+	query := psql.Insert("payout_entry").
+		Columns("doct_id", "paym_id", "matc_id", "gross", "commission", "net").
+		Values(e.DoctID, e.PaymID, e.MatcID, e.Gross, e.Commission, e.Net).
+		Suffix("ON CONFLICT (paym_id) WHERE reverses IS NULL DO NOTHING RETURNING poen_id, created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout entry sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&e.PoenID, &e.CreatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return errors.Wrap(err, "Error inserting payout entry")
+}
+
+// Reverse deletes the entry of a payment not paid yet or books its
+// reversal, once
+func (r *pgPayouts) Reverse(ctx context.Context, paymID uuid.UUID) error {
+	query := psql.Select("*").
+		From("payout_entry").
+		Where(sq.Eq{"paym_id": paymID, "reverses": nil}).
+		Suffix("FOR UPDATE")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout entry sql")
+	}
+	e := PayoutEntry{}
+	lctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(lctx, r.q, &e, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error getting payout entry")
+	}
+
+	if e.PayoID == nil {
+		dSQL, args, err := psql.Delete("payout_entry").Where(sq.Eq{"poen_id": e.PoenID}).ToSql()
+		if err != nil {
+			return errors.Wrap(err, "Error generating payout entry sql")
+		}
+		ctx, done = traceSQL(ctx, dSQL)
+		_, err = r.q.ExecContext(ctx, dSQL, args...)
+		done(err)
+		return errors.Wrap(err, "Error deleting payout entry")
+	}
+	iSQL, args, err := psql.Insert("payout_entry").
+		Columns("doct_id", "paym_id", "matc_id", "gross", "commission", "net", "reverses").
+		Values(e.DoctID, e.PaymID, e.MatcID, -e.Gross, -e.Commission, -e.Net, e.PoenID).
+		Suffix("ON CONFLICT (reverses) DO NOTHING").
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done = traceSQL(ctx, iSQL)
+	_, err = r.q.ExecContext(ctx, iSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error inserting payout reversal")
+}
+
+// Payees lists the doctors owed
+func (r *pgPayouts) Payees(ctx context.Context) ([]uuid.UUID, error) {
+	ids := []uuid.UUID{}
+	query := psql.Select("DISTINCT doct_id").
+		From("payout_entry").
+		Where(sq.Eq{"payo_id": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ids, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing payees")
+	}
+	return ids, nil
+}
+
+// Unpaid lists the entries of a doctor not paid yet
+func (r *pgPayouts) Unpaid(ctx context.Context, doctID uuid.UUID) ([]PayoutEntry, error) {
+	return r.entries(ctx, sq.Eq{"doct_id": doctID, "payo_id": nil})
+}
+
+// Entries lists the entries paid by a payout
+func (r *pgPayouts) Entries(ctx context.Context, payoID uuid.UUID) ([]PayoutEntry, error) {
+	return r.entries(ctx, sq.Eq{"payo_id": payoID})
+}
+
+func (r *pgPayouts) entries(ctx context.Context, where sq.Eq) ([]PayoutEntry, error) {
+	es := []PayoutEntry{}
+	query := psql.Select("*").
+		From("payout_entry").
+		Where(where).
+		OrderBy("created_at", "poen_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &es, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing payout entries")
+	}
+	return es, nil
+}
+
+// Save inserts a payout
+func (r *pgPayouts) Save(ctx context.Context, p *Payout) error {
+	query := psql.Insert("payout").
+		Columns("doct_id", "bank_id", "method", "amount", "status", "scheduled_for").
+		Values(p.DoctID, p.BankID, p.Method, p.Amount, p.Status, p.ScheduledFor.Format("2006-01-02")).
+		Suffix("RETURNING payo_id, created_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&p.PayoID, &p.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting payout")
+}
+
+// Assign sets the payout of entries not paid yet
+func (r *pgPayouts) Assign(ctx context.Context, payoID uuid.UUID, poenIDs []uuid.UUID) error {
+	if len(poenIDs) == 0 {
+		return nil
+	}
+	query := psql.Update("payout_entry").
+		Set("payo_id", payoID).
+		Where(sq.Eq{"poen_id": poenIDs, "payo_id": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error assigning payout entries")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Error assigning payout entries")
+	}
+	if int(n) != len(poenIDs) {
+		return &auth.ConflictError{Message: "Payout entries already paid"}
+	}
+	return nil
+}
+
+// SetStatus marks a scheduled payout paid or failed, the entries of a
+// failed one are unpaid again
+func (r *pgPayouts) SetStatus(ctx context.Context, p *Payout) error {
+	query := psql.Update("payout").
+		Set("status", p.Status).
+		Where(sq.Eq{"payo_id": p.PayoID, "status": PayoutScheduled}).
+		Suffix("RETURNING *")
+	if p.Status == PayoutPaid {
+		query = query.Set("paid_at", sq.Expr("now()"))
+	}
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout sql")
+	}
+	uctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(uctx, r.q, p, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		status := ""
+		sSQL := "SELECT status FROM payout WHERE payo_id = $1"
+		sctx, done := traceSQL(ctx, sSQL)
+		err = r.q.QueryRowxContext(sctx, sSQL, p.PayoID).Scan(&status)
+		done(err)
+		if err == sql.ErrNoRows {
+			return &auth.NotFoundError{Message: "No such payout"}
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error getting payout")
+		}
+		return &auth.ConflictError{Message: "The payout is " + status + " already"}
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error updating payout")
+	}
+	if p.Status != PayoutFailed {
+		return nil
+	}
+
+	rSQL, args, err := psql.Update("payout_entry").
+		Set("payo_id", nil).
+		Where(sq.Eq{"payo_id": p.PayoID}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating payout entry sql")
+	}
+	ctx, done = traceSQL(ctx, rSQL)
+	_, err = r.q.ExecContext(ctx, rSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error releasing payout entries")
+}
+
+// List lists a page of the payouts of a doctor
+func (r *pgPayouts) List(ctx context.Context, doctID uuid.UUID, limit, offset int) ([]Payout, int, error) {
+	ps := []Payout{}
+	where := sq.Eq{"doct_id": doctID}
+
+	countSQL, args, err := psql.Select("count(*)").From("payout").Where(where).ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating payout count sql")
+	}
+	var total int
+	cctx, done := traceSQL(ctx, countSQL)
+	err = sqlx.GetContext(cctx, r.q, &total, countSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error counting payouts")
+	}
+
+	query := psql.Select("*").
+		From("payout").
+		Where(where).
+		OrderBy("created_at DESC", "payo_id")
+	if limit > 0 {
+		query = query.Limit(uint64(limit)).Offset(uint64(offset))
+	}
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating payout sql")
+	}
+	ctx, done = traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ps, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error listing payouts")
+	}
+	return ps, total, nil
+}
+
+type pgWebhooks struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts an event, or touches the pending one with its id
+func (r *pgWebhooks) Save(ctx context.Context, e *WebhookEvent) (bool, error) {
+	query := psql.Insert("webhook_event").
+		Columns("provider", "event_id", "payload").
+		Values(e.Provider, e.EventID, e.Payload).
+		Suffix("ON CONFLICT (provider, event_id) WHERE status = 'pending' DO UPDATE SET updated_at = now()").
+		Suffix("RETURNING wehe_id, status, received_at, updated_at, xmax = 0")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "Error generating webhook event sql")
+	}
+
+	inserted := false
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&e.WeheID, &e.Status, &e.ReceivedAt, &e.UpdatedAt, &inserted)
+	done(err)
+	if err != nil {
+		return false, errors.Wrap(err, "Error inserting webhook event")
+	}
+	return inserted, nil
+}
+
+// Pending lists the events the processor has to go through
+func (r *pgWebhooks) Pending(ctx context.Context, limit int) ([]WebhookEvent, error) {
+	es := []WebhookEvent{}
+	query := psql.Select("*").
+		From("webhook_event").
+		Where(sq.Eq{"status": WebhookPending}).
+		OrderBy("updated_at").
+		Limit(uint64(limit))
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating webhook event sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &es, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing pending webhook events")
+	}
+	return es, nil
+}
+
+// Claim bumps the update time of an event not updated since e.UpdatedAt
+func (r *pgWebhooks) Claim(ctx context.Context, e *WebhookEvent) (bool, error) {
+	query := psql.Update("webhook_event").
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"wehe_id": e.WeheID, "updated_at": e.UpdatedAt}).
+		Suffix("RETURNING updated_at")
+	return r.update(ctx, query, e)
+}
+
+// Finish stores the outcome of processing an event
+func (r *pgWebhooks) Finish(ctx context.Context, e *WebhookEvent) (bool, error) {
+	var processedAt interface{}
+	if e.Status != WebhookPending {
+		processedAt = sq.Expr("now()")
+	}
+	query := psql.Update("webhook_event").
+		SetMap(map[string]interface{}{
+			"status":       e.Status,
+			"attempts":     e.Attempts,
+			"error":        e.Error,
+			"processed_at": processedAt,
+			"updated_at":   sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"wehe_id": e.WeheID, "status": WebhookPending, "updated_at": e.UpdatedAt}).
+		Suffix("RETURNING updated_at")
+	return r.update(ctx, query, e)
+}
+
+// update runs query, reporting whether it changed e
+func (r *pgWebhooks) update(ctx context.Context, query sq.UpdateBuilder, e *WebhookEvent) (bool, error) {
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "Error generating webhook event sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&e.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "Error updating webhook event")
+	}
+	return true, nil
+}
+
+// Replay makes an event pending again
+func (r *pgWebhooks) Replay(ctx context.Context, weheID uuid.UUID) (*WebhookEvent, error) {
+	e := WebhookEvent{}
+	query := psql.Update("webhook_event").
+		SetMap(map[string]interface{}{
+			"status":       WebhookPending,
+			"attempts":     0,
+			"error":        "",
+			"processed_at": nil,
+			"updated_at":   sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"wehe_id": weheID}).
+		Suffix("RETURNING *")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating webhook event sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &e, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No webhook event with this id: " + weheID.String()}
+	}
+	if uniqueViolation(err, "webhook_event_pending_key") {
+		return nil, &auth.ConflictError{Message: "The same change was notified again and is pending"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error replaying webhook event")
+	}
+	return &e, nil
+}
+
+type pgServices struct {
+	q sqlx.ExtContext
+}
+
+// Save inserts a service of a doctor and its first price
+func (r *pgServices) Save(ctx context.Context, s *Service) error {
+	query := psql.Insert("service").
+		Columns("doct_id", "addr_id", "spec_id", "proc_id", "name", "type", "price_min").
+		Values(s.DoctID, s.AddrID, s.SpecID, s.ProcID, s.Name, s.Type, s.PriceMin).
+		Suffix("RETURNING serv_id, version, created_at, updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating service sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&s.ServID, &s.Version, &s.CreatedAt, &s.UpdatedAt)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error inserting service")
+	}
+	return r.addPrice(ctx, s)
+}
+
+// Update updates a service of a doctor still at version, adding its price
+// when the version moved
+func (r *pgServices) Update(ctx context.Context, s *Service, version int) error {
+	query := psql.Update("service").
+		SetMap(map[string]interface{}{
+			"addr_id":    s.AddrID,
+			"spec_id":    s.SpecID,
+			"proc_id":    s.ProcID,
+			"name":       s.Name,
+			"type":       s.Type,
+			"price_min":  s.PriceMin,
+			"version":    s.Version,
+			"updated_at": sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"serv_id": s.ServID, "doct_id": s.DoctID, "version": version, "deleted_at": nil}).
+		Suffix("RETURNING updated_at")
+
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating service sql")
+	}
+
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&s.UpdatedAt)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.ConflictError{Message: "Service was changed since, reload it"}
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error updating service")
+	}
+	if s.Version == version {
+		return nil
+	}
+	return r.addPrice(ctx, s)
+}
+
+// addPrice inserts the price of the version of a service
+func (r *pgServices) addPrice(ctx context.Context, s *Service) error {
+	query := psql.Insert("service_price").
+		Columns("serv_id", "version", "price_min").
+		Values(s.ServID, s.Version, s.PriceMin)
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating service price sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	_, err = r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	return errors.Wrap(err, "Error inserting service price")
+}
+
+// FromID gets a service of a doctor
+func (r *pgServices) FromID(ctx context.Context, doctID, servID uuid.UUID) (*Service, error) {
+	s := Service{}
+	query := psql.Select("*").
+		From("service").
+		Where(sq.Eq{"serv_id": servID, "doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating service sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &s, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such service"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting service")
+	}
+	return &s, nil
+}
+
+// List the services of a doctor
+func (r *pgServices) List(ctx context.Context, doctID uuid.UUID) (Services, error) {
+	ss := Services{}
+	query := psql.Select("*").
+		From("service").
+		Where(sq.Eq{"doct_id": doctID, "deleted_at": nil}).
+		OrderBy("created_at", "serv_id")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating service sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ss, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing services")
+	}
+	return ss, nil
+}
+
+// Prices lists the prices of a service
+func (r *pgServices) Prices(ctx context.Context, servID uuid.UUID) ([]ServicePrice, error) {
+	ps := []ServicePrice{}
+	query := psql.Select("*").
+		From("service_price").
+		Where(sq.Eq{"serv_id": servID}).
+		OrderBy("version DESC")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating service price sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ps, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing service prices")
+	}
+	return ps, nil
+}
+
+// SoftDelete soft deletes a service of a doctor
+func (r *pgServices) SoftDelete(ctx context.Context, doctID, servID uuid.UUID) error {
+	query := psql.Update("service").
+		Set("deleted_at", sq.Expr("now()")).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"serv_id": servID, "doct_id": doctID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating service sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting service")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such service"}
+	}
+	return nil
+}
+
+// Specialized checks an approved specialization of a doctor
+func (r *pgServices) Specialized(ctx context.Context, doctID, specID uuid.UUID) (bool, error) {
+	ok := false
+	query := psql.Select("count(*) > 0").
+		From("doctor_specialization").
+		Where(sq.Eq{"doct_id": doctID, "spec_id": specID, "status": SpecApproved, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &ok, qSQL, args...)
+	done(err)
+	return ok, errors.Wrap(err, "Error getting doctor specialization")
+}
+
+// ProcedureSpec gets the specialization of a procedure
+func (r *pgServices) ProcedureSpec(ctx context.Context, procID uuid.UUID) (uuid.UUID, error) {
+	specID := uuid.Nil
+	query := psql.Select("spec_id").
+		From("procedure").
+		Where(sq.Eq{"proc_id": procID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return uuid.Nil, errors.Wrap(err, "Error generating procedure sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &specID, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, &auth.NotFoundError{Message: "No such procedure"}
+	}
+	return specID, errors.Wrap(err, "Error getting procedure")
+}
+
+type pgSpecializations struct {
+	q sqlx.ExtContext
+}
+
+// specColumns are those of a doctor specialization along with the name in
+// the catalog
+var specColumns = []string{"ds.*", "s.name"}
+
+// Add inserts a doctor specialization pending review, or makes one removed
+// or rejected pending again
+func (r *pgSpecializations) Add(ctx context.Context, s *Specialization) error {
+	query := psql.Select("true").
+		From("specialization").
+		Where(sq.Eq{"spec_id": s.SpecID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating specialization sql")
+	}
+	ok := false
+	cctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(cctx, r.q, &ok, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.NotFoundError{Message: "No such specialization"}
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error getting specialization")
+	}
+
+	ins := psql.Insert("doctor_specialization").
+		Columns("doct_id", "spec_id", "rqe").
+		Values(s.DoctID, s.SpecID, s.RQE).
+		Suffix(`ON CONFLICT (doct_id, spec_id) DO UPDATE SET
+			rqe = EXCLUDED.rqe, status = 'pending', reason = '', reviewed_by = NULL,
+			reviewed_at = NULL, updated_at = now(), deleted_at = NULL
+			WHERE doctor_specialization.deleted_at IS NOT NULL OR doctor_specialization.status = 'rejected'
+			RETURNING status`)
+	qSQL, args, err = ins.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	ictx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ictx, qSQL, args...).Scan(&s.Status)
+	done(err)
+	if err == sql.ErrNoRows {
+		return &auth.ConflictError{Message: "The doctor has the specialization already"}
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error inserting doctor specialization")
+	}
+	cur, err := r.FromID(ctx, s.DoctID, s.SpecID)
+	if err != nil {
+		return err
+	}
+	*s = *cur
+	return nil
+}
+
+// FromID gets a specialization of a doctor
+func (r *pgSpecializations) FromID(ctx context.Context, doctID, specID uuid.UUID) (*Specialization, error) {
+	query := psql.Select(specColumns...).
+		From("doctor_specialization ds").
+		Join("specialization s ON s.spec_id = ds.spec_id").
+		Where(sq.Eq{"ds.doct_id": doctID, "ds.spec_id": specID, "ds.deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	s := Specialization{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &s, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such specialization"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting doctor specialization")
+	}
+	return &s, nil
+}
+
+// List lists the specializations of a doctor
+func (r *pgSpecializations) List(ctx context.Context, doctID uuid.UUID, statuses []string) (Specializations, error) {
+	query := psql.Select(specColumns...).
+		From("doctor_specialization ds").
+		Join("specialization s ON s.spec_id = ds.spec_id").
+		Where(sq.Eq{"ds.doct_id": doctID, "ds.deleted_at": nil}).
+		OrderBy("s.name")
+	if len(statuses) > 0 {
+		query = query.Where(sq.Eq{"ds.status": statuses})
+	}
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	ss := Specializations{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ss, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing doctor specializations")
+	}
+	return ss, nil
+}
+
+// Pending lists the specializations pending review
+func (r *pgSpecializations) Pending(ctx context.Context, limit, offset int) (Specializations, int, error) {
+	where := sq.Eq{"ds.status": SpecPending, "ds.deleted_at": nil}
+	countSQL, args, err := psql.Select("count(*)").From("doctor_specialization ds").Where(where).ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating doctor specialization count sql")
+	}
+	total := 0
+	cctx, done := traceSQL(ctx, countSQL)
+	err = sqlx.GetContext(cctx, r.q, &total, countSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error counting doctor specializations")
+	}
+
+	query := psql.Select(specColumns...).
+		From("doctor_specialization ds").
+		Join("specialization s ON s.spec_id = ds.spec_id").
+		Where(where).
+		OrderBy("ds.updated_at").
+		Limit(uint64(limit)).
+		Offset(uint64(offset))
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	ss := Specializations{}
+	ctx, done = traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ss, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Error listing doctor specializations")
+	}
+	return ss, total, nil
+}
+
+// Review stores the decision on a specialization pending review
+func (r *pgSpecializations) Review(ctx context.Context, s *Specialization) error {
+	query := psql.Update("doctor_specialization").
+		SetMap(map[string]interface{}{
+			"status":      s.Status,
+			"reason":      s.Reason,
+			"reviewed_by": s.ReviewedBy,
+			"reviewed_at": sq.Expr("now()"),
+			"updated_at":  sq.Expr("now()"),
+		}).
+		Where(sq.Eq{"doct_id": s.DoctID, "spec_id": s.SpecID, "status": SpecPending, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	uctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(uctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error reviewing doctor specialization")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Error reviewing doctor specialization")
+	}
+	cur, err := r.FromID(ctx, s.DoctID, s.SpecID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &auth.ConflictError{Message: "The specialization is " + cur.Status + " already"}
+	}
+	*s = *cur
+	return nil
+}
+
+// Remove soft deletes a specialization of a doctor
+func (r *pgSpecializations) Remove(ctx context.Context, doctID, specID uuid.UUID) error {
+	query := psql.Update("doctor_specialization").
+		Set("deleted_at", sq.Expr("now()")).
+		Set("updated_at", sq.Expr("now()")).
+		Where(sq.Eq{"doct_id": doctID, "spec_id": specID, "deleted_at": nil})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating doctor specialization sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	res, err := r.q.ExecContext(ctx, qSQL, args...)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "Error soft deleting doctor specialization")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &auth.NotFoundError{Message: "No such specialization"}
+	}
+	return nil
+}
+
+// SaveDocument inserts a document of a specialization
+func (r *pgSpecializations) SaveDocument(ctx context.Context, d *SpecDocument) error {
+	query := psql.Insert("doctor_specialization_document").
+		Columns("doct_id", "spec_id", "name", "content_type", "size", "content").
+		Values(d.DoctID, d.SpecID, d.Name, d.ContentType, d.Size, d.Content).
+		Suffix("RETURNING dsdo_id, created_at")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error generating document sql")
+	}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = r.q.QueryRowxContext(ctx, qSQL, args...).Scan(&d.DsdoID, &d.CreatedAt)
+	done(err)
+	return errors.Wrap(err, "Error inserting document")
+}
+
+// Documents lists the documents of a specialization, leaving their content
+// out
+func (r *pgSpecializations) Documents(ctx context.Context, doctID, specID uuid.UUID) ([]SpecDocument, error) {
+	query := psql.Select("dsdo_id", "doct_id", "spec_id", "name", "content_type", "size", "created_at").
+		From("doctor_specialization_document").
+		Where(sq.Eq{"doct_id": doctID, "spec_id": specID}).
+		OrderBy("created_at")
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating document sql")
+	}
+	ds := []SpecDocument{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.SelectContext(ctx, r.q, &ds, qSQL, args...)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing documents")
+	}
+	return ds, nil
+}
+
+// Document gets a document with its content
+func (r *pgSpecializations) Document(ctx context.Context, dsdoID uuid.UUID) (*SpecDocument, error) {
+	query := psql.Select("*").
+		From("doctor_specialization_document").
+		Where(sq.Eq{"dsdo_id": dsdoID})
+	qSQL, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating document sql")
+	}
+	d := SpecDocument{}
+	ctx, done := traceSQL(ctx, qSQL)
+	err = sqlx.GetContext(ctx, r.q, &d, qSQL, args...)
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, &auth.NotFoundError{Message: "No such document"}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting document")
+	}
+	return &d, nil
+}
@@ -0,0 +1,67 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/dbtest"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestPgUsersAgainstPostgres(t *testing.T) {
+	tx := dbtest.Tx(t, dbtest.SharedDB(t))
+	s := &PgTxStore{Parent: tx}
+	ctx := context.Background()
+	f := &dbtest.Factory{Q: tx}
+	existing := f.User(t)
+
+	id, _ := uuid.NewV4()
+	failed := errors.New("failed")
+	err := s.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, &User{UserID: id, Email: "pg@mail.com", Role: []string{"user"}})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Expected the unit of work error, got %v", err)
+	}
+	g := Getter{Store: s}
+	_, err = g.Run(ctx, id)
+	if _, ok := err.(*auth.UserNotFoundError); !ok {
+		t.Errorf("Expected rolled back user to be missing, got %v", err)
+	}
+
+	err = s.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, &User{UserID: id, Email: "pg@mail.com", Role: []string{"user"}})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	err = s.Tx(ctx, func(r Repos) error {
+		u, err := r.Users.FromEmail(ctx, existing.Email)
+		if err != nil {
+			return err
+		}
+		if u.UserID != existing.UserID {
+			t.Errorf("Expected factory user %s, got %s", existing.UserID, u.UserID)
+		}
+		_, err = r.Users.Save(ctx, &User{UserID: id, Email: "other@mail.com"})
+		if err == nil {
+			t.Errorf("Expected duplicate user_id to fail")
+		}
+		return err
+	})
+	if err == nil {
+		t.Errorf("Expected the failed unit of work to return its error")
+	}
+	u, err := g.Run(ctx, id)
+	if err != nil || u.Email != "pg@mail.com" {
+		t.Errorf("Expected committed user to survive a later rollback, got %v %v", u, err)
+	}
+}
@@ -0,0 +1,100 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestPgStoreCommit(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	id, _ := uuid.NewV4()
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "user" SET password = \$1 WHERE user_id = \$2`).
+		WithArgs([]byte("hash"), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	s := &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}
+	err = s.Tx(context.Background(), func(r Repos) error {
+		return r.Users.UpdatePassword(context.Background(), id, []byte("hash"))
+	})
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestPgStoreRollbackOnPanic(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	s := &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Errorf("Expected the panic to be propagated")
+			}
+		}()
+		s.Tx(context.Background(), func(r Repos) error {
+			panic("boom")
+		})
+	}()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectations %s", err)
+	}
+}
+
+func TestMemStoreRollback(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	id, _ := uuid.NewV4()
+
+	failed := errors.New("failed")
+	err := s.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, &User{UserID: id, Email: "test@mail.com"})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Expected the unit of work error, got %v", err)
+	}
+
+	g := Getter{Store: s}
+	_, err = g.Run(ctx, id)
+	if _, ok := err.(*auth.UserNotFoundError); !ok {
+		t.Errorf("Expected rolled back user to be missing, got %v", err)
+	}
+
+	err = s.Tx(ctx, func(r Repos) error {
+		_, err := r.Users.Save(ctx, &User{UserID: id, Email: "test@mail.com"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	u, err := g.Run(ctx, id)
+	if err != nil || u.Email != "test@mail.com" {
+		t.Errorf("Expected committed user, got %v %v", u, err)
+	}
+}
@@ -0,0 +1,446 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"time"
+	// slots are generated in the availability timezone, keep the zone
+	// database in the binary for images without one
+	_ "time/tzdata"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// DefaultTimezone is the timezone of availabilities created without one
+const DefaultTimezone = "America/Sao_Paulo"
+
+// maxSlotWindow bounds how far slots are generated at once
+const maxSlotWindow = 31 * 24 * time.Hour
+
+// Availability is a representation of the table availability, hours a
+// doctor attends at an address every week. Starts and Ends are HH:MM in
+// Timezone.
+type Availability struct {
+	AvaiID        uuid.UUID    `db:"avai_id" json:"avaiID"`
+	DoctID        uuid.UUID    `db:"doct_id" json:"doctID"`
+	AddrID        int          `db:"addr_id" json:"addrID"`
+	Weekday       time.Weekday `db:"weekday" json:"weekday"`
+	Starts        string       `db:"starts" json:"starts" example:"08:00"`
+	Ends          string       `db:"ends" json:"ends" example:"12:00"`
+	SlotMinutes   int          `db:"slot_minutes" json:"slotMinutes" example:"30"`
+	BufferMinutes int          `db:"buffer_minutes" json:"bufferMinutes" example:"10"`
+	Timezone      string       `db:"timezone" json:"timezone" example:"America/Sao_Paulo"`
+	CreatedAt     time.Time    `db:"created_at" json:"createdAt"`
+	DeletedAt     null.Time    `db:"deleted_at" json:"deletedAt"`
+}
+
+// AvailabilityException is a representation of the table
+// availability_exception, an interval the doctor doesn't attend at AddrID,
+// or at any address when AddrID is null
+type AvailabilityException struct {
+	AvexID    uuid.UUID `db:"avex_id" json:"avexID"`
+	DoctID    uuid.UUID `db:"doct_id" json:"doctID"`
+	AddrID    null.Int  `db:"addr_id" json:"addrID" swaggertype:"integer"`
+	StartsAt  time.Time `db:"starts_at" json:"startsAt"`
+	EndsAt    time.Time `db:"ends_at" json:"endsAt"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	DeletedAt null.Time `db:"deleted_at" json:"deletedAt"`
+}
+
+// SessionSchedule is a representation of the table session_schedule, a
+// slot booked by a patient
+type SessionSchedule struct {
+	SescID     uuid.UUID `db:"sesc_id" json:"sescID"`
+	DoctID     uuid.UUID `db:"doct_id" json:"doctID"`
+	AddrID     int       `db:"addr_id" json:"addrID"`
+	PatiID     uuid.UUID `db:"pati_id" json:"patiID"`
+	StartsAt   time.Time `db:"starts_at" json:"startsAt"`
+	EndsAt     time.Time `db:"ends_at" json:"endsAt"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+	CanceledAt null.Time `db:"canceled_at" json:"canceledAt"`
+}
+
+// Slot is a free interval a patient can book
+type Slot struct {
+	AddrID   int       `json:"addrID"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+// clockMinutes parses HH:MM into minutes since midnight
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil || len(s) != 5 {
+		return 0, errors.New("Invalid time " + s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func overlaps(aStart, aEnd, bStart, bEnd time.Time) bool {
+	return aStart.Before(bEnd) && bStart.Before(aEnd)
+}
+
+// Slots generates the slots of avs within from and to, leaving out those
+// overlapping an exception or a session already booked at any address
+func Slots(avs []Availability, exs []AvailabilityException, booked []SessionSchedule, from, to time.Time) []Slot {
+	slots := []Slot{}
+	for _, av := range avs {
+		loc, err := time.LoadLocation(av.Timezone)
+		if err != nil {
+			continue
+		}
+		starts, err1 := clockMinutes(av.Starts)
+		ends, err2 := clockMinutes(av.Ends)
+		if err1 != nil || err2 != nil || av.SlotMinutes <= 0 {
+			continue
+		}
+		length := time.Duration(av.SlotMinutes) * time.Minute
+
+		f := from.In(loc)
+		for day := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+			if day.Weekday() != av.Weekday {
+				continue
+			}
+			for m := starts; m+av.SlotMinutes <= ends; m += av.SlotMinutes + av.BufferMinutes {
+				s := time.Date(day.Year(), day.Month(), day.Day(), m/60, m%60, 0, 0, loc)
+				slot := Slot{AddrID: av.AddrID, StartsAt: s, EndsAt: s.Add(length)}
+				if slot.StartsAt.Before(from) || slot.EndsAt.After(to) || blocked(slot, exs, booked) {
+					continue
+				}
+				slots = append(slots, slot)
+			}
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].StartsAt.Equal(slots[j].StartsAt) {
+			return slots[i].AddrID < slots[j].AddrID
+		}
+		return slots[i].StartsAt.Before(slots[j].StartsAt)
+	})
+	return slots
+}
+
+func blocked(s Slot, exs []AvailabilityException, booked []SessionSchedule) bool {
+	for _, e := range exs {
+		if e.DeletedAt.Valid || e.AddrID.Valid && int(e.AddrID.Int64) != s.AddrID {
+			continue
+		}
+		if overlaps(s.StartsAt, s.EndsAt, e.StartsAt, e.EndsAt) {
+			return true
+		}
+	}
+	for _, b := range booked {
+		if !b.CanceledAt.Valid && overlaps(s.StartsAt, s.EndsAt, b.StartsAt, b.EndsAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAvailability sets the defaults of av and checks it doesn't
+// overlap the other availabilities of the doctor
+func validateAvailability(av *Availability, others []Availability) error {
+	if av.Weekday < time.Sunday || av.Weekday > time.Saturday {
+		return &auth.ValidationError{
+			Messages: map[string]string{"weekday": "Weekday must be between 0 and 6"},
+		}
+	}
+	starts, err1 := clockMinutes(av.Starts)
+	ends, err2 := clockMinutes(av.Ends)
+	if err1 != nil || err2 != nil || starts >= ends {
+		return &auth.ValidationError{
+			Messages: map[string]string{"starts": "Hours must be HH:MM and start before ending"},
+		}
+	}
+	if av.SlotMinutes == 0 {
+		av.SlotMinutes = 30
+	}
+	if av.SlotMinutes < 5 || av.SlotMinutes > ends-starts {
+		return &auth.ValidationError{
+			Messages: map[string]string{"slotMinutes": "Slots must be at least 5 minutes and fit the hours"},
+		}
+	}
+	if av.BufferMinutes < 0 || av.BufferMinutes > 240 {
+		return &auth.ValidationError{
+			Messages: map[string]string{"bufferMinutes": "Buffer must be between 0 and 240 minutes"},
+		}
+	}
+	if len(av.Timezone) == 0 {
+		av.Timezone = DefaultTimezone
+	}
+	if _, err := time.LoadLocation(av.Timezone); err != nil {
+		return &auth.ValidationError{
+			Messages: map[string]string{"timezone": "Unknown timezone " + av.Timezone},
+		}
+	}
+
+	// hours in other timezones are compared in UTC, at the offsets of both
+	// halves of the year so daylight saving time can't make them overlap
+	now := time.Now()
+	for _, o := range others {
+		for _, at := range []time.Time{now, now.AddDate(0, 6, 0)} {
+			s1, e1 := utcWeekMinutes(*av, at)
+			s2, e2 := utcWeekMinutes(o, at)
+			for _, shift := range []int{-weekMinutes, 0, weekMinutes} {
+				if s1 < e2+shift && s2+shift < e1 {
+					return &auth.ValidationError{
+						Messages: map[string]string{"starts": "Overlaps the hours from " + o.Starts + " to " + o.Ends + " " + o.Timezone},
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+const weekMinutes = 7 * 24 * 60
+
+// utcWeekMinutes is when the hours of av start and end in minutes from
+// Sunday 00:00 UTC, at the offset its timezone has at at
+func utcWeekMinutes(av Availability, at time.Time) (int, int) {
+	offset := 0
+	if loc, err := time.LoadLocation(av.Timezone); err == nil {
+		_, offset = at.In(loc).Zone()
+	}
+	starts, _ := clockMinutes(av.Starts)
+	ends, _ := clockMinutes(av.Ends)
+	day := int(av.Weekday)*24*60 - offset/60
+	return day + starts, day + ends
+}
+
+// AvailabilityCreator adds weekly hours to a doctor address
+type AvailabilityCreator struct {
+	Store Store
+}
+
+// Run validates and saves av
+func (c *AvailabilityCreator) Run(ctx context.Context, av *Availability) (a *Availability, err error) {
+	ctx, span := tracing.Start(ctx, "user.AvailabilityCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Addresses.FromID(ctx, av.DoctID, av.AddrID)
+		if err != nil {
+			return err
+		}
+		others, err := r.Schedules.Availabilities(ctx, av.DoctID)
+		if err != nil {
+			return err
+		}
+		err = validateAvailability(av, others)
+		if err != nil {
+			return err
+		}
+		av.AvaiID, err = uuid.NewV4()
+		if err != nil {
+			return errors.Wrap(err, "Error generating availability uuid")
+		}
+		return r.Schedules.SaveAvailability(ctx, av)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return av, nil
+}
+
+// AvailabilityLister lists the weekly hours of a doctor
+type AvailabilityLister struct {
+	Store Store
+}
+
+// Run returns the availabilities of doctID
+func (l *AvailabilityLister) Run(ctx context.Context, doctID uuid.UUID) (avs []Availability, err error) {
+	ctx, span := tracing.Start(ctx, "user.AvailabilityLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		avs, err = r.Schedules.Availabilities(ctx, doctID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return avs, nil
+}
+
+// AvailabilityRemover removes weekly hours of a doctor, booked sessions
+// are kept
+type AvailabilityRemover struct {
+	Store Store
+}
+
+// Run soft deletes avaiID of doctID
+func (rm *AvailabilityRemover) Run(ctx context.Context, doctID, avaiID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.AvailabilityRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		return r.Schedules.RemoveAvailability(ctx, doctID, avaiID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Availability removed", nil
+}
+
+// ExceptionCreator blocks an interval of a doctor, e.g. a holiday
+type ExceptionCreator struct {
+	Store Store
+}
+
+// Run validates and saves e, sessions already booked in it are kept
+func (c *ExceptionCreator) Run(ctx context.Context, e *AvailabilityException) (ex *AvailabilityException, err error) {
+	ctx, span := tracing.Start(ctx, "user.ExceptionCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if !e.StartsAt.Before(e.EndsAt) {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"startsAt": "Exception must start before ending"},
+		}
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		if e.AddrID.Valid {
+			_, err = r.Addresses.FromID(ctx, e.DoctID, int(e.AddrID.Int64))
+		} else {
+			_, err = r.Doctors.FromID(ctx, e.DoctID)
+		}
+		if err != nil {
+			return err
+		}
+		e.AvexID, err = uuid.NewV4()
+		if err != nil {
+			return errors.Wrap(err, "Error generating exception uuid")
+		}
+		return r.Schedules.SaveException(ctx, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ExceptionRemover removes an exception of a doctor
+type ExceptionRemover struct {
+	Store Store
+}
+
+// Run soft deletes avexID of doctID
+func (rm *ExceptionRemover) Run(ctx context.Context, doctID, avexID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.ExceptionRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		return r.Schedules.RemoveException(ctx, doctID, avexID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Exception removed", nil
+}
+
+// SlotLister lists the free slots of a doctor
+type SlotLister struct {
+	Store Store
+}
+
+// Run returns the free slots of doctID within from and to, up to a month
+func (l *SlotLister) Run(ctx context.Context, doctID uuid.UUID, from, to time.Time) (slots []Slot, err error) {
+	ctx, span := tracing.Start(ctx, "user.SlotLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if !from.Before(to) || to.Sub(from) > maxSlotWindow {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"to": "The interval must be positive and up to 31 days"},
+		}
+	}
+	if now := time.Now(); from.Before(now) {
+		from = now
+	}
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		slots, err = freeSlots(ctx, r, doctID, from, to)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+func freeSlots(ctx context.Context, r Repos, doctID uuid.UUID, from, to time.Time) ([]Slot, error) {
+	avs, err := r.Schedules.Availabilities(ctx, doctID)
+	if err != nil {
+		return nil, err
+	}
+	exs, err := r.Schedules.Exceptions(ctx, doctID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	booked, err := r.Schedules.Sessions(ctx, doctID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return Slots(avs, exs, booked, from, to), nil
+}
+
+// SlotBooker books a slot for a patient
+type SlotBooker struct {
+	Store Store
+}
+
+// Run books the slot at s.AddrID starting at s.StartsAt for s.PatiID.
+// Bookings of a doctor are serialized by a lock on it, so a slot is booked
+// once; a slot that isn't free anymore is a ConflictError.
+func (b *SlotBooker) Run(ctx context.Context, s *SessionSchedule) (sesc *SessionSchedule, err error) {
+	ctx, span := tracing.Start(ctx, "user.SlotBooker.Run")
+	defer func() { tracing.End(span, err) }()
+
+	if s.StartsAt.Before(time.Now()) {
+		return nil, &auth.ValidationError{
+			Messages: map[string]string{"startsAt": "Can't book a slot in the past"},
+		}
+	}
+	err = b.Store.Tx(ctx, func(r Repos) error {
+		return bookSlot(ctx, r, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// bookSlot books s within the unit of work of r
+func bookSlot(ctx context.Context, r Repos, s *SessionSchedule) error {
+	err := r.Schedules.LockDoctor(ctx, s.DoctID)
+	if err != nil {
+		return err
+	}
+	_, err = r.Patients.FromID(ctx, s.PatiID)
+	if err != nil {
+		return err
+	}
+	_, err = r.Addresses.FromID(ctx, s.DoctID, s.AddrID)
+	if err != nil {
+		return err
+	}
+	slots, err := freeSlots(ctx, r, s.DoctID, s.StartsAt, s.StartsAt.Add(24*time.Hour))
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if slot.AddrID == s.AddrID && slot.StartsAt.Equal(s.StartsAt) {
+			s.EndsAt = slot.EndsAt
+			s.SescID, err = uuid.NewV4()
+			if err != nil {
+				return errors.Wrap(err, "Error generating session uuid")
+			}
+			return r.Schedules.Book(ctx, s)
+		}
+	}
+	return &auth.ConflictError{Message: "Slot is not available"}
+}
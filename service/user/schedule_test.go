@@ -0,0 +1,169 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestSlots(t *testing.T) {
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	// a monday
+	from := time.Date(2030, 1, 7, 0, 0, 0, 0, sp)
+	to := from.AddDate(0, 0, 7)
+	avs := []Availability{
+		{AddrID: 1, Weekday: time.Monday, Starts: "08:00", Ends: "10:00", SlotMinutes: 30, BufferMinutes: 10, Timezone: DefaultTimezone},
+		{AddrID: 2, Weekday: time.Wednesday, Starts: "14:00", Ends: "15:00", SlotMinutes: 60, Timezone: DefaultTimezone},
+	}
+
+	slots := Slots(avs, nil, nil, from, to)
+	// 08:00, 08:40 and 09:20 on monday, 14:00 on wednesday
+	if len(slots) != 4 {
+		t.Fatalf("Expected 4 slots, got %+v", slots)
+	}
+	if !slots[1].StartsAt.Equal(time.Date(2030, 1, 7, 8, 40, 0, 0, sp)) || !slots[1].EndsAt.Equal(time.Date(2030, 1, 7, 9, 10, 0, 0, sp)) {
+		t.Errorf("Expected the buffer between slots, got %+v", slots[1])
+	}
+	if slots[3].AddrID != 2 || slots[3].StartsAt.UTC().Hour() != 17 {
+		t.Errorf("Expected 14:00 in Sao Paulo to be 17:00 UTC, got %+v", slots[3])
+	}
+
+	exs := []AvailabilityException{
+		{AddrID: null.IntFrom(1), StartsAt: time.Date(2030, 1, 7, 8, 0, 0, 0, sp), EndsAt: time.Date(2030, 1, 7, 8, 30, 0, 0, sp)},
+		{AddrID: null.IntFrom(1), StartsAt: time.Date(2030, 1, 9, 0, 0, 0, 0, sp), EndsAt: time.Date(2030, 1, 10, 0, 0, 0, 0, sp)},
+	}
+	booked := []SessionSchedule{
+		{AddrID: 2, StartsAt: time.Date(2030, 1, 7, 8, 45, 0, 0, sp), EndsAt: time.Date(2030, 1, 7, 9, 5, 0, 0, sp)},
+	}
+	slots = Slots(avs, exs, booked, from, to)
+	// the exception at another address doesn't block wednesday, a session
+	// booked at any address does block monday
+	if len(slots) != 2 || !slots[0].StartsAt.Equal(time.Date(2030, 1, 7, 9, 20, 0, 0, sp)) || slots[1].AddrID != 2 {
+		t.Errorf("Expected exceptions and sessions to block slots, got %+v", slots)
+	}
+}
+
+func TestValidateAvailability(t *testing.T) {
+	av := &Availability{Weekday: time.Monday, Starts: "08:00", Ends: "12:00"}
+	if err := validateAvailability(av, nil); err != nil {
+		t.Fatalf("Expected a valid availability, got %s", err)
+	}
+	if av.SlotMinutes != 30 || av.Timezone != DefaultTimezone {
+		t.Errorf("Expected the defaults, got %+v", av)
+	}
+	others := []Availability{*av}
+	for _, inv := range []*Availability{
+		{Weekday: 7, Starts: "08:00", Ends: "12:00"},
+		{Weekday: time.Monday, Starts: "12:00", Ends: "08:00"},
+		{Weekday: time.Monday, Starts: "8:00", Ends: "12:00"},
+		{Weekday: time.Tuesday, Starts: "08:00", Ends: "08:20", SlotMinutes: 30},
+		{Weekday: time.Tuesday, Starts: "08:00", Ends: "12:00", Timezone: "Mars/Olympus"},
+		{Weekday: time.Monday, Starts: "11:00", Ends: "13:00"},
+		// 11:00 to 12:00 in Sao Paulo
+		{Weekday: time.Monday, Starts: "10:00", Ends: "11:00", Timezone: "America/Manaus"},
+		// 07:00 to 09:00 on monday in Sao Paulo
+		{Weekday: time.Monday, Starts: "10:00", Ends: "12:00", Timezone: "UTC"},
+	} {
+		if _, ok := validateAvailability(inv, others).(*auth.ValidationError); !ok {
+			t.Errorf("Expected %+v to be a ValidationError", inv)
+		}
+	}
+	after := &Availability{Weekday: time.Monday, Starts: "11:00", Ends: "12:00", Timezone: "America/Manaus"}
+	if err := validateAvailability(after, others); err != nil {
+		t.Errorf("Expected hours right after in another timezone to be valid, got %s", err)
+	}
+}
+
+func TestSlotBookerBooksOnce(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	a, err := (&AddressCreator{Store: s, Geocoder: testCEPs}).Run(ctx, &Address{DoctID: d.DoctID, CEP: "01310100"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p, err := (&PatientCreator{Store: s}).Run(ctx, &Patient{Name: "Maria", CPF: "12345678909", Email: "maria@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	sp, _ := time.LoadLocation(DefaultTimezone)
+	tomorrow := time.Now().In(sp).AddDate(0, 0, 1)
+	_, err = (&AvailabilityCreator{Store: s}).Run(ctx, &Availability{
+		DoctID: d.DoctID, AddrID: a.AddrID, Weekday: tomorrow.Weekday(), Starts: "08:00", Ends: "09:00",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+
+	day := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, sp)
+	slots, err := (&SlotLister{Store: s}).Run(ctx, d.DoctID, day, day.AddDate(0, 0, 1))
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected 2 slots, got %+v %v", slots, err)
+	}
+
+	b := &SlotBooker{Store: s}
+	sesc, err := b.Run(ctx, &SessionSchedule{DoctID: d.DoctID, AddrID: a.AddrID, PatiID: p.PatiID, StartsAt: slots[0].StartsAt})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if !sesc.EndsAt.Equal(slots[0].EndsAt) {
+		t.Errorf("Expected the session to end with the slot, got %+v", sesc)
+	}
+	_, err = b.Run(ctx, &SessionSchedule{DoctID: d.DoctID, AddrID: a.AddrID, PatiID: p.PatiID, StartsAt: slots[0].StartsAt})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected booking twice to be a ConflictError, got %v", err)
+	}
+	_, err = b.Run(ctx, &SessionSchedule{DoctID: d.DoctID, AddrID: a.AddrID, PatiID: p.PatiID, StartsAt: slots[0].StartsAt.Add(time.Minute)})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected a time off the slots to be a ConflictError, got %v", err)
+	}
+
+	slots, _ = (&SlotLister{Store: s}).Run(ctx, d.DoctID, day, day.AddDate(0, 0, 1))
+	if len(slots) != 1 {
+		t.Errorf("Expected the booked slot to be taken, got %+v", slots)
+	}
+
+	_, err = (&AddressRemover{Store: s}).Run(ctx, &Address{DoctID: d.DoctID, AddrID: a.AddrID}, false)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	free := slots
+	slots, _ = (&SlotLister{Store: s}).Run(ctx, d.DoctID, day, day.AddDate(0, 0, 1))
+	if len(slots) != 0 {
+		t.Errorf("Expected no slots at a removed address, got %+v", slots)
+	}
+	_, err = b.Run(ctx, &SessionSchedule{DoctID: d.DoctID, AddrID: a.AddrID, PatiID: p.PatiID, StartsAt: free[0].StartsAt})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected booking at a removed address to be a NotFoundError, got %v", err)
+	}
+}
+
+func TestPgBookLocksTheDoctorFirst(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed creating sqlmock %s", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT doct_id FROM doctor WHERE (.*) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"doct_id"}))
+	mock.ExpectRollback()
+
+	b := &SlotBooker{Store: &PgStore{DB: sqlx.NewDb(mockDB, "sqlmock")}}
+	_, err = b.Run(context.Background(), &SessionSchedule{AddrID: 1, StartsAt: time.Now().Add(time.Hour)})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected a missing doctor to be a NotFoundError, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
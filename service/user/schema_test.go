@@ -0,0 +1,74 @@
+package user
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/dbtest"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// schemaTables maps each table to the struct scanned from it
+var schemaTables = map[string]interface{}{
+	`user`:                           User{},
+	`action_verification`:            ActionConfirmation{},
+	`doctor`:                         Doctor{},
+	`patient`:                        Patient{},
+	`address`:                        Address{},
+	`availability`:                   Availability{},
+	`availability_exception`:         AvailabilityException{},
+	`session_schedule`:               SessionSchedule{},
+	`match`:                          Match{},
+	`match_history`:                  MatchStatusChange{},
+	`credit_card`:                    CreditCard{},
+	`payment`:                        Payment{},
+	`payment_ledger`:                 PaymentEntry{},
+	`bank`:                           Bank{},
+	`payout`:                         Payout{},
+	`payout_entry`:                   PayoutEntry{},
+	`webhook_event`:                  WebhookEvent{},
+	`service`:                        Service{},
+	`service_price`:                  ServicePrice{},
+	`doctor_specialization`:          Specialization{},
+	`doctor_specialization_document`: SpecDocument{},
+}
+
+// schemaJoined are the columns a struct reads from a joined table
+var schemaJoined = map[string][]string{
+	`doctor`:                {"email", "info", "role"},
+	`patient`:               {"email", "info", "role"},
+	`doctor_specialization`: {"name"},
+}
+
+func TestSchemaMatchesStructTags(t *testing.T) {
+	db := dbtest.NewDB(t)
+	// same mapping sqlx uses by default
+	mapper := reflectx.NewMapperFunc("db", strings.ToLower)
+
+	for table, v := range schemaTables {
+		var cols []string
+		err := db.Select(&cols, `SELECT column_name FROM information_schema.columns
+			WHERE table_schema = 'public' AND table_name = $1`, table)
+		if err != nil {
+			t.Fatalf("Failed listing columns of %s: %s", table, err)
+		}
+		exists := map[string]bool{}
+		for _, c := range cols {
+			exists[c] = true
+		}
+		for _, c := range schemaJoined[table] {
+			exists[c] = true
+		}
+
+		for name := range mapper.TypeMap(reflect.TypeOf(v)).Names {
+			// nested fields of scanned structs (e.g. null.Time) aren't columns
+			if strings.Contains(name, ".") {
+				continue
+			}
+			if !exists[name] {
+				t.Errorf("Table %s has no column %s expected by %T", table, name, v)
+			}
+		}
+	}
+}
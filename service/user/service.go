@@ -0,0 +1,311 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Service types
+const (
+	ServiceInPerson     = "in-person"
+	ServiceTelemedicine = "telemedicine"
+	ServiceHomeVisit    = "home-visit"
+)
+
+// Service is a representation of the table service, what a doctor offers
+// in one of its specializations from one of its addresses
+type Service struct {
+	ServID uuid.UUID `db:"serv_id" json:"servID"`
+	DoctID uuid.UUID `db:"doct_id" json:"doctID"`
+	AddrID int       `db:"addr_id" json:"addrID"`
+	SpecID uuid.UUID `db:"spec_id" json:"specID"`
+	// ProcID is the procedure of the specialization the service is, if
+	// it's one
+	ProcID *uuid.UUID `db:"proc_id" json:"procID" swaggertype:"string"`
+	Name   string     `db:"name" json:"name"`
+	Type   string     `db:"type" json:"type" example:"in-person"`
+	// PriceMin is what the service costs from, in cents
+	PriceMin int `db:"price_min" json:"priceMin"`
+	// Version is bumped on every change of price, matches keep the
+	// version they were proposed at
+	Version   int       `db:"version" json:"version"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+	DeletedAt null.Time `db:"deleted_at" json:"-"`
+	// Prices are the prices the service had, latest first
+	Prices []ServicePrice `db:"-" json:"prices,omitempty"`
+}
+
+// Services is a list of Service
+type Services []Service
+
+// ServicePrice is a representation of the table service_price, the price
+// of a version of a service
+type ServicePrice struct {
+	ServID    uuid.UUID `db:"serv_id" json:"servID"`
+	Version   int       `db:"version" json:"version"`
+	PriceMin  int       `db:"price_min" json:"priceMin"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// PriceRange is what a procedure, or a specialization, is usually charged
+// for a type of service, in cents
+type PriceRange struct {
+	Min int
+	Max int
+}
+
+// MarketPricer tells market prices
+type MarketPricer interface {
+	// PriceRange returns the market price of procID, or of specID when
+	// procID is nil, for serviceType. It's nil when there's too little data
+	// to tell.
+	PriceRange(ctx context.Context, specID uuid.UUID, procID *uuid.UUID, serviceType string) (*PriceRange, error)
+}
+
+// PriceRules bound the price of services by the market price
+type PriceRules struct {
+	Market MarketPricer
+	// TolerancePercent is how far below the market min and above the
+	// market max a price may be
+	TolerancePercent int
+}
+
+// check refuses the price of s when it's out of the market price of its
+// procedure or specialization. Prices aren't bounded without a Market or
+// when it can't tell.
+func (pr PriceRules) check(ctx context.Context, s *Service) error {
+	if pr.Market == nil {
+		return nil
+	}
+	ctx, span := tracing.Start(ctx, "user.MarketPricer.PriceRange")
+	rg, err := pr.Market.PriceRange(ctx, s.SpecID, s.ProcID, s.Type)
+	tracing.End(span, err)
+	if err != nil || rg == nil {
+		return err
+	}
+	lo := rg.Min * (100 - pr.TolerancePercent) / 100
+	hi := rg.Max * (100 + pr.TolerancePercent) / 100
+	if s.PriceMin < lo || s.PriceMin > hi {
+		return &auth.ValidationError{Messages: map[string]string{
+			"priceMin": fmt.Sprintf("Price must be from %d to %d cents, given the market price", lo, hi),
+		}}
+	}
+	return nil
+}
+
+// validateService normalizes s and checks its fields, not what they refer
+// to
+func validateService(s *Service) error {
+	msgs := map[string]string{}
+	s.Name = strings.Join(strings.Fields(s.Name), " ")
+	s.Type = strings.ToLower(strings.TrimSpace(s.Type))
+	if len(s.Name) == 0 {
+		msgs["name"] = "Name is required"
+	}
+	if s.Type != ServiceInPerson && s.Type != ServiceTelemedicine && s.Type != ServiceHomeVisit {
+		msgs["type"] = "Type must be in-person, telemedicine or home-visit"
+	}
+	if s.PriceMin <= 0 {
+		msgs["priceMin"] = "Price must be positive, in cents"
+	}
+	if s.SpecID == uuid.Nil {
+		msgs["specID"] = "Specialization is required"
+	}
+	if len(msgs) > 0 {
+		return &auth.ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// checkServiceRefs checks that the specialization of s is one of its
+// doctor's, its address is one of theirs and its procedure, if any, is of
+// its specialization
+func checkServiceRefs(ctx context.Context, r Repos, s *Service) error {
+	ok, err := r.Services.Specialized(ctx, s.DoctID, s.SpecID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &auth.ValidationError{
+			Messages: map[string]string{"specID": "Not one of the doctor's specializations"},
+		}
+	}
+	_, err = r.Addresses.FromID(ctx, s.DoctID, s.AddrID)
+	if _, nf := err.(*auth.NotFoundError); nf {
+		return &auth.ValidationError{
+			Messages: map[string]string{"addrID": "Not one of the doctor's addresses"},
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if s.ProcID == nil {
+		return nil
+	}
+	specID, err := r.Services.ProcedureSpec(ctx, *s.ProcID)
+	if _, nf := err.(*auth.NotFoundError); nf || err == nil && specID != s.SpecID {
+		return &auth.ValidationError{
+			Messages: map[string]string{"procID": "Not a procedure of the specialization"},
+		}
+	}
+	return err
+}
+
+// ServiceCreator adds a service to a doctor
+type ServiceCreator struct {
+	Store Store
+	Rules PriceRules
+}
+
+// Run validates and saves s at version 1
+func (c *ServiceCreator) Run(ctx context.Context, s *Service) (_ *Service, err error) {
+	ctx, span := tracing.Start(ctx, "user.ServiceCreator.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateService(s)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Rules.check(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, s.DoctID)
+		if err != nil {
+			return err
+		}
+		err = checkServiceRefs(ctx, r, s)
+		if err != nil {
+			return err
+		}
+		return r.Services.Save(ctx, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ServiceLister lists the services of a doctor
+type ServiceLister struct {
+	Store Store
+}
+
+// Run returns the active services of doctID
+func (l *ServiceLister) Run(ctx context.Context, doctID uuid.UUID) (ss Services, err error) {
+	ctx, span := tracing.Start(ctx, "user.ServiceLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		ss, err = r.Services.List(ctx, doctID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// ServiceGetter gets a service of a doctor
+type ServiceGetter struct {
+	Store Store
+}
+
+// Run returns the service servID of doctID with its price history
+func (g *ServiceGetter) Run(ctx context.Context, doctID, servID uuid.UUID) (s *Service, err error) {
+	ctx, span := tracing.Start(ctx, "user.ServiceGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		s, err = r.Services.FromID(ctx, doctID, servID)
+		if err != nil {
+			return err
+		}
+		s.Prices, err = r.Services.Prices(ctx, servID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ServiceUpdater updates a service of a doctor
+type ServiceUpdater struct {
+	Store Store
+	Rules PriceRules
+}
+
+// Run replaces the service s.ServID of s.DoctID with s. A new price is a
+// new version of the service, matches proposed before keep the price of
+// theirs.
+func (u *ServiceUpdater) Run(ctx context.Context, s *Service) (_ *Service, err error) {
+	ctx, span := tracing.Start(ctx, "user.ServiceUpdater.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = validateService(s)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Rules.check(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		cur, err := r.Services.FromID(ctx, s.DoctID, s.ServID)
+		if err != nil {
+			return err
+		}
+		err = checkServiceRefs(ctx, r, s)
+		if err != nil {
+			return err
+		}
+		s.Version, s.CreatedAt = cur.Version, cur.CreatedAt
+		if s.PriceMin != cur.PriceMin {
+			s.Version++
+		}
+		err = r.Services.Update(ctx, s, cur.Version)
+		if err != nil {
+			return err
+		}
+		s.Prices, err = r.Services.Prices(ctx, s.ServID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ServiceRemover removes a service of a doctor
+type ServiceRemover struct {
+	Store Store
+}
+
+// Run soft deletes servID of doctID, returning it. Matches proposed for it
+// keep it.
+func (rm *ServiceRemover) Run(ctx context.Context, doctID, servID uuid.UUID) (s *Service, err error) {
+	ctx, span := tracing.Start(ctx, "user.ServiceRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		s, err = r.Services.FromID(ctx, doctID, servID)
+		if err != nil {
+			return err
+		}
+		return r.Services.SoftDelete(ctx, doctID, servID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,95 @@
+package user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+// fixedMarket prices every procedure and specialization the same
+type fixedMarket PriceRange
+
+func (m fixedMarket) PriceRange(ctx context.Context, specID uuid.UUID, procID *uuid.UUID, serviceType string) (*PriceRange, error) {
+	r := PriceRange(m)
+	return &r, nil
+}
+
+func TestServiceCatalog(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	a, err := (&AddressCreator{Store: s, Geocoder: testCEPs}).Run(ctx, &Address{
+		DoctID: d.DoctID, CEP: "01310100", Street: "Av. Paulista", Number: "1000", City: "São Paulo", UF: "SP",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	spec, _ := uuid.NewV4()
+	other, _ := uuid.NewV4()
+	proc, _ := uuid.NewV4()
+	s.data.doctorSpecs[d.DoctID] = map[uuid.UUID]Specialization{spec: {DoctID: d.DoctID, SpecID: spec, Status: SpecApproved}}
+	s.data.procedures[proc] = other
+	rules := PriceRules{Market: fixedMarket{Min: 10000, Max: 20000}, TolerancePercent: 50}
+
+	for field, sv := range map[string]Service{
+		"type":     {DoctID: d.DoctID, AddrID: a.AddrID, SpecID: spec, Name: "Consulta", Type: "walk-in", PriceMin: 15000},
+		"priceMin": {DoctID: d.DoctID, AddrID: a.AddrID, SpecID: spec, Name: "Consulta", Type: ServiceInPerson, PriceMin: 40000},
+		"specID":   {DoctID: d.DoctID, AddrID: a.AddrID, SpecID: other, Name: "Consulta", Type: ServiceInPerson, PriceMin: 15000},
+		"addrID":   {DoctID: d.DoctID, AddrID: a.AddrID + 1, SpecID: spec, Name: "Consulta", Type: ServiceInPerson, PriceMin: 15000},
+		"procID":   {DoctID: d.DoctID, AddrID: a.AddrID, SpecID: spec, ProcID: &proc, Name: "Consulta", Type: ServiceInPerson, PriceMin: 15000},
+	} {
+		sv := sv
+		_, err = (&ServiceCreator{Store: s, Rules: rules}).Run(ctx, &sv)
+		if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages[field]) == 0 {
+			t.Errorf("Expected %s refused, got %v", field, err)
+		}
+	}
+
+	sv, err := (&ServiceCreator{Store: s, Rules: rules}).Run(ctx, &Service{
+		DoctID: d.DoctID, AddrID: a.AddrID, SpecID: spec, Name: " Consulta  geral ", Type: "Telemedicine", PriceMin: 5000,
+	})
+	if err != nil {
+		t.Fatalf("Expected a price within the tolerance accepted, got %s", err)
+	}
+	if sv.Version != 1 || sv.Name != "Consulta geral" || sv.Type != ServiceTelemedicine {
+		t.Errorf("Expected a normalized service at version 1, got %+v", sv)
+	}
+
+	// renaming keeps the version, repricing makes a new one
+	up := *sv
+	up.Name = "Teleconsulta"
+	_, err = (&ServiceUpdater{Store: s, Rules: rules}).Run(ctx, &up)
+	if err != nil || up.Version != 1 {
+		t.Fatalf("Expected the version kept, got %d %v", up.Version, err)
+	}
+	up.PriceMin = 18000
+	_, err = (&ServiceUpdater{Store: s, Rules: rules}).Run(ctx, &up)
+	if err != nil || up.Version != 2 {
+		t.Fatalf("Expected a new version, got %d %v", up.Version, err)
+	}
+	got, err := (&ServiceGetter{Store: s}).Run(ctx, d.DoctID, sv.ServID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if len(got.Prices) != 2 || got.Prices[0].PriceMin != 18000 || got.Prices[1].PriceMin != 5000 {
+		t.Errorf("Expected the price history latest first, got %+v", got.Prices)
+	}
+
+	n, _ := (&ServiceLister{Store: s}).Run(ctx, d.DoctID)
+	if len(n) != 1 {
+		t.Errorf("Expected a service listed, got %+v", n)
+	}
+	_, err = (&ServiceRemover{Store: s}).Run(ctx, d.DoctID, sv.ServID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = (&ServiceGetter{Store: s}).Run(ctx, d.DoctID, sv.ServID)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected a removed service to be a NotFoundError, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Statuses of the review of a doctor specialization
+const (
+	SpecPending  = "pending"
+	SpecApproved = "approved"
+	SpecRejected = "rejected"
+)
+
+// MaxSpecDocumentSize is the largest document a doctor may upload, in
+// bytes
+const MaxSpecDocumentSize = 5 << 20
+
+// specDocumentTypes are the content types of the documents accepted
+var specDocumentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+var rqeRe = regexp.MustCompile(`^[0-9]{1,6}$`)
+
+// Specialization is a representation of the table doctor_specialization, a
+// specialization a doctor claims. Only approved ones count in search and
+// matching.
+type Specialization struct {
+	DoctID uuid.UUID `db:"doct_id" json:"doctID"`
+	SpecID uuid.UUID `db:"spec_id" json:"specID"`
+	// Name is the name of the specialization in the catalog
+	Name string `db:"name" json:"name"`
+	// RQE is the number of the registration of the doctor as a specialist
+	// at the CRM
+	RQE    string `db:"rqe" json:"rqe" example:"12345"`
+	Status string `db:"status" json:"status" example:"pending"`
+	// Reason is why the specialization was rejected
+	Reason     string     `db:"reason" json:"reason,omitempty"`
+	ReviewedBy *uuid.UUID `db:"reviewed_by" json:"reviewedBy,omitempty" swaggertype:"string"`
+	ReviewedAt null.Time  `db:"reviewed_at" json:"reviewedAt"`
+	CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+	UpdatedAt  time.Time  `db:"updated_at" json:"updatedAt"`
+	DeletedAt  null.Time  `db:"deleted_at" json:"-"`
+	// Documents support the claim, their content is left out
+	Documents []SpecDocument `db:"-" json:"documents,omitempty"`
+}
+
+// Specializations is a list of Specialization
+type Specializations []Specialization
+
+// SpecDocument is a representation of the table
+// doctor_specialization_document, a file supporting a specialization
+type SpecDocument struct {
+	DsdoID      uuid.UUID `db:"dsdo_id" json:"dsdoID"`
+	DoctID      uuid.UUID `db:"doct_id" json:"doctID"`
+	SpecID      uuid.UUID `db:"spec_id" json:"specID"`
+	Name        string    `db:"name" json:"name" example:"rqe.pdf"`
+	ContentType string    `db:"content_type" json:"contentType" example:"application/pdf"`
+	Size        int       `db:"size" json:"size"`
+	Content     []byte    `db:"content" json:"-"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+}
+
+// DoctorSpecLister lists the specializations of a doctor
+type DoctorSpecLister struct {
+	Store Store
+}
+
+// Run returns the specializations of doctID, with their documents when all
+// is set and only the approved ones otherwise
+func (l *DoctorSpecLister) Run(ctx context.Context, doctID uuid.UUID, all bool) (ss Specializations, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorSpecLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, doctID)
+		if err != nil {
+			return err
+		}
+		if !all {
+			ss, err = r.Specializations.List(ctx, doctID, []string{SpecApproved})
+			return err
+		}
+		ss, err = r.Specializations.List(ctx, doctID, nil)
+		if err != nil {
+			return err
+		}
+		return withDocuments(ctx, r, ss)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func withDocuments(ctx context.Context, r Repos, ss Specializations) error {
+	for i := range ss {
+		ds, err := r.Specializations.Documents(ctx, ss[i].DoctID, ss[i].SpecID)
+		if err != nil {
+			return err
+		}
+		ss[i].Documents = ds
+	}
+	return nil
+}
+
+// DoctorSpecAdder adds a specialization to a doctor
+type DoctorSpecAdder struct {
+	Store Store
+}
+
+// Run adds s pending review. A specialization removed or rejected may be
+// added again, one pending or approved is a ConflictError.
+func (a *DoctorSpecAdder) Run(ctx context.Context, s *Specialization) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorSpecAdder.Run")
+	defer func() { tracing.End(span, err) }()
+
+	s.RQE = strings.TrimSpace(s.RQE)
+	msgs := map[string]string{}
+	if uuid.Equal(s.SpecID, uuid.Nil) {
+		msgs["spec_id"] = "Specialization is required"
+	}
+	if !rqeRe.MatchString(s.RQE) {
+		msgs["rqe"] = "RQE must have up to 6 digits"
+	}
+	if len(msgs) > 0 {
+		return "", &auth.ValidationError{Messages: msgs}
+	}
+	err = a.Store.Tx(ctx, func(r Repos) error {
+		_, err := r.Doctors.FromID(ctx, s.DoctID)
+		if err != nil {
+			return err
+		}
+		return r.Specializations.Add(ctx, s)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Specialization added, pending review", nil
+}
+
+// DoctorSpecRemover removes a specialization of a doctor
+type DoctorSpecRemover struct {
+	Store Store
+}
+
+// Run soft deletes specID of doctID, its services stay but aren't offered
+// anymore
+func (rm *DoctorSpecRemover) Run(ctx context.Context, doctID, specID uuid.UUID) (res string, err error) {
+	ctx, span := tracing.Start(ctx, "user.DoctorSpecRemover.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = rm.Store.Tx(ctx, func(r Repos) error {
+		return r.Specializations.Remove(ctx, doctID, specID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Specialization removed", nil
+}
+
+// SpecDocumentUploader attaches documents to specializations pending review
+type SpecDocumentUploader struct {
+	Store Store
+}
+
+// Run stores d, a PDF, JPEG or PNG of up to MaxSpecDocumentSize. Its
+// content type is sniffed from the content, what the client tells is
+// ignored.
+func (u *SpecDocumentUploader) Run(ctx context.Context, d *SpecDocument) (_ *SpecDocument, err error) {
+	ctx, span := tracing.Start(ctx, "user.SpecDocumentUploader.Run")
+	defer func() { tracing.End(span, err) }()
+
+	d.Name = strings.TrimSpace(d.Name)
+	d.Size = len(d.Content)
+	d.ContentType = http.DetectContentType(d.Content)
+	switch {
+	case d.Size == 0:
+		return nil, &auth.ValidationError{Messages: map[string]string{"file": "File is empty"}}
+	case d.Size > MaxSpecDocumentSize:
+		return nil, &auth.ValidationError{Messages: map[string]string{"file": "File is larger than 5MB"}}
+	case !specDocumentTypes[d.ContentType]:
+		return nil, &auth.ValidationError{Messages: map[string]string{"file": "File must be a PDF, JPEG or PNG"}}
+	}
+	if len(d.Name) == 0 {
+		d.Name = "document"
+	}
+	err = u.Store.Tx(ctx, func(r Repos) error {
+		s, err := r.Specializations.FromID(ctx, d.DoctID, d.SpecID)
+		if err != nil {
+			return err
+		}
+		if s.Status != SpecPending {
+			return &auth.ConflictError{Message: "Documents are taken only while the specialization is pending review"}
+		}
+		return r.Specializations.SaveDocument(ctx, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.Content = nil
+	return d, nil
+}
+
+// SpecDocumentGetter reads a document with its content
+type SpecDocumentGetter struct {
+	Store Store
+}
+
+// Run returns dsdoID of the specialization specID of doctID
+func (g *SpecDocumentGetter) Run(ctx context.Context, doctID, specID, dsdoID uuid.UUID) (d *SpecDocument, err error) {
+	ctx, span := tracing.Start(ctx, "user.SpecDocumentGetter.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = g.Store.Tx(ctx, func(r Repos) error {
+		d, err = r.Specializations.Document(ctx, dsdoID)
+		if err == nil && (d.DoctID != doctID || d.SpecID != specID) {
+			err = &auth.NotFoundError{Message: "No such document"}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SpecReviewLister lists the specializations pending review
+type SpecReviewLister struct {
+	Store Store
+}
+
+// Run returns the page of the specializations pending review, those
+// waiting the longest first, with their documents, and how many there are
+func (l *SpecReviewLister) Run(ctx context.Context, limit, offset int) (ss Specializations, total int, err error) {
+	ctx, span := tracing.Start(ctx, "user.SpecReviewLister.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = l.Store.Tx(ctx, func(r Repos) error {
+		ss, total, err = r.Specializations.Pending(ctx, limit, offset)
+		if err != nil {
+			return err
+		}
+		return withDocuments(ctx, r, ss)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ss, total, nil
+}
+
+// SpecReviewer decides on specializations pending review
+type SpecReviewer struct {
+	Store Store
+}
+
+// Run approves or rejects s, rejecting needs a reason. s must be pending,
+// a ConflictError otherwise.
+func (rv *SpecReviewer) Run(ctx context.Context, s *Specialization, reviewerID uuid.UUID) (_ *Specialization, err error) {
+	ctx, span := tracing.Start(ctx, "user.SpecReviewer.Run")
+	defer func() { tracing.End(span, err) }()
+
+	s.Reason = strings.TrimSpace(s.Reason)
+	switch {
+	case s.Status != SpecApproved && s.Status != SpecRejected:
+		return nil, &auth.ValidationError{Messages: map[string]string{"status": "Status must be approved or rejected"}}
+	case s.Status == SpecRejected && len(s.Reason) == 0:
+		return nil, &auth.ValidationError{Messages: map[string]string{"reason": "Reason is required to reject"}}
+	}
+	s.ReviewedBy = &reviewerID
+	err = rv.Store.Tx(ctx, func(r Repos) error {
+		return r.Specializations.Review(ctx, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
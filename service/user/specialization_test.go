@@ -0,0 +1,111 @@
+package user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestSpecializationReview(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	d, err := (&DoctorCreator{Store: s}).Run(ctx, &Doctor{Name: "Dr. House", CRM: "123456/SP", Email: "doc@mail.com"}, "123123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	spec, _ := uuid.NewV4()
+	admin, _ := uuid.NewV4()
+	s.data.specializations[spec] = "Cardiologia"
+	add := &DoctorSpecAdder{Store: s}
+
+	_, err = add.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, RQE: "12a"})
+	if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["rqe"]) == 0 {
+		t.Errorf("Expected an invalid RQE refused, got %v", err)
+	}
+	unknown, _ := uuid.NewV4()
+	_, err = add.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: unknown, RQE: "12345"})
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected a specialization out of the catalog to be a NotFoundError, got %v", err)
+	}
+	_, err = add.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, RQE: " 12345 "})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	_, err = add.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, RQE: "12345"})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected adding a pending specialization again to be a ConflictError, got %v", err)
+	}
+	ok, _ := (&memServices{s}).Specialized(ctx, d.DoctID, spec)
+	if ok {
+		t.Error("Expected a pending specialization not to count")
+	}
+
+	up := &SpecDocumentUploader{Store: s}
+	_, err = up.Run(ctx, &SpecDocument{DoctID: d.DoctID, SpecID: spec, Name: "rqe.txt", Content: []byte("just text")})
+	if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["file"]) == 0 {
+		t.Errorf("Expected a text file refused, got %v", err)
+	}
+	doc, err := up.Run(ctx, &SpecDocument{DoctID: d.DoctID, SpecID: spec, Name: "rqe.pdf", Content: []byte("%PDF-1.4\n%...")})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if doc.ContentType != "application/pdf" || doc.Size != 13 || doc.Content != nil {
+		t.Errorf("Expected the PDF sniffed without its content returned, got %+v", doc)
+	}
+
+	queue, total, err := (&SpecReviewLister{Store: s}).Run(ctx, 20, 0)
+	if err != nil || total != 1 || len(queue[0].Documents) != 1 || queue[0].Name != "Cardiologia" || queue[0].RQE != "12345" {
+		t.Fatalf("Expected the specialization queued with its document, got %d %+v %v", total, queue, err)
+	}
+
+	rv := &SpecReviewer{Store: s}
+	_, err = rv.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, Status: SpecRejected}, admin)
+	if v, ok := err.(*auth.ValidationError); !ok || len(v.Messages["reason"]) == 0 {
+		t.Errorf("Expected a rejection without a reason refused, got %v", err)
+	}
+	r, err := rv.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, Status: SpecRejected, Reason: "RQE of another doctor"}, admin)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if r.Status != SpecRejected || *r.ReviewedBy != admin || !r.ReviewedAt.Valid {
+		t.Errorf("Expected the specialization rejected by the admin, got %+v", r)
+	}
+	_, err = rv.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, Status: SpecApproved}, admin)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected reviewing a rejected specialization to be a ConflictError, got %v", err)
+	}
+	_, err = up.Run(ctx, &SpecDocument{DoctID: d.DoctID, SpecID: spec, Content: []byte("%PDF-1.4\n")})
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected documents refused once reviewed, got %v", err)
+	}
+
+	_, err = add.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, RQE: "54321"})
+	if err != nil {
+		t.Fatalf("Expected a rejected specialization added again, got %s", err)
+	}
+	r, err = rv.Run(ctx, &Specialization{DoctID: d.DoctID, SpecID: spec, Status: SpecApproved}, admin)
+	if err != nil || r.Status != SpecApproved || r.Reason != "" || r.RQE != "54321" {
+		t.Fatalf("Expected the specialization approved, got %+v %v", r, err)
+	}
+	if ok, _ = (&memServices{s}).Specialized(ctx, d.DoctID, spec); !ok {
+		t.Error("Expected an approved specialization to count")
+	}
+	public, _ := (&DoctorSpecLister{Store: s}).Run(ctx, d.DoctID, false)
+	if len(public) != 1 || public[0].Documents != nil {
+		t.Errorf("Expected the approved specialization listed without documents, got %+v", public)
+	}
+
+	_, err = (&DoctorSpecRemover{Store: s}).Run(ctx, d.DoctID, spec)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if ok, _ = (&memServices{s}).Specialized(ctx, d.DoctID, spec); ok {
+		t.Error("Expected a removed specialization not to count")
+	}
+	_, err = (&DoctorSpecRemover{Store: s}).Run(ctx, d.DoctID, spec)
+	if _, ok := err.(*auth.NotFoundError); !ok {
+		t.Errorf("Expected removing twice to be a NotFoundError, got %v", err)
+	}
+}
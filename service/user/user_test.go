@@ -2,6 +2,7 @@ package user
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -68,7 +69,7 @@ func TestCreateUserValues(t *testing.T) {
 		Info:      Info{},
 		DeletedAt: null.Time{Valid: false},
 	}
-	// copy struct because createUser modifies pointer
+	// copy struct because Save modifies pointer
 	uInitial := u
 
 	r, _ := u.Role.Value()
@@ -90,13 +91,13 @@ func TestCreateUserValues(t *testing.T) {
 	}
 
 	// run tested function
-	nUser, err := SaveUser(tx, &u)
+	nUser, err := (&pgUsers{q: tx}).Save(context.Background(), &u)
 	if err != nil {
 		t.Errorf("Error creating user %s", err)
 	}
 
 	// compare user inserted and returned
-	if err := jsonCompare(uInitial, nUser, `["created_at"]`); err != nil {
+	if err := jsonCompare(uInitial, nUser, `["createdAt"]`); err != nil {
 		t.Errorf("Mismatched values of \n %s", err)
 	}
 
@@ -132,7 +133,7 @@ func TestCreateUserQuery(t *testing.T) {
 	}
 
 	// ignore returns
-	_, _ = createUser(tx, &u)
+	_, _ = (&pgUsers{q: tx}).Save(context.Background(), &u)
 
 	err = mock.ExpectationsWereMet()
 	if err != nil {
@@ -4,10 +4,19 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+
+	"github.com/fignocius/echo-api/service/fieldcrypt"
 )
 
-// Value implements the driver Valuer interface.
+// Value implements the driver Valuer interface. Birthdate is encrypted.
 func (i Info) Value() (driver.Value, error) {
+	var err error
+	if len(i.Birthdate) > 0 {
+		i.Birthdate, err = fieldcrypt.Encrypt(i.Birthdate)
+		if err != nil {
+			return nil, err
+		}
+	}
 	b, err := json.Marshal(i)
 	return driver.Value(b), err
 }
@@ -24,7 +33,12 @@ func (i *Info) Scan(src interface{}) error {
 	default:
 		return errors.New("Incompatible type for Info")
 	}
-	return json.Unmarshal(source, i)
+	err := json.Unmarshal(source, i)
+	if err != nil {
+		return err
+	}
+	i.Birthdate, err = fieldcrypt.Decrypt(i.Birthdate)
+	return err
 }
 
 // Value implements the driver Valuer interface.
@@ -89,3 +103,27 @@ func (i *PatiAddress) Scan(src interface{}) error {
 	}
 	return json.Unmarshal(source, i)
 }
+
+// Value implements the driver Valuer interface.
+func (i OpeningHours) Value() (driver.Value, error) {
+	if i == nil {
+		i = OpeningHours{}
+	}
+	b, err := json.Marshal(i)
+	return driver.Value(b), err
+}
+
+// Scan implements the Scanner interface.
+func (i *OpeningHours) Scan(src interface{}) error {
+	var source []byte
+	// let's support string and []byte
+	switch src.(type) {
+	case string:
+		source = []byte(src.(string))
+	case []byte:
+		source = src.([]byte)
+	default:
+		return errors.New("Incompatible type for OpeningHours")
+	}
+	return json.Unmarshal(source, i)
+}
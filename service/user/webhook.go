@@ -0,0 +1,364 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/logger"
+	"github.com/fignocius/echo-api/service/tracing"
+	"github.com/fignocius/echo-api/service/user/auth"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/guregu/null.v3"
+)
+
+// Webhook event statuses
+const (
+	WebhookPending   = "pending"
+	WebhookProcessed = "processed"
+	// WebhookFailed ran out of attempts, an admin may replay it
+	WebhookFailed = "failed"
+)
+
+// WebhookCielo is the provider of the notifications of the Cielo API
+const WebhookCielo = "cielo"
+
+// WebhookEvent is a representation of the table webhook_event, a
+// notification received from a payment gateway as it came
+type WebhookEvent struct {
+	WeheID   uuid.UUID `db:"wehe_id" json:"weheID"`
+	Provider string    `db:"provider" json:"provider" example:"cielo"`
+	// EventID identifies the change notified, retries have the same one
+	EventID     string    `db:"event_id" json:"eventID"`
+	Payload     string    `db:"payload" json:"payload"`
+	Status      string    `db:"status" json:"status" example:"processed"`
+	Attempts    int       `db:"attempts" json:"attempts"`
+	Error       string    `db:"error" json:"error"`
+	ReceivedAt  time.Time `db:"received_at" json:"receivedAt"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updatedAt"`
+	ProcessedAt null.Time `db:"processed_at" json:"processedAt" swaggertype:"string"`
+}
+
+// WebhookReceiver stores the notifications of Cielo for the
+// WebhookProcessor, the sender is answered before they're processed
+type WebhookReceiver struct {
+	Store Store
+}
+
+// Run stores the notification in body, reporting false when it repeats one
+// still pending. An invalid notification is a ValidationError.
+func (wr *WebhookReceiver) Run(ctx context.Context, body []byte) (stored bool, err error) {
+	ctx, span := tracing.Start(ctx, "user.WebhookReceiver.Run")
+	defer func() { tracing.End(span, err) }()
+
+	n, err := cielo.ParseNotification(body)
+	if err != nil {
+		return false, &auth.ValidationError{Messages: map[string]string{"body": err.Error()}}
+	}
+	e := &WebhookEvent{Provider: WebhookCielo, EventID: n.EventID(), Payload: string(body), Status: WebhookPending}
+	err = wr.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		stored, err = r.Webhooks.Save(ctx, e)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return stored, nil
+}
+
+// PaymentQuerier reads payments at the gateway. *cielo.Ecommerce is one.
+type PaymentQuerier interface {
+	Sale(ctx context.Context, paymentID string) (*cielo.Sale, error)
+}
+
+// WebhookProcessor applies the notifications received: the payment
+// notified is read from the gateway and its status and amounts synced, and
+// a confirmed match not started yet is canceled when its payment is
+// voided, declined or charged back. Events are synced to what the gateway
+// says now, so processing one twice is harmless.
+type WebhookProcessor struct {
+	Store   Store
+	Gateway PaymentQuerier
+	// MaxAttempts is how many times an event is tried before it's failed
+	MaxAttempts int
+	BatchSize   int
+	// Listeners are told of the matches canceled
+	Listeners []MatchListener
+	Log       *logger.Logger
+}
+
+// Run processes a batch of pending events, returning how many it went
+// through. Each event is claimed first, so replicas don't process it
+// twice.
+func (wp *WebhookProcessor) Run(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "user.WebhookProcessor.Run")
+	defer func() { tracing.End(span, err) }()
+
+	l := wp.Log
+	if l == nil {
+		l = logger.Default
+	}
+	size := wp.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	max := wp.MaxAttempts
+	if max <= 0 {
+		max = 10
+	}
+	var es []WebhookEvent
+	err = wp.Store.Tx(ctx, func(r Repos) error {
+		var err error
+		es, err = r.Webhooks.Pending(ctx, size)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range es {
+		e := &es[i]
+		claimed := false
+		err = wp.Store.Tx(ctx, func(r Repos) error {
+			var err error
+			claimed, err = r.Webhooks.Claim(ctx, e)
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+		if !claimed {
+			continue
+		}
+		n++
+		perr := wp.process(ctx, e)
+		e.Attempts++
+		switch {
+		case perr == nil:
+			e.Status, e.Error = WebhookProcessed, ""
+		case e.Attempts >= max:
+			e.Status, e.Error = WebhookFailed, perr.Error()
+		default:
+			e.Error = perr.Error()
+		}
+		if perr != nil {
+			l.Error("webhook processing failed", "wehe_id", e.WeheID, "event_id", e.EventID, "attempts", e.Attempts, "error", perr)
+		}
+		// an event received again meanwhile isn't finished, it stays
+		// pending for the change it brought
+		err = wp.Store.Tx(ctx, func(r Repos) error {
+			_, err := r.Webhooks.Finish(ctx, e)
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// process applies e, changes that aren't about the status of a payment are
+// processed doing nothing
+func (wp *WebhookProcessor) process(ctx context.Context, e *WebhookEvent) error {
+	n, err := cielo.ParseNotification([]byte(e.Payload))
+	if err != nil {
+		return err
+	}
+	if n.ChangeType != cielo.ChangePaymentStatus && n.ChangeType != cielo.ChangeChargeback || len(n.PaymentID) == 0 {
+		return nil
+	}
+	s, err := wp.Gateway.Sale(ctx, n.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	var ev *MatchEvent
+	err = wp.Store.Tx(ctx, func(r Repos) error {
+		p, err := r.Payments.FromGateway(ctx, n.PaymentID)
+		if _, ok := err.(*auth.NotFoundError); ok {
+			// the answer to the authorization was lost, the payment is
+			// still pending under the order
+			matcID, ferr := uuid.FromString(s.MerchantOrderID)
+			if ferr != nil {
+				return err
+			}
+			p, err = r.Payments.FromMatch(ctx, matcID)
+		}
+		if err != nil {
+			return err
+		}
+		if p.GatewayID.Valid && p.GatewayID.String != n.PaymentID {
+			// an earlier payment of the order, e.g. one declined
+			return nil
+		}
+
+		from := p.Status
+		if !syncPayment(p, &s.Payment, n.ChangeType == cielo.ChangeChargeback) {
+			return nil
+		}
+		err = r.Payments.Update(ctx, p)
+		if err != nil {
+			return err
+		}
+		err = r.Payments.AddEntry(ctx, &PaymentEntry{
+			PaymID:        p.PaymID,
+			Operation:     PaymentSync,
+			Amount:        s.Payment.Amount,
+			Succeeded:     true,
+			GatewayStatus: null.IntFrom(int64(s.Payment.Status)),
+			ReturnCode:    s.Payment.ReturnCode,
+			ReturnMessage: s.Payment.ReturnMessage,
+		})
+		if err != nil {
+			return err
+		}
+		logger.FromContext(ctx).Info("payment synced", "matc_id", p.MatcID, "from", from, "status", p.Status)
+		if p.Status == PaymentChargeback {
+			// the doctor isn't paid for a charge taken back
+			err = r.Payouts.Reverse(ctx, p.PaymID)
+			if err != nil {
+				return err
+			}
+		}
+		if !unpaid(from) && unpaid(p.Status) {
+			ev, err = cancelUnpaid(ctx, r, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if ev != nil {
+		emit(ctx, wp.Listeners, *ev)
+	}
+	return nil
+}
+
+// syncPayment moves p to the state of gp at the gateway, reporting whether
+// it changed. Statuses the gateway is still deciding on leave p alone, as
+// do changes after a chargeback.
+func syncPayment(p *Payment, gp *cielo.Payment, chargeback bool) bool {
+	if p.Status == PaymentChargeback {
+		return false
+	}
+	var status PaymentStatus
+	// the gateway voids before capture and refunds after it alike, what
+	// capturing left of the authorization was released
+	captured, voided, refunded := gp.CapturedAmount, gp.VoidedAmount, 0
+	if captured > 0 {
+		voided, refunded = gp.Amount-captured, gp.VoidedAmount
+	}
+	switch {
+	case chargeback:
+		status, refunded = PaymentChargeback, captured
+	case gp.Status == cielo.Authorized:
+		status = PaymentAuthorized
+	case gp.Status == cielo.PaymentConfirmed:
+		status = PaymentCaptured
+	case gp.Status == cielo.Voided:
+		status = PaymentVoided
+	case gp.Status == cielo.Refunded:
+		status = PaymentRefunded
+	case gp.Status == cielo.Denied, gp.Status == cielo.Aborted:
+		status = PaymentDeclined
+	default:
+		return false
+	}
+	changed := status != p.Status || captured != p.Captured || voided != p.Voided || refunded != p.Refunded || !p.GatewayID.Valid
+	p.Status, p.Captured, p.Voided, p.Refunded = status, captured, voided, refunded
+	p.GatewayID = null.StringFrom(gp.PaymentID)
+	return changed
+}
+
+// unpaid reports whether a payment in status s can't pay its match
+func unpaid(s PaymentStatus) bool {
+	return s == PaymentVoided || s == PaymentDeclined || s == PaymentChargeback
+}
+
+// cancelUnpaid cancels the match of p when it's confirmed and didn't start
+// yet, without a fee. It's nil when the match is left alone.
+func cancelUnpaid(ctx context.Context, r Repos, p *Payment) (*MatchEvent, error) {
+	m, err := r.Matches.FromID(ctx, p.MatcID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != MatchConfirmed {
+		return nil, nil
+	}
+	startsAt, err := m.StartsAt()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !now.Before(startsAt) {
+		return nil, nil
+	}
+	from := null.StringFrom(string(m.Status))
+	m.Status = MatchCanceledByPatient
+	m.CanceledAt = null.TimeFrom(now)
+	m.CancelFee = 0
+	if m.SescID != nil {
+		err = r.Schedules.CancelSession(ctx, *m.SescID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.Matches.UpdateStatus(ctx, m, m.Version)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newChange(m, from, MatchActor{}, "Payment "+string(p.Status)+" at the gateway", 0)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Matches.AddChange(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return &MatchEvent{Match: *m, Change: *c}, nil
+}
+
+// Every processes events every interval until ctx is done
+func (wp *WebhookProcessor) Every(ctx context.Context, interval time.Duration) {
+	l := wp.Log
+	if l == nil {
+		l = logger.Default
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := wp.Run(ctx)
+		if err != nil {
+			l.Error("webhook processing failed", "error", err)
+		} else if n > 0 {
+			l.Info("webhook processing", "events", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// WebhookReplayer processes events again
+type WebhookReplayer struct {
+	Store Store
+}
+
+// Run makes weheID pending again with its attempts reset, e.g. once what
+// failed it was fixed. A ConflictError means the same change was notified
+// again and is pending already.
+func (wr *WebhookReplayer) Run(ctx context.Context, weheID uuid.UUID) (e *WebhookEvent, err error) {
+	ctx, span := tracing.Start(ctx, "user.WebhookReplayer.Run")
+	defer func() { tracing.End(span, err) }()
+
+	err = wr.Store.Tx(ctx, func(r Repos) error {
+		e, err = r.Webhooks.Replay(ctx, weheID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,146 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fignocius/echo-api/service/cielo"
+	"github.com/fignocius/echo-api/service/user/auth"
+)
+
+func notify(t *testing.T, s *MemStore, paymentID string, change cielo.ChangeType) bool {
+	t.Helper()
+	stored, err := (&WebhookReceiver{Store: s}).Run(context.Background(), []byte(fmt.Sprintf(`{"PaymentId":%q,"ChangeType":%d}`, paymentID, change)))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	return stored
+}
+
+func TestWebhookChargebackReversesPayouts(t *testing.T) {
+	ctx := context.Background()
+	for _, paid := range []bool{false, true} {
+		s := NewMemStore()
+		ecom := cielo.NewFake().Ecommerce()
+		ps := &Payments{Store: s, Gateway: ecom}
+		m, _, _ := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{})
+		stored := s.data.matches[m.MatcID]
+		stored.Status = MatchCompleted
+		s.data.matches[m.MatcID] = stored
+		_, err := ps.Settle(ctx, m.MatcID)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		if paid {
+			_, err = (&BankCreator{Store: s}).Run(ctx, &Bank{
+				DoctID: m.DoctID, Bank: "341", Agency: "2545", Account: "02366-1", Type: BankChecking, Name: "Dr. House",
+			})
+			if err != nil {
+				t.Fatalf("Expected no error, but got %s instead", err)
+			}
+		}
+		pb := &PayoutBatcher{Store: s, CommissionPercent: 15}
+		_, err = pb.Run(ctx)
+		if err != nil || len(s.data.payoutEntries) != 1 {
+			t.Fatalf("Expected the match booked, got %+v %v", s.data.payoutEntries, err)
+		}
+
+		p := s.data.payments[paymentOf(s, m)]
+		notify(t, s, p.GatewayID.String, cielo.ChangeChargeback)
+		notify(t, s, p.GatewayID.String, cielo.ChangePaymentStatus)
+		_, err = (&WebhookProcessor{Store: s, Gateway: ecom, MaxAttempts: 1}).Run(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		st, err := (&PayoutLister{Store: s}).Run(ctx, m.DoctID, 20, 0)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %s instead", err)
+		}
+		switch {
+		case !paid && (len(s.data.payoutEntries) != 0 || st.PendingNet != 0):
+			t.Errorf("Expected the entry not paid yet deleted, got %+v", s.data.payoutEntries)
+		case paid && (len(st.Pending) != 1 || st.Pending[0].Reverses == nil || st.PendingNet != -17000):
+			t.Errorf("Expected the paid entry reversed once, got %+v", st)
+		}
+	}
+}
+
+func TestWebhookProcessor(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	ecom := cielo.NewFake().Ecommerce()
+	ps := &Payments{Store: s, Gateway: ecom}
+	m, _, _ := paidMatch(t, s, ps, "4024007197692931", CancelPolicy{})
+	p := s.data.payments[paymentOf(s, m)]
+	wp := &WebhookProcessor{Store: s, Gateway: ecom, MaxAttempts: 1}
+
+	// captured elsewhere, e.g. at the backoffice of the gateway
+	_, err := ecom.Capture(ctx, p.GatewayID.String, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	if !notify(t, s, p.GatewayID.String, cielo.ChangePaymentStatus) || notify(t, s, p.GatewayID.String, cielo.ChangePaymentStatus) {
+		t.Errorf("Expected a repeated notification to be the same event")
+	}
+	n, err := wp.Run(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected an event processed, got %d %v", n, err)
+	}
+	p = s.data.payments[p.PaymID]
+	ledger := s.data.paymentLedger[p.PaymID]
+	if p.Status != PaymentCaptured || p.Captured != 20000 || ledger[len(ledger)-1].Operation != PaymentSync {
+		t.Errorf("Expected the capture synced, got %+v", p)
+	}
+	if n, _ = wp.Run(ctx); n != 0 {
+		t.Errorf("Expected nothing left to process, got %d", n)
+	}
+
+	notify(t, s, p.GatewayID.String, cielo.ChangeChargeback)
+	_, err = wp.Run(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	p = s.data.payments[p.PaymID]
+	if p.Status != PaymentChargeback || p.Refunded != 20000 {
+		t.Errorf("Expected the chargeback synced, got %+v", p)
+	}
+	stored := s.data.matches[m.MatcID]
+	history := s.data.matchHistory[m.MatcID]
+	last := history[len(history)-1]
+	if stored.Status != MatchCanceledByPatient || stored.CancelFee != 0 || last.UserID != nil {
+		t.Errorf("Expected the match canceled by the system, got %+v %+v", stored, last)
+	}
+
+	// the gateway doesn't know the payment, the event fails
+	notify(t, s, "24bc8366-fc31-4d6c-8555-17049a836a07", cielo.ChangePaymentStatus)
+	_, err = wp.Run(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s instead", err)
+	}
+	var failed *WebhookEvent
+	for _, e := range s.data.webhooks {
+		if e.Status == WebhookFailed {
+			e := e
+			failed = &e
+		}
+	}
+	if failed == nil || failed.Attempts != 1 || len(failed.Error) == 0 {
+		t.Fatalf("Expected the event failed, got %+v", s.data.webhooks)
+	}
+	e, err := (&WebhookReplayer{Store: s}).Run(ctx, failed.WeheID)
+	if err != nil || e.Status != WebhookPending || e.Attempts != 0 {
+		t.Errorf("Expected the event pending again, got %+v %v", e, err)
+	}
+	s.data.webhooks[failed.WeheID] = *failed
+	notify(t, s, "24bc8366-fc31-4d6c-8555-17049a836a07", cielo.ChangePaymentStatus)
+	_, err = (&WebhookReplayer{Store: s}).Run(ctx, failed.WeheID)
+	if _, ok := err.(*auth.ConflictError); !ok {
+		t.Errorf("Expected replaying along a pending event to be a ConflictError, got %v", err)
+	}
+
+	_, err = (&WebhookReceiver{Store: s}).Run(ctx, []byte(`PaymentId=1&ChangeType=1`))
+	if _, ok := err.(*auth.ValidationError); !ok {
+		t.Errorf("Expected an invalid notification refused, got %v", err)
+	}
+}
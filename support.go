@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fignocius/echo-api/service/support"
+	"github.com/pkg/errors"
+)
+
+const supportUsage = `usage: echo-api support <command>
+
+commands:
+  import [-dry-run] FILE
+                     upsert specializations and procedures from a CSV with
+                     the columns specialization, procedure and tuss_code`
+
+// runSupport implements the support subcommand
+func runSupport(args []string) error {
+	if len(args) == 0 || args[0] != "import" {
+		return errors.New(supportUsage)
+	}
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "count what would change and roll back")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(supportUsage)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := support.ParseCSV(f)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	im := &support.Importer{Store: &support.PgStore{DB: db}, DryRun: *dryRun}
+	res, err := im.Run(context.Background(), rows)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println("dry run, nothing was saved")
+	}
+	fmt.Printf("%d rows: %d specializations created, %d procedures created, %d updated, %d unchanged\n",
+		len(rows), res.SpecializationsCreated, res.ProceduresCreated, res.ProceduresUpdated, res.Unchanged)
+	return nil
+}